@@ -2,107 +2,233 @@
 // Author: gwenz@anki.com
 //
 // cliconfig.go provides a means to configure many parts of the game (track,
-// vehicles, etc) in using standard command-line arguments. Unless there is a
-// very good reason not to, this is THE way to configure these parts of the
-// game.
+// vehicles, etc) in using standard command-line arguments, and optionally a
+// config file. Unless there is a very good reason not to, this is THE way to
+// configure these parts of the game.
 
 package engine
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/faiface/pixel"
 	"github.com/faiface/pixel/pixelgl"
 
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/emulator"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/robo/track"
 )
 
-// CLIGameConfig is the game's configuration, based on command-line values
+// CLIGameConfig is the game's configuration, based on command-line values and
+// an optional config file.
 type CLIGameConfig struct {
+	spec      GameConfigSpec
 	trk       *track.Track
 	vehs      []robo.Vehicle
 	win       *pixelgl.Window
 	mbHeight  uint
 	showInstr bool
+	api       *core.APIServer
+	emu       *emulator.Emulator
 }
 
 // NewCLIGameConfig parses command-line arguments and creates a game
-// configuration based on their values.
+// configuration based on their values. If the configuration is invalid, the
+// error and usage are printed, and the program exits.
 func NewCLIGameConfig(title string, lightSpec light.Spec) *CLIGameConfig {
-	var gc CLIGameConfig
-
-	winFlag /*******/ := flag.String("w", "1200x850", "Window size, expressed as integer pixels WIDTHxHEIGHT")
-	mbFlag /********/ := flag.Uint("mb", 200, "Message board height, expressed as integer number of pixels. Can be 0.")
-	tWidthFlag /****/ := flag.Float64("twidth", 0.20, "Track width, in Meters")
-	tMaxCofsFlag /**/ := flag.Float64("tmaxcofs", 0.0, "Track max center offset, from road center")
-	trackFlag /*****/ := flag.String("t", "Capsule", "Track name or modular track string")
-	vehsFlag /******/ := flag.String("v", "gs", "List of vehicles, using two-letter abberviations; eg \"gs sk\" for Groundshock and Skull")
-	insFlag /*******/ := flag.Bool("ins", false, "Display instructions at the start of each game phase")
+	gc, err := NewGameConfig(title, lightSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid game configuration: %v\n\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	return gc
+}
+
+// NewGameConfig parses command-line arguments and creates a game configuration.
+// The -config flag selects a JSON config file (see GameConfigSpec); any other
+// flags that are set explicitly override the corresponding fields of the file.
+// lightSpec is used for vehicles that do not name a light spec.
+func NewGameConfig(title string, lightSpec light.Spec) (*CLIGameConfig, error) {
+	def := DefaultGameConfigSpec()
+	configFlag /****/ := flag.String("config", "", "Game config file (JSON, or YAML if named *.yaml or *.yml). Other flags override values from the file.")
+	winFlag /*******/ := flag.String("w", fmt.Sprintf("%dx%d", def.Window.Width, def.Window.Height), "Window size, expressed as integer pixels WIDTHxHEIGHT")
+	mbFlag /********/ := flag.Uint("mb", def.Window.MsgBoardHeight, "Message board height, expressed as integer number of pixels. Can be 0.")
+	tWidthFlag /****/ := flag.Float64("twidth", float64(def.Track.Width), "Track width, in Meters")
+	tMaxCofsFlag /**/ := flag.Float64("tmaxcofs", float64(def.Track.MaxCofs), "Track max center offset, from road center")
+	trackFlag /*****/ := flag.String("t", def.Track.Name, "Track name or modular track string")
+	vehsFlag /******/ := flag.String("v", string(def.Vehicles[0].Type), "List of vehicles, using two-letter abberviations; eg \"gs sk\" for Groundshock and Skull")
+	vtFlag /********/ := flag.String("vehtypes", "", "List of JSON vehicle type files to load, eg \"mytypes.json\"")
+	insFlag /*******/ := flag.Bool("ins", def.ShowInstructions, "Display instructions at the start of each game phase")
+	simFlag /*******/ := flag.String("sim", def.Sim.Simulator, "Robotics simulator: \"ideal\" or \"realistic\"")
+	colFlag /*******/ := flag.String("collider", def.Sim.Collider, "Vehicle collider: \"detector\" (no reaction) or \"responder\"")
+	locFlag /*******/ := flag.Bool("localize", def.Sim.Localize, "Publish localization events with realistic rate, latency and noise, like real vehicles")
+	linkFlag /******/ := flag.Bool("cmdlink", def.Sim.LinkCmds, "Delay vehicle commands and count BLE writes against a budget, like real vehicles")
+	apiFlag /*******/ := flag.String("api", def.API, "Serve the HTTP/WebSocket API on this address, eg \"localhost:8080\"")
+	emuFlag /*******/ := flag.String("emulate", def.Emulator, "Expose the vehicles as virtual devices on consecutive sockets from this address, eg \"localhost:9000\" or \"unix:/tmp/goverdrive\"")
 	flag.Parse()
 
-	// parse the window size
-	var winWidth, winHeight uint
-	if n, werr := fmt.Sscanf(*winFlag, "%dx%d", &winWidth, &winHeight); (werr != nil) || (n != 2) {
-		panic(fmt.Sprintf("win=\"%s\" could not be parsed as WxH pixels", *winFlag))
+	spec := def
+	if *configFlag != "" {
+		var err error
+		if spec, err = LoadGameConfigSpec(*configFlag, def); err != nil {
+			return nil, err
+		}
 	}
 
-	// message board height
-	gc.mbHeight = *mbFlag
-	if gc.mbHeight > (winHeight / 2) {
-		panic(fmt.Sprintf("Message board height=%v is too big, relative to window height=%v", gc.mbHeight, winHeight))
+	// explicitly set flags override the config file
+	var ferr error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "w":
+			if n, err := fmt.Sscanf(*winFlag, "%dx%d", &spec.Window.Width, &spec.Window.Height); (err != nil) || (n != 2) {
+				ferr = fmt.Errorf("win=\"%s\" could not be parsed as WxH pixels", *winFlag)
+			}
+		case "mb":
+			spec.Window.MsgBoardHeight = *mbFlag
+		case "twidth":
+			spec.Track.Width = phys.Meters(*tWidthFlag)
+		case "tmaxcofs":
+			spec.Track.MaxCofs = phys.Meters(*tMaxCofsFlag)
+		case "t":
+			spec.Track.Name = *trackFlag
+		case "v":
+			spec.Vehicles = make([]VehicleSpec, 0)
+			for _, vs := range strings.Fields(*vehsFlag) {
+				spec.Vehicles = append(spec.Vehicles, VehicleSpec{Type: robo.VehType(vs)})
+			}
+		case "vehtypes":
+			spec.VehTypeFiles = strings.Fields(*vtFlag)
+		case "ins":
+			spec.ShowInstructions = *insFlag
+		case "sim":
+			spec.Sim.Simulator = *simFlag
+		case "collider":
+			spec.Sim.Collider = *colFlag
+		case "localize":
+			spec.Sim.Localize = *locFlag
+		case "cmdlink":
+			spec.Sim.LinkCmds = *linkFlag
+		case "api":
+			spec.API = *apiFlag
+		case "emulate":
+			spec.Emulator = *emuFlag
+		}
+	})
+	if ferr != nil {
+		return nil, ferr
 	}
 
-	// track width
-	twidth := phys.Meters(*tWidthFlag)
-	if (twidth < 0.001) || (twidth > 2.0) {
-		panic(fmt.Sprintf("Track width=%v is not reasonable", twidth))
+	return NewGameConfigFromSpec(title, spec, lightSpec)
+}
+
+// NewGameConfigFromSpec creates a game configuration directly from a spec, with
+// no command-line arguments.
+func NewGameConfigFromSpec(title string, spec GameConfigSpec, lightSpec light.Spec) (*CLIGameConfig, error) {
+	gc := CLIGameConfig{spec: spec}
+
+	// message board height
+	gc.mbHeight = spec.Window.MsgBoardHeight
+	if !spec.Window.Headless && (gc.mbHeight > (spec.Window.Height / 2)) {
+		return nil, fmt.Errorf("Message board height=%v is too big, relative to window height=%v", gc.mbHeight, spec.Window.Height)
 	}
 
 	// game instructions
-	gc.showInstr = *insFlag
-
-	// create the track
-	tMaxCofs := phys.Meters(*tMaxCofsFlag)
-	if *trackFlag != "" {
-		gc.trk, _ = track.NewModularTrack(twidth, tMaxCofs, *trackFlag)
-		if gc.trk == nil {
-			gc.trk, _ = track.NewStarterKitTrack(twidth, tMaxCofs, *trackFlag)
+	gc.showInstr = spec.ShowInstructions
+
+	// create the track, vehicles, and check the simulator
+	var err error
+	if err = spec.loadVehTypes(); err != nil {
+		return nil, err
+	}
+	if gc.trk, err = spec.newTrack(); err != nil {
+		return nil, err
+	}
+	if gc.vehs, err = spec.newVehicles(gc.trk, lightSpec); err != nil {
+		return nil, err
+	}
+	if err = spec.checkSim(); err != nil {
+		return nil, err
+	}
+
+	// create the window
+	if !spec.Window.Headless {
+		winCfg := pixelgl.WindowConfig{
+			Title:  title,
+			Bounds: pixel.R(0, 0, float64(spec.Window.Width), float64(spec.Window.Height)),
+			VSync:  true,
 		}
-		if gc.trk == nil {
-			gc.trk, _ = track.NewCustomTrack(twidth, tMaxCofs, *trackFlag)
+		if gc.win, err = pixelgl.NewWindow(winCfg); err != nil {
+			return nil, err
 		}
 	}
-	if gc.trk == nil {
-		fmt.Printf("Supported starter kit tracks:\n  %s\n", track.StarterKitTrackNames("\n  "))
-		fmt.Printf("Supported custom tracks:\n  %s\n", track.CustomTrackNames("\n  "))
-		panic("A valid track is required to proceed!")
+
+	// start the API server
+	if spec.API != "" {
+		gc.api = core.NewAPIServer()
+		if err = gc.api.Listen(spec.API); err != nil {
+			return nil, err
+		}
 	}
 
-	// create the vehicles
-	vehStrList := strings.Split(*vehsFlag, " ")
-	gc.vehs = make([]robo.Vehicle, 0)
-	for _, vs := range vehStrList {
-		gc.vehs = append(gc.vehs, *robo.NewVehicle(robo.VehType(vs), lightSpec, gc.trk.CenLen()))
+	// start the virtual vehicles; NewSystem gives the vehicles Ids that match
+	// their index
+	if spec.Emulator != "" {
+		gc.emu = emulator.New(emulator.DefaultParams())
+		vehIds := make([]int, len(gc.vehs))
+		for i := range vehIds {
+			vehIds[i] = i
+		}
+		if err = gc.emu.ListenAll(spec.Emulator, vehIds); err != nil {
+			gc.emu.Close()
+			return nil, err
+		}
 	}
 
-	// create the window
-	winCfg := pixelgl.WindowConfig{
-		Title:  title,
-		Bounds: pixel.R(0, 0, float64(winWidth), float64(winHeight)),
-		VSync:  true,
+	return &gc, nil
+}
+
+// Spec returns the final spec, after applying the config file and flags.
+func (gc *CLIGameConfig) Spec() GameConfigSpec {
+	return gc.spec
+}
+
+// GameParamsChecker is optionally implemented by game-specific parameters, so
+// that GameParams can reject invalid values, eg a winning score of 0.
+type GameParamsChecker interface {
+	Check() error
+}
+
+// GameParams decodes the game-specific parameters section of the config file
+// into v, which is typically a pointer to a struct with default values already
+// filled in; fields missing from the file keep their default. If v is a
+// GameParamsChecker, the result is checked, even if there are no game
+// parameters in the file.
+func (gc *CLIGameConfig) GameParams(v interface{}) error {
+	if len(gc.spec.Game) > 0 {
+		if err := json.Unmarshal(gc.spec.Game, v); err != nil {
+			return fmt.Errorf("Game parameters could not be parsed: %v", err)
+		}
 	}
-	var werr error
-	gc.win, werr = pixelgl.NewWindow(winCfg)
-	if werr != nil {
-		panic(werr)
+	if checker, ok := v.(GameParamsChecker); ok {
+		if err := checker.Check(); err != nil {
+			return fmt.Errorf("Game parameters are invalid: %v", err)
+		}
 	}
+	return nil
+}
 
-	return &gc
+// NewSystem creates the robotics system for the track and vehicles, using the
+// configured simulator and collider.
+func (gc *CLIGameConfig) NewSystem() *robo.System {
+	return gc.spec.newSystem(gc.trk, &gc.vehs)
 }
 
 // Track returns a pointer to the track that was created
@@ -115,11 +241,21 @@ func (gc *CLIGameConfig) Vehicles() *[]robo.Vehicle {
 	return &gc.vehs
 }
 
-// Window returns a pointer to the window that was created
+// Window returns a pointer to the window that was created, or nil if headless
 func (gc *CLIGameConfig) Window() *pixelgl.Window {
 	return gc.win
 }
 
+// APIServer returns the API server, or nil if there is none
+func (gc *CLIGameConfig) APIServer() *core.APIServer {
+	return gc.api
+}
+
+// Emulator returns the virtual vehicle emulator, or nil if there is none
+func (gc *CLIGameConfig) Emulator() *emulator.Emulator {
+	return gc.emu
+}
+
 // MsgBoardPixHeight returns the number of vertical pixels that should be
 // dedicated to the message board.
 func (gc *CLIGameConfig) MsgBoardPixHeight() uint {
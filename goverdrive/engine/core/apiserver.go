@@ -0,0 +1,587 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// apiserver.go is an optional local HTTP/WebSocket API to the live robotics
+// system, so that controllers can be prototyped in any language. The game loop
+// (windowed or headless) services the API once per game tick: commands are
+// applied on the game loop goroutine, and a snapshot of the state is taken for
+// the HTTP handlers and streams. While the windowed game loop is paused,
+// commands are still applied once per frame.
+//
+// Endpoints, all JSON:
+//   GET  /api/state              time, phase and all vehicles
+//   GET  /api/vehicles           all vehicles; see APIVehicle
+//   GET  /api/vehicles/{id}      one vehicle
+//   POST /api/vehicles/{id}/cmd  command one vehicle; see APIVehCmd
+//   GET  /api/track              track geometry; see APITrack
+//   GET  /api/stream             WebSocket stream of APIStreamMsg; optional
+//                                query ?every=N sends state every N ticks
+//
+// Example:
+//   $ curl -X POST -d '{"Dspd": 0.8, "Cofs": -0.05}' localhost:8080/api/vehicles/0/cmd
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/image/colornames"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+const (
+	// apiCmdTimeout is how long a command waits for the game loop, eg while the
+	// game is paused, or between game phases
+	apiCmdTimeout = 2 * time.Second
+
+	// apiStreamBuffer is the number of messages buffered per stream; a client
+	// that falls further behind misses messages
+	apiStreamBuffer = 256
+)
+
+// APIVehicle is the state of one vehicle.
+type APIVehicle struct {
+	Id        int // stable vehicle Id; see robo.System.AddVehicle
+	Type      robo.VehType
+	Pose      track.Pose
+	Vel       track.Vel
+	Odom      phys.Meters
+	CmdDspd   phys.MetersPerSec
+	CmdCofs   phys.Meters // in Track coordinates
+	Trackwise bool        // facing trackwise
+	Turn      string      // turn in progress, or "none"; see robo.TurnType
+	Lights    []string    // light group names
+}
+
+// APIState is a snapshot of the robotics system, taken on a game tick.
+type APIState struct {
+	Time     phys.SimTime
+	Phase    string // type name of the current game phase
+	Vehicles []APIVehicle
+}
+
+// APIVehCmd is a command for one vehicle. Nil/empty fields leave the
+// corresponding command unchanged.
+type APIVehCmd struct {
+	Dspd   *phys.MetersPerSec // see Vehicle.SetCmdDriveDspd
+	Dacl   phys.MetersPerSec2 // with Dspd; 0 => 1.0
+	Cofs   *phys.Meters       // see Vehicle.SetCmdDriveCofs
+	Cspd   phys.MetersPerSec  // with Cofs; 0 => 0.1
+	Uturn  bool               // see Vehicle.CmdUturn; applied before Dspd and Cofs
+	Turn   string             // "left", "right", "uturn" or "uturn_jump"; see Vehicle.CmdTurn
+	Lights map[string]string  // light group name -> color name, eg "red"
+}
+
+// APIRoadPiece is the geometry of one road piece.
+type APIRoadPiece struct {
+	CenLen      phys.Meters
+	DAngle      phys.Radians
+	EntryDofs   phys.Meters
+	EntryPose   phys.Pose
+	CurveCenter *phys.Point // nil => straight
+}
+
+// APITrack is the track geometry.
+type APITrack struct {
+	Width     phys.Meters
+	MaxCofs   phys.Meters
+	CenLen    phys.Meters
+	MinCorner phys.Point
+	MaxCorner phys.Point
+	Pieces    []APIRoadPiece
+}
+
+// APIStreamMsg is one message of the WebSocket stream. Type is "state",
+// "event", or "error" if a state or event could not be encoded.
+type APIStreamMsg struct {
+	Type  string
+	State *APIState   `json:",omitempty"`
+	Event *robo.Event `json:",omitempty"`
+	Error string      `json:",omitempty"`
+}
+
+// APIServer serves the API. Set it in engine.GamePhaseVizConfig or
+// HeadlessConfig so that the game loop services it.
+type APIServer struct {
+	mux  *http.ServeMux
+	cmds chan *apiCmd
+
+	// owned by the game loop goroutine
+	rsys   *robo.System
+	events *robo.EventQueue
+	phase  string
+	tick   uint64
+
+	// shared with the HTTP handlers
+	mu      sync.Mutex
+	state   *APIState
+	trk     *APITrack
+	streams map[*apiStream]bool
+}
+
+// apiCmd is a function to run on the game loop goroutine. Whichever of the
+// game loop and the HTTP handler changes state from apiCmdQueued first decides
+// whether the command runs, so a command that timed out never runs later.
+type apiCmd struct {
+	f     func(rsys *robo.System) error
+	done  chan error
+	state int32 // apiCmd*; accessed atomically
+}
+
+// apiCmd states
+const (
+	apiCmdQueued int32 = iota
+	apiCmdRunning
+	apiCmdCancelled
+)
+
+// apiStream is one WebSocket client of /api/stream.
+type apiStream struct {
+	every uint64
+	msgs  chan []byte
+}
+
+// NewAPIServer creates an API server. It serves nothing until it is handed to
+// an http.Server, or Listen is called.
+func NewAPIServer() *APIServer {
+	api := &APIServer{
+		mux:     http.NewServeMux(),
+		cmds:    make(chan *apiCmd, 64),
+		streams: make(map[*apiStream]bool),
+	}
+	api.mux.HandleFunc("/api/state", api.handleState)
+	api.mux.HandleFunc("/api/vehicles", api.handleVehicles)
+	api.mux.HandleFunc("/api/vehicles/", api.handleVehicle)
+	api.mux.HandleFunc("/api/track", api.handleTrack)
+	api.mux.HandleFunc("/api/stream", api.handleStream)
+	return api
+}
+
+// Listen starts serving the API on a TCP address, eg "localhost:8080", in the
+// background.
+func (api *APIServer) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go http.Serve(l, api)
+	return nil
+}
+
+func (api *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mux.ServeHTTP(w, r)
+}
+
+//////////////////////////////////////////////////////////////////////
+// Game loop side
+
+// Attach starts serving a robotics system. The game loops call it before
+// starting a game phase.
+func (api *APIServer) Attach(rsys *robo.System) {
+	if api.rsys == rsys {
+		return
+	}
+	if api.events != nil {
+		api.events.Close()
+	}
+	api.rsys = rsys
+	api.events = robo.NewEventQueue(rsys.Events, robo.EvCollisionStart, robo.EvCollisionEnd, robo.EvLapCompleted,
+		robo.EvRegionEnter, robo.EvRegionExit, robo.EvPhaseStart, robo.EvPhaseStop,
+		robo.EvObstacleCollisionStart, robo.EvObstacleCollisionEnd, robo.EvVehAdded, robo.EvVehRemoved,
+		robo.EvLocPositionUpdate, robo.EvLocTransitionUpdate, robo.EvVehDelocalized,
+		robo.EvVehCmdOverBudget)
+	trk := newAPITrack(&rsys.Track)
+	api.mu.Lock()
+	api.trk = trk
+	api.mu.Unlock()
+	api.snapshot()
+}
+
+// Service applies pending commands, and publishes the state and events. The
+// game loops call it once per game tick.
+func (api *APIServer) Service(rsys *robo.System) {
+	api.Attach(rsys)
+	api.runCmds(rsys)
+	api.snapshot()
+}
+
+// ServiceStopped applies pending commands while sim time is stopped, eg while
+// the windowed game loop is paused, so that clients are not told that the game
+// is busy. The windowed game loop calls it once per frame. Nothing is streamed,
+// since no time passes, but the state shows the new commands.
+func (api *APIServer) ServiceStopped(rsys *robo.System) {
+	api.Attach(rsys)
+	if api.runCmds(rsys) > 0 {
+		state := api.newState()
+		api.mu.Lock()
+		api.state = state
+		api.mu.Unlock()
+	}
+}
+
+// runCmds runs the pending commands that have not been cancelled, and returns
+// the number that ran.
+func (api *APIServer) runCmds(rsys *robo.System) int {
+	n := 0
+	for {
+		select {
+		case cmd := <-api.cmds:
+			if atomic.CompareAndSwapInt32(&cmd.state, apiCmdQueued, apiCmdRunning) {
+				cmd.done <- runAPICmd(rsys, cmd.f)
+				n++
+			}
+		default:
+			return n
+		}
+	}
+}
+
+// runAPICmd runs a command, turning a panic (eg from an invalid light name)
+// into an error so that it cannot stop the game.
+func runAPICmd(rsys *robo.System, f func(rsys *robo.System) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return f(rsys)
+}
+
+// snapshot takes a snapshot of the state, and sends it and any new events to
+// the streams.
+func (api *APIServer) snapshot() {
+	msgs := make([][]byte, 0)
+	for _, ev := range api.events.Drain() {
+		if ev.Kind == robo.EvPhaseStart {
+			api.phase = ev.Phase
+		}
+		ev.Data = nil // eg the game phase itself
+		msgs = append(msgs, encodeStreamMsg(APIStreamMsg{Type: "event", Event: &ev}))
+	}
+	state := api.newState()
+	stateMsg := encodeStreamMsg(APIStreamMsg{Type: "state", State: state})
+	api.tick++
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.state = state
+	for s := range api.streams {
+		for _, msg := range msgs {
+			s.send(msg)
+		}
+		if api.tick%s.every == 0 {
+			s.send(stateMsg)
+		}
+	}
+}
+
+// newState returns the current state of the robotics system.
+func (api *APIServer) newState() *APIState {
+	rsys := api.rsys
+	state := &APIState{
+		Time:     rsys.Now(),
+		Phase:    api.phase,
+		Vehicles: make([]APIVehicle, len(rsys.Vehicles)),
+	}
+	for v := range rsys.Vehicles {
+		veh := &rsys.Vehicles[v]
+		state.Vehicles[v] = APIVehicle{
+			Id:        veh.Id(),
+			Type:      veh.Type(),
+			Pose:      veh.CurTrackPose(),
+			Vel:       veh.CurTrackVel(),
+			Odom:      veh.Odom(),
+			CmdDspd:   veh.CmdDriveDspd(),
+			CmdCofs:   veh.CmdTrackCofs(),
+			Trackwise: veh.IsFacingTrackwise(),
+			Turn:      veh.CurTurn().String(),
+			Lights:    veh.Lights().Names(),
+		}
+	}
+	return state
+}
+
+// send queues a message, or drops it if the client is too far behind.
+func (s *apiStream) send(msg []byte) {
+	select {
+	case s.msgs <- msg:
+	default:
+	}
+}
+
+// encodeStreamMsg encodes a stream message. A message that cannot be encoded,
+// eg because of a NaN from a game, is replaced by an error message, rather than
+// stopping the game.
+func encodeStreamMsg(msg APIStreamMsg) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		data, _ = json.Marshal(APIStreamMsg{Type: "error", Error: fmt.Sprintf("%s could not be encoded: %v", msg.Type, err)})
+	}
+	return data
+}
+
+func newAPITrack(trk *track.Track) *APITrack {
+	at := &APITrack{
+		Width:     trk.Width(),
+		MaxCofs:   trk.MaxCofs(),
+		CenLen:    trk.CenLen(),
+		MinCorner: trk.MinCorner(),
+		MaxCorner: trk.MaxCorner(),
+		Pieces:    make([]APIRoadPiece, trk.NumRp()),
+	}
+	for i := range at.Pieces {
+		rpi := track.Rpi(i)
+		rp := trk.Rp(rpi)
+		at.Pieces[i] = APIRoadPiece{
+			CenLen:    rp.CenLen(),
+			DAngle:    rp.DAngle(),
+			EntryDofs: trk.RpEntryDofs(rpi),
+			EntryPose: trk.RpEntryPose(rpi),
+		}
+		if !rp.IsStraight() {
+			cc := trk.RpCurveCenter(rpi)
+			at.Pieces[i].CurveCenter = &cc
+		}
+	}
+	return at
+}
+
+//////////////////////////////////////////////////////////////////////
+// HTTP side
+
+// runOnGameLoop queues a command for the game loop, and waits for its result.
+// A command that times out is cancelled, so that it is never applied after the
+// client has been told that it failed.
+func (api *APIServer) runOnGameLoop(f func(rsys *robo.System) error) error {
+	cmd := &apiCmd{f: f, done: make(chan error, 1)}
+	timeout := time.After(apiCmdTimeout)
+	select {
+	case api.cmds <- cmd:
+	case <-timeout:
+		return errAPIBusy
+	}
+	select {
+	case err := <-cmd.done:
+		return err
+	case <-timeout:
+		if atomic.CompareAndSwapInt32(&cmd.state, apiCmdQueued, apiCmdCancelled) {
+			return errAPIBusy
+		}
+		return <-cmd.done // already running on the game loop
+	}
+}
+
+var errAPIBusy = fmt.Errorf("The game loop is not running, eg the game is paused")
+
+func (api *APIServer) curState() *APIState {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.state
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Response could not be encoded: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+}
+
+func (api *APIServer) handleState(w http.ResponseWriter, r *http.Request) {
+	state := api.curState()
+	if state == nil {
+		writeError(w, http.StatusServiceUnavailable, errAPIBusy)
+		return
+	}
+	writeJSON(w, state)
+}
+
+func (api *APIServer) handleVehicles(w http.ResponseWriter, r *http.Request) {
+	state := api.curState()
+	if state == nil {
+		writeError(w, http.StatusServiceUnavailable, errAPIBusy)
+		return
+	}
+	writeJSON(w, state.Vehicles)
+}
+
+// handleVehicle handles /api/vehicles/{id} and /api/vehicles/{id}/cmd.
+func (api *APIServer) handleVehicle(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/vehicles/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if (err != nil) || (len(parts) > 2) || ((len(parts) == 2) && (parts[1] != "cmd")) {
+		http.NotFound(w, r)
+		return
+	}
+	state := api.curState()
+	if state == nil {
+		writeError(w, http.StatusServiceUnavailable, errAPIBusy)
+		return
+	}
+	var av *APIVehicle
+	for v := range state.Vehicles {
+		if state.Vehicles[v].Id == id {
+			av = &state.Vehicles[v]
+		}
+	}
+	if av == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Vehicle %d does not exist", id))
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, *av)
+		return
+	}
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Vehicle commands must be POSTed"))
+		return
+	}
+	var cmd APIVehCmd
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Command could not be parsed: %v", err))
+		return
+	}
+	for name, cname := range cmd.Lights {
+		if _, ok := colornames.Map[strings.ToLower(cname)]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Light %s: color=%q is not recognized", name, cname))
+			return
+		}
+	}
+	err = api.runOnGameLoop(func(rsys *robo.System) error {
+		veh := rsys.Vehicle(id)
+		if veh == nil {
+			return fmt.Errorf("Vehicle %d does not exist", id) // eg removed since the snapshot
+		}
+		return cmd.apply(veh, rsys.Now())
+	})
+	if err == errAPIBusy {
+		writeError(w, http.StatusServiceUnavailable, err)
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+	} else {
+		writeJSON(w, struct{}{})
+	}
+}
+
+// apply applies the command to a vehicle, on the game loop goroutine.
+func (cmd *APIVehCmd) apply(veh *robo.Vehicle, now phys.SimTime) error {
+	names := make(map[string]bool)
+	for _, name := range veh.Lights().Names() {
+		names[name] = true
+	}
+	for name := range cmd.Lights {
+		if !names[name] {
+			return fmt.Errorf("Light %q is not recognized; vehicle lights are %v", name, veh.Lights().Names())
+		}
+	}
+
+	turn := robo.TurnNone
+	if cmd.Turn != "" {
+		var err error
+		if turn, err = robo.ParseTurnType(cmd.Turn); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Uturn {
+		veh.CmdUturn(robo.DefUturnRadius)
+	}
+	if turn != robo.TurnNone {
+		veh.CmdTurn(turn, robo.DefUturnRadius)
+	}
+	if cmd.Dspd != nil {
+		dacl := cmd.Dacl
+		if dacl == 0 {
+			dacl = 1.0
+		}
+		veh.SetCmdDriveDspd(*cmd.Dspd, dacl)
+	}
+	if cmd.Cofs != nil {
+		cspd := cmd.Cspd
+		if cspd == 0 {
+			cspd = 0.1
+		}
+		veh.SetCmdDriveCofs(*cmd.Cofs, cspd)
+	}
+	for name, cname := range cmd.Lights {
+		veh.Lights().Set(name, colornames.Map[strings.ToLower(cname)])
+	}
+	return nil
+}
+
+func (api *APIServer) handleTrack(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	trk := api.trk
+	api.mu.Unlock()
+	if trk == nil {
+		writeError(w, http.StatusServiceUnavailable, errAPIBusy)
+		return
+	}
+	writeJSON(w, trk)
+}
+
+func (api *APIServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	s := &apiStream{every: 1, msgs: make(chan []byte, apiStreamBuffer)}
+	if str := r.URL.Query().Get("every"); str != "" {
+		n, err := strconv.ParseUint(str, 10, 32)
+		if (err != nil) || (n == 0) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("every=%q must be a positive integer", str))
+			return
+		}
+		s.every = n
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.close()
+
+	api.mu.Lock()
+	api.streams[s] = true
+	api.mu.Unlock()
+	defer func() {
+		api.mu.Lock()
+		delete(api.streams, s)
+		api.mu.Unlock()
+	}()
+
+	// the client only sends pings and close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := ws.readMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case msg := <-s.msgs:
+			if err := ws.writeText(msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+)
+
+// postCmd posts a vehicle command, and returns the HTTP status code. It can be
+// called from any goroutine.
+func postCmd(t *testing.T, url string, vehId int, cmd string) int {
+	resp, err := http.Post(url+"/api/vehicles/"+strconv.Itoa(vehId)+"/cmd", "application/json", strings.NewReader(cmd))
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// wsClient is the client side of a WebSocket connection, for testing the
+// server side.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// wsTestKey and wsTestAccept are the example handshake from RFC 6455.
+const (
+	wsTestKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	wsTestAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// dialStream opens a WebSocket connection to /api/stream, with an optional
+// query, and checks the handshake.
+func dialStream(t *testing.T, srv *httptest.Server, query string) *wsClient {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", srv.URL+"/api/stream"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", wsTestKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	c := &wsClient{conn: conn, br: bufio.NewReader(conn)}
+	resp, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "handshake status", http.StatusSwitchingProtocols, resp.StatusCode)
+	testEqual(t, "handshake accept", wsTestAccept, resp.Header.Get("Sec-WebSocket-Accept"))
+	return c
+}
+
+// writeFrame sends one masked frame, as clients must.
+func (c *wsClient) writeFrame(t *testing.T, opcode byte, payload []byte) {
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | opcode)
+	if len(payload) < 126 {
+		buf.WriteByte(0x80 | byte(len(payload)))
+	} else {
+		buf.WriteByte(0x80 | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	buf.Write(mask)
+	for i, b := range payload {
+		buf.WriteByte(b ^ mask[i%4])
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame returns the next frame from the server, which must be unmasked.
+func (c *wsClient) readFrame(t *testing.T) (opcode byte, payload []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "frame fin", byte(0x80), hdr[0]&0xF0)
+	testEqual(t, "frame mask", byte(0), hdr[1]&0x80)
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext uint16
+		if err := binary.Read(c.br, binary.BigEndian, &ext); err != nil {
+			t.Fatal(err)
+		}
+		n = uint64(ext)
+	case 127:
+		if err := binary.Read(c.br, binary.BigEndian, &n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+// readMsg returns the next stream message.
+func (c *wsClient) readMsg(t *testing.T) APIStreamMsg {
+	opcode, payload := c.readFrame(t)
+	testEqual(t, "opcode", byte(wsOpText), opcode)
+	var msg APIStreamMsg
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		t.Fatalf("Stream message could not be parsed: %v\n%s", err, payload)
+	}
+	return msg
+}
+
+// expectNoMsg checks that the server sends nothing for a while.
+func (c *wsClient) expectNoMsg(t *testing.T) {
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.br.ReadByte(); err == nil {
+		t.Errorf("Unexpected stream message")
+	}
+}
+
+// waitForStreams waits until the API server has n streams.
+func waitForStreams(api *APIServer, n int) {
+	for {
+		api.mu.Lock()
+		ns := len(api.streams)
+		api.mu.Unlock()
+		if ns == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// cmdPhase is a testPhase that finishes once the first vehicle has been
+// commanded to drive at 0.9 m/s. Update is called on the game loop goroutine.
+type cmdPhase struct {
+	*testPhase
+}
+
+func (p cmdPhase) Update(rsys *robo.System, in Input) (bool, GamePhaseVizObjects) {
+	return rsys.Vehicles[0].CmdDriveDspd() == 0.9, EmptyGamePhaseVizObjects()
+}
+
+// waitForCmd waits until a command is queued for the game loop.
+func waitForCmd(api *APIServer) {
+	for len(api.cmds) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAPICmdTimeout(t *testing.T) {
+	rsys := newTestSystem(t, "gs", "sk")
+	api := NewAPIServer()
+	api.Attach(rsys)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	// nothing services the API, eg the game is between phases
+	testEqual(t, "busy", http.StatusServiceUnavailable, postCmd(t, srv.URL, 0, `{"Dspd": 0.9}`))
+
+	// the command that timed out is never applied
+	api.Service(rsys)
+	testEqual(t, "dspd after timeout", phys.MetersPerSec(0), rsys.Vehicle(0).CmdDriveDspd())
+
+	// a command that is serviced is applied once
+	done := make(chan int)
+	go func() { done <- postCmd(t, srv.URL, 1, `{"Dspd": 0.7}`) }()
+	waitForCmd(api)
+	api.Service(rsys)
+	testEqual(t, "ok", http.StatusOK, <-done)
+	testEqual(t, "dspd", phys.MetersPerSec(0.7), rsys.Vehicle(1).CmdDriveDspd())
+}
+
+func TestAPIServiceStopped(t *testing.T) {
+	rsys := newTestSystem(t, "gs")
+	api := NewAPIServer()
+	api.Attach(rsys)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	done := make(chan int)
+	go func() { done <- postCmd(t, srv.URL, 0, `{"Dspd": 0.4}`) }()
+	waitForCmd(api)
+	tick := api.tick
+	api.ServiceStopped(rsys)
+	testEqual(t, "ok", http.StatusOK, <-done)
+	testEqual(t, "dspd", phys.MetersPerSec(0.4), rsys.Vehicle(0).CmdDriveDspd())
+	testEqual(t, "state dspd", phys.MetersPerSec(0.4), api.curState().Vehicles[0].CmdDspd)
+	testEqual(t, "no tick", tick, api.tick)
+}
+
+func TestAPIEncodeErrors(t *testing.T) {
+	// eg a game that sets a NaN
+	state := &APIState{Vehicles: []APIVehicle{{Odom: phys.Meters(math.NaN())}}}
+	var msg APIStreamMsg
+	if err := json.Unmarshal(encodeStreamMsg(APIStreamMsg{Type: "state", State: state}), &msg); err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "type", "error", msg.Type)
+
+	w := httptest.NewRecorder()
+	writeJSON(w, state)
+	testEqual(t, "code", http.StatusInternalServerError, w.Code)
+
+	w = httptest.NewRecorder()
+	writeJSON(w, robo.Event{Kind: robo.EvLapCompleted})
+	testEqual(t, "code", http.StatusOK, w.Code)
+}
+
+func TestAPIStream(t *testing.T) {
+	rsys := newTestSystem(t, "gs", "sk")
+	api := NewAPIServer()
+	api.Attach(rsys)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trk APITrack
+	err = json.NewDecoder(resp.Body).Decode(&trk)
+	resp.Body.Close()
+	testEqual(t, "track err", nil, err)
+	testEqual(t, "track len", rsys.Track.CenLen(), trk.CenLen)
+	testEqual(t, "track pieces", rsys.Track.NumRp(), len(trk.Pieces))
+
+	// not a WebSocket request
+	resp, err = http.Get(srv.URL + "/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	testEqual(t, "no upgrade", http.StatusUpgradeRequired, resp.StatusCode)
+
+	all := dialStream(t, srv, "")
+	defer all.conn.Close()
+	every3 := dialStream(t, srv, "?every=3")
+	defer every3.conn.Close()
+	waitForStreams(api, 2)
+
+	// an event, then one state per tick; the state is over 125 bytes, so it
+	// needs an extended payload length
+	PublishPhaseEvent(rsys, robo.EvPhaseStart, newTestPhase(0))
+	const ticks = 6
+	for i := 0; i < ticks; i++ {
+		rsys.Tick()
+		api.Service(rsys)
+	}
+	msg := all.readMsg(t)
+	testEqual(t, "event type", "event", msg.Type)
+	if msg.Event != nil {
+		testEqual(t, "event kind", robo.EvPhaseStart, msg.Event.Kind)
+	}
+	for i := 0; i < ticks; i++ {
+		opcode, payload := all.readFrame(t)
+		testEqual(t, "state opcode", byte(wsOpText), opcode)
+		if len(payload) <= 125 {
+			t.Errorf("State message is only %d bytes", len(payload))
+		}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Fatal(err)
+		}
+		testEqual(t, "state type", "state", msg.Type)
+		testEqual(t, "state phase", "*core.testPhase", msg.State.Phase)
+		testEqual(t, "state vehicles", 2, len(msg.State.Vehicles))
+	}
+	all.expectNoMsg(t)
+
+	// ?every=3 gets every event, but only every 3rd state
+	testEqual(t, "every=3 event", "event", every3.readMsg(t).Type)
+	for i := 0; i < ticks/3; i++ {
+		testEqual(t, "every=3 state", "state", every3.readMsg(t).Type)
+	}
+	every3.expectNoMsg(t)
+
+	// pings are answered, including ones with an extended payload length
+	ping := bytes.Repeat([]byte("ping"), 50)
+	every3.writeFrame(t, wsOpPing, ping)
+	opcode, payload := every3.readFrame(t)
+	testEqual(t, "pong opcode", byte(wsOpPong), opcode)
+	testEqual(t, "pong payload", string(ping), string(payload))
+
+	// close is answered, and the stream is removed
+	every3.writeFrame(t, wsOpClose, nil)
+	opcode, _ = every3.readFrame(t)
+	testEqual(t, "close opcode", byte(wsOpClose), opcode)
+	waitForStreams(api, 1)
+}
+
+func TestAPICmdOnGameLoop(t *testing.T) {
+	rsys := newTestSystem(t, "gs", "sk")
+	api := NewAPIServer()
+	api.Attach(rsys)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	// the command waits for the game loop
+	posted := make(chan int)
+	go func() { posted <- postCmd(t, srv.URL, 0, `{"Dspd": 0.9}`) }()
+	waitForCmd(api)
+	testEqual(t, "dspd before game loop", phys.MetersPerSec(0), rsys.Vehicle(0).CmdDriveDspd())
+
+	// the game phase only finishes if it sees the command on its own goroutine
+	finished := make(chan bool)
+	go func() {
+		_, done := runHeadless(HeadlessConfig{API: api, MaxSimTime: 10 * phys.SimSecond}, rsys, cmdPhase{newTestPhase(0)})
+		finished <- done
+	}()
+	testEqual(t, "posted", http.StatusOK, <-posted)
+	testEqual(t, "game phase saw command", true, <-finished)
+	testEqual(t, "state dspd", phys.MetersPerSec(0.9), api.curState().Vehicles[0].CmdDspd)
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// game.go sequences the game phases of a full game, eg lineup, countdown,
+// race, podium. State is shared between phases, phases can branch and repeat
+// (eg best-of-N rounds), and rankings are aggregated into a final result.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/anki/goverdrive/robo"
+)
+
+// GameOver can be returned by a NextPhaseFunc to end the game.
+const GameOver = "<game over>"
+
+// GameState is shared by all of the phases of a game. Built-in fields are
+// maintained by Game; game-specific state can be kept in Data.
+type GameState struct {
+	PhaseName  string         // name of the current (or most recent) phase
+	Repeat     int            // number of times the current phase has already run in a row
+	NumPhases  int            // number of phases that have finished
+	PhaseRanks [][]VehRanking // sorted rankings of each finished phase, in order
+	Points     map[int]int    // VehId => total points from scored phases
+	Wins       map[int]int    // VehId => number of 1st place finishes in scored phases
+	Data       map[string]interface{}
+}
+
+// NewGamePhaseFunc creates the game phase to run. It is called every time the
+// phase runs, so repeats start from a fresh game phase.
+type NewGamePhaseFunc func(gs *GameState) GamePhase
+
+// NextPhaseFunc decides what happens after a game phase finishes, given the
+// sorted rankings of that phase. It returns the name of the next phase, "" for
+// the next phase in the order they were added, or GameOver.
+type NextPhaseFunc func(gs *GameState, rankings []VehRanking) string
+
+// PointsFunc converts a vehicle's ranking in one phase into points towards the
+// final result.
+type PointsFunc func(r VehRanking, numVeh int) int
+
+// GamePhaseSpec describes one game phase of a Game.
+type GamePhaseSpec struct {
+	Name   string
+	New    NewGamePhaseFunc
+	Scored bool          // true => rankings count towards the final result
+	Next   NextPhaseFunc // nil => next phase in order
+}
+
+// Game runs a sequence of game phases as one full game.
+type Game struct {
+	Points PointsFunc // nil => RankPoints
+	specs  []GamePhaseSpec
+	state  GameState
+}
+
+// NewGame creates a game from a list of game phases. By default, the phases
+// run once each, in the order listed.
+func NewGame(specs ...GamePhaseSpec) *Game {
+	g := Game{specs: make([]GamePhaseSpec, 0)}
+	for _, spec := range specs {
+		g.AddPhase(spec)
+	}
+	return &g
+}
+
+// AddPhase adds a game phase to the end of the game. Names must be unique.
+func (g *Game) AddPhase(spec GamePhaseSpec) {
+	if spec.New == nil {
+		panic(fmt.Sprintf("Game phase %q has no New function", spec.Name))
+	}
+	if (spec.Name == "") || (spec.Name == GameOver) || (g.phaseIndex(spec.Name) >= 0) {
+		panic(fmt.Sprintf("Game phase name %q is invalid or already used", spec.Name))
+	}
+	g.specs = append(g.specs, spec)
+}
+
+// State returns the shared game state. It is reset at the start of each Run.
+func (g *Game) State() *GameState {
+	return &g.state
+}
+
+// RunHeadless runs the full game with no visualization, using
+// RunHeadlessGameLoop for each phase. cfg applies to each phase separately.
+// The aggregated final rankings are returned, sorted by rank.
+func (g *Game) RunHeadless(cfg HeadlessConfig, rsys *robo.System) []VehRanking {
+	return g.RunPhases(rsys, func(phase GamePhase) bool {
+		RunHeadlessGameLoop(cfg, rsys, phase)
+		return true
+	})
+}
+
+// RunPhases runs the full game with any game loop, eg engine.RunGame uses the
+// windowed one. runPhase runs one game phase, and returns false if the game
+// should be abandoned (eg the window was closed). The aggregated final rankings
+// are returned, sorted by rank.
+func (g *Game) RunPhases(rsys *robo.System, runPhase func(phase GamePhase) bool) []VehRanking {
+	if len(g.specs) == 0 {
+		panic("Game has no phases")
+	}
+	g.state = GameState{
+		PhaseRanks: make([][]VehRanking, 0),
+		Points:     make(map[int]int),
+		Wins:       make(map[int]int),
+		Data:       make(map[string]interface{}),
+	}
+	for _, veh := range rsys.Vehicles {
+		g.state.Points[veh.Id()] = 0
+		g.state.Wins[veh.Id()] = 0
+	}
+
+	i := 0
+	for {
+		spec := g.specs[i]
+		if spec.Name == g.state.PhaseName {
+			g.state.Repeat++
+		} else {
+			g.state.PhaseName = spec.Name
+			g.state.Repeat = 0
+		}
+
+		phase := spec.New(&g.state)
+		if !runPhase(phase) {
+			break
+		}
+		rankings := SortedVehRankings(phase)
+		g.state.NumPhases++
+		g.state.PhaseRanks = append(g.state.PhaseRanks, rankings)
+		if spec.Scored {
+			g.score(rankings, len(rsys.Vehicles))
+		}
+
+		next := ""
+		if spec.Next != nil {
+			next = spec.Next(&g.state, rankings)
+		}
+		if next == GameOver {
+			break
+		} else if next == "" {
+			i++
+			if i >= len(g.specs) {
+				break
+			}
+		} else {
+			i = g.phaseIndex(next)
+			if i < 0 {
+				panic(fmt.Sprintf("Game phase %q returned unknown next phase %q", spec.Name, next))
+			}
+		}
+	}
+
+	return g.finalRankings()
+}
+
+func (g *Game) phaseIndex(name string) int {
+	for i, spec := range g.specs {
+		if spec.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *Game) score(rankings []VehRanking, numVeh int) {
+	pointsFn := g.Points
+	if pointsFn == nil {
+		pointsFn = RankPoints
+	}
+	for _, r := range rankings {
+		g.state.Points[r.VehId] += pointsFn(r, numVeh)
+		if r.Rank == 1 {
+			g.state.Wins[r.VehId]++
+		}
+	}
+}
+
+// finalRankings ranks vehicles by total points; vehicles with the same points
+// share the same rank.
+func (g *Game) finalRankings() []VehRanking {
+	rankings := make([]VehRanking, 0, len(g.state.Points))
+	for v, pts := range g.state.Points {
+		rankings = append(rankings, VehRanking{VehId: v, ScoreString: fmt.Sprintf("%d points", pts)})
+	}
+	sort.Slice(rankings, func(i, j int) bool {
+		pi := g.state.Points[rankings[i].VehId]
+		pj := g.state.Points[rankings[j].VehId]
+		return (pi > pj) || ((pi == pj) && (rankings[i].VehId < rankings[j].VehId))
+	})
+	for i := range rankings {
+		if (i > 0) && (g.state.Points[rankings[i].VehId] == g.state.Points[rankings[i-1].VehId]) {
+			rankings[i].Rank = rankings[i-1].Rank
+		} else {
+			rankings[i].Rank = i + 1
+		}
+	}
+	return rankings
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// RankPoints is the default PointsFunc. 1st place gets numVeh points, 2nd place
+// gets numVeh-1, etc. Unranked vehicles (Rank<1) get no points.
+func RankPoints(r VehRanking, numVeh int) int {
+	if (r.Rank < 1) || (r.Rank > numVeh) {
+		return 0
+	}
+	return numVeh - r.Rank + 1
+}
+
+// BestOf returns a NextPhaseFunc that repeats a scored game phase for up to n
+// rounds, and stops repeating once a vehicle has won a majority of n rounds.
+// Then the game continues with the next phase in order. Only wins in this
+// series of rounds count, not wins in earlier phases.
+func BestOf(n int) NextPhaseFunc {
+	return func(gs *GameState, rankings []VehRanking) string {
+		if gs.Repeat+1 >= n {
+			return ""
+		}
+		for _, wins := range seriesWins(gs) {
+			if wins > n/2 {
+				return ""
+			}
+		}
+		return gs.PhaseName
+	}
+}
+
+// seriesWins returns VehId => number of 1st place finishes in the current
+// series, ie the rounds of the current phase that ran in a row.
+func seriesWins(gs *GameState) map[int]int {
+	wins := make(map[int]int)
+	for _, rankings := range gs.PhaseRanks[len(gs.PhaseRanks)-(gs.Repeat+1):] {
+		for _, r := range rankings {
+			if r.Rank == 1 {
+				wins[r.VehId]++
+			}
+		}
+	}
+	return wins
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package core
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/robo"
+)
+
+// winnerPhase is a game phase that finishes on its first tick, with a
+// predetermined winner; every other vehicle is 2nd.
+type winnerPhase struct {
+	winner   int
+	rankings []VehRanking
+}
+
+func (p *winnerPhase) InstructionText(rsys *robo.System) string {
+	return ""
+}
+
+func (p *winnerPhase) Start(rsys *robo.System) {
+}
+
+func (p *winnerPhase) Update(rsys *robo.System, in Input) (bool, GamePhaseVizObjects) {
+	return true, EmptyGamePhaseVizObjects()
+}
+
+func (p *winnerPhase) Stop(rsys *robo.System) {
+	p.rankings = make([]VehRanking, 0)
+	for _, veh := range rsys.Vehicles {
+		rank := 2
+		if veh.Id() == p.winner {
+			rank = 1
+		}
+		p.rankings = append(p.rankings, VehRanking{VehId: veh.Id(), Rank: rank})
+	}
+}
+
+func (p *winnerPhase) VehRankings() []VehRanking {
+	return p.rankings
+}
+
+// winners returns a NewGamePhaseFunc whose nth run is won by winners[n].
+func winners(winners ...int) NewGamePhaseFunc {
+	return func(gs *GameState) GamePhase {
+		return &winnerPhase{winner: winners[gs.Repeat]}
+	}
+}
+
+func TestBestOf(t *testing.T) {
+	tests := []struct {
+		heatWinner  int
+		finalWins   []int
+		finalRounds int
+	}{
+		{0, []int{0, 0, 1}, 2},
+		{0, []int{1, 1, 0}, 2},
+		{0, []int{1, 0, 1}, 3}, // the heat win does not count towards the final
+		{1, []int{0, 1, 0}, 3},
+	}
+	for _, test := range tests {
+		g := NewGame(
+			GamePhaseSpec{Name: "heat", New: winners(test.heatWinner), Scored: true},
+			GamePhaseSpec{Name: "final", New: winners(test.finalWins...), Scored: true, Next: BestOf(3)},
+		)
+		g.RunHeadless(HeadlessConfig{}, newTestSystem(t, "gs", "sk"))
+		testEqual(t, "phases", 1+test.finalRounds, g.State().NumPhases)
+	}
+}
+
+func TestGameVehIds(t *testing.T) {
+	// after vehicle 0 is removed, the vehicle Ids no longer match their index
+	rsys := newTestSystem(t, "gs", "sk", "nk")
+	rsys.RemoveVehicle(0)
+	g := NewGame(GamePhaseSpec{Name: "race", New: winners(2), Scored: true})
+	rankings := g.RunHeadless(HeadlessConfig{}, rsys)
+	testEqual(t, "rankings", 2, len(rankings))
+	testEqual(t, "winner", 2, rankings[0].VehId)
+	testEqual(t, "winner points", 2, g.State().Points[2])
+	testEqual(t, "2nd", 1, rankings[1].VehId)
+	_, ok := g.State().Points[0]
+	testEqual(t, "removed vehicle scored", false, ok)
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// headless.go runs a game phase without a window, OpenGL, or user input. This
+// is intended for automated tests, batch simulations, and servers.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/emulator"
+)
+
+// RoboTicksPerGameTick is the number of robotics sim ticks per game tick, ie
+// per call to GamePhase.Update().
+//
+// TODO(gwenz): It's unclear what range of values works for
+// RoboTicksPerGameTick, and whether there is any need for a game developer to
+// change it.
+const RoboTicksPerGameTick uint = 2
+
+// HeadlessConfig is the configuration for running a game phase without any
+// visualization or user input.
+type HeadlessConfig struct {
+	// TimeScale is the ratio of sim time to wall-clock time; eg 1.0 is
+	// real-time, and 2.0 is twice as fast as real-time. TimeScale<=0 means run
+	// as fast as possible.
+	TimeScale float64
+
+	// MaxSimTime stops the game phase after this much sim time has passed, even
+	// if the game phase is not done. MaxSimTime==0 means no limit.
+	MaxSimTime phys.SimTime
+
+	// Input is the source of user input, eg a ScriptedInput. Input==nil means
+	// there is no user input.
+	Input Input
+
+	// API is an optional API server, eg for controllers in other languages.
+	// It is serviced once per game tick.
+	API *APIServer
+
+	// Emulator optionally exposes the vehicles as virtual devices, eg for
+	// controllers of physical vehicles. It is serviced once per game tick.
+	Emulator *emulator.Emulator
+}
+
+// RunHeadlessGameLoop runs one game phase from start to finish, using the same
+// Start/Update/Stop lifecycle as engine.RunGameLoop, but with no window. User
+// input, if any, comes from cfg.Input.
+//
+// The final vehicle rankings are returned, sorted by rank.
+func RunHeadlessGameLoop(cfg HeadlessConfig, rsys *robo.System, phase GamePhase) []VehRanking {
+	rankings, _ := runHeadless(cfg, rsys, phase)
+	return rankings
+}
+
+// runHeadless is RunHeadlessGameLoop, and also returns whether the game phase
+// finished, rather than being stopped at cfg.MaxSimTime.
+func runHeadless(cfg HeadlessConfig, rsys *robo.System, phase GamePhase) (rankings []VehRanking, done bool) {
+	input := cfg.Input
+	if input == nil {
+		input = NewScriptedInput() // no events => nothing is ever pressed
+	}
+
+	if cfg.API != nil {
+		cfg.API.Attach(rsys)
+	}
+	if cfg.Emulator != nil {
+		cfg.Emulator.Attach(rsys)
+	}
+	phase.Start(rsys)
+	PublishPhaseEvent(rsys, robo.EvPhaseStart, phase)
+	tBeg := rsys.Now()
+
+	// The pace of the loop is only throttled when a time scale is requested
+	var gameDelay <-chan time.Time
+	var gameDeltaT time.Duration
+	if cfg.TimeScale > 0 {
+		gameDeltaT = time.Duration(float64(GameTickDuration(rsys)) / cfg.TimeScale)
+		gameDelay = time.After(gameDeltaT)
+	}
+
+	for !done {
+		// Robotics simulation
+		for i := uint(0); i < RoboTicksPerGameTick; i++ {
+			rsys.Tick()
+		}
+
+		// Game logic; there is nothing to visualize
+		input.Update(rsys.Now())
+		done, _ = phase.Update(rsys, input)
+		if cfg.API != nil {
+			cfg.API.Service(rsys)
+		}
+		if cfg.Emulator != nil {
+			cfg.Emulator.Service(rsys)
+		}
+
+		if (cfg.MaxSimTime > 0) && ((rsys.Now() - tBeg) >= cfg.MaxSimTime) {
+			break
+		}
+		if gameDelay != nil {
+			<-gameDelay
+			gameDelay = time.After(gameDeltaT)
+		}
+	}
+
+	phase.Stop(rsys)
+	PublishPhaseEvent(rsys, robo.EvPhaseStop, phase)
+	return SortedVehRankings(phase), done
+}
+
+// PublishPhaseEvent publishes a phase start/stop event. The event's Phase is
+// the game phase's type name, and Data is the game phase itself.
+func PublishPhaseEvent(rsys *robo.System, kind robo.EventKind, phase GamePhase) {
+	rsys.Events.Publish(robo.Event{Kind: kind, Phase: fmt.Sprintf("%T", phase), Data: phase})
+}
+
+// GameTickDuration is the amount of sim time that passes in one game tick, ie
+// one call to GamePhase.Update().
+func GameTickDuration(rsys *robo.System) time.Duration {
+	return time.Duration(uint64(RoboTicksPerGameTick)*uint64(rsys.SimDeltaT())) * time.Nanosecond
+}
+
+// SortedVehRankings returns the game phase's vehicle rankings, sorted by rank.
+func SortedVehRankings(phase GamePhase) []VehRanking {
+	rankings := VehRankingSorter{phase.VehRankings()}
+	sort.Sort(&rankings) // in-place
+	return rankings.Rankings
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// input.go decouples game phases from any particular source of user input. A
+// game phase asks about logical actions (eg "speed up"), and an Input
+// implementation decides how actions map to keyboard buttons, a script, a
+// network connection, etc.
+
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/anki/goverdrive/phys"
+)
+
+// Action is a logical user input action, eg "speed up". Games may define their
+// own actions, in addition to the standard ones below.
+type Action string
+
+// Standard actions. ActionContinue and ActionPause are used by the game loop
+// itself; the rest are conventions shared by the example games.
+const (
+	ActionContinue  Action = "continue"  // dismiss instructions or final rankings
+	ActionPause     Action = "pause"     // momentary pause, while pressed
+	ActionSelect    Action = "select"    // eg select which vehicle to control
+	ActionSpeedUp   Action = "speedup"   // increase driving speed
+	ActionSlowDown  Action = "slowdown"  // decrease driving speed
+	ActionCofsLeft  Action = "cofsleft"  // change center offset to the left
+	ActionCofsRight Action = "cofsright" // change center offset to the right
+	ActionUturn     Action = "uturn"     // u-turn
+
+	// Time control actions; see engine.TimeControl
+	ActionTimePause  Action = "timepause"  // pause or resume sim time
+	ActionTimeStep   Action = "timestep"   // single-step one sim tick
+	ActionTimeFaster Action = "timefaster" // increase the time scale
+	ActionTimeSlower Action = "timeslower" // decrease the time scale
+	ActionTimeNormal Action = "timenormal" // return to real-time
+)
+
+// PlayerAction returns a player-specific version of an action. This is for
+// games where more than one player shares the same input device.
+func PlayerAction(player int, a Action) Action {
+	return Action(fmt.Sprintf("p%d.%s", player, a))
+}
+
+// Input is the source of user input for a game phase. The "just" states refer
+// to changes since the previous call to Update.
+type Input interface {
+	// Pressed returns true if the action is currently pressed.
+	Pressed(a Action) bool
+
+	// JustPressed returns true if the action was pressed since the last Update.
+	JustPressed(a Action) bool
+
+	// JustReleased returns true if the action was released since the last
+	// Update.
+	JustReleased(a Action) bool
+
+	// PointerPos returns the position of the pointer (eg mouse), in window
+	// pixels. Inputs without a pointer return (0, 0).
+	PointerPos() (x, y float64)
+
+	// Update gathers new input state. It is called by the game loop once per
+	// game tick, before GamePhase.Update().
+	Update(now phys.SimTime)
+}
+
+// interactiveInput is optionally implemented by an Input, to say whether it can
+// change while sim time is stopped. Inputs that don't implement it, eg
+// engine.KeyboardInput, are assumed to be interactive.
+type interactiveInput interface {
+	interactive() bool
+}
+
+// IsInteractive returns true if the input can change while sim time is stopped,
+// eg while the game loop waits for the user to dismiss the instructions.
+func IsInteractive(in Input) bool {
+	ii, ok := in.(interactiveInput)
+	return !ok || ii.interactive()
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// ScriptedInputEvent is a single change to an action's state, at a particular
+// sim time.
+type ScriptedInputEvent struct {
+	Time    phys.SimTime
+	Action  Action
+	Pressed bool // false => released
+}
+
+// ScriptedInput satisfies the Input interface, by playing back a script of
+// timestamped events. It is intended for tests and headless simulations.
+type ScriptedInput struct {
+	events       []ScriptedInputEvent // not yet applied
+	pressed      map[Action]bool
+	justPressed  map[Action]bool
+	justReleased map[Action]bool
+	pointerX     float64
+	pointerY     float64
+}
+
+// NewScriptedInput creates a scripted input with no events, ie nothing is
+// ever pressed.
+func NewScriptedInput() *ScriptedInput {
+	return &ScriptedInput{
+		events:       make([]ScriptedInputEvent, 0),
+		pressed:      make(map[Action]bool),
+		justPressed:  make(map[Action]bool),
+		justReleased: make(map[Action]bool),
+	}
+}
+
+// Add adds events to the script. Events may be added in any order.
+func (si *ScriptedInput) Add(events ...ScriptedInputEvent) {
+	si.events = append(si.events, events...)
+	sort.SliceStable(si.events, func(i, j int) bool {
+		return si.events[i].Time < si.events[j].Time
+	})
+}
+
+// Press adds an event to press an action at time t.
+func (si *ScriptedInput) Press(t phys.SimTime, a Action) {
+	si.Add(ScriptedInputEvent{Time: t, Action: a, Pressed: true})
+}
+
+// Release adds an event to release an action at time t.
+func (si *ScriptedInput) Release(t phys.SimTime, a Action) {
+	si.Add(ScriptedInputEvent{Time: t, Action: a, Pressed: false})
+}
+
+// Tap adds events to press and release an action at time t. The action will be
+// both "just pressed" and "just released" after the next Update.
+func (si *ScriptedInput) Tap(t phys.SimTime, a Action) {
+	si.Press(t, a)
+	si.Release(t, a)
+}
+
+// SetPointerPos sets the pointer position, in window pixels.
+func (si *ScriptedInput) SetPointerPos(x, y float64) {
+	si.pointerX = x
+	si.pointerY = y
+}
+
+func (si *ScriptedInput) Pressed(a Action) bool {
+	return si.pressed[a]
+}
+
+func (si *ScriptedInput) JustPressed(a Action) bool {
+	return si.justPressed[a]
+}
+
+func (si *ScriptedInput) JustReleased(a Action) bool {
+	return si.justReleased[a]
+}
+
+func (si *ScriptedInput) PointerPos() (x, y float64) {
+	return si.pointerX, si.pointerY
+}
+
+// interactive returns false: events only apply as sim time passes, so nothing
+// changes while sim time is stopped.
+func (si *ScriptedInput) interactive() bool {
+	return false
+}
+
+// Update applies all events whose time is <= now.
+func (si *ScriptedInput) Update(now phys.SimTime) {
+	si.justPressed = make(map[Action]bool)
+	si.justReleased = make(map[Action]bool)
+	n := 0
+	for ; (n < len(si.events)) && (si.events[n].Time <= now); n++ {
+		ev := si.events[n]
+		if ev.Pressed {
+			si.justPressed[ev.Action] = true
+		} else {
+			si.justReleased[ev.Action] = true
+		}
+		si.pressed[ev.Action] = ev.Pressed
+	}
+	si.events = si.events[n:]
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package core
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+)
+
+// testEqual reports a testing error if the two values are not equal
+func testEqual(t *testing.T, tag string, exp interface{}, got interface{}) {
+	if exp != got {
+		t.Errorf("%s error: exp=%v, got=%v", tag, exp, got)
+	}
+}
+
+// testInputState checks the pressed, just pressed and just released state of
+// an action.
+func testInputState(t *testing.T, tag string, in Input, a Action, pressed, justPressed, justReleased bool) {
+	testEqual(t, tag+" pressed", pressed, in.Pressed(a))
+	testEqual(t, tag+" just pressed", justPressed, in.JustPressed(a))
+	testEqual(t, tag+" just released", justReleased, in.JustReleased(a))
+}
+
+func TestScriptedInput(t *testing.T) {
+	ms := phys.SimTime(1000000)
+	si := NewScriptedInput()
+
+	// events are added out of order
+	si.Release(30*ms, ActionSpeedUp)
+	si.Press(10*ms, ActionSpeedUp)
+	si.Tap(20*ms, ActionUturn)
+
+	si.Update(0)
+	testInputState(t, "t=0", si, ActionSpeedUp, false, false, false)
+
+	si.Update(10 * ms)
+	testInputState(t, "t=10", si, ActionSpeedUp, true, true, false)
+
+	// "just" states only last until the next Update
+	si.Update(15 * ms)
+	testInputState(t, "t=15", si, ActionSpeedUp, true, false, false)
+
+	// a tap is both just pressed and just released, and ends up released
+	si.Update(20 * ms)
+	testInputState(t, "t=20 tap", si, ActionUturn, false, true, true)
+	testInputState(t, "t=20", si, ActionSpeedUp, true, false, false)
+
+	// events that were missed between updates are all applied
+	si.Update(40 * ms)
+	testInputState(t, "t=40 tap", si, ActionUturn, false, false, false)
+	testInputState(t, "t=40", si, ActionSpeedUp, false, false, true)
+
+	si.Update(50 * ms)
+	testInputState(t, "t=50", si, ActionSpeedUp, false, false, false)
+}
+
+func TestScriptedInputSameTime(t *testing.T) {
+	// events at the same time keep the order they were added in
+	si := NewScriptedInput()
+	si.Add(
+		ScriptedInputEvent{Time: 5, Action: ActionSelect, Pressed: false},
+		ScriptedInputEvent{Time: 5, Action: ActionSelect, Pressed: true})
+	si.Press(1, ActionSelect)
+	si.Update(1)
+	testInputState(t, "t=1", si, ActionSelect, true, true, false)
+	si.Update(5)
+	testInputState(t, "t=5", si, ActionSelect, true, true, true)
+
+	x, y := si.PointerPos()
+	testEqual(t, "pointer x", 0.0, x)
+	testEqual(t, "pointer y", 0.0, y)
+	si.SetPointerPos(3, 4)
+	x, y = si.PointerPos()
+	testEqual(t, "pointer x", 3.0, x)
+	testEqual(t, "pointer y", 4.0, y)
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// session.go records a game session (user input, vehicle commands, collisions,
+// and final state) so that it can be saved to a file and replayed tick-for-tick
+// later. Replay relies on the robotics simulation and game logic being
+// deterministic, given the same input at the same sim time.
+//
+// Record:
+//   rec := core.NewRecorder(input, engine.DefaultButtonMap().Actions(), rsys)
+//   vizCfg.Input = rec
+//   engine.RunGameLoop(vizCfg, rsys, phase)
+//   rec.Finish(phase).Save("session.json")
+//
+// Replay, with a window:
+//   vizCfg.Input = sess.ReplayInput()
+//   engine.RunGameLoop(vizCfg, rsys, phase)
+//
+// Replay, headless, and check that the outcome is identical:
+//   err := core.VerifySession(sess, rsys, phase)
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+const sessionVersion = 1
+
+// SessionVehState is the final state of one vehicle in a session.
+type SessionVehState struct {
+	Type robo.VehType
+	Pose track.Pose
+	Vel  track.Vel
+	Odom phys.Meters
+}
+
+// Session is a complete, serializable record of one game phase.
+type Session struct {
+	Version     int
+	TrackCenLen phys.Meters    // sanity check that replay uses the same track
+	VehTypes    []robo.VehType // sanity check that replay uses the same vehicles
+	Actions     []Action       // actions that were recorded
+	StartTime   phys.SimTime
+
+	Input      []ScriptedInputEvent
+	VehCmds    []robo.VehCmd
+	Collisions []robo.CollisionEvent
+
+	// Final state, when the game phase finished
+	EndTime  phys.SimTime
+	EndVehs  []SessionVehState
+	EndRanks []VehRanking
+}
+
+// LoadSession reads a session from a file.
+func LoadSession(filename string) (*Session, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var sess Session
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, fmt.Errorf("Session file %s could not be parsed: %v", filename, err)
+	}
+	if sess.Version != sessionVersion {
+		return nil, fmt.Errorf("Session file %s has version %d; only version %d is supported", filename, sess.Version, sessionVersion)
+	}
+	return &sess, nil
+}
+
+// Save writes the session to a file.
+func (sess *Session) Save(filename string) error {
+	data, err := json.MarshalIndent(sess, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// ReplayInput returns an input that plays back the recorded input events.
+func (sess *Session) ReplayInput() *ScriptedInput {
+	si := NewScriptedInput()
+	si.Add(sess.Input...)
+	return si
+}
+
+// Compare returns an error describing the first difference between two
+// sessions, or nil if they are identical.
+func (sess *Session) Compare(other *Session) error {
+	if sess.TrackCenLen != other.TrackCenLen {
+		return fmt.Errorf("Track length differs: %v vs %v", sess.TrackCenLen, other.TrackCenLen)
+	}
+	if !reflect.DeepEqual(sess.VehTypes, other.VehTypes) {
+		return fmt.Errorf("Vehicle types differ: %v vs %v", sess.VehTypes, other.VehTypes)
+	}
+	for i := 0; (i < len(sess.VehCmds)) && (i < len(other.VehCmds)); i++ {
+		if !reflect.DeepEqual(sess.VehCmds[i], other.VehCmds[i]) {
+			return fmt.Errorf("Vehicle command %d differs: %+v vs %+v", i, sess.VehCmds[i], other.VehCmds[i])
+		}
+	}
+	if len(sess.VehCmds) != len(other.VehCmds) {
+		return fmt.Errorf("Number of vehicle commands differs: %d vs %d", len(sess.VehCmds), len(other.VehCmds))
+	}
+	if !reflect.DeepEqual(sess.Collisions, other.Collisions) {
+		return fmt.Errorf("Collisions differ: %v vs %v", sess.Collisions, other.Collisions)
+	}
+	if sess.EndTime != other.EndTime {
+		return fmt.Errorf("End time differs: %v vs %v", sess.EndTime, other.EndTime)
+	}
+	for v := range sess.EndVehs {
+		if (v >= len(other.EndVehs)) || (sess.EndVehs[v] != other.EndVehs[v]) {
+			return fmt.Errorf("Final state of vehicle %d differs", v)
+		}
+	}
+	if !reflect.DeepEqual(sess.EndRanks, other.EndRanks) {
+		return fmt.Errorf("Vehicle rankings differ: %v vs %v", sess.EndRanks, other.EndRanks)
+	}
+	return nil
+}
+
+// VerifySession replays a session headlessly with the supplied robotics system
+// and game phase, and checks that the outcome is identical to the recording.
+// The robotics system and game phase must be configured the same way as when
+// the session was recorded.
+//
+// The replay is driven by the recorded input only. The recorded vehicle
+// commands are what the game phase is expected to issue in response, and are
+// compared one by one, so the first command that differs is reported along
+// with its sim time. Commands from outside the game phase, eg from an API
+// server, are not replayed, so such sessions do not verify.
+//
+// The replay is stopped one game tick after the recorded end time; a game
+// phase that is still running then is reported as a mismatch.
+func VerifySession(sess *Session, rsys *robo.System, phase GamePhase) error {
+	if rsys.Now() != sess.StartTime {
+		return fmt.Errorf("Start time differs: %v vs %v", sess.StartTime, rsys.Now())
+	}
+	if sess.EndTime < sess.StartTime {
+		return fmt.Errorf("End time %v is before start time %v", sess.EndTime, sess.StartTime)
+	}
+	maxSimTime := sess.EndTime - sess.StartTime + phys.SimTime(GameTickDuration(rsys))
+	rec := NewRecorder(sess.ReplayInput(), sess.Actions, rsys)
+	_, done := runHeadless(HeadlessConfig{Input: rec, MaxSimTime: maxSimTime}, rsys, phase)
+	replay := rec.Finish(phase)
+	if !done {
+		return fmt.Errorf("Game phase did not finish by %v; the recording finished at %v", replay.EndTime, sess.EndTime)
+	}
+	return sess.Compare(replay)
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// Recorder records a game session. It satisfies the Input interface by
+// wrapping another input, so it can be dropped into
+// engine.GamePhaseVizConfig or HeadlessConfig.
+//
+// NOTE: Sim time does not pass during a momentary pause, so any input events
+// that happen during a pause are replayed at the tick when the pause started.
+type Recorder struct {
+	in         Input
+	rsys       *robo.System
+	sess       Session
+	collisions *robo.EventQueue
+}
+
+// NewRecorder starts recording a session. The listed actions are recorded from
+// the wrapped input, and all vehicle commands and collisions are recorded from
+// the robotics system.
+func NewRecorder(in Input, actions []Action, rsys *robo.System) *Recorder {
+	rec := Recorder{
+		in:   in,
+		rsys: rsys,
+		sess: Session{
+			Version:     sessionVersion,
+			TrackCenLen: rsys.Track.CenLen(),
+			VehTypes:    make([]robo.VehType, len(rsys.Vehicles)),
+			Actions:     actions,
+			StartTime:   rsys.Now(),
+			Input:       make([]ScriptedInputEvent, 0),
+			VehCmds:     make([]robo.VehCmd, 0),
+			Collisions:  make([]robo.CollisionEvent, 0),
+		},
+	}
+	for v, veh := range rsys.Vehicles {
+		rec.sess.VehTypes[v] = veh.Type()
+	}
+	rec.collisions = robo.NewEventQueue(rsys.Events, robo.EvCollisionStart)
+	rsys.SetVehCmdObserver(func(cmd robo.VehCmd) {
+		rec.sess.VehCmds = append(rec.sess.VehCmds, cmd)
+	})
+	return &rec
+}
+
+// Finish stops recording, captures the final state of the robotics system and
+// game phase, and returns the session.
+func (rec *Recorder) Finish(phase GamePhase) *Session {
+	rec.rsys.SetVehCmdObserver(nil)
+	rec.collisions.Close()
+	rec.sess.EndTime = rec.rsys.Now()
+	rec.sess.EndVehs = make([]SessionVehState, len(rec.rsys.Vehicles))
+	for v, veh := range rec.rsys.Vehicles {
+		rec.sess.EndVehs[v] = SessionVehState{
+			Type: veh.Type(),
+			Pose: veh.CurTrackPose(),
+			Vel:  veh.CurTrackVel(),
+			Odom: veh.Odom(),
+		}
+	}
+	rec.sess.EndRanks = SortedVehRankings(phase)
+	return &rec.sess
+}
+
+func (rec *Recorder) Pressed(a Action) bool {
+	return rec.in.Pressed(a)
+}
+
+func (rec *Recorder) JustPressed(a Action) bool {
+	return rec.in.JustPressed(a)
+}
+
+func (rec *Recorder) JustReleased(a Action) bool {
+	return rec.in.JustReleased(a)
+}
+
+func (rec *Recorder) PointerPos() (x, y float64) {
+	return rec.in.PointerPos()
+}
+
+func (rec *Recorder) interactive() bool {
+	return IsInteractive(rec.in)
+}
+
+// Update updates the wrapped input, and records any changes to the recorded
+// actions. New collisions are recorded too.
+func (rec *Recorder) Update(now phys.SimTime) {
+	rec.in.Update(now)
+
+	for _, a := range rec.sess.Actions {
+		jp := rec.in.JustPressed(a)
+		jr := rec.in.JustReleased(a)
+		press := ScriptedInputEvent{Time: now, Action: a, Pressed: true}
+		release := ScriptedInputEvent{Time: now, Action: a, Pressed: false}
+		switch {
+		case jp && jr && rec.in.Pressed(a):
+			rec.sess.Input = append(rec.sess.Input, release, press)
+		case jp && jr:
+			rec.sess.Input = append(rec.sess.Input, press, release)
+		case jp:
+			rec.sess.Input = append(rec.sess.Input, press)
+		case jr:
+			rec.sess.Input = append(rec.sess.Input, release)
+		}
+	}
+
+	// Collision start events are used, rather than CurCollisions(), so that a
+	// collision that starts and ends between two updates is still recorded. They
+	// are published in vehicle order, so the recording is repeatable.
+	for _, ev := range rec.collisions.Drain() {
+		rec.sess.Collisions = append(rec.sess.Collisions, *ev.Collision)
+	}
+}
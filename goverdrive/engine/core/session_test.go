@@ -0,0 +1,108 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// recordTestSession runs the test phase headlessly with a short script, and
+// returns the recorded session.
+func recordTestSession(t *testing.T, duration phys.SimTime) *Session {
+	si := NewScriptedInput()
+	si.Tap(phys.SimSecond/2, ActionSpeedUp)
+	si.Tap(phys.SimSecond, ActionUturn)
+	rsys := newTestSystem(t, "gs", "sk", "nk")
+	rec := NewRecorder(si, []Action{ActionSpeedUp, ActionUturn}, rsys)
+	phase := newTestPhase(duration)
+	RunHeadlessGameLoop(HeadlessConfig{Input: rec}, rsys, phase)
+	return rec.Finish(phase)
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	sess := recordTestSession(t, 3*phys.SimSecond)
+	testEqual(t, "input events", 4, len(sess.Input))
+	if len(sess.VehCmds) < 5 {
+		t.Errorf("Only %d vehicle commands were recorded", len(sess.VehCmds))
+	}
+
+	// two runs are identical
+	if err := sess.Compare(recordTestSession(t, 3*phys.SimSecond)); err != nil {
+		t.Errorf("Second run differs: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+	if err := sess.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSession(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Compare(loaded); err != nil {
+		t.Errorf("Loaded session differs: %v", err)
+	}
+
+	if err := VerifySession(loaded, newTestSystem(t, "gs", "sk", "nk"), newTestPhase(3*phys.SimSecond)); err != nil {
+		t.Errorf("Replay differs: %v", err)
+	}
+}
+
+func TestVerifySessionMismatch(t *testing.T) {
+	sess := recordTestSession(t, phys.SimSecond)
+
+	// a game phase that runs longer is stopped, rather than replayed forever
+	if err := VerifySession(sess, newTestSystem(t, "gs", "sk", "nk"), newTestPhase(phys.SimSecond*3600)); err == nil {
+		t.Errorf("Longer game phase should not verify")
+	}
+	if err := VerifySession(sess, newTestSystem(t, "gs", "sk", "nk"), newTestPhase(phys.SimSecond/2)); err == nil {
+		t.Errorf("Shorter game phase should not verify")
+	}
+	if err := VerifySession(sess, newTestSystem(t, "gs", "sk", "th"), newTestPhase(phys.SimSecond)); err == nil {
+		t.Errorf("Different vehicles should not verify")
+	}
+
+	// eg a hand-edited session; 0 must not mean "no limit"
+	sess.EndTime = sess.StartTime
+	if err := VerifySession(sess, newTestSystem(t, "gs", "sk", "nk"), newTestPhase(phys.SimSecond*3600)); err == nil {
+		t.Errorf("Zero-length session should not verify")
+	}
+}
+
+// TestRecorderShortCollision checks that a collision that starts and ends
+// between two updates is recorded.
+func TestRecorderShortCollision(t *testing.T) {
+	rsys := newTestSystem(t, "gs", "sk")
+	rec := NewRecorder(NewScriptedInput(), nil, rsys)
+	apart := rsys.Vehicles[1].CurTrackPose()
+	together := rsys.Vehicles[0].CurTrackPose()
+
+	rsys.Tick()
+	rec.Update(rsys.Now())
+	rsys.Vehicles[1].Reposition(track.Pose{Point: together.Point})
+	rsys.Tick()
+	rsys.Vehicles[1].Reposition(apart)
+	rsys.Tick()
+	rec.Update(rsys.Now())
+	rsys.Tick()
+	rec.Update(rsys.Now())
+
+	sess := rec.Finish(newTestPhase(0))
+	testEqual(t, "collisions", 1, len(sess.Collisions))
+	if len(sess.Collisions) == 1 {
+		testEqual(t, "collision veh 0", 0, sess.Collisions[0].VehInfo[0].Id)
+		testEqual(t, "collision veh 1", 1, sess.Collisions[0].VehInfo[1].Id)
+	}
+}
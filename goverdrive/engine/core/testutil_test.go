@@ -0,0 +1,84 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// newTestSystem creates a robotics system on a capsule track, with the vehicles
+// lined up as for a tournament match.
+func newTestSystem(t *testing.T, vtypes ...robo.VehType) *robo.System {
+	trk, err := track.NewStarterKitTrack(0.2, 0, "capsule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehs := make([]robo.Vehicle, len(vtypes))
+	for v, vt := range vtypes {
+		veh, err := robo.NewVehicle(vt, nil, trk.CenLen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		vehs[v] = *veh
+	}
+	rsys := robo.NewSystem(trk, &vehs, robo.NewIdealSimulator(), robo.NewCollisionDetector(trk, &vehs))
+	lineupVehicles(rsys)
+	return rsys
+}
+
+// testPhase is a minimal game phase: every vehicle drives, the input speeds up
+// the first vehicle and u-turns the last one, and the vehicle with the highest
+// odometer wins.
+type testPhase struct {
+	duration phys.SimTime
+	tBeg     phys.SimTime
+	dspd     phys.MetersPerSec
+	rankings []VehRanking
+}
+
+func newTestPhase(duration phys.SimTime) *testPhase {
+	return &testPhase{duration: duration, dspd: 0.5}
+}
+
+func (p *testPhase) InstructionText(rsys *robo.System) string {
+	return "Test phase"
+}
+
+func (p *testPhase) Start(rsys *robo.System) {
+	p.tBeg = rsys.Now()
+	for v := range rsys.Vehicles {
+		rsys.Vehicles[v].SetCmdDriveDspd(p.dspd, 1.0)
+	}
+}
+
+func (p *testPhase) Update(rsys *robo.System, in Input) (bool, GamePhaseVizObjects) {
+	n := len(rsys.Vehicles)
+	if in.JustPressed(ActionSpeedUp) {
+		p.dspd += 0.3
+		rsys.Vehicles[0].SetCmdDriveDspd(p.dspd, 1.0)
+	}
+	if in.JustPressed(ActionUturn) {
+		rsys.Vehicles[n-1].CmdUturn(robo.DefUturnRadius)
+	}
+	return (rsys.Now() - p.tBeg) >= p.duration, EmptyGamePhaseVizObjects()
+}
+
+func (p *testPhase) Stop(rsys *robo.System) {
+	vehs := append([]robo.Vehicle{}, rsys.Vehicles...)
+	sort.SliceStable(vehs, func(i, j int) bool { return vehs[i].Odom() > vehs[j].Odom() })
+	p.rankings = make([]VehRanking, len(vehs))
+	for v := range vehs {
+		p.rankings[v] = VehRanking{VehId: vehs[v].Id(), Rank: v + 1, ScoreString: fmt.Sprintf("%.3f m", vehs[v].Odom())}
+	}
+}
+
+func (p *testPhase) VehRankings() []VehRanking {
+	return p.rankings
+}
@@ -0,0 +1,373 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// tournament.go runs a game phase headlessly many times, across a matrix of
+// tracks, vehicle lineups and game parameter sets, eg to tune game rules with
+// AI-vs-AI matches. Each match has its own robo.System, so matches run in
+// parallel goroutines.
+
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// DefaultMatchMaxSimTime is the sim time limit for each match, if
+// TournamentConfig.MaxSimTime is 0. It stops a game phase that never finishes,
+// eg because of bad parameters, from hanging the tournament.
+const DefaultMatchMaxSimTime phys.SimTime = 600 * phys.SimSecond
+
+// ParamSet is a named set of game-specific parameters, eg decoded from JSON
+// into a game's parameter struct.
+type ParamSet struct {
+	Name   string
+	Params json.RawMessage
+}
+
+// MatchSpec identifies one match of a tournament.
+type MatchSpec struct {
+	Id       int
+	Track    string
+	Lineup   []robo.VehType
+	ParamSet ParamSet
+	Seed     int64 // for the game phase's random number generator, if any
+}
+
+// MatchResult is the outcome of one match.
+type MatchResult struct {
+	Match        MatchSpec
+	Rankings     []VehRanking         // sorted by rank
+	VehTypes     map[int]robo.VehType // VehId => type, for the lineup and any vehicles added during the match
+	SimDuration  phys.SimTime
+	WallDuration time.Duration
+	TimedOut     bool // true => the game phase was stopped at the max sim time
+	Collisions   int
+	Err          string // non-empty => the match could not be run
+}
+
+// vehType returns the type of a vehicle in the match.
+func (res *MatchResult) vehType(vehId int) robo.VehType {
+	if vt, ok := res.VehTypes[vehId]; ok {
+		return vt
+	}
+	return "--" // eg added and removed during the match
+}
+
+// TournamentConfig describes a tournament. Every combination of track, lineup
+// and parameter set is played Repeats times, each with a different seed.
+type TournamentConfig struct {
+	Tracks     []string // track names; see track.StarterKitTrackNames
+	TrackWidth phys.Meters
+	Lineups    [][]robo.VehType
+	ParamSets  []ParamSet // empty => one unnamed parameter set
+	Repeats    int
+	BaseSeed   int64        // match seed = BaseSeed + match Id
+	Parallel   int          // number of goroutines; <=0 => runtime.NumCPU()
+	MaxSimTime phys.SimTime // per match; 0 => DefaultMatchMaxSimTime
+	LightSpec  light.Spec   // nil => each vehicle type's default
+
+	// NewPhase creates the game phase for a match. It is called from the
+	// match's goroutine, so it must not share mutable state between matches.
+	NewPhase func(m MatchSpec) GamePhase
+}
+
+// Matches returns the full list of matches in the tournament, in order.
+func (cfg *TournamentConfig) Matches() []MatchSpec {
+	paramSets := cfg.ParamSets
+	if len(paramSets) == 0 {
+		paramSets = []ParamSet{ParamSet{}}
+	}
+	matches := make([]MatchSpec, 0)
+	for _, trk := range cfg.Tracks {
+		for _, lineup := range cfg.Lineups {
+			for _, ps := range paramSets {
+				for r := 0; r < cfg.Repeats; r++ {
+					id := len(matches)
+					matches = append(matches, MatchSpec{
+						Id:       id,
+						Track:    trk,
+						Lineup:   lineup,
+						ParamSet: ps,
+						Seed:     cfg.BaseSeed + int64(id),
+					})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// RunTournament runs all of the matches, and returns the results in match
+// order. A match that fails (eg an invalid track name, or a panic in the game
+// phase) has its error recorded in the result, and does not stop the others.
+func RunTournament(cfg TournamentConfig) []MatchResult {
+	if cfg.NewPhase == nil {
+		panic("TournamentConfig.NewPhase is required")
+	}
+	parallel := cfg.Parallel
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+
+	matches := cfg.Matches()
+	results := make([]MatchResult, len(matches))
+	work := make(chan MatchSpec)
+	var wg sync.WaitGroup
+	for g := 0; g < parallel; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range work {
+				results[m.Id] = runMatch(&cfg, m)
+			}
+		}()
+	}
+	for _, m := range matches {
+		work <- m
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
+
+// runMatch runs one match with its own robotics system.
+func runMatch(cfg *TournamentConfig, m MatchSpec) (result MatchResult) {
+	result.Match = m
+	wallBeg := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			result.Err = fmt.Sprint(r)
+		}
+		result.WallDuration = time.Since(wallBeg)
+	}()
+
+	trk, err := track.NewStarterKitTrack(cfg.TrackWidth, 0, m.Track)
+	if err != nil {
+		result.Err = err.Error()
+		return
+	}
+	vehs := make([]robo.Vehicle, len(m.Lineup))
+	for v, vt := range m.Lineup {
+		veh, err := robo.NewVehicle(vt, cfg.LightSpec, trk.CenLen())
+		if err != nil {
+			result.Err = err.Error()
+			return
+		}
+		vehs[v] = *veh
+	}
+	rsys := robo.NewSystem(trk, &vehs, robo.NewIdealSimulator(), robo.NewCollisionDetector(trk, &vehs))
+	lineupVehicles(rsys)
+
+	// rankings refer to vehicles by Id, which can outlive the vehicle
+	result.VehTypes = make(map[int]robo.VehType)
+	for _, veh := range rsys.Vehicles {
+		result.VehTypes[veh.Id()] = veh.Type()
+	}
+	rsys.Events.Subscribe(func(ev robo.Event) {
+		result.VehTypes[ev.VehId] = rsys.Vehicle(ev.VehId).Type()
+	}, robo.EvVehAdded)
+
+	maxSimTime := cfg.MaxSimTime
+	if maxSimTime == 0 {
+		maxSimTime = DefaultMatchMaxSimTime
+	}
+	collisions := robo.NewEventQueue(rsys.Events, robo.EvCollisionStart)
+	phase := cfg.NewPhase(m)
+	var done bool
+	result.Rankings, done = runHeadless(HeadlessConfig{MaxSimTime: maxSimTime}, rsys, phase)
+	result.SimDuration = rsys.Now()
+	result.TimedOut = !done
+	result.Collisions = collisions.Len()
+	return
+}
+
+// lineupVehicles spreads the vehicles evenly around the track, alternating
+// sides of the road, so that they do not start out colliding. Game phases can
+// reposition them in Start().
+func lineupVehicles(rsys *robo.System) {
+	for v := range rsys.Vehicles {
+		cofs := rsys.Track.Width() / 4
+		if v%2 == 1 {
+			cofs = -cofs
+		}
+		dofs := rsys.Track.CenLen() * phys.Meters(v) / phys.Meters(len(rsys.Vehicles))
+		rsys.Vehicles[v].Reposition(track.Pose{Point: track.Point{Dofs: dofs, Cofs: cofs}})
+	}
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// WriteResultsCSV writes one row per vehicle per match.
+func WriteResultsCSV(w io.Writer, results []MatchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"match", "track", "lineup", "params", "seed", "veh_id", "veh_type", "rank", "score",
+		"sim_sec", "wall_sec", "timed_out", "collisions", "error"})
+	for _, res := range results {
+		m := res.Match
+		common := []string{
+			strconv.Itoa(m.Id), m.Track, lineupString(m.Lineup), m.ParamSet.Name, strconv.FormatInt(m.Seed, 10),
+		}
+		stats := []string{
+			fmt.Sprintf("%.3f", float64(res.SimDuration)/float64(phys.SimSecond)),
+			fmt.Sprintf("%.3f", res.WallDuration.Seconds()),
+			strconv.FormatBool(res.TimedOut),
+			strconv.Itoa(res.Collisions),
+			res.Err,
+		}
+		if len(res.Rankings) == 0 {
+			cw.Write(append(append(common, "", "", "", ""), stats...))
+			continue
+		}
+		for _, r := range res.Rankings {
+			veh := []string{strconv.Itoa(r.VehId), string(res.vehType(r.VehId)), strconv.Itoa(r.Rank), r.ScoreString}
+			row := append(append(append([]string{}, common...), veh...), stats...)
+			cw.Write(row)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteResultsJSON writes the results and their summary as one JSON object.
+func WriteResultsJSON(w io.Writer, results []MatchResult) error {
+	out := struct {
+		Summary TournamentSummary
+		Results []MatchResult
+	}{Summarize(results), results}
+	data, err := json.MarshalIndent(out, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func lineupString(lineup []robo.VehType) string {
+	strs := make([]string, len(lineup))
+	for i, vt := range lineup {
+		strs[i] = string(vt)
+	}
+	return strings.Join(strs, " ")
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// VehTypeStats summarizes the results for one vehicle type, with one parameter
+// set.
+type VehTypeStats struct {
+	ParamSet string
+	VehType  robo.VehType
+	Entries  int // number of times the vehicle type took part in a match
+	Wins     int // number of 1st place finishes (ties count for each)
+	WinRate  float64
+	MeanRank float64
+}
+
+// TournamentSummary has summary statistics for a tournament.
+type TournamentSummary struct {
+	Matches        int
+	Errors         int
+	TimedOut       int // matches stopped at the max sim time
+	MeanSimSec     float64
+	StdDevSimSec   float64
+	MeanCollisions float64
+	MaxCollisions  int
+	VehTypes       []VehTypeStats // sorted by parameter set, then win rate
+}
+
+// Summarize computes summary statistics. Matches with errors are only counted
+// in Errors.
+func Summarize(results []MatchResult) TournamentSummary {
+	var sum TournamentSummary
+	simSecs := make([]float64, 0)
+	totalCollisions := 0
+	vtStats := make(map[string]*VehTypeStats)
+	rankSums := make(map[string]int)
+
+	for _, res := range results {
+		sum.Matches++
+		if res.Err != "" {
+			sum.Errors++
+			continue
+		}
+		if res.TimedOut {
+			sum.TimedOut++
+		}
+		simSecs = append(simSecs, float64(res.SimDuration)/float64(phys.SimSecond))
+		totalCollisions += res.Collisions
+		if res.Collisions > sum.MaxCollisions {
+			sum.MaxCollisions = res.Collisions
+		}
+		for _, r := range res.Rankings {
+			vt := res.vehType(r.VehId)
+			key := res.Match.ParamSet.Name + "/" + string(vt)
+			st, ok := vtStats[key]
+			if !ok {
+				st = &VehTypeStats{ParamSet: res.Match.ParamSet.Name, VehType: vt}
+				vtStats[key] = st
+			}
+			st.Entries++
+			if r.Rank == 1 {
+				st.Wins++
+			}
+			rankSums[key] += r.Rank
+		}
+	}
+
+	if n := len(simSecs); n > 0 {
+		for _, s := range simSecs {
+			sum.MeanSimSec += s
+		}
+		sum.MeanSimSec /= float64(n)
+		for _, s := range simSecs {
+			sum.StdDevSimSec += (s - sum.MeanSimSec) * (s - sum.MeanSimSec)
+		}
+		sum.StdDevSimSec = math.Sqrt(sum.StdDevSimSec / float64(n))
+		sum.MeanCollisions = float64(totalCollisions) / float64(n)
+	}
+
+	sum.VehTypes = make([]VehTypeStats, 0, len(vtStats))
+	for key, st := range vtStats {
+		st.WinRate = float64(st.Wins) / float64(st.Entries)
+		st.MeanRank = float64(rankSums[key]) / float64(st.Entries)
+		sum.VehTypes = append(sum.VehTypes, *st)
+	}
+	sort.Slice(sum.VehTypes, func(i, j int) bool {
+		a, b := sum.VehTypes[i], sum.VehTypes[j]
+		if a.ParamSet != b.ParamSet {
+			return a.ParamSet < b.ParamSet
+		}
+		if a.WinRate != b.WinRate {
+			return a.WinRate > b.WinRate
+		}
+		return a.VehType < b.VehType
+	})
+	return sum
+}
+
+// String is a human-readable summary, eg for printing to the console.
+func (sum TournamentSummary) String() string {
+	s := fmt.Sprintf("Matches: %d  Errors: %d  Timed out: %d\n", sum.Matches, sum.Errors, sum.TimedOut)
+	s += fmt.Sprintf("Sim duration: mean=%.1f sec, stddev=%.1f sec\n", sum.MeanSimSec, sum.StdDevSimSec)
+	s += fmt.Sprintf("Collisions per match: mean=%.2f, max=%d\n", sum.MeanCollisions, sum.MaxCollisions)
+	for _, st := range sum.VehTypes {
+		s += fmt.Sprintf("  [%s] %s: entries=%d, wins=%d (%.1f%%), mean rank=%.2f\n",
+			st.ParamSet, st.VehType, st.Entries, st.Wins, 100*st.WinRate, st.MeanRank)
+	}
+	return s
+}
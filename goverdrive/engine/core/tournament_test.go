@@ -0,0 +1,89 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+)
+
+// swapPhase replaces the first vehicle with a new "th" when it starts, so that
+// vehicle Ids no longer match the lineup.
+type swapPhase struct {
+	*testPhase
+}
+
+func (p swapPhase) Start(rsys *robo.System) {
+	rsys.RemoveVehicle(rsys.Vehicles[0].Id())
+	veh, err := robo.NewVehicle("th", nil, rsys.Track.CenLen())
+	if err != nil {
+		panic(err)
+	}
+	rsys.AddVehicle(*veh)
+	p.testPhase.Start(rsys)
+}
+
+func TestTournamentVehIds(t *testing.T) {
+	results := RunTournament(TournamentConfig{
+		Tracks:     []string{"capsule"},
+		TrackWidth: 0.2,
+		Lineups:    [][]robo.VehType{{"gs", "sk"}},
+		Repeats:    2,
+		MaxSimTime: 10 * phys.SimSecond,
+		NewPhase:   func(m MatchSpec) GamePhase { return swapPhase{newTestPhase(phys.SimSecond)} },
+	})
+	for _, res := range results {
+		testEqual(t, "error", "", res.Err)
+		testEqual(t, "timed out", false, res.TimedOut)
+		testEqual(t, "rankings", 2, len(res.Rankings))
+		for _, r := range res.Rankings {
+			if (r.VehId == 0) || (res.vehType(r.VehId) == "gs") {
+				t.Errorf("Removed vehicle is ranked: %+v", r)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteResultsCSV(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), ",th,") {
+		t.Errorf("CSV is missing the added vehicle:\n%s", buf.String())
+	}
+	sum := Summarize(results)
+	testEqual(t, "vehicle types", 2, len(sum.VehTypes))
+}
+
+func TestTournamentMaxSimTime(t *testing.T) {
+	cfg := TournamentConfig{
+		Tracks:     []string{"capsule"},
+		TrackWidth: 0.2,
+		Lineups:    [][]robo.VehType{{"gs"}},
+		Repeats:    1,
+		NewPhase:   func(m MatchSpec) GamePhase { return newTestPhase(1 << 62) }, // never finishes
+	}
+
+	cfg.MaxSimTime = 5 * phys.SimSecond
+	res := RunTournament(cfg)[0]
+	testEqual(t, "timed out", true, res.TimedOut)
+	testEqual(t, "sim duration", cfg.MaxSimTime, res.SimDuration)
+
+	// 0 does not mean "no limit"
+	cfg.MaxSimTime = 0
+	res = RunTournament(cfg)[0]
+	testEqual(t, "default timed out", true, res.TimedOut)
+	testEqual(t, "default sim duration", DefaultMatchMaxSimTime, res.SimDuration)
+	testEqual(t, "summary", 1, Summarize([]MatchResult{res}).TimedOut)
+
+	// finishing on the last allowed tick is not a time out
+	cfg.MaxSimTime = 5 * phys.SimSecond
+	cfg.NewPhase = func(m MatchSpec) GamePhase { return newTestPhase(cfg.MaxSimTime) }
+	res = RunTournament(cfg)[0]
+	testEqual(t, "last tick timed out", false, res.TimedOut)
+	testEqual(t, "last tick sim duration", cfg.MaxSimTime, res.SimDuration)
+}
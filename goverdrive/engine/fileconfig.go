@@ -0,0 +1,299 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// fileconfig.go describes the game configuration (track, vehicles, window,
+// simulator, and game-specific parameters) as a spec that can be read from a
+// JSON or YAML file. Command-line flags can override individual fields; see
+// cliconfig.go.
+//
+// Example config file:
+//   {
+//     "Window":   {"Width": 1200, "Height": 850, "MsgBoardHeight": 200},
+//     "Track":    {"Name": "Capsule", "Width": 0.2},
+//     "Vehicles": [
+//       {"Type": "gs", "Pose": {"Dofs": 0.0, "Cofs": -0.05}},
+//       {"Type": "sk", "Pose": {"Dofs": 0.5, "Cofs": 0.05}, "Direction": "countertrackwise", "Lights": "pod"}
+//     ],
+//     "LightSpecs": {
+//       "pod": {"center": {"Color": "white", "Lights": [{"X": 0, "Y": 0, "R": 0.01}]}}
+//     },
+//     "Sim":  {
+//       "Simulator": "realistic", "Realistic": {"Seed": 7, "SpeedNoise": 0.01},
+//       "Collider": "responder", "Response": {"Restitution": 0.5}
+//     },
+//     "API":  "localhost:8080",
+//     "Emulator": "localhost:9000",
+//     "Game": {"WinningScore": 3}
+//   }
+//
+// The same config file in YAML, which uses the same field names:
+//   Window: {Width: 1200, Height: 850, MsgBoardHeight: 200}
+//   Track: {Name: Capsule, Width: 0.2}
+//   Vehicles:
+//     - {Type: gs, Pose: {Dofs: 0.0, Cofs: -0.05}}
+//     - {Type: sk, Pose: {Dofs: 0.5, Cofs: 0.05}, Direction: countertrackwise, Lights: pod}
+//   ...
+//   Game:
+//     WinningScore: 3
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/image/colornames"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// GameConfigSpec is the complete, serializable description of a game
+// configuration.
+type GameConfigSpec struct {
+	Window           WindowSpec
+	Track            TrackSpec
+	VehTypeFiles     []string // JSON vehicle type files, loaded before creating the vehicles; see robo.LoadVehTypes
+	Vehicles         []VehicleSpec
+	LightSpecs       map[string]map[string]LightGroupSpec // custom light specs, by name
+	Sim              SimSpec
+	ShowInstructions bool
+	API              string          // address for the HTTP/WebSocket API server, eg "localhost:8080"; "" => none
+	Emulator         string          // first address for the virtual vehicles; see emulator.Emulator.ListenAll; "" => none
+	Game             json.RawMessage // game-specific parameters; see CLIGameConfig.GameParams
+}
+
+// WindowSpec describes the window.
+type WindowSpec struct {
+	Width          uint // pixels
+	Height         uint // pixels
+	MsgBoardHeight uint // pixels; can be 0
+	Headless       bool // true => no window is created
+}
+
+// TrackSpec describes the track.
+type TrackSpec struct {
+	Name    string // track name or modular track string
+	Width   phys.Meters
+	MaxCofs phys.Meters // max center offset, from road center
+}
+
+// VehicleSpec describes one vehicle, and where it starts.
+type VehicleSpec struct {
+	Type      robo.VehType
+	Lights    string      // "" => the game's light spec; else "gen2", "hexpod", or a name from LightSpecs
+	Pose      *track.Pose // nil => the track origin
+	Direction string      // "" => Pose.DAngle; else "trackwise" or "countertrackwise"
+}
+
+// LightGroupSpec describes one group of lights in a custom light spec.
+type LightGroupSpec struct {
+	Color  string // default color, by name; eg "goldenrod"
+	Lights []light.Position
+}
+
+// SimSpec selects the robotics simulator, collider, localization and command
+// link.
+type SimSpec struct {
+	Simulator    string                       // "ideal" or "realistic"
+	Realistic    robo.RealisticSimParams      // for the "realistic" simulator
+	Collider     string                       // "detector" or "responder"
+	Response     robo.CollisionResponseParams // for the "responder" collider
+	Localize     bool                         // true => publish localization events, like real vehicles
+	Localization robo.LocalizationParams      // if Localize
+	LinkCmds     bool                         // true => delay vehicle commands, like BLE
+	CmdLink      robo.CmdLinkParams           // if LinkCmds
+}
+
+// DefaultGameConfigSpec returns the spec used when there is no config file and
+// no command-line flags.
+func DefaultGameConfigSpec() GameConfigSpec {
+	return GameConfigSpec{
+		Window:   WindowSpec{Width: 1200, Height: 850, MsgBoardHeight: 200},
+		Track:    TrackSpec{Name: "Capsule", Width: 0.20, MaxCofs: 0.0},
+		Vehicles: []VehicleSpec{VehicleSpec{Type: "gs"}},
+		Sim: SimSpec{
+			Simulator:    "ideal",
+			Realistic:    robo.DefaultRealisticSimParams(),
+			Collider:     "detector",
+			Response:     robo.DefaultCollisionResponseParams(),
+			Localization: robo.DefaultLocalizationParams(),
+			CmdLink:      robo.DefaultCmdLinkParams(),
+		},
+	}
+}
+
+// LoadGameConfigSpec reads a config file; files named *.yaml or *.yml are YAML,
+// and anything else is JSON. Fields missing from the file keep their value from
+// base, eg DefaultGameConfigSpec().
+func LoadGameConfigSpec(filename string, base GameConfigSpec) (GameConfigSpec, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return base, err
+	}
+	if ext := strings.ToLower(filepath.Ext(filename)); (ext == ".yaml") || (ext == ".yml") {
+		if data, err = yamlToJSON(data); err != nil {
+			return base, fmt.Errorf("Config file %s could not be parsed: %v", filename, err)
+		}
+	}
+	spec := base
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return base, fmt.Errorf("Config file %s could not be parsed: %v", filename, err)
+	}
+	return spec, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so that YAML config files are
+// decoded exactly like JSON ones, including the raw "Game" section.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue converts the maps decoded by the yaml package, which can have keys
+// of any type, into maps with string keys.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[fmt.Sprint(key)] = jsonValue(elem)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	}
+	return v
+}
+
+// loadVehTypes registers the vehicle types from the spec's vehicle type files.
+func (spec *GameConfigSpec) loadVehTypes() error {
+	for _, filename := range spec.VehTypeFiles {
+		if err := robo.LoadVehTypes(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTrack creates the track described by the spec.
+func (spec *GameConfigSpec) newTrack() (*track.Track, error) {
+	ts := spec.Track
+	if (ts.Width < 0.001) || (ts.Width > 2.0) {
+		return nil, fmt.Errorf("Track width=%v is not reasonable", ts.Width)
+	}
+	return track.NewNamedTrack(ts.Width, ts.MaxCofs, ts.Name)
+}
+
+// lightSpec returns the named light spec. An empty name means defSpec.
+func (spec *GameConfigSpec) lightSpec(name string, defSpec light.Spec) (light.Spec, error) {
+	if name == "" {
+		return defSpec, nil
+	}
+	groups, ok := spec.LightSpecs[name]
+	if !ok {
+		return light.SpecByName(name)
+	}
+	ls := make(light.Spec)
+	for gname, gs := range groups {
+		c, ok := colornames.Map[strings.ToLower(gs.Color)]
+		if !ok {
+			return nil, fmt.Errorf("Light spec %s, group %s: color=%q is not recognized", name, gname, gs.Color)
+		}
+		ls[gname] = light.NewGroup(c, gs.Lights)
+	}
+	return ls, nil
+}
+
+// newVehicles creates the vehicles described by the spec, in their starting
+// poses.
+func (spec *GameConfigSpec) newVehicles(trk *track.Track, defLightSpec light.Spec) ([]robo.Vehicle, error) {
+	if len(spec.Vehicles) == 0 {
+		return nil, fmt.Errorf("At least one vehicle is required")
+	}
+	vehs := make([]robo.Vehicle, 0)
+	for v, vs := range spec.Vehicles {
+		ls, err := spec.lightSpec(vs.Lights, defLightSpec)
+		if err != nil {
+			return nil, fmt.Errorf("Vehicle %d: %v", v, err)
+		}
+		veh, err := robo.NewVehicle(vs.Type, ls, trk.CenLen())
+		if err != nil {
+			return nil, fmt.Errorf("Vehicle %d: %v", v, err)
+		}
+
+		pose := track.Pose{}
+		if vs.Pose != nil {
+			pose = *vs.Pose
+		}
+		if (pose.Dofs < 0) || (pose.Dofs >= trk.CenLen()) {
+			return nil, fmt.Errorf("Vehicle %d: Dofs=%v invalid; must be in [0, %v)", v, pose.Dofs, trk.CenLen())
+		}
+		switch strings.ToLower(vs.Direction) {
+		case "":
+		case "trackwise":
+			pose.DAngle = 0
+		case "countertrackwise":
+			pose.DAngle = math.Pi
+		default:
+			return nil, fmt.Errorf("Vehicle %d: Direction=%q is not recognized", v, vs.Direction)
+		}
+		veh.Reposition(pose)
+		vehs = append(vehs, *veh)
+	}
+	return vehs, nil
+}
+
+// checkSim checks that the simulator and collider names are recognized.
+func (spec *GameConfigSpec) checkSim() error {
+	switch strings.ToLower(spec.Sim.Simulator) {
+	case "", "ideal", "realistic":
+	default:
+		return fmt.Errorf("Simulator=%q is not recognized", spec.Sim.Simulator)
+	}
+	switch strings.ToLower(spec.Sim.Collider) {
+	case "", "detector", "responder":
+	default:
+		return fmt.Errorf("Collider=%q is not recognized", spec.Sim.Collider)
+	}
+	if spec.Sim.Localize && (spec.Sim.Localization.LocationSpacing <= 0) {
+		return fmt.Errorf("Localization LocationSpacing=%v is invalid", spec.Sim.Localization.LocationSpacing)
+	}
+	if spec.Sim.LinkCmds && (spec.Sim.CmdLink.MaxWritesPerSec < 0) {
+		return fmt.Errorf("CmdLink MaxWritesPerSec=%v is invalid", spec.Sim.CmdLink.MaxWritesPerSec)
+	}
+	return nil
+}
+
+// newSystem creates the robotics system, with the simulator, collider,
+// localizer and command link named by the spec. The spec must have passed checkSim().
+func (spec *GameConfigSpec) newSystem(trk *track.Track, vehs *[]robo.Vehicle) *robo.System {
+	var sim robo.Simulator = robo.NewIdealSimulator()
+	if strings.ToLower(spec.Sim.Simulator) == "realistic" {
+		sim = robo.NewRealisticSimulator(spec.Sim.Realistic)
+	}
+	var collider robo.VehicleCollider = robo.NewCollisionDetector(trk, vehs)
+	if strings.ToLower(spec.Sim.Collider) == "responder" {
+		collider = robo.NewCollisionResponder(trk, vehs, spec.Sim.Response)
+	}
+	rsys := robo.NewSystem(trk, vehs, sim, collider)
+	if spec.Sim.Localize {
+		rsys.SetLocalizer(robo.NewLocalizer(spec.Sim.Localization))
+	}
+	if spec.Sim.LinkCmds {
+		rsys.SetCmdLink(robo.NewCmdLink(spec.Sim.CmdLink))
+	}
+	return rsys
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testConfigJSON = `{
+  "Track":    {"Name": "Oval", "Width": 0.25},
+  "Vehicles": [
+    {"Type": "gs", "Pose": {"Dofs": 0.0, "Cofs": -0.05}},
+    {"Type": "sk", "Pose": {"Dofs": 0.5, "Cofs": 0.05}, "Direction": "countertrackwise"}
+  ],
+  "Sim":  {"Simulator": "realistic", "Realistic": {"Seed": 7}},
+  "Game": {"WinningScore": 3}
+}`
+
+const testConfigYAML = `
+Track: {Name: Oval, Width: 0.25}
+Vehicles:
+  - {Type: gs, Pose: {Dofs: 0.0, Cofs: -0.05}}
+  - Type: sk
+    Pose: {Dofs: 0.5, Cofs: 0.05}
+    Direction: countertrackwise
+Sim:
+  Simulator: realistic
+  Realistic:
+    Seed: 7
+Game:
+  WinningScore: 3
+`
+
+// testParams are game parameters with a check, like a game's.
+type testParams struct {
+	WinningScore int
+	Name         string
+}
+
+func (p *testParams) Check() error {
+	if p.WinningScore < 1 {
+		return fmt.Errorf("WinningScore=%d must be at least 1", p.WinningScore)
+	}
+	return nil
+}
+
+// loadTestConfig writes a config file and loads it.
+func loadTestConfig(t *testing.T, name, data string) GameConfigSpec {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := LoadGameConfigSpec(filename, DefaultGameConfigSpec())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return spec
+}
+
+func TestLoadGameConfigSpecYAML(t *testing.T) {
+	jspec := loadTestConfig(t, "game.json", testConfigJSON)
+	testEqual(t, "track", "Oval", jspec.Track.Name)
+	testEqual(t, "window", DefaultGameConfigSpec().Window, jspec.Window) // missing => base
+
+	for _, name := range []string{"game.yaml", "game.YML"} {
+		jspec := jspec
+		yspec := loadTestConfig(t, name, testConfigYAML)
+		var jgame, ygame testParams
+		json := CLIGameConfig{spec: jspec}
+		yaml := CLIGameConfig{spec: yspec}
+		testEqual(t, "json params", nil, json.GameParams(&jgame))
+		testEqual(t, "yaml params", nil, yaml.GameParams(&ygame))
+		testEqual(t, "params", jgame, ygame)
+
+		// the raw game parameters are compared above
+		jspec.Game, yspec.Game = nil, nil
+		if !reflect.DeepEqual(jspec, yspec) {
+			t.Errorf("%s differs from JSON:\n%+v\n%+v", name, yspec, jspec)
+		}
+	}
+}
+
+func TestGameParams(t *testing.T) {
+	gc := CLIGameConfig{spec: DefaultGameConfigSpec()}
+	params := testParams{WinningScore: 5, Name: "default"}
+	testEqual(t, "no game section", nil, gc.GameParams(&params))
+	testEqual(t, "default", testParams{5, "default"}, params)
+
+	// missing fields keep their defaults
+	gc.spec.Game = []byte(`{"Name": "custom"}`)
+	testEqual(t, "partial", nil, gc.GameParams(&params))
+	testEqual(t, "custom", testParams{5, "custom"}, params)
+
+	gc.spec.Game = []byte(`{"WinningScore": 0}`)
+	if err := gc.GameParams(&params); err == nil {
+		t.Errorf("WinningScore=0 should be rejected")
+	}
+	gc.spec.Game = []byte(`{"WinningScore": "three"}`)
+	if err := gc.GameParams(&params); err == nil {
+		t.Errorf("WinningScore=\"three\" should not parse")
+	}
+}
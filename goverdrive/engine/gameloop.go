@@ -1,14 +1,16 @@
 // Copyright 2017 Anki, Inc.
 // Author: gwenz@anki.com
 
-// Package engine has the reusable game engine core, such as the game loop.
+// Package engine has the windowed game loop, keyboard input and command line
+// configuration. The rest of the game engine, eg the game phase lifecycle and
+// the headless game loop, is in package engine/core, which does not need a
+// window or OpenGL.
 package engine
 
 import (
 	"fmt"
 	"golang.org/x/image/colornames"
 	"math"
-	"sort"
 	"time"
 
 	"github.com/faiface/pixel"
@@ -16,16 +18,13 @@ import (
 	"github.com/faiface/pixel/text"
 	"golang.org/x/image/font/basicfont"
 
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/emulator"
 	"github.com/anki/goverdrive/viz"
 )
 
 const (
-	// TODO(gwenz): It's unclear what range of values works for
-	// roboTicksPerGameTick, and whether there is any need for a game developer to
-	// change it.
-	roboTicksPerGameTick uint = 2
-
 	mbPaddingPixX = 20
 	mbPaddingPixY = 40
 )
@@ -38,93 +37,196 @@ type GamePhaseVizConfig struct {
 	MsgBoardPixHeight uint // pixels
 	WorldViz          viz.WorldViz
 	Window            *pixelgl.Window
+	Input             core.Input         // nil => keyboard input from Window, with DefaultButtonMap()
+	TimeControl       *TimeControl       // nil => real-time, controlled by the keyboard only
+	API               *core.APIServer    // nil => no API server
+	Emulator          *emulator.Emulator // nil => no virtual vehicles
 	atlas             *text.Atlas
 }
 
 // RunGameLoop is the core loop that drives the game. It runs one game phase
 // from start to finish, with the supplied visualization config and robotics
-// system. To run without vizualization or UI, set the window to nil.
+// system. To run without vizualization or UI, set the window to nil; this is
+// the same as core.RunHeadlessGameLoop with a default core.HeadlessConfig.
 //
 // RunGameLoop includes:
 //   - Robotics simulation
 //   - User input
 //   - Rendering the world, and displaying it to a window
-func RunGameLoop(vizCfg GamePhaseVizConfig, rsys *robo.System, phase GamePhase) {
+func RunGameLoop(vizCfg GamePhaseVizConfig, rsys *robo.System, phase core.GamePhase) {
+	if vizCfg.Window == nil {
+		cfg := core.HeadlessConfig{Input: vizCfg.Input, API: vizCfg.API, Emulator: vizCfg.Emulator}
+		if vizCfg.TimeControl != nil {
+			cfg.TimeScale = vizCfg.TimeControl.Scale()
+		} else if (cfg.API != nil) || (cfg.Emulator != nil) {
+			cfg.TimeScale = 1.0 // API clients and controllers expect the sim to run in real-time
+		}
+		core.RunHeadlessGameLoop(cfg, rsys, phase)
+		return
+	}
+
 	fmt.Printf("track.CenLen()=%v, track.MinCorner()=%v, track.MaxCorner=%v\n", rsys.Track.CenLen(), rsys.Track.MinCorner(), rsys.Track.MaxCorner())
 	//fmt.Printf("winBounds.Min=%v, winBounds.Max=%v\n", vizCfg.Window.Bounds().Min, vizCfg.Window.Bounds().Max)
 
 	vizCfg.atlas = text.NewAtlas(basicfont.Face7x13, text.ASCII)
 	vizCfg.Window.SetSmooth(true) // less pixelated rendering
+	if vizCfg.Input == nil {
+		vizCfg.Input = NewKeyboardInput(vizCfg.Window, DefaultButtonMap())
+	}
+	if vizCfg.TimeControl == nil {
+		vizCfg.TimeControl = NewTimeControl()
+	}
+	tc := vizCfg.TimeControl
 
+	if vizCfg.API != nil {
+		vizCfg.API.Attach(rsys)
+	}
+	if vizCfg.Emulator != nil {
+		vizCfg.Emulator.Attach(rsys)
+	}
 	phase.Start(rsys)
+	core.PublishPhaseEvent(rsys, robo.EvPhaseStart, phase)
 
 	if vizCfg.ShowInstr {
 		// before starting the game, display instructions on the message board
-		vizObj := EmptyGamePhaseVizObjects()
+		vizObj := core.EmptyGamePhaseVizObjects()
 		vizObj.MBText = phase.InstructionText(rsys) + "\n<<<Press SPACE BAR to continue>>>"
 		drawToWindow(vizCfg, rsys, vizObj)
-		fps := time.Tick(time.Second / 20)
-		for !vizCfg.Window.JustReleased(pixelgl.KeySpace) {
-			vizCfg.Window.Update()
-			<-fps
-		}
+		waitForRelease(vizCfg, rsys, core.ActionContinue)
 	}
 
-	var gameDeltaT time.Duration = time.Duration(uint64(roboTicksPerGameTick)*uint64(rsys.SimDeltaT())) * time.Nanosecond
-	gameDelay := time.After(gameDeltaT)
+	gameDeltaT := core.GameTickDuration(rsys)
+	frameDelay := time.After(tc.framePeriod(gameDeltaT))
+	roboTicks := uint(0) // since the last game tick; only non-zero after single-stepping
+	vizObj := core.EmptyGamePhaseVizObjects()
 	done := false
 	for !done && !vizCfg.Window.Closed() {
-		// Robotics simulation
-		for i := uint(0); i < roboTicksPerGameTick; i++ {
-			rsys.Tick()
+		// Robotics simulation, and game logic once per game tick. Normally this
+		// is one game tick per frame, but less when paused.
+		var gameTicked bool
+		gameTicked, done = runFrame(vizCfg, rsys, phase, &roboTicks, &vizObj)
+		if !gameTicked {
+			serviceWhileStopped(vizCfg, rsys)
 		}
 
-		// Game logic
-		isDone, vizObj := phase.Update(rsys, vizCfg.Window)
-		done = isDone
-
-		// Display and inputs
-		if vizCfg.Window != nil {
-			<-gameDelay
-			gameDelay = time.After(gameDeltaT)
-			drawToWindow(vizCfg, rsys, vizObj)
-			vizCfg.Window.Update() // display and inputs
-
-			// momentary pause (while key is pressed)
-			if vizCfg.Window.JustPressed(pixelgl.KeyBackspace) {
-				fps := time.Tick(time.Second / 20)
-				for !vizCfg.Window.JustReleased(pixelgl.KeyBackspace) {
-					vizCfg.Window.Update()
-					<-fps
-				}
-			}
+		// Display and inputs. VSync would limit fast-forward to the display's
+		// refresh rate.
+		<-frameDelay
+		frameDelay = time.After(tc.framePeriod(gameDeltaT))
+		if vsync := (tc.Scale() <= 1.0); vizCfg.Window.VSync() != vsync {
+			vizCfg.Window.SetVSync(vsync)
 		}
+		drawToWindow(vizCfg, rsys, vizObj)
+		vizCfg.Window.Update() // display and inputs
+
+		handleFrameInput(vizCfg, rsys, gameTicked)
 	}
 
 	phase.Stop(rsys)
+	core.PublishPhaseEvent(rsys, robo.EvPhaseStop, phase)
 
 	if done {
-		// Show the final vehicle ranking on the Message Board
-
-		vizObj := EmptyGamePhaseVizObjects()
-		rstr := ""
-		rankings := VehRankingSorter{phase.VehRankings()}
-		sort.Sort(&rankings) // in-place
-		for _, r := range rankings.Rankings {
-			rstr += fmt.Sprintf("[%s] %s\n", rsys.Vehicles[r.VehId].Type(), r.String())
+		showRankings(vizCfg, rsys, "", core.SortedVehRankings(phase))
+	}
+}
+
+// RunGame runs a full game with visualization, using RunGameLoop for each
+// phase. The aggregated final rankings are shown and returned, sorted by rank.
+func RunGame(vizCfg GamePhaseVizConfig, g *core.Game, rsys *robo.System) []core.VehRanking {
+	rankings := g.RunPhases(rsys, func(phase core.GamePhase) bool {
+		RunGameLoop(vizCfg, rsys, phase)
+		return (vizCfg.Window == nil) || !vizCfg.Window.Closed()
+	})
+	if (vizCfg.Window != nil) && !vizCfg.Window.Closed() {
+		showRankings(vizCfg, rsys, "FINAL RESULT\n", rankings)
+	}
+	return rankings
+}
+
+// runFrame runs the robotics ticks for one frame, as allowed by the time
+// control, and updates the game phase once every core.RoboTicksPerGameTick
+// sim ticks. roboTicks counts the sim ticks since the last game tick, across
+// frames; it is only non-zero after single-stepping. vizObj is replaced by the
+// game phase's latest visualization objects.
+func runFrame(vizCfg GamePhaseVizConfig, rsys *robo.System, phase core.GamePhase, roboTicks *uint, vizObj *core.GamePhaseVizObjects) (gameTicked bool, done bool) {
+	for n := vizCfg.TimeControl.roboTicks(); (n > 0) && !done; n-- {
+		rsys.Tick()
+		*roboTicks++
+		if *roboTicks == core.RoboTicksPerGameTick {
+			*roboTicks = 0
+			gameTicked = true
+			vizCfg.Input.Update(rsys.Now())
+			done, *vizObj = phase.Update(rsys, vizCfg.Input)
+			if vizCfg.API != nil {
+				vizCfg.API.Service(rsys)
+			}
+			if vizCfg.Emulator != nil {
+				vizCfg.Emulator.Service(rsys)
+			}
 		}
-		vizObj.MBText = rstr + "\nDONE. Press SPACE BAR to continue.."
-		drawToWindow(vizCfg, rsys, vizObj)
-		fps := time.Tick(time.Second / 20)
-		for !vizCfg.Window.JustReleased(pixelgl.KeySpace) {
-			vizCfg.Window.Update()
-			<-fps
+	}
+	return gameTicked, done
+}
+
+// handleFrameInput applies the time control and momentary pause actions, once
+// per frame. A non-interactive input, eg a ScriptedInput, only changes when it
+// is updated on a game tick; its "just" states would otherwise be seen again on
+// every frame while paused, and toggle the pause straight back.
+func handleFrameInput(vizCfg GamePhaseVizConfig, rsys *robo.System, gameTicked bool) {
+	if !gameTicked && !core.IsInteractive(vizCfg.Input) {
+		return
+	}
+	vizCfg.TimeControl.handleInput(vizCfg.Input)
+
+	// momentary pause (while key is pressed)
+	if vizCfg.Input.JustPressed(core.ActionPause) {
+		waitForRelease(vizCfg, rsys, core.ActionPause)
+	}
+}
+
+// showRankings shows vehicle rankings on the Message Board, and waits for the
+// user to continue.
+func showRankings(vizCfg GamePhaseVizConfig, rsys *robo.System, title string, rankings []core.VehRanking) {
+	vizObj := core.EmptyGamePhaseVizObjects()
+	rstr := title
+	for _, r := range rankings {
+		vtype := robo.VehType("--") // eg the vehicle was removed
+		if veh := rsys.Vehicle(r.VehId); veh != nil {
+			vtype = veh.Type()
 		}
+		rstr += fmt.Sprintf("[%s] %s\n", vtype, r.String())
 	}
+	vizObj.MBText = rstr + "\nDONE. Press SPACE BAR to continue.."
+	drawToWindow(vizCfg, rsys, vizObj)
+	waitForRelease(vizCfg, rsys, core.ActionContinue)
 }
 
-func drawToWindow(vizCfg GamePhaseVizConfig, rsys *robo.System, vizObj GamePhaseVizObjects) {
-	canvas := vizCfg.WorldViz.RenderAll(&rsys.Track, vizObj.Regions, &rsys.Vehicles, vizObj.Shapes)
+// waitForRelease keeps the window responsive, with no sim or game updates,
+// until an input action is released. It does not wait for a non-interactive
+// input, eg a ScriptedInput, since it cannot change while sim time is stopped.
+func waitForRelease(vizCfg GamePhaseVizConfig, rsys *robo.System, a core.Action) {
+	if !core.IsInteractive(vizCfg.Input) {
+		return
+	}
+	fps := time.Tick(time.Second / 20)
+	for !vizCfg.Input.JustReleased(a) && !vizCfg.Window.Closed() {
+		vizCfg.Window.Update()
+		vizCfg.Input.Update(rsys.Now())
+		serviceWhileStopped(vizCfg, rsys)
+		<-fps
+	}
+}
+
+// serviceWhileStopped services the API while sim time is stopped, eg while
+// paused or single-stepping, so that API commands do not time out.
+func serviceWhileStopped(vizCfg GamePhaseVizConfig, rsys *robo.System) {
+	if vizCfg.API != nil {
+		vizCfg.API.ServiceStopped(rsys)
+	}
+}
+
+func drawToWindow(vizCfg GamePhaseVizConfig, rsys *robo.System, vizObj core.GamePhaseVizObjects) {
+	canvas := vizCfg.WorldViz.RenderAll(&rsys.Track, vizObj.Regions, rsys.Obstacles(), &rsys.Vehicles, vizObj.Shapes)
 
 	// TODO(gwenz): Encapsulate window/canvas/text/etc into package viz, so
 	// that gameloop does not directly depend on visualization implementation?
@@ -149,4 +251,17 @@ func drawToWindow(vizCfg GamePhaseVizConfig, rsys *robo.System, vizObj GamePhase
 	txt.Color = colornames.Lightgrey
 	txt.WriteString(vizObj.MBText)
 	txt.Draw(vizCfg.Window, pixel.IM.Scaled(pixel.ZV, 1.4/scaleFactor).Moved(mbPos))
+
+	// time control indicator, in the top left corner of the window
+	if vizCfg.TimeControl != nil {
+		vizCfg.Window.SetMatrix(pixel.IM)
+		tcPos := pixel.V(mbPaddingPixX, vizCfg.Window.Bounds().H()-mbPaddingPixY)
+		tcTxt := text.New(pixel.V(0, 0), vizCfg.atlas)
+		tcTxt.Color = colornames.Lightgrey
+		if vizCfg.TimeControl.Paused() || (vizCfg.TimeControl.Scale() != 1.0) {
+			tcTxt.Color = colornames.Yellow
+		}
+		tcTxt.WriteString(vizCfg.TimeControl.String())
+		tcTxt.Draw(vizCfg.Window, pixel.IM.Scaled(pixel.ZV, 1.4).Moved(tcPos))
+	}
 }
@@ -0,0 +1,128 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// input.go maps keyboard buttons to the logical actions of core.Input, for the
+// windowed game loop.
+
+package engine
+
+import (
+	"sort"
+
+	"github.com/faiface/pixel/pixelgl"
+
+	"github.com/anki/goverdrive/engine/core"
+	"github.com/anki/goverdrive/phys"
+)
+
+// ButtonMap maps each action to one or more physical buttons. Any one of the
+// buttons triggers the action.
+type ButtonMap map[core.Action][]pixelgl.Button
+
+// Set maps an action to a set of buttons, replacing any previous mapping for
+// that action.
+func (bm ButtonMap) Set(a core.Action, buttons ...pixelgl.Button) {
+	bm[a] = buttons
+}
+
+// Actions returns all of the actions in the button map, in sorted order.
+func (bm ButtonMap) Actions() []core.Action {
+	actions := make([]core.Action, 0, len(bm))
+	for a := range bm {
+		actions = append(actions, a)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i] < actions[j] })
+	return actions
+}
+
+// DefaultButtonMap returns a new ButtonMap with the standard keyboard layout:
+//   - Single player: arrow keys, SPACE BAR to select, RIGHT SHIFT to u-turn
+//   - Player 0: WASD keys, LEFT SHIFT to u-turn
+//   - Player 1: arrow keys, RIGHT SHIFT to u-turn
+//   - SPACE BAR to continue, BACKSPACE to pause
+//   - Time control: see TimeControl
+func DefaultButtonMap() ButtonMap {
+	bm := ButtonMap{
+		core.ActionContinue:   {pixelgl.KeySpace},
+		core.ActionPause:      {pixelgl.KeyBackspace},
+		core.ActionSelect:     {pixelgl.KeySpace},
+		core.ActionSpeedUp:    {pixelgl.KeyUp},
+		core.ActionSlowDown:   {pixelgl.KeyDown},
+		core.ActionCofsLeft:   {pixelgl.KeyLeft},
+		core.ActionCofsRight:  {pixelgl.KeyRight},
+		core.ActionUturn:      {pixelgl.KeyRightShift},
+		core.ActionTimePause:  {pixelgl.KeyP},
+		core.ActionTimeStep:   {pixelgl.KeyPeriod},
+		core.ActionTimeFaster: {pixelgl.KeyRightBracket},
+		core.ActionTimeSlower: {pixelgl.KeyLeftBracket},
+		core.ActionTimeNormal: {pixelgl.KeyBackslash},
+	}
+	bm.Set(core.PlayerAction(0, core.ActionSpeedUp), pixelgl.KeyW)
+	bm.Set(core.PlayerAction(0, core.ActionSlowDown), pixelgl.KeyS)
+	bm.Set(core.PlayerAction(0, core.ActionCofsLeft), pixelgl.KeyA)
+	bm.Set(core.PlayerAction(0, core.ActionCofsRight), pixelgl.KeyD)
+	bm.Set(core.PlayerAction(0, core.ActionUturn), pixelgl.KeyLeftShift)
+	bm.Set(core.PlayerAction(1, core.ActionSpeedUp), pixelgl.KeyUp)
+	bm.Set(core.PlayerAction(1, core.ActionSlowDown), pixelgl.KeyDown)
+	bm.Set(core.PlayerAction(1, core.ActionCofsLeft), pixelgl.KeyLeft)
+	bm.Set(core.PlayerAction(1, core.ActionCofsRight), pixelgl.KeyRight)
+	bm.Set(core.PlayerAction(1, core.ActionUturn), pixelgl.KeyRightShift)
+	return bm
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// KeyboardInput satisfies the core.Input interface, using the keyboard and
+// mouse of a pixelgl window.
+type KeyboardInput struct {
+	win  *pixelgl.Window
+	bmap ButtonMap
+}
+
+// NewKeyboardInput creates a keyboard input for the window, using the button
+// map to translate buttons into actions.
+func NewKeyboardInput(win *pixelgl.Window, bmap ButtonMap) *KeyboardInput {
+	return &KeyboardInput{win: win, bmap: bmap}
+}
+
+// Window returns the window that input is gathered from.
+func (ki *KeyboardInput) Window() *pixelgl.Window {
+	return ki.win
+}
+
+func (ki *KeyboardInput) Pressed(a core.Action) bool {
+	for _, b := range ki.bmap[a] {
+		if ki.win.Pressed(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ki *KeyboardInput) JustPressed(a core.Action) bool {
+	for _, b := range ki.bmap[a] {
+		if ki.win.JustPressed(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ki *KeyboardInput) JustReleased(a core.Action) bool {
+	for _, b := range ki.bmap[a] {
+		if ki.win.JustReleased(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ki *KeyboardInput) PointerPos() (x, y float64) {
+	pos := ki.win.MousePosition()
+	return pos.X, pos.Y
+}
+
+// Update is a no-op. The game loop calls Window.Update(), which gathers new
+// keyboard and mouse input as a side effect.
+func (ki *KeyboardInput) Update(now phys.SimTime) {
+}
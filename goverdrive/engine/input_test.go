@@ -0,0 +1,28 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/engine/core"
+)
+
+// testEqual reports a testing error if the two values are not equal
+func testEqual(t *testing.T, tag string, exp interface{}, got interface{}) {
+	if exp != got {
+		t.Errorf("%s error: exp=%v, got=%v", tag, exp, got)
+	}
+}
+
+func TestWaitForReleaseScripted(t *testing.T) {
+	// the script can never release the action while sim time is stopped, so
+	// waitForRelease must not wait for it (or touch the nil window)
+	si := core.NewScriptedInput()
+	si.Press(0, core.ActionContinue)
+	si.Update(0)
+	testEqual(t, "interactive", false, core.IsInteractive(si))
+	waitForRelease(GamePhaseVizConfig{Input: si}, nil, core.ActionContinue)
+	testEqual(t, "pressed", true, si.Pressed(core.ActionContinue))
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/engine/core"
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// newTestSystem creates a robotics system on a capsule track, with the vehicles
+// spread evenly around the track.
+func newTestSystem(t *testing.T, vtypes ...robo.VehType) *robo.System {
+	trk, err := track.NewStarterKitTrack(0.2, 0, "capsule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehs := make([]robo.Vehicle, len(vtypes))
+	for v, vt := range vtypes {
+		veh, err := robo.NewVehicle(vt, nil, trk.CenLen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		vehs[v] = *veh
+	}
+	rsys := robo.NewSystem(trk, &vehs, robo.NewIdealSimulator(), robo.NewCollisionDetector(trk, &vehs))
+	for v := range rsys.Vehicles {
+		dofs := trk.CenLen() * phys.Meters(v) / phys.Meters(len(vtypes))
+		rsys.Vehicles[v].Reposition(track.Pose{Point: track.Point{Dofs: dofs}})
+	}
+	return rsys
+}
+
+// testPhase is a minimal game phase: every vehicle drives until the duration
+// has passed. It counts its updates.
+type testPhase struct {
+	duration phys.SimTime
+	tBeg     phys.SimTime
+	updates  int
+}
+
+func newTestPhase(duration phys.SimTime) *testPhase {
+	return &testPhase{duration: duration}
+}
+
+func (p *testPhase) InstructionText(rsys *robo.System) string {
+	return "Test phase"
+}
+
+func (p *testPhase) Start(rsys *robo.System) {
+	p.tBeg = rsys.Now()
+	for v := range rsys.Vehicles {
+		rsys.Vehicles[v].SetCmdDriveDspd(0.5, 1.0)
+	}
+}
+
+func (p *testPhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	p.updates++
+	return (rsys.Now() - p.tBeg) >= p.duration, core.EmptyGamePhaseVizObjects()
+}
+
+func (p *testPhase) Stop(rsys *robo.System) {
+}
+
+func (p *testPhase) VehRankings() []core.VehRanking {
+	return make([]core.VehRanking, 0)
+}
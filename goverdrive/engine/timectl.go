@@ -0,0 +1,163 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// timectl.go controls how fast sim time passes compared to wall-clock time, in
+// the windowed game loop. Only the pace changes: each game tick is still
+// core.RoboTicksPerGameTick sim ticks, so game phases see the same sim time.
+
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/anki/goverdrive/engine/core"
+)
+
+// Limits for TimeControl.SetScale()
+const (
+	MinTimeScale = 0.1
+	MaxTimeScale = 10.0
+)
+
+// pausedFramePeriod keeps the window responsive while paused
+const pausedFramePeriod = time.Second / 20
+
+// timeScalePresets are the steps used by TimeControl.Faster() and Slower().
+var timeScalePresets = []float64{0.1, 0.25, 0.5, 1.0, 2.0, 5.0, 10.0}
+
+// TimeControl is the time scale (slow motion and fast-forward), pause and
+// single-step state of the game loop. Games can call it directly, eg to slow
+// down while a collision is in progress. By default, the keyboard bindings are:
+//   - P to pause and resume
+//   - PERIOD to single-step one sim tick (pauses, if needed)
+//   - LEFT/RIGHT BRACKET to slow down / speed up
+//   - BACKSLASH to return to real-time
+//
+// Fast-forward is limited by how quickly the window can be drawn, since each
+// game tick is still drawn.
+type TimeControl struct {
+	scale  float64 // sim time / wall-clock time
+	paused bool
+	steps  uint // sim ticks requested by Step(), not yet run
+}
+
+// NewTimeControl creates a time control that runs in real-time.
+func NewTimeControl() *TimeControl {
+	return &TimeControl{scale: 1.0}
+}
+
+// Scale returns the ratio of sim time to wall-clock time, when not paused.
+func (tc *TimeControl) Scale() float64 {
+	return tc.scale
+}
+
+// SetScale sets the ratio of sim time to wall-clock time; eg 0.1 is slow motion
+// and 10.0 is fast-forward. It is clamped to [MinTimeScale, MaxTimeScale].
+func (tc *TimeControl) SetScale(scale float64) {
+	if scale < MinTimeScale {
+		scale = MinTimeScale
+	} else if scale > MaxTimeScale {
+		scale = MaxTimeScale
+	}
+	tc.scale = scale
+}
+
+// Faster increases the time scale to the next preset.
+func (tc *TimeControl) Faster() {
+	for _, s := range timeScalePresets {
+		if s > tc.scale {
+			tc.scale = s
+			return
+		}
+	}
+}
+
+// Slower decreases the time scale to the previous preset.
+func (tc *TimeControl) Slower() {
+	for i := len(timeScalePresets) - 1; i >= 0; i-- {
+		if timeScalePresets[i] < tc.scale {
+			tc.scale = timeScalePresets[i]
+			return
+		}
+	}
+}
+
+// Paused returns true if sim time is paused.
+func (tc *TimeControl) Paused() bool {
+	return tc.paused
+}
+
+// Pause stops sim time from passing, except by Step().
+func (tc *TimeControl) Pause() {
+	tc.paused = true
+}
+
+// Resume lets sim time pass again, at the current time scale.
+func (tc *TimeControl) Resume() {
+	tc.paused = false
+	tc.steps = 0
+}
+
+// TogglePause pauses or resumes.
+func (tc *TimeControl) TogglePause() {
+	if tc.paused {
+		tc.Resume()
+	} else {
+		tc.Pause()
+	}
+}
+
+// Step pauses, if needed, and then advances sim time by one sim tick. The game
+// phase is updated every core.RoboTicksPerGameTick steps.
+func (tc *TimeControl) Step() {
+	tc.paused = true
+	tc.steps++
+}
+
+// String is for the on-screen indicator; eg "0.25x" or "PAUSED".
+func (tc *TimeControl) String() string {
+	if tc.paused {
+		return "PAUSED"
+	}
+	return fmt.Sprintf("%gx", tc.scale)
+}
+
+// handleInput applies the standard time control actions.
+func (tc *TimeControl) handleInput(in core.Input) {
+	if in.JustPressed(core.ActionTimePause) {
+		tc.TogglePause()
+	}
+	if in.JustPressed(core.ActionTimeStep) {
+		tc.Step()
+	}
+	if in.JustPressed(core.ActionTimeFaster) {
+		tc.Faster()
+	}
+	if in.JustPressed(core.ActionTimeSlower) {
+		tc.Slower()
+	}
+	if in.JustPressed(core.ActionTimeNormal) {
+		tc.SetScale(1.0)
+	}
+}
+
+// roboTicks returns the number of sim ticks to run in the next frame, and
+// consumes any requested steps.
+func (tc *TimeControl) roboTicks() uint {
+	if tc.paused {
+		n := tc.steps
+		tc.steps = 0
+		return n
+	}
+	return core.RoboTicksPerGameTick
+}
+
+// framePeriod returns the wall-clock time between frames, given the sim time
+// per game tick.
+func (tc *TimeControl) framePeriod(gameDeltaT time.Duration) time.Duration {
+	if tc.paused {
+		return pausedFramePeriod
+	}
+	return time.Duration(float64(gameDeltaT) / tc.scale)
+}
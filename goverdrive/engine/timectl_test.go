@@ -0,0 +1,120 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package engine
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/engine/core"
+	"github.com/anki/goverdrive/phys"
+)
+
+func TestTimeControlPresets(t *testing.T) {
+	tc := NewTimeControl()
+	testEqual(t, "initial scale", 1.0, tc.Scale())
+
+	for _, exp := range []float64{2.0, 5.0, 10.0, 10.0} {
+		tc.Faster()
+		testEqual(t, "faster", exp, tc.Scale())
+	}
+	for _, exp := range []float64{5.0, 2.0, 1.0, 0.5, 0.25, 0.1, 0.1} {
+		tc.Slower()
+		testEqual(t, "slower", exp, tc.Scale())
+	}
+
+	// from between presets, to the nearest preset in that direction
+	tc.SetScale(0.3)
+	tc.Faster()
+	testEqual(t, "faster from 0.3", 0.5, tc.Scale())
+	tc.SetScale(0.3)
+	tc.Slower()
+	testEqual(t, "slower from 0.3", 0.25, tc.Scale())
+}
+
+func TestTimeControlSetScale(t *testing.T) {
+	tests := []struct {
+		scale, exp float64
+	}{
+		{0.3, 0.3},
+		{0, MinTimeScale},
+		{-1, MinTimeScale},
+		{0.01, MinTimeScale},
+		{MaxTimeScale, MaxTimeScale},
+		{100, MaxTimeScale},
+	}
+	tc := NewTimeControl()
+	for _, test := range tests {
+		tc.SetScale(test.scale)
+		testEqual(t, "scale", test.exp, tc.Scale())
+	}
+}
+
+func TestTimeControlStep(t *testing.T) {
+	rsys := newTestSystem(t, "gs")
+	phase := newTestPhase(1000 * phys.SimSecond)
+	phase.Start(rsys)
+	vizCfg := GamePhaseVizConfig{Input: core.NewScriptedInput(), TimeControl: NewTimeControl()}
+	tc := vizCfg.TimeControl
+	roboTicks := uint(0)
+	vizObj := core.EmptyGamePhaseVizObjects()
+
+	// running: one game tick per frame
+	tBeg := rsys.Now()
+	gameTicked, _ := runFrame(vizCfg, rsys, phase, &roboTicks, &vizObj)
+	testEqual(t, "running game ticked", true, gameTicked)
+	testEqual(t, "running updates", 1, phase.updates)
+	testEqual(t, "running sim time", core.GameTickDuration(rsys).Nanoseconds(), int64(rsys.Now()-tBeg))
+
+	// paused: nothing happens
+	tc.Pause()
+	tBeg = rsys.Now()
+	gameTicked, _ = runFrame(vizCfg, rsys, phase, &roboTicks, &vizObj)
+	testEqual(t, "paused game ticked", false, gameTicked)
+	testEqual(t, "paused sim time", int64(0), int64(rsys.Now()-tBeg))
+
+	// each step is exactly one sim tick, and the phase is only updated every
+	// core.RoboTicksPerGameTick steps
+	for i := uint(1); i <= 3*core.RoboTicksPerGameTick; i++ {
+		tBeg = rsys.Now()
+		tc.Step()
+		testEqual(t, "paused after step", true, tc.Paused())
+		gameTicked, _ = runFrame(vizCfg, rsys, phase, &roboTicks, &vizObj)
+		testEqual(t, "step sim time", int64(rsys.SimDeltaT()), int64(rsys.Now()-tBeg))
+		testEqual(t, "step game ticked", (i%core.RoboTicksPerGameTick) == 0, gameTicked)
+		testEqual(t, "step updates", 1+int(i/core.RoboTicksPerGameTick), phase.updates)
+
+		// no more sim ticks until the next step
+		tBeg = rsys.Now()
+		runFrame(vizCfg, rsys, phase, &roboTicks, &vizObj)
+		testEqual(t, "after step sim time", int64(0), int64(rsys.Now()-tBeg))
+	}
+
+	// resume clears steps that have not been run yet
+	tc.Step()
+	tc.Step()
+	tc.Resume()
+	testEqual(t, "resumed", false, tc.Paused())
+	testEqual(t, "resumed robo ticks", core.RoboTicksPerGameTick, tc.roboTicks())
+	tc.Pause()
+	testEqual(t, "no pending steps", uint(0), tc.roboTicks())
+}
+
+// TestTimeControlScriptedPause checks that a scripted pause does not toggle
+// straight back, since a ScriptedInput stays "just pressed" while paused.
+func TestTimeControlScriptedPause(t *testing.T) {
+	rsys := newTestSystem(t, "gs")
+	phase := newTestPhase(1000 * phys.SimSecond)
+	phase.Start(rsys)
+	in := core.NewScriptedInput()
+	in.Tap(rsys.Now()+phys.SimTime(core.GameTickDuration(rsys)), core.ActionTimePause)
+	vizCfg := GamePhaseVizConfig{Input: in, TimeControl: NewTimeControl()}
+	roboTicks := uint(0)
+	vizObj := core.EmptyGamePhaseVizObjects()
+
+	for frame := 0; frame < 5; frame++ {
+		gameTicked, _ := runFrame(vizCfg, rsys, phase, &roboTicks, &vizObj)
+		handleFrameInput(vizCfg, rsys, gameTicked)
+	}
+	testEqual(t, "paused", true, vizCfg.TimeControl.Paused())
+}
@@ -7,16 +7,14 @@ import (
 	"fmt"
 	"golang.org/x/image/colornames"
 
-	"github.com/faiface/pixel/pixelgl"
-
-	"github.com/anki/goverdrive/engine"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/gameutil/lapmetrics"
 	"github.com/anki/goverdrive/gameutil/vehlights"
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/robo/track"
-	"github.com/anki/goverdrive/viz"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 const (
@@ -26,8 +24,8 @@ const (
 
 // DriveGamePhase does simple driving for a set of vehicles.
 type DriveGamePhase struct {
-	numVeh     int
-	curVeh     int
+	vehIds     []int // vehicles in the game
+	curVeh     int   // index into vehIds
 	lapMetrics lapmetrics.LapMetrics
 	lapText    string
 }
@@ -49,7 +47,10 @@ func (gp *DriveGamePhase) Start(rsys *robo.System) {
 		rsys.Vehicles[i].Reposition(track.Pose{Point: lineupPoint, DAngle: 0})
 		rsys.Vehicles[i].SetCmdDriveDspd(0.4, 1.0)
 	}
-	gp.numVeh = len(rsys.Vehicles)
+	gp.vehIds = make([]int, len(rsys.Vehicles))
+	for v := range rsys.Vehicles {
+		gp.vehIds[v] = rsys.Vehicles[v].Id()
+	}
 	gp.curVeh = 0
 }
 
@@ -57,25 +58,27 @@ func (gp *DriveGamePhase) Stop(rsys *robo.System) {
 	// no-op
 }
 
-func (gp *DriveGamePhase) VehRankings() []engine.VehRanking {
-	rankings := make([]engine.VehRanking, gp.numVeh)
-	for v := 0; v < gp.numVeh; v++ {
-		rankings[v] = engine.VehRanking{VehId: v, Rank: v, ScoreString: "0"}
+func (gp *DriveGamePhase) VehRankings() []core.VehRanking {
+	rankings := make([]core.VehRanking, len(gp.vehIds))
+	for v, id := range gp.vehIds {
+		rankings[v] = core.VehRanking{VehId: id, Rank: v, ScoreString: "0"}
 	}
 	return rankings
 }
 
-func (gp *DriveGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool, engine.GamePhaseVizObjects) {
-	vizObj := engine.EmptyGamePhaseVizObjects()
-	veh := &rsys.Vehicles[gp.curVeh]
-
-	if win.JustPressed(pixelgl.KeySpace) {
+func (gp *DriveGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
+	if in.JustPressed(core.ActionSelect) {
 		// advance control to next vehicle
-		gp.curVeh = ((gp.curVeh + 1) % gp.numVeh)
+		gp.curVeh = ((gp.curVeh + 1) % len(gp.vehIds))
+	}
+	veh := rsys.Vehicle(gp.vehIds[gp.curVeh])
+	if veh == nil {
+		return false, vizObj // eg removed through the API; select another
 	}
 
 	dspd := veh.CmdDriveDspd()
-	if win.JustPressed(pixelgl.KeyUp) {
+	if in.JustPressed(core.ActionSpeedUp) {
 		frames := []light.Frame{light.Frame{Color: colornames.Lime, Tms: 200}}
 		veh.Lights().SetAnimation(rsys.Now(), "guns", frames, 1)
 		dspd += 0.1
@@ -84,7 +87,7 @@ func (gp *DriveGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool,
 		}
 		veh.SetCmdDriveDspd(dspd, 0.4)
 	}
-	if win.JustPressed(pixelgl.KeyDown) {
+	if in.JustPressed(core.ActionSlowDown) {
 		frames := []light.Frame{light.Frame{Color: colornames.Red, Tms: 200}}
 		veh.Lights().SetAnimation(rsys.Now(), "tail", frames, 1)
 		dspd -= 0.1
@@ -93,22 +96,22 @@ func (gp *DriveGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool,
 		}
 		veh.SetCmdDriveDspd(dspd, 0.4)
 	}
-	if win.JustPressed(pixelgl.KeyRightShift) {
+	if in.JustPressed(core.ActionUturn) {
 		veh.CmdUturn(robo.DefUturnRadius)
 	}
 
 	cofs := veh.CmdDriveCofs()
 	dCofs := phys.Meters(0)
-	if win.JustPressed(pixelgl.KeyLeft) {
+	if in.JustPressed(core.ActionCofsLeft) {
 		dCofs = +0.025
 	}
-	if win.JustPressed(pixelgl.KeyRight) {
+	if in.JustPressed(core.ActionCofsRight) {
 		dCofs = -0.025
 	}
 	veh.SetCmdDriveCofs(cofs+dCofs, 0.1)
 
 	// circle around the controlled vehicle
-	*vizObj.Shapes = append(*vizObj.Shapes, viz.NewCartesGameCirc(gp.curVeh, phys.Point{X: 0, Y: 0}, 0.05, colornames.White, 0.004))
+	*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewCartesGameCirc(veh.Id(), phys.Point{X: 0, Y: 0}, 0.05, colornames.White, 0.004))
 
 	// speedometer light
 	clr := vehlights.SpeedometerColor(vehlights.DefSpeedometerColors, veh.CurDriveDspd())
@@ -116,10 +119,10 @@ func (gp *DriveGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool,
 
 	// lap counts
 	gp.lapMetrics.Update(rsys.Now(), &rsys.Track, &rsys.Vehicles)
-	for v := range rsys.Vehicles {
-		newlaps := gp.lapMetrics.NewCompletedLapInfo(v)
+	for _, veh := range rsys.Vehicles {
+		newlaps := gp.lapMetrics.NewCompletedLapInfo(veh.Id())
 		for _, li := range newlaps {
-			gp.lapText = fmt.Sprintf("Veh %d lap completed: %s\n", v, li.String()) + gp.lapText
+			gp.lapText = fmt.Sprintf("Veh %d lap completed: %s\n", veh.Id(), li.String()) + gp.lapText
 		}
 	}
 
@@ -0,0 +1,51 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/anki/goverdrive/gym"
+	"github.com/anki/goverdrive/robo"
+)
+
+func main() {
+	addrFlag /*******/ := flag.String("addr", "localhost:7777", "TCP address to listen on; or a path, for a Unix socket")
+	trackFlag /******/ := flag.String("t", "Capsule", "Track name or modular track string")
+	vehsFlag /*******/ := flag.String("v", "gs sk", "List of vehicle types")
+	maxStepsFlag /***/ := flag.Int("maxsteps", 3000, "Steps per episode; 0 => no limit")
+	ticksFlag /******/ := flag.Int("ticks", 2, "Robotics ticks per step")
+	penaltyFlag /****/ := flag.Float64("penalty", 1.0, "Reward penalty for each collision")
+	flag.Parse()
+
+	cfg := gym.DefaultConfig()
+	cfg.Track = *trackFlag
+	cfg.Vehicles = make([]robo.VehType, 0)
+	for _, vs := range strings.Fields(*vehsFlag) {
+		cfg.Vehicles = append(cfg.Vehicles, robo.VehType(vs))
+	}
+	cfg.MaxSteps = *maxStepsFlag
+	cfg.TicksPerStep = *ticksFlag
+	cfg.CollisionPenalty = *penaltyFlag
+	if _, err := gym.NewEnv(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	network := "tcp"
+	if strings.Contains(*addrFlag, "/") {
+		network = "unix"
+	}
+	l, err := net.Listen(network, *addrFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("gym server listening on %s %s", network, l.Addr())
+	log.Fatal(gym.Serve(l, cfg))
+}
@@ -8,13 +8,11 @@ import (
 	"golang.org/x/image/colornames"
 	"math"
 
-	"github.com/faiface/pixel/pixelgl"
-
-	"github.com/anki/goverdrive/engine"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/track"
-	"github.com/anki/goverdrive/viz"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 const (
@@ -24,8 +22,8 @@ const (
 
 // MoverGamePhase does simple driving for a set of vehicles.
 type MoverGamePhase struct {
-	numVeh int
-	curVeh int
+	vehIds []int // vehicles in the game
+	curVeh int   // index into vehIds
 }
 
 func (gp *MoverGamePhase) InstructionText(rys *robo.System) string {
@@ -42,7 +40,10 @@ func (gp *MoverGamePhase) Start(rsys *robo.System) {
 		rsys.Vehicles[i].SetCmdDriveCofs(0, 0)
 		rsys.Vehicles[i].SetCmdDriveDspd(0, 0)
 	}
-	gp.numVeh = len(rsys.Vehicles)
+	gp.vehIds = make([]int, len(rsys.Vehicles))
+	for v := range rsys.Vehicles {
+		gp.vehIds[v] = rsys.Vehicles[v].Id()
+	}
 	gp.curVeh = 0
 }
 
@@ -50,43 +51,45 @@ func (gp *MoverGamePhase) Stop(rsys *robo.System) {
 	// no-op
 }
 
-func (gp *MoverGamePhase) VehRankings() []engine.VehRanking {
-	rankings := make([]engine.VehRanking, gp.numVeh)
-	for v := 0; v < gp.numVeh; v++ {
-		rankings = append(rankings, engine.VehRanking{VehId: v, Rank: v, ScoreString: "0"})
+func (gp *MoverGamePhase) VehRankings() []core.VehRanking {
+	rankings := make([]core.VehRanking, 0, len(gp.vehIds))
+	for v, id := range gp.vehIds {
+		rankings = append(rankings, core.VehRanking{VehId: id, Rank: v, ScoreString: "0"})
 	}
 	return rankings
 }
 
-func (gp *MoverGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool, engine.GamePhaseVizObjects) {
-	vizObj := engine.EmptyGamePhaseVizObjects()
-	veh := &rsys.Vehicles[gp.curVeh]
-
-	if win.JustPressed(pixelgl.KeySpace) {
+func (gp *MoverGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
+	if in.JustPressed(core.ActionSelect) {
 		// advance control to next vehicle
-		gp.curVeh = ((gp.curVeh + 1) % gp.numVeh)
+		gp.curVeh = ((gp.curVeh + 1) % len(gp.vehIds))
+	}
+	veh := rsys.Vehicle(gp.vehIds[gp.curVeh])
+	if veh == nil {
+		return false, vizObj // eg removed through the API; select another
 	}
 
 	tpose := veh.CurTrackPose()
-	if win.JustPressed(pixelgl.KeyRightShift) {
+	if in.JustPressed(core.ActionUturn) {
 		tpose.DAngle = phys.NormalizeRadians(tpose.DAngle + math.Pi)
 	}
-	if win.JustPressed(pixelgl.KeyUp) {
+	if in.JustPressed(core.ActionSpeedUp) {
 		tpose.Dofs = rsys.Track.NormalizeDofs(tpose.Dofs + dDofs)
 	}
-	if win.JustPressed(pixelgl.KeyDown) {
+	if in.JustPressed(core.ActionSlowDown) {
 		tpose.Dofs = rsys.Track.NormalizeDofs(tpose.Dofs - dDofs)
 	}
-	if win.JustPressed(pixelgl.KeyLeft) {
+	if in.JustPressed(core.ActionCofsLeft) {
 		tpose.Cofs += dCofs
 	}
-	if win.JustPressed(pixelgl.KeyRight) {
+	if in.JustPressed(core.ActionCofsRight) {
 		tpose.Cofs -= dCofs
 	}
 	veh.Reposition(tpose)
 
 	// circle in the controlled vehicle
-	*vizObj.Shapes = append(*vizObj.Shapes, viz.NewCartesGameCirc(gp.curVeh, phys.Point{X: 0, Y: 0}, 0.01, colornames.White, 0))
+	*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewCartesGameCirc(veh.Id(), phys.Point{X: 0, Y: 0}, 0.01, colornames.White, 0))
 
 	// message board text
 	for _, veh2 := range (*rsys).Vehicles {
@@ -7,7 +7,6 @@ import (
 	"github.com/faiface/pixel/pixelgl"
 
 	"github.com/anki/goverdrive/engine"
-	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/viz"
 )
@@ -19,9 +18,7 @@ func run() {
 	// Create the remaining game components
 	primViz := viz.NewPixelViz()
 	worldViz := viz.NewPixelWorldViz(primViz, gameConfig.Track())
-	rsim := robo.NewIdealSimulator()
-	rcollide := robo.NewCollisionDetector(gameConfig.Track(), gameConfig.Vehicles())
-	roboSys := robo.NewSystem(gameConfig.Track(), gameConfig.Vehicles(), rsim, rcollide)
+	roboSys := gameConfig.NewSystem()
 
 	// Run the game
 	vizCfg := engine.GamePhaseVizConfig{
@@ -29,6 +26,8 @@ func run() {
 		MsgBoardPixHeight: gameConfig.MsgBoardPixHeight(),
 		WorldViz:          worldViz,
 		Window:            gameConfig.Window(),
+		API:               gameConfig.APIServer(),
+		Emulator:          gameConfig.Emulator(),
 	}
 	engine.RunGameLoop(vizCfg, roboSys, &MoverGamePhase{})
 }
@@ -7,34 +7,23 @@ import (
 	"fmt"
 	"golang.org/x/image/colornames"
 
-	"github.com/faiface/pixel/pixelgl"
-
-	"github.com/anki/goverdrive/engine"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/robo/track"
-	"github.com/anki/goverdrive/viz"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 const (
 	minDspd = 0.3
 	maxDspd = 1.2
-
-	gameAccel = 0
-	gameDecel = 1
-	gameCofsL = 2
-	gameCofsR = 3
-	gameUturn = 4
 )
 
-type buttonMapType map[int]pixelgl.Button
-
-var buttonMap [2]buttonMapType
-
 // BumperCarsGamePhase does simple driving for a set of vehicles.
 type BumperCarsGamePhase struct {
 	numVeh     int
+	vehIds     [2]int // by player
 	hitPointsL [2]int
 	hitPointsR [2]int
 }
@@ -53,23 +42,6 @@ U-turn                       Left Shift Key  Right Shift Key
 }
 
 func (gp *BumperCarsGamePhase) Start(rsys *robo.System) {
-	buttonMap = [2]buttonMapType{
-		buttonMapType{ // player 0
-			gameAccel: pixelgl.KeyW,
-			gameDecel: pixelgl.KeyS,
-			gameCofsL: pixelgl.KeyA,
-			gameCofsR: pixelgl.KeyD,
-			gameUturn: pixelgl.KeyLeftShift,
-		},
-		buttonMapType{ // player 1
-			gameAccel: pixelgl.KeyUp,
-			gameDecel: pixelgl.KeyDown,
-			gameCofsL: pixelgl.KeyLeft,
-			gameCofsR: pixelgl.KeyRight,
-			gameUturn: pixelgl.KeyRightShift,
-		},
-	}
-
 	gp.numVeh = len(rsys.Vehicles)
 	if gp.numVeh != 2 {
 		panic("BumperCarsGamePhase requires exactly 2 vehicles")
@@ -80,6 +52,7 @@ func (gp *BumperCarsGamePhase) Start(rsys *robo.System) {
 			Cofs: 0}
 		rsys.Vehicles[i].Reposition(track.Pose{Point: lineupPoint, DAngle: 0})
 		rsys.Vehicles[i].SetCmdDriveDspd(0.4, 1.0)
+		gp.vehIds[i] = rsys.Vehicles[i].Id()
 		gp.hitPointsL[i] = 2
 		gp.hitPointsR[i] = 2
 	}
@@ -89,50 +62,66 @@ func (gp *BumperCarsGamePhase) Stop(rsys *robo.System) {
 	// no-op
 }
 
-func (gp *BumperCarsGamePhase) VehRankings() []engine.VehRanking {
+func (gp *BumperCarsGamePhase) VehRankings() []core.VehRanking {
 	var score [2]int
 	for v := 0; v < gp.numVeh; v++ {
 		score[v] = gp.hitPointsL[v] + gp.hitPointsR[v]
 	}
-	rankings := make([]engine.VehRanking, gp.numVeh)
+	rankings := make([]core.VehRanking, gp.numVeh)
 	for v := 0; v < gp.numVeh; v++ {
 		rank := 1
 		if score[(v+1)%2] > score[v] {
 			rank = 2
 		}
-		rankings[v] = engine.VehRanking{
-			VehId:       v,
+		rankings[v] = core.VehRanking{
+			VehId:       gp.vehIds[v],
 			Rank:        rank,
 			ScoreString: fmt.Sprintf("%d Hit Points", score[v])}
 	}
 	return rankings
 }
 
-func (gp *BumperCarsGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool, engine.GamePhaseVizObjects) {
-	vizObj := engine.EmptyGamePhaseVizObjects()
+// player returns the player that drives the vehicle with the Id, or -1.
+func (gp *BumperCarsGamePhase) player(id int) int {
+	for p := 0; p < gp.numVeh; p++ {
+		if gp.vehIds[p] == id {
+			return p
+		}
+	}
+	return -1
+}
+
+func (gp *BumperCarsGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
 	isDone := false
 
 	// Update hit point indicator lights
 	for v := 0; v < gp.numVeh; v++ {
+		veh := rsys.Vehicle(gp.vehIds[v])
+		if veh == nil {
+			// removed through the API => out of the game
+			isDone = true
+			continue
+		}
 		if gp.hitPointsL[v] >= 2 {
-			rsys.Vehicles[v].Lights().Set("h1", colornames.Yellow)
-			rsys.Vehicles[v].Lights().Set("h2", colornames.Yellow)
+			veh.Lights().Set("h1", colornames.Yellow)
+			veh.Lights().Set("h2", colornames.Yellow)
 		} else if gp.hitPointsL[v] == 1 {
-			rsys.Vehicles[v].Lights().Set("h1", colornames.Black)
-			rsys.Vehicles[v].Lights().Set("h2", colornames.Yellow)
+			veh.Lights().Set("h1", colornames.Black)
+			veh.Lights().Set("h2", colornames.Yellow)
 		} else {
-			rsys.Vehicles[v].Lights().Set("h1", colornames.Black)
-			rsys.Vehicles[v].Lights().Set("h2", colornames.Black)
+			veh.Lights().Set("h1", colornames.Black)
+			veh.Lights().Set("h2", colornames.Black)
 		}
 		if gp.hitPointsR[v] >= 2 {
-			rsys.Vehicles[v].Lights().Set("h4", colornames.Yellow)
-			rsys.Vehicles[v].Lights().Set("h5", colornames.Yellow)
+			veh.Lights().Set("h4", colornames.Yellow)
+			veh.Lights().Set("h5", colornames.Yellow)
 		} else if gp.hitPointsR[v] == 1 {
-			rsys.Vehicles[v].Lights().Set("h4", colornames.Yellow)
-			rsys.Vehicles[v].Lights().Set("h5", colornames.Black)
+			veh.Lights().Set("h4", colornames.Yellow)
+			veh.Lights().Set("h5", colornames.Black)
 		} else {
-			rsys.Vehicles[v].Lights().Set("h4", colornames.Black)
-			rsys.Vehicles[v].Lights().Set("h5", colornames.Black)
+			veh.Lights().Set("h4", colornames.Black)
+			veh.Lights().Set("h5", colornames.Black)
 		}
 		if (gp.hitPointsL[v] + gp.hitPointsR[v]) == 0 {
 			// you lost!
@@ -140,12 +129,15 @@ func (gp *BumperCarsGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 		}
 	}
 
-	// Process keyboard inputs
+	// Process player inputs
 	for v := 0; v < gp.numVeh; v++ {
-		veh := &rsys.Vehicles[v]
+		veh := rsys.Vehicle(gp.vehIds[v])
+		if veh == nil {
+			continue
+		}
 
 		dspd := veh.CmdDriveDspd()
-		if win.JustPressed(buttonMap[v][gameAccel]) {
+		if in.JustPressed(core.PlayerAction(v, core.ActionSpeedUp)) {
 			frames := []light.Frame{light.Frame{Color: colornames.Lime, Tms: 200}}
 			veh.Lights().SetAnimation(rsys.Now(), "h0", frames, 1)
 			dspd += 0.1
@@ -154,7 +146,7 @@ func (gp *BumperCarsGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 			}
 			veh.SetCmdDriveDspd(dspd, 0.8)
 		}
-		if win.JustPressed(buttonMap[v][gameDecel]) {
+		if in.JustPressed(core.PlayerAction(v, core.ActionSlowDown)) {
 			frames := []light.Frame{light.Frame{Color: colornames.Red, Tms: 200}}
 			veh.Lights().SetAnimation(rsys.Now(), "h3", frames, 1)
 			dspd -= 0.1
@@ -163,16 +155,16 @@ func (gp *BumperCarsGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 			}
 			veh.SetCmdDriveDspd(dspd, 0.8)
 		}
-		if win.JustPressed(buttonMap[v][gameUturn]) {
+		if in.JustPressed(core.PlayerAction(v, core.ActionUturn)) {
 			veh.CmdUturn(robo.DefUturnRadius)
 		}
 
 		cofs := veh.CmdDriveCofs()
 		dCofs := phys.Meters(0)
-		if win.JustPressed(buttonMap[v][gameCofsL]) {
+		if in.JustPressed(core.PlayerAction(v, core.ActionCofsLeft)) {
 			dCofs = +0.025
 		}
-		if win.JustPressed(buttonMap[v][gameCofsR]) {
+		if in.JustPressed(core.PlayerAction(v, core.ActionCofsRight)) {
 			dCofs = -0.025
 		}
 		veh.SetCmdDriveCofs(cofs+dCofs, 0.1)
@@ -182,7 +174,7 @@ func (gp *BumperCarsGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 	for _, ce := range rsys.Collider.CurCollisions() {
 		// display impact points of current collisions, using red dot on the vehicle
 		for i := 0; i < 2; i++ {
-			*vizObj.Shapes = append(*vizObj.Shapes, viz.NewCartesGameCirc(ce.VehInfo[i].Id, ce.VehInfo[i].POI, 0.01, colornames.Red, 0))
+			*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewCartesGameCirc(ce.VehInfo[i].Id, ce.VehInfo[i].POI, 0.01, colornames.Red, 0))
 		}
 	}
 	for _, ce := range rsys.Collider.NewCollisions() {
@@ -190,20 +182,24 @@ func (gp *BumperCarsGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 		for i := 0; i < 2; i++ {
 			cvi := ce.VehInfo[i]
 			ovi := ce.VehInfo[(i+1)%2] // other vehicle
-			cv := &rsys.Vehicles[cvi.Id]
-			ov := &rsys.Vehicles[ovi.Id]
+			cv := rsys.Vehicle(cvi.Id)
+			ov := rsys.Vehicle(ovi.Id)
+			p := gp.player(cvi.Id)
+			if (cv == nil) || (ov == nil) || (p < 0) {
+				continue // eg removed, or added, through the API
+			}
 
 			if cvi.IsRightSideCollision() {
 				cv.SetCmdDriveCofs(cv.CmdDriveCofs()+0.025, 0.1)
-				if gp.hitPointsR[cvi.Id] > 0 {
-					gp.hitPointsR[cvi.Id]--
+				if gp.hitPointsR[p] > 0 {
+					gp.hitPointsR[p]--
 				}
 			}
 
 			if cvi.IsLeftSideCollision() {
 				cv.SetCmdDriveCofs(cv.CmdDriveCofs()-0.025, 0.1)
-				if gp.hitPointsL[cvi.Id] > 0 {
-					gp.hitPointsL[cvi.Id]--
+				if gp.hitPointsL[p] > 0 {
+					gp.hitPointsL[p]--
 				}
 			}
 
@@ -223,8 +219,10 @@ func (gp *BumperCarsGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 
 	// message board text
 	rankings := gp.VehRankings()
-	for v, veh2 := range (*rsys).Vehicles {
-		vizObj.MBText += fmt.Sprintf("Veh %d    %s    %s\n", v, veh2.Type(), rankings[v].ScoreString)
+	for v := 0; v < gp.numVeh; v++ {
+		if veh2 := rsys.Vehicle(gp.vehIds[v]); veh2 != nil {
+			vizObj.MBText += fmt.Sprintf("Veh %d    %s    %s\n", veh2.Id(), veh2.Type(), rankings[v].ScoreString)
+		}
 	}
 
 	return isDone, vizObj
@@ -0,0 +1,163 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/anki/goverdrive/engine/core"
+	"github.com/anki/goverdrive/gameutil/lapmetrics"
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// RaceParams are the tunable rules of the AI race.
+type RaceParams struct {
+	Laps           int               // first vehicle to complete this many laps ends the race
+	MinDspd        phys.MetersPerSec // AI speed range
+	MaxDspd        phys.MetersPerSec
+	ChangeProb     float64 // probability, per game tick, that an AI picks a new speed and lane
+	CollisionDspd  phys.MetersPerSec
+	CollisionDelay phys.SimTime // time that a vehicle is held at CollisionDspd
+}
+
+// DefaultRaceParams returns the parameters used when a parameter set does not
+// specify them.
+func DefaultRaceParams() RaceParams {
+	return RaceParams{
+		Laps:           3,
+		MinDspd:        0.5,
+		MaxDspd:        1.2,
+		ChangeProb:     0.02,
+		CollisionDspd:  0.2,
+		CollisionDelay: 1 * phys.SimSecond,
+	}
+}
+
+// RaceGamePhase is a race where every vehicle is driven by a simple random AI.
+// Vehicles that collide are slowed down for a moment.
+type RaceGamePhase struct {
+	params     RaceParams
+	rng        *rand.Rand
+	lapMetrics *lapmetrics.LapMetrics
+	collisions *robo.EventQueue
+	tSlowEnd   map[int]phys.SimTime // by vehicle Id; 0 or missing => not slowed
+	rankings   []core.VehRanking
+}
+
+// NewRaceGamePhase creates a race. The seed makes the AI decisions repeatable.
+func NewRaceGamePhase(params RaceParams, seed int64) *RaceGamePhase {
+	return &RaceGamePhase{
+		params: params,
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (gp *RaceGamePhase) InstructionText(rsys *robo.System) string {
+	return fmt.Sprintf("AI race: first to %d laps wins\n", gp.params.Laps)
+}
+
+func (gp *RaceGamePhase) Start(rsys *robo.System) {
+	// line up behind the finish line, alternating lanes
+	for v := range rsys.Vehicles {
+		lineupPoint := track.Point{
+			Dofs: rsys.Track.NormalizeDofs(-0.15 * phys.Meters(v+1)),
+			Cofs: phys.Meters(1-2*(v%2)) * (rsys.Track.Width() / 4),
+		}
+		rsys.Vehicles[v].Reposition(track.Pose{Point: lineupPoint, DAngle: 0})
+	}
+	gp.lapMetrics = lapmetrics.New(rsys.Now(), &rsys.Vehicles, true, false)
+	gp.collisions = robo.NewEventQueue(rsys.Events, robo.EvCollisionStart)
+	gp.tSlowEnd = make(map[int]phys.SimTime)
+	for v := range rsys.Vehicles {
+		gp.drive(rsys, &rsys.Vehicles[v])
+	}
+	gp.rank(rsys)
+}
+
+func (gp *RaceGamePhase) Stop(rsys *robo.System) {
+	gp.collisions.Close()
+	gp.rank(rsys)
+}
+
+func (gp *RaceGamePhase) VehRankings() []core.VehRanking {
+	return gp.rankings
+}
+
+func (gp *RaceGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
+
+	// collisions slow down both vehicles
+	for _, ev := range gp.collisions.Drain() {
+		for _, vci := range ev.Collision.VehInfo {
+			if veh := rsys.Vehicle(vci.Id); veh != nil {
+				gp.tSlowEnd[vci.Id] = rsys.Now() + gp.params.CollisionDelay
+				veh.SetCmdDriveDspd(gp.params.CollisionDspd, 2.0)
+			}
+		}
+	}
+
+	// AI driving
+	for v := range rsys.Vehicles {
+		veh := &rsys.Vehicles[v]
+		tSlowEnd := gp.tSlowEnd[veh.Id()]
+		if (tSlowEnd != 0) && (rsys.Now() >= tSlowEnd) {
+			delete(gp.tSlowEnd, veh.Id())
+			gp.drive(rsys, veh)
+		} else if (tSlowEnd == 0) && (gp.rng.Float64() < gp.params.ChangeProb) {
+			gp.drive(rsys, veh)
+		}
+	}
+
+	gp.lapMetrics.Update(rsys.Now(), &rsys.Track, &rsys.Vehicles)
+	gp.rank(rsys)
+	done := false
+	for _, veh := range rsys.Vehicles {
+		if gp.lapMetrics.NumLapsCompleted(veh.Id()) >= gp.params.Laps {
+			done = true
+		}
+	}
+
+	vizObj.MBText = gp.InstructionText(rsys)
+	for _, r := range gp.rankings {
+		vizObj.MBText += r.String() + "\n"
+	}
+	return done, vizObj
+}
+
+// drive picks a new random speed and lane for a vehicle.
+func (gp *RaceGamePhase) drive(rsys *robo.System, veh *robo.Vehicle) {
+	p := gp.params
+	dspd := p.MinDspd + phys.MetersPerSec(gp.rng.Float64())*(p.MaxDspd-p.MinDspd)
+	lane := phys.Meters(gp.rng.Intn(3)-1) * (rsys.Track.Width() / 4)
+	veh.SetCmdDriveDspd(dspd, 0.5)
+	veh.SetCmdTrackCofs(lane, 0.1)
+}
+
+// rank orders vehicles by completed laps, then by distance driven.
+func (gp *RaceGamePhase) rank(rsys *robo.System) {
+	vehs := make([]*robo.Vehicle, len(rsys.Vehicles))
+	for v := range vehs {
+		vehs[v] = &rsys.Vehicles[v]
+	}
+	laps := func(veh *robo.Vehicle) int { return gp.lapMetrics.NumLapsCompleted(veh.Id()) }
+	sort.SliceStable(vehs, func(i, j int) bool {
+		vi, vj := vehs[i], vehs[j]
+		if laps(vi) != laps(vj) {
+			return laps(vi) > laps(vj)
+		}
+		return vi.Odom() > vj.Odom()
+	})
+	gp.rankings = make([]core.VehRanking, len(vehs))
+	for i, veh := range vehs {
+		gp.rankings[i] = core.VehRanking{
+			VehId:       veh.Id(),
+			Rank:        i + 1,
+			ScoreString: fmt.Sprintf("%d laps, %.2f m", laps(veh), veh.Odom()),
+		}
+	}
+}
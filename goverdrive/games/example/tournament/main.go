@@ -0,0 +1,126 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/anki/goverdrive/engine/core"
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+func main() {
+	nFlag /*********/ := flag.Int("n", 10, "Number of matches for each combination of track, lineup and parameter set")
+	tracksFlag /****/ := flag.String("t", "capsule", "List of starter kit track names, or \"all\"")
+	lineupsFlag /***/ := flag.String("v", "gs sk", "Comma-separated list of vehicle lineups; eg \"gs sk,gs sk th\"")
+	paramsFlag /****/ := flag.String("params", "", "JSON file with a list of parameter sets, eg [{\"Name\": \"short\", \"Params\": {\"Laps\": 1}}]")
+	seedFlag /******/ := flag.Int64("seed", 1, "Base random seed")
+	parallelFlag /**/ := flag.Int("j", 0, "Number of matches to run in parallel; 0 => number of CPUs")
+	maxSimFlag /****/ := flag.Float64("maxsim", 600, "Max sim time per match, in seconds; 0 => core.DefaultMatchMaxSimTime")
+	csvFlag /*******/ := flag.String("csv", "", "Write per-match results to this CSV file")
+	jsonFlag /******/ := flag.String("json", "", "Write results and summary to this JSON file")
+	flag.Parse()
+
+	cfg := core.TournamentConfig{
+		Tracks:     trackNames(*tracksFlag),
+		TrackWidth: 0.20,
+		Lineups:    lineups(*lineupsFlag),
+		Repeats:    *nFlag,
+		BaseSeed:   *seedFlag,
+		Parallel:   *parallelFlag,
+		MaxSimTime: phys.SimTime(*maxSimFlag * float64(phys.SimSecond)),
+		LightSpec:  light.Gen2Spec,
+		NewPhase:   newPhase,
+	}
+	if *paramsFlag != "" {
+		var err error
+		if cfg.ParamSets, err = loadParamSets(*paramsFlag); err != nil {
+			exitOnError(err)
+		}
+	}
+
+	results := core.RunTournament(cfg)
+	fmt.Print(core.Summarize(results).String())
+
+	if *csvFlag != "" {
+		exitOnError(writeFile(*csvFlag, func(w io.Writer) error { return core.WriteResultsCSV(w, results) }))
+	}
+	if *jsonFlag != "" {
+		exitOnError(writeFile(*jsonFlag, func(w io.Writer) error { return core.WriteResultsJSON(w, results) }))
+	}
+}
+
+// newPhase creates an AI race for a match, with the match's parameters on top
+// of the defaults.
+func newPhase(m core.MatchSpec) core.GamePhase {
+	params := DefaultRaceParams()
+	if len(m.ParamSet.Params) > 0 {
+		if err := json.Unmarshal(m.ParamSet.Params, &params); err != nil {
+			panic(fmt.Sprintf("Parameter set %q could not be parsed: %v", m.ParamSet.Name, err))
+		}
+	}
+	return NewRaceGamePhase(params, m.Seed)
+}
+
+func trackNames(s string) []string {
+	if s != "all" {
+		return strings.Fields(s)
+	}
+	names := strings.Fields(track.StarterKitTrackNames(" "))
+	sort.Strings(names)
+	return names
+}
+
+func lineups(s string) [][]robo.VehType {
+	lineups := make([][]robo.VehType, 0)
+	for _, ls := range strings.Split(s, ",") {
+		lineup := make([]robo.VehType, 0)
+		for _, vs := range strings.Fields(ls) {
+			lineup = append(lineup, robo.VehType(vs))
+		}
+		lineups = append(lineups, lineup)
+	}
+	return lineups
+}
+
+func loadParamSets(filename string) ([]core.ParamSet, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var paramSets []core.ParamSet
+	if err := json.Unmarshal(data, &paramSets); err != nil {
+		return nil, fmt.Errorf("Parameter sets file %s could not be parsed: %v", filename, err)
+	}
+	return paramSets, nil
+}
+
+func writeFile(filename string, write func(w io.Writer) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
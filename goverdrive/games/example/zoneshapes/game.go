@@ -7,14 +7,12 @@ import (
 	"fmt"
 	"golang.org/x/image/colornames"
 
-	"github.com/faiface/pixel/pixelgl"
-
-	"github.com/anki/goverdrive/engine"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/robo/track"
-	"github.com/anki/goverdrive/viz"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 var (
@@ -29,11 +27,12 @@ var (
 //  - TrackRegion
 //  - GameShape
 type ZoneShapesGamePhase struct {
-	trShoulder1 *viz.TrackRegion
-	trShoulder2 *viz.TrackRegion
-	trGreen     *viz.TrackRegion
-	trRed       *viz.TrackRegion
-	trPurple    *viz.TrackRegion
+	trShoulder1 *shapes.TrackRegion
+	trShoulder2 *shapes.TrackRegion
+	trGreen     *shapes.TrackRegion
+	trRed       *shapes.TrackRegion
+	trPurple    *shapes.TrackRegion
+	vehId       int // the game's only vehicle
 }
 
 func (gp *ZoneShapesGamePhase) InstructionText(rys *robo.System) string {
@@ -49,11 +48,11 @@ func (gp *ZoneShapesGamePhase) Start(rsys *robo.System) {
 	// The "shoulders" are narrow, full-track-length regions at the sides of the
 	// track, much like the shoulder of an actual road.
 	shoulderWidth := phys.Meters(0.02)
-	gp.trShoulder1 = &viz.TrackRegion{
+	gp.trShoulder1 = &shapes.TrackRegion{
 		Region: *track.NewRegion(&rsys.Track, track.Point{Dofs: 0, Cofs: -rsys.Track.Width() / 2}, rsys.Track.CenLen(), shoulderWidth),
 		Color:  shoulderColor,
 	}
-	gp.trShoulder2 = &viz.TrackRegion{
+	gp.trShoulder2 = &shapes.TrackRegion{
 		Region: *track.NewRegion(&rsys.Track, track.Point{Dofs: 0, Cofs: +rsys.Track.Width()/2 - shoulderWidth}, rsys.Track.CenLen(), shoulderWidth),
 		Color:  shoulderColor,
 	}
@@ -61,16 +60,16 @@ func (gp *ZoneShapesGamePhase) Start(rsys *robo.System) {
 	// The colored regions are placed at a few random places, including some
 	// overlap. Their start point and size should be fine for any normal modular
 	// track, but could fail hard for unusually small tracks.
-	gp.trGreen = &viz.TrackRegion{
+	gp.trGreen = &shapes.TrackRegion{
 		Region: *track.NewRegion(&rsys.Track, track.Point{Dofs: 0.3, Cofs: -rsys.Track.Width() / 2}, 1.0, rsys.Track.Width()/2),
 		Color:  greenColor,
 	}
-	gp.trRed = &viz.TrackRegion{
+	gp.trRed = &shapes.TrackRegion{
 		Region: *track.NewRegion(&rsys.Track, track.Point{Dofs: 0.4, Cofs: -rsys.Track.Width() / 2}, 0.5, rsys.Track.Width()),
 		Color:  redColor,
 	}
 	dofs := rsys.Track.NormalizeDofs(-1.1) // regions starts from "behind" the finish line
-	gp.trPurple = &viz.TrackRegion{
+	gp.trPurple = &shapes.TrackRegion{
 		Region: *track.NewRegion(&rsys.Track, track.Point{Dofs: dofs, Cofs: 0.01}, 1.0, rsys.Track.Width()/4),
 		Color:  purpleColor,
 	}
@@ -80,6 +79,7 @@ func (gp *ZoneShapesGamePhase) Start(rsys *robo.System) {
 	if numVeh != 1 {
 		panic(fmt.Sprintf("ZoneShapesGamePhase is a one-vehicle game; actual numVeh=%d", numVeh))
 	}
+	gp.vehId = rsys.Vehicles[0].Id()
 	rsys.Vehicles[0].SetCmdDriveDspd(0.4, 0.4)
 	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0, Cofs: 0}, DAngle: 0})
 }
@@ -88,22 +88,22 @@ func (gp *ZoneShapesGamePhase) Stop(rsys *robo.System) {
 	// no-op
 }
 
-func (gp *ZoneShapesGamePhase) VehRankings() []engine.VehRanking {
+func (gp *ZoneShapesGamePhase) VehRankings() []core.VehRanking {
 	// This example game has no meaningful ranking concept.
 	// there should only be one vehicle; see Start()
-	rankings := []engine.VehRanking{
-		engine.VehRanking{VehId: 0, Rank: 1, ScoreString: "0"},
+	rankings := []core.VehRanking{
+		core.VehRanking{VehId: gp.vehId, Rank: 1, ScoreString: "0"},
 	}
 	return rankings
 }
 
-func (gp *ZoneShapesGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool, engine.GamePhaseVizObjects) {
-	vizObj := engine.EmptyGamePhaseVizObjects()
+func (gp *ZoneShapesGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
 	veh := &rsys.Vehicles[0] // more concise handle to the game's only vehicle
 
 	// Adjust driving speed arrow Up/Down arrow keys are pressed
 	dspd := veh.CmdDriveDspd()
-	if win.JustPressed(pixelgl.KeyUp) {
+	if in.JustPressed(core.ActionSpeedUp) {
 		frames := []light.Frame{light.Frame{Color: colornames.Lime, Tms: 200}}
 		veh.Lights().SetAnimation(rsys.Now(), "guns", frames, 1)
 		dspd += 0.1
@@ -112,7 +112,7 @@ func (gp *ZoneShapesGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 		}
 		veh.SetCmdDriveDspd(dspd, 0.4)
 	}
-	if win.JustPressed(pixelgl.KeyDown) {
+	if in.JustPressed(core.ActionSlowDown) {
 		frames := []light.Frame{light.Frame{Color: colornames.Red, Tms: 200}}
 		veh.Lights().SetAnimation(rsys.Now(), "tail", frames, 1)
 		dspd -= 0.1
@@ -121,17 +121,17 @@ func (gp *ZoneShapesGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 		}
 		veh.SetCmdDriveDspd(dspd, 0.4)
 	}
-	if win.JustPressed(pixelgl.KeyRightShift) {
+	if in.JustPressed(core.ActionUturn) {
 		veh.CmdUturn(robo.DefUturnRadius)
 	}
 
 	// Adjust center offset when Left/Right arrow keys are pressed
 	cofs := veh.CmdDriveCofs()
 	dCofs := phys.Meters(0)
-	if win.JustPressed(pixelgl.KeyLeft) {
+	if in.JustPressed(core.ActionCofsLeft) {
 		dCofs = +0.02
 	}
-	if win.JustPressed(pixelgl.KeyRight) {
+	if in.JustPressed(core.ActionCofsRight) {
 		dCofs = -0.02
 	}
 	veh.SetCmdDriveCofs(cofs+dCofs, 0.1)
@@ -146,19 +146,19 @@ func (gp *ZoneShapesGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 	// Track regions trigger game shapes that are anchored to the vehicle
 	// Reminder: all lengths are in units of phys.Meters
 	if gp.trShoulder1.ContainsPoint(veh.CurTrackPose().Point) {
-		*vizObj.Shapes = append(*vizObj.Shapes, viz.NewTrackGameLine(0, track.Point{Dofs: -0.05, Cofs: -0.05}, track.Point{Dofs: 0.05, Cofs: -0.05}, shoulderColor, 0.005))
+		*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewTrackGameLine(veh.Id(), track.Point{Dofs: -0.05, Cofs: -0.05}, track.Point{Dofs: 0.05, Cofs: -0.05}, shoulderColor, 0.005))
 	}
 	if gp.trShoulder2.ContainsPoint(veh.CurTrackPose().Point) {
-		*vizObj.Shapes = append(*vizObj.Shapes, viz.NewTrackGameLine(0, track.Point{Dofs: -0.05, Cofs: +0.05}, track.Point{Dofs: 0.05, Cofs: +0.05}, shoulderColor, 0.005))
+		*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewTrackGameLine(veh.Id(), track.Point{Dofs: -0.05, Cofs: +0.05}, track.Point{Dofs: 0.05, Cofs: +0.05}, shoulderColor, 0.005))
 	}
 	if gp.trGreen.ContainsPoint(veh.CurTrackPose().Point) {
-		*vizObj.Shapes = append(*vizObj.Shapes, viz.NewCartesGameLine(0, phys.Point{X: 0.05, Y: 0}, phys.Point{X: 0.10, Y: 0}, greenColor, 0.01))
+		*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewCartesGameLine(veh.Id(), phys.Point{X: 0.05, Y: 0}, phys.Point{X: 0.10, Y: 0}, greenColor, 0.01))
 	}
 	if gp.trRed.ContainsPoint(veh.CurTrackPose().Point) {
-		*vizObj.Shapes = append(*vizObj.Shapes, viz.NewCartesGameCirc(0, phys.Point{X: -0.1, Y: 0}, 0.03, redColor, 0))
+		*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewCartesGameCirc(veh.Id(), phys.Point{X: -0.1, Y: 0}, 0.03, redColor, 0))
 	}
 	if gp.trPurple.ContainsPoint(veh.CurTrackPose().Point) {
-		*vizObj.Shapes = append(*vizObj.Shapes, viz.NewTrackGameCirc(0, track.Point{Dofs: +0.1, Cofs: 0}, 0.03, purpleColor, 0))
+		*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewTrackGameCirc(veh.Id(), track.Point{Dofs: +0.1, Cofs: 0}, 0.03, purpleColor, 0))
 	}
 
 	// Message board text
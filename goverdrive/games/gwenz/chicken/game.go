@@ -8,16 +8,14 @@ import (
 	"golang.org/x/image/colornames"
 	"math"
 
-	"github.com/faiface/pixel/pixelgl"
-
-	"github.com/anki/goverdrive/engine"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/gameutil/shapes/persist"
 	"github.com/anki/goverdrive/gameutil/vehlights"
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/robo/track"
-	"github.com/anki/goverdrive/viz"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 //////////////////////////////////////////////////////////////////////
@@ -37,8 +35,7 @@ func (s fsmState) String() string {
 //////////////////////////////////////////////////////////////////////
 
 const (
-	kTie         = -1
-	winningScore = 5
+	kTie = -1
 
 	// FSM state names
 	stRecover      fsmState = iota
@@ -64,8 +61,34 @@ const (
 	kDaclCharge  = 0.15
 )
 
+// actSwerve is the game-specific input action for a player to swerve. Use
+// core.PlayerAction() to get each player's swerve action. See buttonMap()
+// for the keyboard mapping.
+const actSwerve core.Action = "swerve"
+
+// ChickenParams are the game parameters that can be set in the "Game" section
+// of a config file.
+type ChickenParams struct {
+	WinningScore int
+}
+
+// DefaultChickenParams returns the parameters used when there is no config file.
+func DefaultChickenParams() ChickenParams {
+	return ChickenParams{WinningScore: 5}
+}
+
+// Check satisfies engine.GameParamsChecker.
+func (p *ChickenParams) Check() error {
+	if p.WinningScore < 1 {
+		return fmt.Errorf("WinningScore=%d must be at least 1", p.WinningScore)
+	}
+	return nil
+}
+
 type ChickenGamePhase struct {
+	params     ChickenParams
 	numVeh     int
+	vehIds     [2]int
 	state      fsmState
 	tStateBeg  phys.SimTime
 	score      [2]int
@@ -84,7 +107,7 @@ SCORING
      Collision => Player who swerved FIRST gets a point
   No Collision => Player who swerved LAST  gets a point
 `
-	return s + fmt.Sprintf("  Winner is first to %d points\n", winningScore)
+	return s + fmt.Sprintf("  Winner is first to %d points\n", gp.params.WinningScore)
 }
 
 func (gp *ChickenGamePhase) Start(rsys *robo.System) {
@@ -92,6 +115,9 @@ func (gp *ChickenGamePhase) Start(rsys *robo.System) {
 	if gp.numVeh != 2 {
 		panic("Chicken requires exactly two vehicles")
 	}
+	for v := range rsys.Vehicles {
+		gp.vehIds[v] = rsys.Vehicles[v].Id()
+	}
 
 	// Vehicle "lineup"
 	dofs0 := rsys.Track.NormalizeDofs(+0.1)
@@ -108,15 +134,15 @@ func (gp *ChickenGamePhase) Stop(rsys *robo.System) {
 	// no-op
 }
 
-func (gp *ChickenGamePhase) VehRankings() []engine.VehRanking {
-	rankings := make([]engine.VehRanking, gp.numVeh)
+func (gp *ChickenGamePhase) VehRankings() []core.VehRanking {
+	rankings := make([]core.VehRanking, gp.numVeh)
 	for v := 0; v < gp.numVeh; v++ {
 		rank := 1
 		if gp.score[v] < gp.score[(v+1)%2] {
 			rank = 2
 		}
-		rankings[v] = engine.VehRanking{
-			VehId:       v,
+		rankings[v] = core.VehRanking{
+			VehId:       gp.vehIds[v],
 			Rank:        rank,
 			ScoreString: fmt.Sprintf("%v", gp.score[v]),
 		}
@@ -124,8 +150,8 @@ func (gp *ChickenGamePhase) VehRankings() []engine.VehRanking {
 	return rankings
 }
 
-func (gp *ChickenGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool, engine.GamePhaseVizObjects) {
-	vizObj := engine.EmptyGamePhaseVizObjects()
+func (gp *ChickenGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
 	done := false
 
 	// Display the score and status
@@ -180,12 +206,12 @@ func (gp *ChickenGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 		}
 
 		// Swerve when button is pressed, and remember who swerved first
-		if (gp.tSwerve[0] == 0) && win.JustPressed(pixelgl.KeyLeftShift) {
+		if (gp.tSwerve[0] == 0) && in.JustPressed(core.PlayerAction(0, actSwerve)) {
 			gp.tSwerve[0] = now
 			rsys.Vehicles[0].SetCmdDriveCofs(kCofsMiss, kCspd)
 			rsys.Vehicles[0].Lights().Set("top", colornames.Black)
 		}
-		if (gp.tSwerve[1] == 0) && win.JustPressed(pixelgl.KeyRightShift) {
+		if (gp.tSwerve[1] == 0) && in.JustPressed(core.PlayerAction(1, actSwerve)) {
 			gp.tSwerve[1] = now
 			rsys.Vehicles[1].SetCmdDriveCofs(kCofsMiss, kCspd)
 			rsys.Vehicles[1].Lights().Set("top", colornames.Black)
@@ -196,7 +222,7 @@ func (gp *ChickenGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 			gp.didCollide = true
 			// display impact points of current collisions, using red dot on the vehicle
 			for i := 0; i < 2; i++ {
-				gp.persister.Add(rsys.Now(), 1000, viz.NewCartesGameCirc(ce.VehInfo[i].Id, ce.VehInfo[i].POI, 0.01, colornames.Red, 0))
+				gp.persister.Add(rsys.Now(), 1000, shapes.NewCartesGameCirc(ce.VehInfo[i].Id, ce.VehInfo[i].POI, 0.01, colornames.Red, 0))
 			}
 		}
 
@@ -238,7 +264,7 @@ func (gp *ChickenGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 				if winner == v {
 					clr = colornames.Limegreen
 					gp.score[v]++
-					if gp.score[v] >= winningScore {
+					if gp.score[v] >= gp.params.WinningScore {
 						done = true
 					}
 				} else if winner == kTie {
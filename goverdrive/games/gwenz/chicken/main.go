@@ -4,10 +4,13 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/faiface/pixel/pixelgl"
 
 	"github.com/anki/goverdrive/engine"
-	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/viz"
 )
@@ -19,9 +22,7 @@ func run() {
 	// Create the remaining game components
 	primViz := viz.NewPixelViz()
 	worldViz := viz.NewPixelWorldViz(primViz, gameConfig.Track())
-	rsim := robo.NewIdealSimulator()
-	rcollide := robo.NewCollisionDetector(gameConfig.Track(), gameConfig.Vehicles())
-	roboSys := robo.NewSystem(gameConfig.Track(), gameConfig.Vehicles(), rsim, rcollide)
+	roboSys := gameConfig.NewSystem()
 
 	// Run the game
 	vizCfg := engine.GamePhaseVizConfig{
@@ -29,8 +30,25 @@ func run() {
 		MsgBoardPixHeight: gameConfig.MsgBoardPixHeight(),
 		WorldViz:          worldViz,
 		Window:            gameConfig.Window(),
+		API:               gameConfig.APIServer(),
+		Emulator:          gameConfig.Emulator(),
+		Input:             engine.NewKeyboardInput(gameConfig.Window(), buttonMap()),
+	}
+	params := DefaultChickenParams()
+	if err := gameConfig.GameParams(&params); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	engine.RunGameLoop(vizCfg, roboSys, &ChickenGamePhase{})
+	engine.RunGameLoop(vizCfg, roboSys, &ChickenGamePhase{params: params})
+}
+
+// buttonMap adds keys for the game-specific actions to the default keyboard
+// layout.
+func buttonMap() engine.ButtonMap {
+	bm := engine.DefaultButtonMap()
+	bm.Set(core.PlayerAction(0, actSwerve), pixelgl.KeyLeftShift)
+	bm.Set(core.PlayerAction(1, actSwerve), pixelgl.KeyRightShift)
+	return bm
 }
 
 func main() {
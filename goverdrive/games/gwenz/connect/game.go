@@ -7,14 +7,12 @@ import (
 	"fmt"
 	cn "golang.org/x/image/colornames"
 
-	"github.com/faiface/pixel/pixelgl"
-
-	"github.com/anki/goverdrive/engine"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/gameutil/follow"
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/track"
-	"github.com/anki/goverdrive/viz"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 const (
@@ -41,6 +39,14 @@ const (
 	goalRadius     = 0.04
 )
 
+// Game-specific input actions. See buttonMap() for the keyboard mapping.
+const (
+	actLeaderCofsLeft  core.Action = "leadercofsleft"
+	actLeaderCofsRight core.Action = "leadercofsright"
+	actFollowAhead     core.Action = "followahead"
+	actFollowBehind    core.Action = "followbehind"
+)
+
 type fsmState int
 
 const (
@@ -52,7 +58,7 @@ const (
 
 // ConnectGamePhase does simple driving for a set of vehicles.
 type ConnectGamePhase struct {
-	numVeh        int
+	vehIds        []int // by index into rsys.Vehicles, eg vPlayer
 	score         int
 	playerDesDspd phys.MetersPerSec
 	playerDesCofs phys.Meters
@@ -68,10 +74,13 @@ PLAYER CAR:    Arrow keys, Right Shift Key
 }
 
 func (gp *ConnectGamePhase) Start(rsys *robo.System) {
-	gp.numVeh = len(rsys.Vehicles)
-	if gp.numVeh != 3 {
+	if len(rsys.Vehicles) != 3 {
 		panic("Game requires exactly 3 vehicles!")
 	}
+	gp.vehIds = make([]int, len(rsys.Vehicles))
+	for v := range rsys.Vehicles {
+		gp.vehIds[v] = rsys.Vehicles[v].Id()
+	}
 
 	// initial formation
 	rsys.Vehicles[vLeader].Reposition(track.Pose{Point: track.Point{Dofs: 0.1, Cofs: 0}, DAngle: 0})
@@ -86,23 +95,23 @@ func (gp *ConnectGamePhase) Start(rsys *robo.System) {
 
 	gp.score = 0
 	gp.state = stAttempt
-	gp.follower = follow.New(vLeader, vFollow, -0.4, 0.0, formDacl, formCspd, rsys.Track.CenLen(), rsys.Now(), 0)
+	gp.follower = follow.New(rsys.Vehicles[vLeader].Id(), rsys.Vehicles[vFollow].Id(), -0.4, 0.0, formDacl, formCspd, rsys.Track.CenLen(), rsys.Now(), 0)
 }
 
 func (gp *ConnectGamePhase) Stop(rsys *robo.System) {
 	// no-op
 }
 
-func (gp *ConnectGamePhase) VehRankings() []engine.VehRanking {
-	rankings := make([]engine.VehRanking, gp.numVeh)
-	for v := 0; v < gp.numVeh; v++ {
-		rankings = append(rankings, engine.VehRanking{VehId: v, Rank: v, ScoreString: "0"})
+func (gp *ConnectGamePhase) VehRankings() []core.VehRanking {
+	rankings := make([]core.VehRanking, 0, len(gp.vehIds))
+	for v, id := range gp.vehIds {
+		rankings = append(rankings, core.VehRanking{VehId: id, Rank: v, ScoreString: "0"})
 	}
 	return rankings
 }
 
-func (gp *ConnectGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool, engine.GamePhaseVizObjects) {
-	vizObj := engine.EmptyGamePhaseVizObjects()
+func (gp *ConnectGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
 	// concise pointers to (not copies of!!) game vehicles
 	lVeh := &rsys.Vehicles[vLeader]
 	fVeh := &rsys.Vehicles[vFollow]
@@ -115,20 +124,20 @@ func (gp *ConnectGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 	// Adjust position of the leader car
 	cofs := lVeh.CmdDriveCofs()
 	dCofs := phys.Meters(0)
-	if win.JustPressed(pixelgl.KeyQ) {
+	if in.JustPressed(actLeaderCofsLeft) {
 		dCofs = +0.025
 	}
-	if win.JustPressed(pixelgl.KeyE) {
+	if in.JustPressed(actLeaderCofsRight) {
 		dCofs = -0.025
 	}
 	lVeh.SetCmdDriveCofs(cofs+dCofs, 0.1)
 
 	// Adjust desired position of the Follow car
 	followDofs := gp.follower.TargetDeltaDofs()
-	if win.JustPressed(pixelgl.KeyW) {
+	if in.JustPressed(actFollowAhead) {
 		followDofs += formDofsDelta
 	}
-	if win.JustPressed(pixelgl.KeyS) {
+	if in.JustPressed(actFollowBehind) {
 		followDofs -= formDofsDelta
 	}
 	if followDofs <= (-rsys.Track.CenLen() / 2) {
@@ -147,24 +156,24 @@ func (gp *ConnectGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 	if phys.MetersPerSecAreNear(pVeh.CurDriveDspd(), gp.playerDesDspd, 0.02) &&
 		phys.MetersAreNear(pVeh.CurDriveCofs(), gp.playerDesCofs, 0.002) {
 		// new player command ok
-		if win.JustPressed(pixelgl.KeyRightShift) {
+		if in.JustPressed(core.ActionUturn) {
 			pVeh.CmdUturn(robo.DefUturnRadius)
 		}
 
 		// speed
-		if win.JustPressed(pixelgl.KeyUp) {
+		if in.JustPressed(core.ActionSpeedUp) {
 			gp.playerDesDspd = playerFastDspd
 		}
-		if win.JustPressed(pixelgl.KeyDown) {
+		if in.JustPressed(core.ActionSlowDown) {
 			gp.playerDesDspd = playerSlowDspd
 		}
 		pVeh.SetCmdDriveDspd(gp.playerDesDspd, playerDacl)
 
 		// center offset
-		if win.JustPressed(pixelgl.KeyLeft) {
+		if in.JustPressed(core.ActionCofsLeft) {
 			gp.playerDesCofs = rsys.Track.Width() / 2
 		}
-		if win.JustPressed(pixelgl.KeyRight) {
+		if in.JustPressed(core.ActionCofsRight) {
 			gp.playerDesCofs = -(rsys.Track.Width() / 2)
 		}
 		pVeh.SetCmdDriveCofs(gp.playerDesCofs, playerCspd)
@@ -176,7 +185,7 @@ func (gp *ConnectGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 	isFar := (rsys.Track.DofsDist(ltpose.Dofs, ptpose.Dofs) > newAttemptDist) && (rsys.Track.DofsDist(ftpose.Dofs, ptpose.Dofs) > newAttemptDist)
 	didCollide := false
 	for _, ce := range rsys.Collider.NewCollisions() {
-		if (ce.VehInfo[0].Id == vPlayer) || (ce.VehInfo[1].Id == vPlayer) {
+		if (ce.VehInfo[0].Id == pVeh.Id()) || (ce.VehInfo[1].Id == pVeh.Id()) {
 			didCollide = true
 		}
 	}
@@ -191,7 +200,7 @@ func (gp *ConnectGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 			DAngle: 0,
 		}
 		pGoal := rsys.Track.ToPose(tposeGoal).Point
-		*vizObj.Shapes = append(*vizObj.Shapes, viz.NewCartesGameCirc(-1, pGoal, goalRadius, cn.White, 0.004))
+		*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewCartesGameCirc(-1, pGoal, goalRadius, cn.White, 0.004))
 
 		pPlayer := rsys.Track.ToPose(pVeh.CurTrackPose()).Point
 		if phys.Dist(pGoal, pPlayer) < goalRadius {
@@ -229,7 +238,7 @@ func (gp *ConnectGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool
 	for _, ce := range rsys.Collider.CurCollisions() {
 		// impact points of current collisions, using red dot on the vehicle
 		for i := 0; i < 2; i++ {
-			*vizObj.Shapes = append(*vizObj.Shapes, viz.NewCartesGameCirc(ce.VehInfo[i].Id, ce.VehInfo[i].POI, 0.01, cn.Red, 0))
+			*vizObj.Shapes = append(*vizObj.Shapes, shapes.NewCartesGameCirc(ce.VehInfo[i].Id, ce.VehInfo[i].POI, 0.01, cn.Red, 0))
 		}
 	}
 	pVeh.Lights().Set("top", lcolor)
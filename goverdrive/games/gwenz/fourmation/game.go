@@ -7,9 +7,7 @@ import (
 	"fmt"
 	"golang.org/x/image/colornames"
 
-	"github.com/faiface/pixel/pixelgl"
-
-	"github.com/anki/goverdrive/engine"
+	"github.com/anki/goverdrive/engine/core"
 	"github.com/anki/goverdrive/gameutil/follow"
 	"github.com/anki/goverdrive/gameutil/vehlights"
 	"github.com/anki/goverdrive/phys"
@@ -30,6 +28,7 @@ const (
 
 // FourmationGamePhase drives a set of four vehicles in a formation.
 type FourmationGamePhase struct {
+	vehIds       []int
 	followers    []*follow.Follower
 	curFormation int
 }
@@ -88,12 +87,16 @@ func (gp *FourmationGamePhase) Start(rsys *robo.System) {
 		rsys.Vehicles[i].SetCmdDriveDspd(0.4, 1.0)
 	}
 
+	gp.vehIds = make([]int, numVeh)
+	for v := range rsys.Vehicles {
+		gp.vehIds[v] = rsys.Vehicles[v].Id()
+	}
 	gp.followers = make([]*follow.Follower, numVeh-1)
 	for v := 0; v < (numVeh - 1); v++ {
 		vFollow := v + 1
 		deltaDofs := phys.Meters(-0.2 - (float32(v) * 0.2))
 		deltaCofs := phys.Meters(0)
-		gp.followers[v] = follow.New(0, vFollow, deltaDofs, deltaCofs, followDacl, followCspd, rsys.Track.CenLen(), rsys.Now(), 0)
+		gp.followers[v] = follow.New(rsys.Vehicles[0].Id(), rsys.Vehicles[vFollow].Id(), deltaDofs, deltaCofs, followDacl, followCspd, rsys.Track.CenLen(), rsys.Now(), 0)
 	}
 	gp.curFormation = 0
 	gp.changeFormation(gp.curFormation)
@@ -103,25 +106,25 @@ func (gp *FourmationGamePhase) Stop(rsys *robo.System) {
 	// no-op
 }
 
-func (gp *FourmationGamePhase) VehRankings() []engine.VehRanking {
-	rankings := make([]engine.VehRanking, numVeh)
+func (gp *FourmationGamePhase) VehRankings() []core.VehRanking {
+	rankings := make([]core.VehRanking, numVeh)
 	for v := 0; v < numVeh; v++ {
-		rankings[v] = engine.VehRanking{VehId: v, Rank: v, ScoreString: "0"}
+		rankings[v] = core.VehRanking{VehId: gp.vehIds[v], Rank: v, ScoreString: "0"}
 	}
 	return rankings
 }
 
-func (gp *FourmationGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (bool, engine.GamePhaseVizObjects) {
-	vizObj := engine.EmptyGamePhaseVizObjects()
+func (gp *FourmationGamePhase) Update(rsys *robo.System, in core.Input) (bool, core.GamePhaseVizObjects) {
+	vizObj := core.EmptyGamePhaseVizObjects()
 	veh := &rsys.Vehicles[0]
 
-	if win.JustPressed(pixelgl.KeySpace) {
+	if in.JustPressed(core.ActionSelect) {
 		gp.curFormation = (gp.curFormation + 1) % numFormations
 		gp.changeFormation(gp.curFormation)
 	}
 
 	dspd := veh.CmdDriveDspd()
-	if win.JustPressed(pixelgl.KeyUp) {
+	if in.JustPressed(core.ActionSpeedUp) {
 		frames := []light.Frame{light.Frame{Color: colornames.Lime, Tms: 200}}
 		veh.Lights().SetAnimation(rsys.Now(), "guns", frames, 1)
 		dspd += 0.1
@@ -130,7 +133,7 @@ func (gp *FourmationGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 		}
 		veh.SetCmdDriveDspd(dspd, 0.4)
 	}
-	if win.JustPressed(pixelgl.KeyDown) {
+	if in.JustPressed(core.ActionSlowDown) {
 		frames := []light.Frame{light.Frame{Color: colornames.Red, Tms: 200}}
 		veh.Lights().SetAnimation(rsys.Now(), "tail", frames, 1)
 		dspd -= 0.1
@@ -139,16 +142,16 @@ func (gp *FourmationGamePhase) Update(rsys *robo.System, win *pixelgl.Window) (b
 		}
 		veh.SetCmdDriveDspd(dspd, 0.4)
 	}
-	if win.JustPressed(pixelgl.KeyRightShift) {
+	if in.JustPressed(core.ActionUturn) {
 		veh.CmdUturn(robo.DefUturnRadius)
 	}
 
 	cofs := veh.CmdDriveCofs()
 	dCofs := phys.Meters(0)
-	if win.JustPressed(pixelgl.KeyLeft) {
+	if in.JustPressed(core.ActionCofsLeft) {
 		dCofs = +0.025
 	}
-	if win.JustPressed(pixelgl.KeyRight) {
+	if in.JustPressed(core.ActionCofsRight) {
 		dCofs = -0.025
 	}
 	veh.SetCmdDriveCofs(cofs+dCofs, 0.1)
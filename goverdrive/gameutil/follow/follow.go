@@ -15,8 +15,8 @@ import (
 // relationship relative to a "leader" vehicle. Two or more Followers can be
 // used to create a multi-vehicle formation.
 type Follower struct {
-	vLeader         int
-	vFollow         int
+	vLeader         int // vehicle Id
+	vFollow         int // vehicle Id
 	targetDeltaDofs phys.Meters
 	targetDeltaCofs phys.Meters
 	dacl            phys.MetersPerSec2
@@ -35,7 +35,7 @@ const (
 	minorFallbackFactor = 0.95
 )
 
-// New returns a pointer to a new Follow object.
+// New returns a pointer to a new Follow object. The vehicles are given by Id.
 func New(vLeader, vFollow int,
 	targetDeltaDofs, targetDeltaCofs phys.Meters,
 	dacl phys.MetersPerSec2,
@@ -82,11 +82,15 @@ func (c *Follower) SetTargetDeltaCofs(target phys.Meters) {
 
 // Update issues new vehicle commands, if needed, to maintain the desired
 // leader-follower positional relationship. true is returned if the follower is
-// sufficiently near its relative target position.
+// sufficiently near its relative target position. false is returned if either
+// vehicle is no longer in the system.
 func (c *Follower) Update(rsys *robo.System) bool {
 	// l=leader, f=follower (for brevity)
-	lVeh := &rsys.Vehicles[c.vLeader]
-	fVeh := &rsys.Vehicles[c.vFollow]
+	lVeh := rsys.Vehicle(c.vLeader)
+	fVeh := rsys.Vehicle(c.vFollow)
+	if (lVeh == nil) || (fVeh == nil) {
+		return false
+	}
 
 	deltaDist := rsys.Track.DriveDeltaDist(lVeh.CurTrackPose(), fVeh.CurTrackPose().Dofs)
 	deltaDofsErrAmt := deltaDist - c.targetDeltaDofs
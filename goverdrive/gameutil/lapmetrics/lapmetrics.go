@@ -41,68 +41,102 @@ func (cli *CompletedLapInfo) String() string {
 
 //////////////////////////////////////////////////////////////////////
 
-// LapMetrics stores track VehLapInfo for all vehicles
+// LapMetrics stores track VehLapInfo for all vehicles, by vehicle Id. The info
+// of a vehicle that is removed from the system is kept.
 type LapMetrics struct {
 	recordTrackwiseLaps        bool
 	recordCounterTrackwiseLaps bool
-	info                       []VehLapInfo
+	info                       map[int]*VehLapInfo // by vehicle Id
+	events                     *robo.EventBus      // nil => don't publish
 }
 
 // New returns a fresh LapMetrics object, which starts measuring from the
-// current speed, odom, etc of the vehicles.
+// current speed, odom, etc of the vehicles. Vehicles added to the system later
+// are measured from the first Update that sees them.
 func New(now phys.SimTime, vehs *[]robo.Vehicle, recordTrackwiseLaps, recordCounterTrackwiseLaps bool) *LapMetrics {
 	lm := LapMetrics{
 		recordTrackwiseLaps:        recordTrackwiseLaps,
 		recordCounterTrackwiseLaps: recordCounterTrackwiseLaps,
-		info: make([]VehLapInfo, len(*vehs)),
+		info:                       make(map[int]*VehLapInfo),
 	}
-	for v, veh := range *vehs {
-		lm.info[v] = VehLapInfo{
-			curLapStartOdom: veh.Odom(),
-			curLapStartTime: now,
-			curLapMinDspd:   veh.CurDriveDspd(),
-			curLapMaxDspd:   veh.CurDriveDspd(),
-			doneLaps:        make([]CompletedLapInfo, 0),
-		}
+	for v := range *vehs {
+		lm.startVeh(now, &(*vehs)[v])
 	}
 	return &lm
 }
 
-// NumLapsCompleted returns the number laps that a vehicle has completed.
+// startVeh starts measuring a vehicle.
+func (lm *LapMetrics) startVeh(now phys.SimTime, veh *robo.Vehicle) *VehLapInfo {
+	vli := &VehLapInfo{
+		curLapStartOdom: veh.Odom(),
+		curLapStartTime: now,
+		curLapMinDspd:   veh.CurDriveDspd(),
+		curLapMaxDspd:   veh.CurDriveDspd(),
+		doneLaps:        make([]CompletedLapInfo, 0),
+	}
+	lm.info[veh.Id()] = vli
+	return vli
+}
+
+// PublishTo publishes an EvLapCompleted event on the bus for every completed
+// lap. The event's Data is the CompletedLapInfo.
+func (lm *LapMetrics) PublishTo(bus *robo.EventBus) {
+	lm.events = bus
+}
+
+// NumLapsCompleted returns the number laps that a vehicle has completed, by
+// vehicle Id.
 func (lm *LapMetrics) NumLapsCompleted(v int) int {
-	return len(lm.info[v].doneLaps)
+	if vli, ok := lm.info[v]; ok {
+		return len(vli.doneLaps)
+	}
+	return 0
 }
 
-// AllCompletedLapInfo returns all completed lap info for a particular vehicle.
+// AllCompletedLapInfo returns all completed lap info for a particular vehicle,
+// by vehicle Id.
 func (lm *LapMetrics) AllCompletedLapInfo(v int) []CompletedLapInfo {
-	return lm.info[v].doneLaps
+	if vli, ok := lm.info[v]; ok {
+		return vli.doneLaps
+	}
+	return nil
 }
 
 // NewCompletedLapInfo returns info about all newly completed laps, ie since the
 // last call to NewCompletedLapInfo.
 func (lm *LapMetrics) NewCompletedLapInfo(v int) []CompletedLapInfo {
 	newLapInfo := make([]CompletedLapInfo, 0) // empty
-	numCompl := lm.NumLapsCompleted(v)
-	if lm.info[v].numNewReportedLaps < numCompl {
-		newLapInfo = lm.info[v].doneLaps[lm.info[v].numNewReportedLaps:numCompl]
-		lm.info[v].numNewReportedLaps = numCompl
+	vli, ok := lm.info[v]
+	if !ok {
+		return newLapInfo
+	}
+	numCompl := len(vli.doneLaps)
+	if vli.numNewReportedLaps < numCompl {
+		newLapInfo = vli.doneLaps[vli.numNewReportedLaps:numCompl]
+		vli.numNewReportedLaps = numCompl
 	}
 	return newLapInfo
 }
 
 // Update is the "tick" that should be called from the game phase's Update().
 func (lm *LapMetrics) Update(now phys.SimTime, trk *track.Track, vehs *[]robo.Vehicle) {
-	for v, veh := range *vehs {
+	for v := range *vehs {
+		veh := &(*vehs)[v]
+		vli, ok := lm.info[veh.Id()]
+		if !ok {
+			vli = lm.startVeh(now, veh) // added to the system since the last update
+		}
+
 		// Update current lap's min/max values
 		curDspd := veh.CurDriveDspd()
-		if curDspd < lm.info[v].curLapMinDspd {
-			lm.info[v].curLapMinDspd = curDspd
+		if curDspd < vli.curLapMinDspd {
+			vli.curLapMinDspd = curDspd
 		}
-		if curDspd > lm.info[v].curLapMaxDspd {
-			lm.info[v].curLapMaxDspd = curDspd
+		if curDspd > vli.curLapMaxDspd {
+			vli.curLapMaxDspd = curDspd
 		}
 
-		lapDist := veh.Odom() - lm.info[v].curLapStartOdom
+		lapDist := veh.Odom() - vli.curLapStartOdom
 		// TODO(gwenz): Review and tune lap thresholds
 		if veh.CurDriveDofs() < 0.10 {
 			// restart lap tracking
@@ -113,20 +147,23 @@ func (lm *LapMetrics) Update(now phys.SimTime, trk *track.Track, vehs *[]robo.Ve
 				if (isTrackwise && lm.recordTrackwiseLaps) ||
 					(!isTrackwise && lm.recordCounterTrackwiseLaps) {
 					newLap := CompletedLapInfo{
-						LapNumber:   len(lm.info[v].doneLaps) + 1,
-						LapTime:     now - lm.info[v].curLapStartTime,
+						LapNumber:   len(vli.doneLaps) + 1,
+						LapTime:     now - vli.curLapStartTime,
 						IsTrackwise: isTrackwise,
 						PathLen:     lapDist,
-						MinDspd:     lm.info[v].curLapMinDspd,
-						MaxDspd:     lm.info[v].curLapMaxDspd,
+						MinDspd:     vli.curLapMinDspd,
+						MaxDspd:     vli.curLapMaxDspd,
+					}
+					vli.doneLaps = append(vli.doneLaps, newLap)
+					if lm.events != nil {
+						lm.events.Publish(robo.Event{Kind: robo.EvLapCompleted, VehId: veh.Id(), Lap: newLap.LapNumber, Data: newLap})
 					}
-					lm.info[v].doneLaps = append(lm.info[v].doneLaps, newLap)
 				}
 			}
-			lm.info[v].curLapStartOdom = veh.Odom() - veh.CurDriveDofs()
-			lm.info[v].curLapStartTime = now
-			lm.info[v].curLapMinDspd = curDspd
-			lm.info[v].curLapMaxDspd = curDspd
+			vli.curLapStartOdom = veh.Odom() - veh.CurDriveDofs()
+			vli.curLapStartTime = now
+			vli.curLapMinDspd = curDspd
+			vli.curLapMaxDspd = curDspd
 		}
 	}
 }
@@ -8,13 +8,13 @@ import (
 	_ "fmt"
 
 	"github.com/anki/goverdrive/phys"
-	"github.com/anki/goverdrive/viz"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 // shapeNode is a linked-list node for a persistent shape. A linked list is used
 // because it has O(1) add/remove time.
 type shapeNode struct {
-	shape   *viz.GameShape
+	shape   *shapes.GameShape
 	tExpire phys.SimTime
 	next    *shapeNode
 }
@@ -33,7 +33,7 @@ func New() *Manager {
 
 // Add adds a GameShape to the persistence manager. The duration to persist is
 // in milliseconds (for convenience).
-func (m *Manager) Add(now phys.SimTime, msDur uint, shape *viz.GameShape) {
+func (m *Manager) Add(now phys.SimTime, msDur uint, shape *shapes.GameShape) {
 	node := shapeNode{
 		shape:   shape,
 		tExpire: now + (phys.SimTime(msDur) * phys.SimMillisecond),
@@ -53,8 +53,8 @@ func (m *Manager) Add(now phys.SimTime, msDur uint, shape *viz.GameShape) {
 
 // Update removes all GameShape objects that have expired, and returns a list of
 // shapes that have not yet expired.
-func (m *Manager) Update(now phys.SimTime) *[]*viz.GameShape {
-	vizShapes := make([]*viz.GameShape, 0, m.numElem)
+func (m *Manager) Update(now phys.SimTime) *[]*shapes.GameShape {
+	vizShapes := make([]*shapes.GameShape, 0, m.numElem)
 	var prev *shapeNode = nil
 	for cur := m.head; cur != nil; {
 		if cur.tExpire > now {
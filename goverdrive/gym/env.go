@@ -0,0 +1,336 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+// Package gym is a reinforcement-learning style environment on top of
+// robo.System, with reset/step/observe/reward semantics. Each step applies one
+// action per vehicle, runs the simulation for a fixed number of ticks, and
+// returns per-vehicle observations and rewards. Episodes are deterministic for
+// a given seed, so external trainers can reproduce them; see server.go for the
+// socket protocol.
+package gym
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// RewardFunc computes the reward for one vehicle for the step that produced
+// obs. prev is the vehicle's observation from the previous step.
+type RewardFunc func(env *Env, prev, obs Observation) float64
+
+// Config describes the environment.
+type Config struct {
+	Track        string // track name or modular track string; see track.NewNamedTrack
+	TrackWidth   phys.Meters
+	Vehicles     []robo.VehType
+	MaxSteps     int         // episode length; 0 => no limit
+	TicksPerStep int         // robo.System ticks per step; 0 => 2, ie one game tick
+	NearbyDist   phys.Meters // vehicles within this Dofs distance are observed; 0 => 0.5
+	MaxNearby    int         // max number of nearby vehicles observed; 0 => all
+
+	// CollisionPenalty is subtracted from the default reward, once for each
+	// new collision.
+	CollisionPenalty float64
+
+	// Reward overrides the default reward, which is the distance driven during
+	// the step, in Meters, minus the collision penalty.
+	Reward RewardFunc
+}
+
+// DefaultConfig returns a two-vehicle environment on the Capsule track.
+func DefaultConfig() Config {
+	return Config{
+		Track:            "Capsule",
+		TrackWidth:       0.20,
+		Vehicles:         []robo.VehType{"gs", "sk"},
+		MaxSteps:         3000,
+		TicksPerStep:     2,
+		NearbyDist:       0.5,
+		CollisionPenalty: 1.0,
+	}
+}
+
+// Action is a command for one vehicle. Nil fields leave the corresponding
+// command unchanged, so the zero Action does nothing.
+type Action struct {
+	Dspd  *phys.MetersPerSec // see Vehicle.SetCmdDriveDspd
+	Dacl  phys.MetersPerSec2 // with Dspd; 0 => 1.0
+	Cofs  *phys.Meters       // see Vehicle.SetCmdDriveCofs
+	Cspd  phys.MetersPerSec  // with Cofs; 0 => 0.1
+	Uturn bool               // see Vehicle.CmdUturn; applied before Dspd and Cofs
+}
+
+// NearbyVehicle is another vehicle as seen from the observing vehicle, in the
+// observing vehicle's driving direction.
+type NearbyVehicle struct {
+	VehId   int
+	DDofs   phys.Meters       // >0 => ahead
+	DCofs   phys.Meters       // >0 => to the left
+	RelDspd phys.MetersPerSec // its track speed minus ours, in our driving direction
+}
+
+// Observation is what one vehicle observes after a step.
+type Observation struct {
+	VehId         int
+	Time          phys.SimTime
+	Pose          track.Pose
+	Vel           track.Vel
+	DriveDspd     phys.MetersPerSec
+	DriveCofs     phys.Meters
+	Odom          phys.Meters
+	Nearby        []NearbyVehicle // sorted by distance
+	NewCollisions []int           // ids of vehicles collided with during the step
+	Colliding     bool            // in an ongoing collision at the end of the step
+}
+
+// StepResult is the outcome of one step.
+type StepResult struct {
+	Obs     []Observation
+	Rewards []float64
+	Done    bool
+	Steps   int
+}
+
+// Env is one environment. It is not safe for concurrent use.
+type Env struct {
+	cfg        Config
+	trk        *track.Track
+	rsys       *robo.System
+	collisions *robo.EventQueue
+	obs        []Observation
+	steps      int
+}
+
+// NewEnv checks the config and creates an environment. Call Reset to start an
+// episode.
+func NewEnv(cfg Config) (*Env, error) {
+	if cfg.TicksPerStep <= 0 {
+		cfg.TicksPerStep = 2
+	}
+	if cfg.NearbyDist <= 0 {
+		cfg.NearbyDist = 0.5
+	}
+	if cfg.Reward == nil {
+		cfg.Reward = DefaultReward
+	}
+	if len(cfg.Vehicles) == 0 {
+		return nil, fmt.Errorf("At least one vehicle is required")
+	}
+	for v, vt := range cfg.Vehicles {
+		if !robo.IsValidVehType(vt) {
+			return nil, fmt.Errorf("Vehicle %d: VehType=%q is invalid. Valid vehicle types:\n%s", v, vt, robo.VehTypeHelp())
+		}
+	}
+	trk, err := track.NewNamedTrack(cfg.TrackWidth, 0, cfg.Track)
+	if err != nil {
+		return nil, err
+	}
+	return &Env{cfg: cfg, trk: trk}, nil
+}
+
+// Config returns the environment's config, with defaults filled in.
+func (env *Env) Config() Config {
+	return env.cfg
+}
+
+// System is the robotics system of the current episode, or nil before the
+// first Reset.
+func (env *Env) System() *robo.System {
+	return env.rsys
+}
+
+// Steps is the number of steps taken in the current episode.
+func (env *Env) Steps() int {
+	return env.steps
+}
+
+// Reset starts a new episode with a fresh robo.System. The seed determines the
+// vehicles' starting poses, so equal seeds and actions give equal episodes.
+func (env *Env) Reset(seed int64) []Observation {
+	if env.collisions != nil {
+		env.collisions.Close()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	trk := env.trk
+	vehs := make([]robo.Vehicle, len(env.cfg.Vehicles))
+	for v, vt := range env.cfg.Vehicles {
+		veh, err := robo.NewVehicle(vt, nil, trk.CenLen())
+		if err != nil {
+			panic(fmt.Sprintf("Vehicle %d: %v", v, err)) // checked by NewEnv
+		}
+		vehs[v] = *veh
+	}
+	env.rsys = robo.NewSystem(trk, &vehs, robo.NewIdealSimulator(), robo.NewCollisionDetector(trk, &vehs))
+
+	// spread the vehicles evenly around the track from a random starting point,
+	// in random lanes and directions, so that they do not start out colliding
+	dofs0 := phys.Meters(rng.Float64()) * trk.CenLen()
+	for v := range env.rsys.Vehicles {
+		pose := track.Pose{
+			Point: track.Point{
+				Dofs: trk.NormalizeDofs(dofs0 + trk.CenLen()*phys.Meters(v)/phys.Meters(len(vehs))),
+				Cofs: phys.Meters(rng.Intn(3)-1) * (trk.Width() / 4),
+			},
+		}
+		if rng.Intn(2) == 1 {
+			pose.DAngle = math.Pi
+		}
+		env.rsys.Vehicles[v].Reposition(pose)
+	}
+
+	env.collisions = robo.NewEventQueue(env.rsys.Events, robo.EvCollisionStart)
+	env.steps = 0
+	env.obs = env.observe()
+	return env.Observe()
+}
+
+// Step applies one action per vehicle (missing actions do nothing), then runs
+// the simulation for TicksPerStep ticks.
+func (env *Env) Step(actions []Action) (StepResult, error) {
+	if env.rsys == nil {
+		return StepResult{}, fmt.Errorf("Step called before Reset")
+	}
+	if len(actions) > len(env.rsys.Vehicles) {
+		return StepResult{}, fmt.Errorf("Got %d actions for %d vehicles", len(actions), len(env.rsys.Vehicles))
+	}
+	if env.Done() {
+		return StepResult{}, fmt.Errorf("Episode is done after %d steps; Reset to start a new one", env.steps)
+	}
+	for v, a := range actions {
+		applyAction(&env.rsys.Vehicles[v], a)
+	}
+	for t := 0; t < env.cfg.TicksPerStep; t++ {
+		env.rsys.Tick()
+	}
+	env.steps++
+
+	prev := env.obs
+	env.obs = env.observe()
+	res := StepResult{
+		Obs:     env.Observe(),
+		Rewards: make([]float64, len(env.obs)),
+		Done:    env.Done(),
+		Steps:   env.steps,
+	}
+	for v := range env.obs {
+		res.Rewards[v] = env.cfg.Reward(env, prev[v], env.obs[v])
+	}
+	return res, nil
+}
+
+// Observe returns the observations as of the end of the last step (or Reset).
+func (env *Env) Observe() []Observation {
+	obs := make([]Observation, len(env.obs))
+	copy(obs, env.obs)
+	return obs
+}
+
+// Done is true when the episode has reached MaxSteps.
+func (env *Env) Done() bool {
+	return (env.cfg.MaxSteps > 0) && (env.steps >= env.cfg.MaxSteps)
+}
+
+// DefaultReward is the distance driven during the step, minus
+// Config.CollisionPenalty for each new collision.
+func DefaultReward(env *Env, prev, obs Observation) float64 {
+	return float64(obs.Odom-prev.Odom) - env.cfg.CollisionPenalty*float64(len(obs.NewCollisions))
+}
+
+func applyAction(veh *robo.Vehicle, a Action) {
+	if a.Uturn {
+		veh.CmdUturn(robo.DefUturnRadius)
+	}
+	if a.Dspd != nil {
+		dacl := a.Dacl
+		if dacl == 0 {
+			dacl = 1.0
+		}
+		veh.SetCmdDriveDspd(*a.Dspd, dacl)
+	}
+	if a.Cofs != nil {
+		cspd := a.Cspd
+		if cspd == 0 {
+			cspd = 0.1
+		}
+		veh.SetCmdDriveCofs(*a.Cofs, cspd)
+	}
+}
+
+// observe builds every vehicle's observation from the current system state,
+// and consumes the collision events since the last call.
+func (env *Env) observe() []Observation {
+	rsys := env.rsys
+	obs := make([]Observation, len(rsys.Vehicles))
+	for v := range rsys.Vehicles {
+		veh := &rsys.Vehicles[v]
+		obs[v] = Observation{
+			VehId:         veh.Id(),
+			Time:          rsys.Now(),
+			Pose:          veh.CurTrackPose(),
+			Vel:           veh.CurTrackVel(),
+			DriveDspd:     veh.CurDriveDspd(),
+			DriveCofs:     veh.CurDriveCofs(),
+			Odom:          veh.Odom(),
+			Nearby:        env.nearby(v),
+			NewCollisions: make([]int, 0),
+		}
+	}
+	for _, ev := range env.collisions.Drain() {
+		a, b := ev.Collision.VehInfo[0].Id, ev.Collision.VehInfo[1].Id
+		if va := robo.FindVehicle(rsys.Vehicles, a); va >= 0 {
+			obs[va].NewCollisions = append(obs[va].NewCollisions, b)
+		}
+		if vb := robo.FindVehicle(rsys.Vehicles, b); vb >= 0 {
+			obs[vb].NewCollisions = append(obs[vb].NewCollisions, a)
+		}
+	}
+	for _, ce := range rsys.Collider.CurCollisions() {
+		for _, vci := range ce.VehInfo {
+			if v := robo.FindVehicle(rsys.Vehicles, vci.Id); v >= 0 {
+				obs[v].Colliding = true
+			}
+		}
+	}
+	return obs
+}
+
+// nearby lists the vehicles within NearbyDist of vehicle v, closest first.
+func (env *Env) nearby(v int) []NearbyVehicle {
+	rsys := env.rsys
+	me := &rsys.Vehicles[v]
+	pose := me.CurTrackPose()
+	sign := phys.MetersPerSec(1)
+	if !me.IsFacingTrackwise() {
+		sign = -1
+	}
+	near := make([]NearbyVehicle, 0)
+	for o := range rsys.Vehicles {
+		if o == v {
+			continue
+		}
+		other := &rsys.Vehicles[o]
+		ddofs := rsys.Track.DriveDeltaDofs(pose, other.CurTrackPose().Dofs)
+		if math.Abs(float64(ddofs)) > float64(env.cfg.NearbyDist) {
+			continue
+		}
+		near = append(near, NearbyVehicle{
+			VehId:   other.Id(),
+			DDofs:   ddofs,
+			DCofs:   rsys.Track.DriveDeltaCofs(pose, other.CurTrackPose().Cofs),
+			RelDspd: sign * (other.CurTrackVel().D - me.CurTrackVel().D),
+		})
+	}
+	sort.SliceStable(near, func(i, j int) bool {
+		return math.Abs(float64(near[i].DDofs)) < math.Abs(float64(near[j].DDofs))
+	})
+	if (env.cfg.MaxNearby > 0) && (len(near) > env.cfg.MaxNearby) {
+		near = near[:env.cfg.MaxNearby]
+	}
+	return near
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package gym
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+)
+
+// testEqual reports a testing error if the two values are not equal
+func testEqual(t *testing.T, tag string, exp interface{}, got interface{}) {
+	if exp != got {
+		t.Errorf("%s error: exp=%v, got=%v", tag, exp, got)
+	}
+}
+
+// runEpisode drives every vehicle at a fixed speed, with occasional lane
+// changes and uturns, and returns the final observations and total rewards.
+func runEpisode(t *testing.T, env *Env, seed int64) ([]Observation, []float64) {
+	env.Reset(seed)
+	dspd := phys.MetersPerSec(0.8)
+	total := make([]float64, len(env.Config().Vehicles))
+	var res StepResult
+	for !res.Done {
+		actions := make([]Action, len(total))
+		if env.Steps() == 0 {
+			for v := range actions {
+				actions[v].Dspd = &dspd
+			}
+		}
+		if env.Steps()%100 == 50 {
+			cofs := phys.Meters(0.05)
+			actions[0].Cofs = &cofs
+			actions[1].Uturn = true
+		}
+		var err error
+		if res, err = env.Step(actions); err != nil {
+			t.Fatal(err)
+		}
+		for v, r := range res.Rewards {
+			total[v] += r
+		}
+	}
+	return res.Obs, total
+}
+
+func TestEnvDeterminism(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxSteps = 500
+	env, err := NewEnv(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs1, total1 := runEpisode(t, env, 3)
+	obs2, total2 := runEpisode(t, env, 3)
+	for v := range obs1 {
+		testEqual(t, "pose", obs1[v].Pose, obs2[v].Pose)
+		testEqual(t, "odom", obs1[v].Odom, obs2[v].Odom)
+		testEqual(t, "total reward", total1[v], total2[v])
+		if obs1[v].Odom < 1.0 {
+			t.Errorf("vehicle %d only drove %v", v, obs1[v].Odom)
+		}
+	}
+	testEqual(t, "steps", 500, env.Steps())
+	if _, err := env.Step(nil); err == nil {
+		t.Errorf("Step after the episode is done should fail")
+	}
+}
+
+func TestEnvObservation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.NearbyDist = 100 // every vehicle is nearby
+	env, err := NewEnv(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := env.Reset(1)
+	testEqual(t, "len(obs)", 2, len(obs))
+	for v := range obs {
+		testEqual(t, "veh id", v, obs[v].VehId)
+		testEqual(t, "len(nearby)", 1, len(obs[v].Nearby))
+		testEqual(t, "nearby veh id", 1-v, obs[v].Nearby[0].VehId)
+		testEqual(t, "colliding", false, obs[v].Colliding)
+	}
+
+	// put vehicle 1 right behind vehicle 0, overlapping it
+	rsys := env.System()
+	pose := rsys.Vehicles[0].CurTrackPose()
+	pose.Dofs = rsys.Track.NormalizeDofs(pose.Dofs + 0.02)
+	rsys.Vehicles[1].Reposition(pose)
+	res, err := env.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "len(new collisions)", 1, len(res.Obs[0].NewCollisions))
+	testEqual(t, "colliding", true, res.Obs[1].Colliding)
+	if r := res.Rewards[0]; (r > -cfg.CollisionPenalty+0.01) || (r < -cfg.CollisionPenalty-0.01) {
+		t.Errorf("reward error: exp=%v, got=%v", -cfg.CollisionPenalty, r)
+	}
+	res, _ = env.Step(nil)
+	testEqual(t, "len(new collisions) after", 0, len(res.Obs[0].NewCollisions))
+}
+
+func TestServeConn(t *testing.T) {
+	client, server := net.Pipe()
+	go ServeConn(server, DefaultConfig())
+	defer client.Close()
+	scanner := bufio.NewScanner(client)
+	send := func(req string) Response {
+		fmt.Fprintln(client, req)
+		if !scanner.Scan() {
+			t.Fatalf("no response to %s", req)
+		}
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := send(`{"Cmd": "observe"}`)
+	if resp.Error == "" {
+		t.Errorf("observe before reset should fail")
+	}
+	resp = send(`{"Cmd": "reset", "Seed": 7}`)
+	testEqual(t, "reset error", "", resp.Error)
+	testEqual(t, "reset len(obs)", 2, len(resp.Obs))
+	resp = send(`{"Cmd": "step", "Actions": [{"Dspd": 1.0}, {"Cofs": -0.05}]}`)
+	testEqual(t, "step error", "", resp.Error)
+	testEqual(t, "step steps", 1, resp.Steps)
+	testEqual(t, "step len(rewards)", 2, len(resp.Rewards))
+	resp = send(`{"Cmd": "bogus"}`)
+	if resp.Error == "" {
+		t.Errorf("bogus command should fail")
+	}
+	resp = send(`{"Cmd": "close"}`)
+	testEqual(t, "close done", true, resp.Done)
+}
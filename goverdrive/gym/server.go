@@ -0,0 +1,114 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// server.go is a line-oriented JSON protocol, so that trainers written in any
+// language can run episodes over a local socket. Each connection gets its own
+// Env. Every request is one JSON object on one line, and gets exactly one JSON
+// response line:
+//
+//   -> {"Cmd": "reset", "Seed": 7}
+//   <- {"Obs": [...], "Rewards": null, "Done": false, "Steps": 0}
+//   -> {"Cmd": "step", "Actions": [{"Dspd": 0.8}, {"Cofs": -0.05, "Uturn": true}]}
+//   <- {"Obs": [...], "Rewards": [0.016, 0.0], "Done": false, "Steps": 1}
+//   -> {"Cmd": "observe"}
+//   <- {"Obs": [...], "Rewards": null, "Done": false, "Steps": 1}
+//   -> {"Cmd": "close"}
+//   <- {"Obs": null, "Rewards": null, "Done": true, "Steps": 1}
+//
+// A failed request gets a response with a non-empty Error, and the connection
+// stays open.
+
+package gym
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// Request is one request from a trainer.
+type Request struct {
+	Cmd     string // "reset", "step", "observe" or "close"
+	Seed    int64  // for "reset"
+	Actions []Action
+}
+
+// Response is the reply to one request.
+type Response struct {
+	StepResult
+	Error string `json:",omitempty"`
+}
+
+// Serve accepts connections on l, and runs each one in its own goroutine with
+// its own Env. It returns when l is closed.
+func Serve(l net.Listener, cfg Config) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := ServeConn(conn, cfg); err != nil {
+				log.Printf("gym: %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn runs the protocol over one connection, until the trainer sends
+// "close" or closes the connection.
+func ServeConn(rw io.ReadWriter, cfg Config) error {
+	env, err := NewEnv(cfg)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(rw)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	enc := json.NewEncoder(rw)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var req Request
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("Request could not be parsed: %v", err)
+		} else {
+			resp = env.handle(req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+		if req.Cmd == "close" {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// handle runs one request.
+func (env *Env) handle(req Request) Response {
+	switch req.Cmd {
+	case "reset":
+		env.Reset(req.Seed)
+	case "step":
+		res, err := env.Step(req.Actions)
+		if err != nil {
+			return Response{Error: err.Error()}
+		}
+		return Response{StepResult: res}
+	case "observe":
+		if env.rsys == nil {
+			return Response{Error: "observe called before reset"}
+		}
+	case "close":
+		return Response{StepResult: StepResult{Done: true, Steps: env.steps}}
+	default:
+		return Response{Error: fmt.Sprintf("Cmd=%q is not recognized", req.Cmd)}
+	}
+	return Response{StepResult: StepResult{Obs: env.Observe(), Done: env.Done(), Steps: env.steps}}
+}
@@ -91,3 +91,8 @@ go get golang.org/x/image/math/fixed
 pushd src/golang.org/x/image/math/fixed
 git checkout --quiet e20db36d77bd0cb36cea8fe49d5c37d82d21591f
 popd
+
+go get gopkg.in/yaml.v2
+pushd src/gopkg.in/yaml.v2
+git checkout --quiet cd8b52f8269e
+popd
@@ -0,0 +1,263 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// cmdlink.go emulates the BLE connection to physical vehicles. On hardware,
+// every speed, offset, turn and light command is a BLE write, which arrives
+// late and competes for limited bandwidth. A CmdLink delays vehicle commands,
+// and counts the writes to each vehicle against a budget, so that games which
+// spam commands are found early.
+
+package robo
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+)
+
+const (
+	// BLEMsgMaxSize is the largest message that fits in one BLE write, ie
+	// ANKI_VEHICLE_MSG_MAX_SIZE.
+	BLEMsgMaxSize = 20
+
+	// Message sizes, in bytes, including the size byte. See
+	// ankidrive/protocol.h.
+	bleSetSpeedSize      = 7  // ANKI_VEHICLE_MSG_C2V_SET_SPEED
+	bleTurnSize          = 4  // ANKI_VEHICLE_MSG_C2V_TURN
+	bleSetOffsetSize     = 6  // ANKI_VEHICLE_MSG_C2V_SET_OFFSET_FROM_ROAD_CENTER
+	bleChangeLaneSize    = 12 // ANKI_VEHICLE_MSG_C2V_CHANGE_LANE
+	bleSetLightsSize     = 3  // ANKI_VEHICLE_MSG_C2V_SET_LIGHTS
+	bleLightsPatternSize = 18 // ANKI_VEHICLE_MSG_C2V_LIGHTS_PATTERN
+)
+
+// CmdLinkParams tunes the CmdLink. Zero values disable the corresponding
+// latency, serialization and budget.
+type CmdLinkParams struct {
+	Seed int64 // for the jitter; equal seeds give equal delays
+
+	// Latency is the delay from issuing a command to it taking effect, plus up
+	// to LatencyJitter of uniformly random delay. The commands to one vehicle
+	// are never reordered.
+	Latency       phys.SimTime
+	LatencyJitter phys.SimTime
+
+	// WriteInterval is the time that each BLE write occupies the connection to
+	// a vehicle, so that bursts of commands queue up behind each other.
+	WriteInterval phys.SimTime
+
+	// MaxWritesPerSec is the budget of BLE writes to each vehicle, in any one
+	// second. Commands over the budget publish EvVehCmdOverBudget, and are
+	// dropped if DropOverBudget.
+	MaxWritesPerSec int
+	DropOverBudget  bool
+}
+
+// DefaultCmdLinkParams returns parameters that roughly match a BLE connection
+// to a physical vehicle.
+func DefaultCmdLinkParams() CmdLinkParams {
+	return CmdLinkParams{
+		Seed:            1,
+		Latency:         30 * phys.SimMillisecond,
+		LatencyJitter:   15 * phys.SimMillisecond,
+		WriteInterval:   7500 * phys.SimMicrosecond,
+		MaxWritesPerSec: 30,
+		DropOverBudget:  false,
+	}
+}
+
+// CmdLinkStats counts the traffic to one vehicle.
+type CmdLinkStats struct {
+	Cmds             int // sent, ie not dropped
+	Writes           int
+	Bytes            int
+	OverBudget       int // commands over the budget, including dropped ones
+	Dropped          int
+	PeakWritesPerSec int
+}
+
+// CmdLink delivers vehicle commands late, and enforces a BLE budget; see
+// System.SetCmdLink.
+type CmdLink struct {
+	params  CmdLinkParams
+	src     *countingSource
+	rng     *rand.Rand
+	vehs    map[int]*vehLinkState // by vehicle Id
+	pending []pendingVehCmd       // in the order they were sent
+}
+
+type vehLinkState struct {
+	writeTimes  []phys.SimTime // of the writes in the last second, for the budget
+	lastDeliver phys.SimTime   // of the latest command, so that they are never reordered
+	stats       CmdLinkStats
+}
+
+type pendingVehCmd struct {
+	at  phys.SimTime
+	cmd VehCmd
+}
+
+func NewCmdLink(params CmdLinkParams) *CmdLink {
+	src := &countingSource{src: rand.NewSource(params.Seed).(rand.Source64)}
+	return &CmdLink{
+		params:  params,
+		src:     src,
+		rng:     rand.New(src),
+		vehs:    make(map[int]*vehLinkState),
+		pending: make([]pendingVehCmd, 0),
+	}
+}
+
+// Params returns the link's parameters.
+func (l *CmdLink) Params() CmdLinkParams {
+	return l.params
+}
+
+// Stats returns the traffic to the vehicle with the Id, so far.
+func (l *CmdLink) Stats(vehId int) CmdLinkStats {
+	if st, ok := l.vehs[vehId]; ok {
+		return st.stats
+	}
+	return CmdLinkStats{}
+}
+
+// VehCmdBLEWrites returns the number of BLE writes, and the total bytes, that a
+// physical vehicle needs for the command. Repositions are not sent; they are
+// done by hand.
+func VehCmdBLEWrites(cmd VehCmd) (writes, bytes int) {
+	switch cmd.Kind {
+	case VehCmdDriveDspd:
+		return 1, bleSetSpeedSize
+	case VehCmdDriveCofs, VehCmdTrackCofs:
+		return 2, bleSetOffsetSize + bleChangeLaneSize
+	case VehCmdUturn, VehCmdTurn:
+		return 1, bleTurnSize
+	case VehCmdLights:
+		return lightCmdBLEWrites(cmd.Light)
+	}
+	return 0, 0
+}
+
+// lightCmdBLEWrites counts one message per light group.
+func lightCmdBLEWrites(lc *light.Cmd) (writes, bytes int) {
+	if lc == nil {
+		return 0, 0
+	}
+	size := bleSetLightsSize
+	if lc.Kind == light.CmdAnimation {
+		size = bleLightsPatternSize
+	}
+	return len(lc.Names), len(lc.Names) * size
+}
+
+//////////////////////////////////////////////////////////////////////
+// System
+
+// SetCmdLink routes all vehicle commands, including light commands, through
+// the link, instead of taking effect on the next tick. A nil link turns this
+// off; commands that are still pending are dropped.
+func (s *System) SetCmdLink(l *CmdLink) {
+	s.cmdLink = l
+	for i := range s.Vehicles {
+		s.linkVehCmds(&s.Vehicles[i])
+	}
+}
+
+// CmdLink returns the system's command link, or nil if there is none.
+func (s *System) CmdLink() *CmdLink {
+	return s.cmdLink
+}
+
+// linkVehCmds hooks up the system's command link to one vehicle.
+func (s *System) linkVehCmds(veh *Vehicle) {
+	l := s.cmdLink
+	if l == nil {
+		veh.cmdLink = nil
+		veh.Lights().SetLink(nil)
+		return
+	}
+
+	vehId := veh.id
+	veh.cmdLink = func(cmd VehCmd) {
+		cmd.Time = s.now
+		cmd.VehId = vehId
+		l.send(s, cmd)
+	}
+	veh.Lights().SetLink(func(lc light.Cmd) {
+		l.send(s, VehCmd{Time: s.now, VehId: vehId, Kind: VehCmdLights, Light: &lc})
+	})
+}
+
+// send checks the command against the budget, and queues it.
+func (l *CmdLink) send(s *System, cmd VehCmd) {
+	p := &l.params
+	st, ok := l.vehs[cmd.VehId]
+	if !ok {
+		st = &vehLinkState{writeTimes: make([]phys.SimTime, 0)}
+		l.vehs[cmd.VehId] = st
+	}
+
+	// budget, over a sliding window of one second
+	writes, bytes := VehCmdBLEWrites(cmd)
+	recent := st.writeTimes[:0]
+	for _, t := range st.writeTimes {
+		if (t + phys.SimSecond) > cmd.Time {
+			recent = append(recent, t)
+		}
+	}
+	st.writeTimes = recent
+	if (p.MaxWritesPerSec > 0) && ((len(st.writeTimes) + writes) > p.MaxWritesPerSec) {
+		st.stats.OverBudget++
+		if p.DropOverBudget {
+			st.stats.Dropped++
+		}
+		s.Events.Publish(Event{Kind: EvVehCmdOverBudget, VehId: cmd.VehId, VehCmd: &cmd})
+		if p.DropOverBudget {
+			return
+		}
+	}
+	for i := 0; i < writes; i++ {
+		st.writeTimes = append(st.writeTimes, cmd.Time)
+	}
+	st.stats.Cmds++
+	st.stats.Writes += writes
+	st.stats.Bytes += bytes
+	if len(st.writeTimes) > st.stats.PeakWritesPerSec {
+		st.stats.PeakWritesPerSec = len(st.writeTimes)
+	}
+
+	// delivery, after the latency and any earlier writes
+	at := cmd.Time + p.Latency
+	if p.LatencyJitter > 0 {
+		at += phys.SimTime(l.rng.Int63n(int64(p.LatencyJitter)))
+	}
+	if at < st.lastDeliver {
+		at = st.lastDeliver
+	}
+	at += phys.SimTime(writes) * p.WriteInterval
+	st.lastDeliver = at
+	l.pending = append(l.pending, pendingVehCmd{at: at, cmd: cmd})
+}
+
+// deliver applies the commands that are due, in the order they are due.
+// Commands to removed vehicles are dropped.
+func (l *CmdLink) deliver(s *System) {
+	due := make([]pendingVehCmd, 0)
+	later := l.pending[:0]
+	for _, pc := range l.pending {
+		if pc.at <= s.now {
+			due = append(due, pc)
+		} else {
+			later = append(later, pc)
+		}
+	}
+	l.pending = later
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at < due[j].at })
+
+	for _, pc := range due {
+		if veh := s.Vehicle(pc.cmd.VehId); veh != nil {
+			veh.applyCmd(s.now, pc.cmd)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// newCmdLinkSystem creates a system with two idle vehicles and a command link.
+// A nil params means no link.
+func newCmdLinkSystem(t *testing.T, params *CmdLinkParams) *System {
+	rsys := newAddRemoveSystem(t, newDetector)
+	if params != nil {
+		rsys.SetCmdLink(NewCmdLink(*params))
+	}
+	return rsys
+}
+
+func TestVehCmdBLEWrites(t *testing.T) {
+	cmds := []VehCmd{
+		{Kind: VehCmdDriveDspd, Dspd: 1, Dacl: 1},
+		{Kind: VehCmdDriveCofs, Cofs: 0.01, Cspd: 0.1},
+		{Kind: VehCmdTurn, Turn: TurnLeft},
+		{Kind: VehCmdLights, Light: &light.Cmd{Kind: light.CmdAnimation, Names: []string{"top", "tail"}}},
+	}
+	expWrites := []int{1, 2, 1, 2}
+	for i, cmd := range cmds {
+		writes, bytes := VehCmdBLEWrites(cmd)
+		testEqual(t, string(cmd.Kind)+" writes", expWrites[i], writes)
+		if (bytes <= 0) || (bytes > writes*BLEMsgMaxSize) {
+			t.Errorf("%s bytes=%d do not fit in %d writes", cmd.Kind, bytes, writes)
+		}
+	}
+	writes, _ := VehCmdBLEWrites(VehCmd{Kind: VehCmdReposition})
+	testEqual(t, "repositions are not sent", 0, writes)
+}
+
+func TestCmdLinkZeroParams(t *testing.T) {
+	// with no latency, a link is the same as no link
+	params := CmdLinkParams{}
+	direct := newCmdLinkSystem(t, nil)
+	linked := newCmdLinkSystem(t, &params)
+	for _, rsys := range []*System{direct, linked} {
+		for i := 0; i < 100; i++ {
+			rsys.Vehicles[0].SetCmdDriveDspd(phys.MetersPerSec(0.01*float64(i)), 10)
+			if i == 20 {
+				rsys.Vehicles[1].SetCmdDriveCofs(0.05, 0.2)
+			}
+			if i == 50 {
+				rsys.Vehicles[1].CmdTurn(TurnLeft, 0.05)
+			}
+			rsys.Tick()
+		}
+	}
+	for v := range direct.Vehicles {
+		testEqual(t, "pose", direct.Vehicles[v].CurTrackPose(), linked.Vehicles[v].CurTrackPose())
+	}
+}
+
+func TestCmdLinkLatency(t *testing.T) {
+	params := CmdLinkParams{Latency: 50 * phys.SimMillisecond, WriteInterval: 5 * phys.SimMillisecond}
+	rsys := newCmdLinkSystem(t, &params)
+	cmds := make([]VehCmd, 0)
+	rsys.SetVehCmdObserver(func(cmd VehCmd) { cmds = append(cmds, cmd) })
+
+	start := rsys.Now()
+	veh := &rsys.Vehicles[0]
+	veh.SetCmdDriveDspd(0.5, 10)
+	testEqual(t, "observed now", 1, len(cmds))
+	testEqual(t, "not applied yet", phys.MetersPerSec(0), veh.CmdDriveDspd())
+	for veh.CmdDriveDspd() == 0 {
+		rsys.Tick()
+		veh = &rsys.Vehicles[0]
+	}
+	if due := start + 55*phys.SimMillisecond; (rsys.Now() < due) || (rsys.Now() >= due+simDeltaT) {
+		t.Errorf("applied at %v, expected on the first tick after %v", rsys.Now(), due)
+	}
+
+	// a burst queues up behind itself, and keeps its order
+	start = rsys.Now()
+	for i := 1; i <= 4; i++ {
+		veh.SetCmdDriveDspd(phys.MetersPerSec(0.1*float64(i)), 10)
+	}
+	for i := 0; i < 6; i++ {
+		rsys.Tick()
+	}
+	veh = &rsys.Vehicles[0]
+	testEqual(t, "first 2 writes", phys.MetersPerSec(0.2), veh.CmdDriveDspd())
+	for rsys.Now() < (start + 70*phys.SimMillisecond) {
+		rsys.Tick()
+	}
+	veh = &rsys.Vehicles[0]
+	testEqual(t, "last write", phys.MetersPerSec(0.4), veh.CmdDriveDspd())
+}
+
+func TestCmdLinkJitterKeepsOrder(t *testing.T) {
+	params := CmdLinkParams{Seed: 7, Latency: 20 * phys.SimMillisecond, LatencyJitter: 40 * phys.SimMillisecond}
+	rsys := newCmdLinkSystem(t, &params)
+	applied := make([]phys.MetersPerSec, 0)
+	for i := 1; i <= 30; i++ {
+		rsys.Vehicles[0].SetCmdDriveDspd(phys.MetersPerSec(0.01*float64(i)), 10)
+		rsys.Tick()
+		applied = append(applied, rsys.Vehicles[0].CmdDriveDspd())
+	}
+	for i := 0; i < 10; i++ {
+		rsys.Tick()
+	}
+	for i := 1; i < len(applied); i++ {
+		if applied[i] < applied[i-1] {
+			t.Errorf("command %v was applied after %v", applied[i-1], applied[i])
+		}
+	}
+	testEqual(t, "last command", phys.MetersPerSec(0.3), rsys.Vehicles[0].CmdDriveDspd())
+}
+
+func TestCmdLinkBudget(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		params := CmdLinkParams{MaxWritesPerSec: 10, DropOverBudget: drop}
+		rsys := newCmdLinkSystem(t, &params)
+		q := NewEventQueue(rsys.Events, EvVehCmdOverBudget)
+
+		// 8 writes, then a lane change that needs 2 more, then over
+		for i := 1; i <= 8; i++ {
+			rsys.Vehicles[0].SetCmdDriveDspd(phys.MetersPerSec(0.1*float64(i)), 10)
+		}
+		rsys.Vehicles[0].SetCmdTrackCofs(0.05, 0.1)
+		rsys.Vehicles[0].SetCmdDriveDspd(1.5, 10)
+		rsys.Vehicles[0].Lights().Set("top", color.White)
+		rsys.Vehicles[1].SetCmdDriveDspd(0.3, 10)
+		rsys.Tick()
+
+		evs := q.Drain()
+		testEqual(t, "len(over budget)", 2, len(evs))
+		if len(evs) == 2 {
+			testEqual(t, "over budget veh", 0, evs[0].VehId)
+			testEqual(t, "over budget cmd", VehCmdDriveDspd, evs[0].VehCmd.Kind)
+			testEqual(t, "over budget light", VehCmdLights, evs[1].VehCmd.Kind)
+		}
+		stats := rsys.CmdLink().Stats(0)
+		testEqual(t, "over budget", 2, stats.OverBudget)
+		testEqual(t, "other vehicle has its own budget", 0, rsys.CmdLink().Stats(1).OverBudget)
+		if drop {
+			testEqual(t, "dropped", 2, stats.Dropped)
+			testEqual(t, "cmds", 9, stats.Cmds)
+			testEqual(t, "writes", 10, stats.Writes)
+			testEqual(t, "peak", 10, stats.PeakWritesPerSec)
+			testEqual(t, "dropped speed", phys.MetersPerSec(0.8), rsys.Vehicles[0].CmdDriveDspd())
+		} else {
+			testEqual(t, "cmds", 11, stats.Cmds)
+			testEqual(t, "peak", 12, stats.PeakWritesPerSec)
+			testEqual(t, "reported speed", phys.MetersPerSec(1.5), rsys.Vehicles[0].CmdDriveDspd())
+		}
+
+		// the budget is per second
+		for rsys.Now() < phys.SimSecond+50*phys.SimMillisecond {
+			rsys.Tick()
+		}
+		rsys.Vehicles[0].SetCmdDriveDspd(0.2, 10)
+		rsys.Tick()
+		testEqual(t, "budget renewed", 0, q.Len())
+	}
+}
+
+func TestCmdLinkLights(t *testing.T) {
+	params := CmdLinkParams{Latency: 30 * phys.SimMillisecond}
+	rsys := newCmdLinkSystem(t, &params)
+	lights := rsys.Vehicles[0].Lights()
+	before := lights.Snapshot().Static["top"]
+	lights.Set("top", color.White)
+	rsys.Tick()
+	testEqual(t, "not set yet", before, rsys.Vehicles[0].Lights().Snapshot().Static["top"])
+	for i := 0; i < 3; i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "set", toRGBA(color.White), rsys.Vehicles[0].Lights().Snapshot().Static["top"])
+
+	// animations start when they arrive
+	lights = rsys.Vehicles[0].Lights()
+	lights.SetAnimation(rsys.Now(), "tail", []light.Frame{{Color: color.White, Tms: 100}}, 1)
+	testEqual(t, "not animating yet", false, lights.IsAnimating("tail"))
+	for i := 0; i < 3; i++ {
+		rsys.Tick()
+	}
+	arrived := rsys.Now()
+	lights = rsys.Vehicles[0].Lights()
+	testEqual(t, "animating", true, lights.IsAnimating("tail"))
+	testEqual(t, "frame ends after arrival", arrived+100*phys.SimMillisecond, lights.Snapshot().Anim["tail"].FrameEndTime)
+}
+
+func TestCmdLinkRemoveVehicle(t *testing.T) {
+	params := CmdLinkParams{Latency: 30 * phys.SimMillisecond}
+	rsys := newCmdLinkSystem(t, &params)
+	rsys.Vehicles[1].SetCmdDriveDspd(0.5, 10)
+	rsys.RemoveVehicle(1)
+	for i := 0; i < 5; i++ {
+		rsys.Tick()
+	}
+
+	// added vehicles use the link too
+	veh := mustNewVehicle(t, "gs", rsys.Track.CenLen())
+	veh.Reposition(track.Pose{Point: track.Point{Dofs: 1.5, Cofs: 0}})
+	id := rsys.AddVehicle(veh)
+	rsys.Vehicle(id).SetCmdDriveDspd(0.5, 10)
+	testEqual(t, "delayed", phys.MetersPerSec(0), rsys.Vehicle(id).CmdDriveDspd())
+	testEqual(t, "counted", 1, rsys.CmdLink().Stats(id).Cmds)
+
+	// removing the link applies commands immediately again
+	rsys.SetCmdLink(nil)
+	rsys.Vehicle(id).SetCmdDriveDspd(0.7, 10)
+	testEqual(t, "immediate", phys.MetersPerSec(0.7), rsys.Vehicle(id).CmdDriveDspd())
+}
+
+func TestCmdLinkSnapshot(t *testing.T) {
+	params := DefaultCmdLinkParams()
+	rsys := newCmdLinkSystem(t, &params)
+	for i := 0; i < 40; i++ {
+		rsys.Vehicles[i%2].SetCmdDriveDspd(phys.MetersPerSec(0.02*float64(i)), 10)
+		rsys.Tick()
+	}
+	rsys.Vehicles[0].Lights().Set("top", color.White)
+	snap := mustJSONRoundTrip(t, rsys.Snapshot())
+	if snap.CmdLink == nil {
+		t.Fatal("command link state is not saved")
+	}
+	testEqual(t, "pending saved", true, len(snap.CmdLink.Pending) > 0)
+	wantState, _ := runSnapshotSystem(t, rsys, 50)
+	if err := rsys.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := runSnapshotSystem(t, rsys, 50)
+	testEqual(t, "rewound state", wantState, state)
+
+	// restored vehicles still use the link
+	rsys.Vehicles[0].SetCmdDriveDspd(1.0, 10)
+	testEqual(t, "still linked", true, rsys.Vehicles[0].CmdDriveDspd() != 1.0)
+
+	rsys.SetCmdLink(nil)
+	if err := rsys.Restore(snap); err == nil {
+		t.Errorf("expected an error for a command link mismatch")
+	}
+}
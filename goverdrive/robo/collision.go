@@ -1,17 +1,15 @@
 // Copyright 2017 Anki, Inc.
 // Author: gwenz@anki.com
 //
-// Detect vehicle collisions. There may or may not be a reaction.
-//
-// TODO(gwenz): Should the robotics system natively support collisions between a
-// vehicle and a non-vehicle object, eg a road obstacle that is part of the
-// game?
+// Detect vehicle collisions. There may or may not be a reaction. Collisions
+// between a vehicle and a non-vehicle object are in obstacle.go.
 
 package robo
 
 import (
 	_ "fmt"
 	"math"
+	"sort"
 
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo/track"
@@ -24,7 +22,7 @@ type VehicleCollider interface {
 	// since the last call to NewCollisions. In most cases, this will be a very
 	// small list (or empty list). There is no order guarantee for returned
 	// CollisionEvents. NOTE: If called irregularly, some of the older "new"
-	// collisions may be forgotten
+	// collisions may be forgotten. System.Events has no such limitation.
 	NewCollisions() []CollisionEvent
 
 	// CurCollisions returns all collision events that are ongoing. There is no
@@ -34,13 +32,44 @@ type VehicleCollider interface {
 	// Update updates the collision and vehicle states, based on position of each
 	// vehicle. Should be called by the robotics system.
 	update(now phys.SimTime, trk *track.Track, vehs *[]Vehicle)
+
+	// snapshot and restore save and restore the collider's state; see
+	// System.Snapshot. restore does not change anything if it fails.
+	snapshot() ColliderSnapshot
+	restore(snap ColliderSnapshot) error
+}
+
+// CollisionSide is the side of a vehicle that was hit.
+type CollisionSide int
+
+const (
+	CollisionSideUnknown CollisionSide = iota
+	CollisionFront
+	CollisionRear
+	CollisionLeft
+	CollisionRight
+)
+
+func (cs CollisionSide) String() string {
+	switch cs {
+	case CollisionFront:
+		return "front"
+	case CollisionRear:
+		return "rear"
+	case CollisionLeft:
+		return "left"
+	case CollisionRight:
+		return "right"
+	}
+	return "unknown"
 }
 
 // VehicleCollisionInfo captures the collision info for one of the two vehicles
 // involved. The POI (point-of-impact) is in that vehicle's frame of reference.
 type VehicleCollisionInfo struct {
-	Id  int
-	POI phys.Point
+	Id   int
+	POI  phys.Point
+	Side CollisionSide // side of this vehicle that was hit
 }
 
 // CollisionEvent captures all of the information about a vehicle's collision
@@ -48,28 +77,51 @@ type VehicleCollisionInfo struct {
 type CollisionEvent struct {
 	ImpactTime phys.SimTime
 	VehInfo    [2]VehicleCollisionInfo
+
+	// Normal is the unit direction of impact, in absolute Cartesian space, from
+	// VehInfo[0] towards VehInfo[1].
+	Normal phys.Point
+
+	// ClosingSpeed is the relative speed of the vehicles along Normal; >0 =>
+	// they were approaching each other.
+	ClosingSpeed phys.MetersPerSec
+
+	// Penetration is how far the vehicle rectangles overlap along Normal.
+	Penetration phys.Meters
 }
 
-// XXX(gwenz): Angle boundaries for high-level colllision direction are
-// simplistic. May want to take each vehicle's actual length and width into
-// account.
+// The Is*Collision functions use Side. For a VehicleCollisionInfo with an
+// unknown Side, they fall back on the angle of the POI, which does not take the
+// vehicle's length and width into account.
 
 func (vci VehicleCollisionInfo) IsFrontCollision() bool {
+	if vci.Side != CollisionSideUnknown {
+		return vci.Side == CollisionFront
+	}
 	angle := vci.POI.ToPolarPoint().A
 	return (angle > (-math.Pi / 4)) && (angle < (+math.Pi / 4))
 }
 
 func (vci VehicleCollisionInfo) IsRearCollision() bool {
+	if vci.Side != CollisionSideUnknown {
+		return vci.Side == CollisionRear
+	}
 	angle := vci.POI.ToPolarPoint().A
-	return (angle > (3 * math.Pi / 4)) || (angle < (-4 * math.Pi / 4))
+	return (angle > (3 * math.Pi / 4)) || (angle < (-3 * math.Pi / 4))
 }
 
 func (vci VehicleCollisionInfo) IsLeftSideCollision() bool {
+	if vci.Side != CollisionSideUnknown {
+		return vci.Side == CollisionLeft
+	}
 	angle := vci.POI.ToPolarPoint().A
 	return (angle >= (math.Pi / 4)) && (angle <= (3 * math.Pi / 4))
 }
 
 func (vci VehicleCollisionInfo) IsRightSideCollision() bool {
+	if vci.Side != CollisionSideUnknown {
+		return vci.Side == CollisionRight
+	}
 	angle := vci.POI.ToPolarPoint().A
 	return (angle >= (-3 * math.Pi / 4)) && (angle <= (-math.Pi / 4))
 }
@@ -78,13 +130,28 @@ func (vci VehicleCollisionInfo) IsRightSideCollision() bool {
 
 // CollisionDetector is a simple detector of vehicle collisions, based on
 // rectangular vehicle gemoetry. It does not modify vehicle state when a
-// collision happens.
+// collision happens; see CollisionResponder for that.
+//
+// A broad phase sorts the vehicles by Dofs, and only does the collision math
+// for vehicles that are close along the track, so large fleets are cheap. The
+// detector does not depend on the number of vehicles, which can change between
+// updates.
+//
+// Collisions are swept: the detector also checks the poses in between the last
+// update and this one, so fast vehicles cannot pass through each other, and
+// ImpactTime is the interpolated time of first contact. A collision that is
+// only found by the sweep, ie the vehicles have already passed each other, is
+// ongoing until the next update.
 type CollisionDetector struct {
-	maxDimension  map[vehPair]phys.Meters
 	curCollisions map[vehPair]CollisionEvent
 	newCollisions map[vehPair]CollisionEvent
+
+	prevInputs []vehCollisionInputs // as of the last update
+	prevTime   phys.SimTime
+	sweptPoses map[vehPair][2]track.Pose // impact poses of collisions only found by the sweep
 }
 
+// vehPair identifies two vehicles, by Id, with Veh1<Veh2.
 type vehPair struct {
 	Veh1, Veh2 int
 }
@@ -92,22 +159,10 @@ type vehPair struct {
 // NewCollisionDetector creates a new detector suited for the specific trk and
 // set of vehicles.
 func NewCollisionDetector(trk *track.Track, vehs *[]Vehicle) *CollisionDetector {
-	maxDimension := make(map[vehPair]phys.Meters)
-	for v1 := range *vehs {
-		for v2 := v1 + 1; v2 < len(*vehs); v2++ {
-			veh1 := (*vehs)[v1]
-			veh2 := (*vehs)[v2]
-			lmax := math.Max(float64(veh1.Length()), float64(veh2.Length()))
-			wmax := math.Max(float64(veh1.Width()), float64(veh2.Width()))
-			max := math.Max(lmax, wmax)
-			maxDimension[vehPair{v1, v2}] = phys.Meters(max)
-		}
-	}
-
 	return &CollisionDetector{
-		maxDimension:  maxDimension,
 		curCollisions: make(map[vehPair]CollisionEvent),
 		newCollisions: make(map[vehPair]CollisionEvent),
+		sweptPoses:    make(map[vehPair][2]track.Pose),
 	}
 }
 
@@ -132,18 +187,27 @@ func (cd *CollisionDetector) CurCollisions() []CollisionEvent {
 func (cd *CollisionDetector) update(now phys.SimTime, trk *track.Track, vehs *[]Vehicle) {
 	// populate collision inputs, for helper function
 	inputs := make([]vehCollisionInputs, len(*vehs))
-	for i, veh := range *vehs {
-		inputs[i] = vehCollisionInputs{
-			dofs:  veh.CurTrackPose().Dofs,
-			pose:  trk.ToPose(veh.CurTrackPose()),
-			len:   veh.Length(),
-			width: veh.Width(),
-		}
+	for i := range *vehs {
+		inputs[i] = newVehCollisionInputs(trk, &(*vehs)[i])
 	}
 
 	cd.updateHelper(now, trk, inputs)
 }
 
+// refreshInputs re-snapshots the inputs of the vehicles with the Ids, after
+// they were moved since the last update, eg by a CollisionResponder. The next
+// update then sweeps them from where they are now.
+func (cd *CollisionDetector) refreshInputs(trk *track.Track, vehs []Vehicle, ids map[int]bool) {
+	for i, in := range cd.prevInputs {
+		if !ids[in.id] {
+			continue
+		}
+		if v := FindVehicle(vehs, in.id); v >= 0 {
+			cd.prevInputs[i] = newVehCollisionInputs(trk, &vehs[v])
+		}
+	}
+}
+
 //////////////////////////////////////////////////////////////////////
 
 // vehCollisionInputs is an intermediate type that holds all of the per-vehicle
@@ -151,57 +215,325 @@ func (cd *CollisionDetector) update(now phys.SimTime, trk *track.Track, vehs *[]
 // unit test the collision indexing and math without having to create a track
 // and set of vehicles and then carefully manipulate their state.
 type vehCollisionInputs struct {
+	id    int         // vehicle Id; inputs are in Id order
 	dofs  phys.Meters // Track
 	pose  phys.Pose   // Cartesian
 	len   phys.Meters
 	width phys.Meters
+	vel   phys.Point // Cartesian, in MetersPerSec; only used for ClosingSpeed
+
+	// for swept collisions
+	tpose       track.Pose
+	repositions int
+}
+
+func newVehCollisionInputs(trk *track.Track, veh *Vehicle) vehCollisionInputs {
+	return vehCollisionInputs{
+		id:          veh.id,
+		dofs:        veh.CurTrackPose().Dofs,
+		pose:        trk.ToPose(veh.CurTrackPose()),
+		len:         veh.Length(),
+		width:       veh.Width(),
+		vel:         cartesianVel(trk, veh.CurTrackPose().Point, veh.CurTrackVel()),
+		tpose:       veh.CurTrackPose(),
+		repositions: veh.repositions,
+	}
+}
+
+// cartesianVel approximates a Cartesian velocity from a track velocity, using
+// the heading of the road at the point.
+func cartesianVel(trk *track.Track, pt track.Point, tv track.Vel) phys.Point {
+	theta := float64(trk.ToPose(track.Pose{Point: pt}).Theta)
+	cos, sin := math.Cos(theta), math.Sin(theta)
+	return phys.Point{
+		X: phys.Meters((float64(tv.D) * cos) - (float64(tv.C) * sin)),
+		Y: phys.Meters((float64(tv.D) * sin) + (float64(tv.C) * cos)),
+	}
 }
 
 func (cd *CollisionDetector) updateHelper(now phys.SimTime, trk *track.Track, allInputs []vehCollisionInputs) {
-	for v0 := range allInputs {
-		for v1 := v0 + 1; v1 < len(allInputs); v1++ {
-			pair := vehPair{v0, v1}
+	// Vehicles that were driving since the last update get swept. Vehicles that
+	// are new or were repositioned jumped there, so they only get checked where
+	// they are now. Vehicles are matched up by Id, since vehicles can be added
+	// and removed between updates.
+	prevById := make(map[int]vehCollisionInputs, len(cd.prevInputs))
+	for _, in := range cd.prevInputs {
+		prevById[in.id] = in
+	}
+	prev := make([]vehCollisionInputs, len(allInputs))
+	isSwept := make([]bool, len(allInputs))
+	moved := make([]phys.Meters, len(allInputs))
+	maxMoved := phys.Meters(0)
+	for v := range allInputs {
+		p, ok := prevById[allInputs[v].id]
+		if ok && (p.repositions == allInputs[v].repositions) && (now > cd.prevTime) {
+			prev[v] = p
+			isSwept[v] = true
+			moved[v] = trk.DofsDist(prev[v].dofs, allInputs[v].dofs)
+			maxMoved = phys.Meters(math.Max(float64(maxMoved), float64(moved[v])))
+		}
+	}
+	cd.sweptPoses = make(map[vehPair][2]track.Pose)
+
+	colliding := make(map[vehPair]bool)
+	for _, ipair := range broadPhasePairs(trk, allInputs, 2*maxMoved) {
+		v0, v1 := ipair.Veh1, ipair.Veh2
+		pair := vehPair{allInputs[v0].id, allInputs[v1].id}
+		_, isOngoing := cd.curCollisions[pair]
+		isPairSwept := isSwept[v0] && isSwept[v1] && !isOngoing
+
+		// Track pieces can overlap in 2D space, ie very different Dofs values can
+		// map to same Cartesian coordinates, such as an overpass. In this case,
+		// the vehicles are NOT colliding.
+		maxDist := pairMaxDimension(allInputs[v0], allInputs[v1])
+		if isPairSwept {
+			maxDist += moved[v0] + moved[v1]
+		}
+		if trk.DofsDist(allInputs[v0].dofs, allInputs[v1].dofs) > maxDist {
+			continue
+		}
 
-			// Track pieces can overlap in 2D space, ie very different Dofs values can
-			// map to same Cartesian coordinates, such as an overpass. In this case,
-			// the vehicles are NOT colliding.
-			maxDim := cd.maxDimension[pair]
-			if trk.DofsDist(allInputs[v0].dofs, allInputs[v1].dofs) > maxDim {
-				delete(cd.curCollisions, pair)
-				continue
+		// vehicles are close => need to do the collision math
+		inputs := [2]vehCollisionInputs{allInputs[v0], allInputs[v1]}
+		isCollision, contact := calcContact(inputs)
+		impactTime := now
+		if isPairSwept {
+			// find the first contact since the last update
+			var isSweptCollision bool
+			var frac float64
+			prevPair := [2]vehCollisionInputs{prev[v0], prev[v1]}
+			isSweptCollision, frac, inputs, contact = sweepContact(trk, prevPair, inputs)
+			if isSweptCollision {
+				impactTime = cd.prevTime + phys.SimTime(frac*float64(now-cd.prevTime))
+				if !isCollision {
+					cd.sweptPoses[pair] = [2]track.Pose{inputs[0].tpose, inputs[1].tpose}
+				}
 			}
+			isCollision = isSweptCollision
+		}
+		if !isCollision {
+			continue
+		}
+		colliding[pair] = true
+		if !isOngoing {
+			newEvent := newCollisionEvent(impactTime, [2]int{pair.Veh1, pair.Veh2}, inputs, contact)
+			cd.curCollisions[pair] = newEvent
+			cd.newCollisions[pair] = newEvent
+			// NOTE: ^^^ will quietly replace any existing "newCollision" for the pair
+		}
+		// For non-new collisions, do NOT update curCollisions, to preserve the
+		// initial time of impact.
+	}
 
-			// vehicles are close => need to do the collision math
-			poiInputs := [2]vehCollisionInputs{allInputs[v0], allInputs[v1]}
-			isCollision, absPOI := calcPointOfImpact(poiInputs)
-			if isCollision {
-				if _, ok := cd.curCollisions[pair]; !ok {
-					// Convert absolute Cartesian point into vehicle-relative point for
-					// each vehicle
-					var vehInfo [2]VehicleCollisionInfo
-					impactPose := phys.Pose{Point: absPOI, Theta: 0}
-					vehInfo[0].POI = impactPose.RelativeTo(allInputs[v0].pose).Point
-					vehInfo[1].POI = impactPose.RelativeTo(allInputs[v1].pose).Point
-					vehInfo[0].Id = v0
-					vehInfo[1].Id = v1
-
-					newEvent := CollisionEvent{
-						ImpactTime: now,
-						VehInfo:    vehInfo,
-					}
-					cd.curCollisions[pair] = newEvent
-					cd.newCollisions[pair] = newEvent
-					// NOTE: ^^^ will quietly replace any existing "newCollision" for the pair
-				}
-				// For non-new collisions, do NOT update curCollisions, to preserve the
-				// initial time of impact.
+	// pairs that are not colliding at this moment
+	for pair := range cd.curCollisions {
+		if !colliding[pair] {
+			delete(cd.curCollisions, pair)
+		}
+	}
+	cd.prevInputs = allInputs
+	cd.prevTime = now
+}
+
+const (
+	maxSweepSteps       = 64 // per update, before bisection
+	sweepBisectionSteps = 10
+)
+
+// sweepContact looks for the first contact between two vehicles as they move
+// from their prev poses (frac=0) to their cur poses (frac=1). The track poses
+// are interpolated, so that vehicles follow the curves of the road. It returns
+// the frac of first contact, and the inputs and contact at that moment.
+func sweepContact(trk *track.Track, prev, cur [2]vehCollisionInputs) (bool, float64, [2]vehCollisionInputs, collisionContact) {
+	// step size is a fraction of the smallest vehicle dimension, so that the
+	// vehicles cannot skip past each other between steps
+	relMove := 0.0
+	minDim := math.Inf(1)
+	for i := range cur {
+		relMove += float64(trk.DofsDist(prev[i].dofs, cur[i].dofs))
+		relMove += math.Abs(float64(cur[i].tpose.Cofs - prev[i].tpose.Cofs))
+		minDim = math.Min(minDim, math.Min(float64(cur[i].len), float64(cur[i].width)))
+	}
+	steps := int(math.Ceil(relMove / (minDim / 2)))
+	if steps < 1 {
+		steps = 1
+	} else if steps > maxSweepSteps {
+		steps = maxSweepSteps
+	}
+
+	at := func(frac float64) [2]vehCollisionInputs {
+		var inputs [2]vehCollisionInputs
+		for i := range inputs {
+			inputs[i] = interpCollisionInputs(trk, prev[i], cur[i], frac)
+		}
+		return inputs
+	}
+	lo := 0.0
+	for k := 1; k <= steps; k++ {
+		hi := float64(k) / float64(steps)
+		inputs := at(hi)
+		isCollision, contact := calcContact(inputs)
+		if !isCollision {
+			lo = hi
+			continue
+		}
+		// bisect for the moment of first contact; hi always collides
+		for b := 0; b < sweepBisectionSteps; b++ {
+			mid := (lo + hi) / 2
+			midInputs := at(mid)
+			if ok, midContact := calcContact(midInputs); ok {
+				hi, inputs, contact = mid, midInputs, midContact
 			} else {
-				// not colliding at this moment
-				delete(cd.curCollisions, pair)
-				continue
+				lo = mid
 			}
 		}
+		return true, hi, inputs, contact
 	}
+	return false, 0, cur, collisionContact{}
+}
+
+// interpCollisionInputs interpolates a vehicle's collision inputs along the
+// track, from in0 (frac=0) to in1 (frac=1).
+func interpCollisionInputs(trk *track.Track, in0, in1 vehCollisionInputs, frac float64) vehCollisionInputs {
+	p0, p1 := in0.tpose, in1.tpose
+	ddofs := float64(p1.Dofs - p0.Dofs)
+	if half := float64(trk.CenLen()) / 2; ddofs > half {
+		ddofs -= float64(trk.CenLen())
+	} else if ddofs < -half {
+		ddofs += float64(trk.CenLen())
+	}
+	tp := track.Pose{
+		Point: track.Point{
+			Dofs: trk.NormalizeDofs(p0.Dofs + phys.Meters(frac*ddofs)),
+			Cofs: p0.Cofs + phys.Meters(frac*float64(p1.Cofs-p0.Cofs)),
+		},
+		DAngle: p0.DAngle + phys.Radians(frac*float64(phys.NormalizeRadians(p1.DAngle-p0.DAngle))),
+	}
+	in := in1
+	in.dofs = tp.Dofs
+	in.tpose = tp
+	in.pose = trk.ToPose(tp)
+	in.vel = phys.Point{
+		X: in0.vel.X + phys.Meters(frac)*(in1.vel.X-in0.vel.X),
+		Y: in0.vel.Y + phys.Meters(frac)*(in1.vel.Y-in0.vel.Y),
+	}
+	return in
+}
+
+// pairMaxDimension is the largest length or width of two vehicles. Vehicles
+// that are further apart than this along the track cannot be colliding.
+func pairMaxDimension(in0, in1 vehCollisionInputs) phys.Meters {
+	lmax := math.Max(float64(in0.len), float64(in1.len))
+	wmax := math.Max(float64(in0.width), float64(in1.width))
+	return phys.Meters(math.Max(lmax, wmax))
+}
+
+// broadPhasePairs returns the vehicle pairs that may be colliding, ie are within
+// the largest vehicle dimension (plus margin) of each other along the track,
+// with Veh1<Veh2. NOTE: The pairs are indices into allInputs, not Ids.
+// The vehicles are sorted by Dofs, and each one is only paired with the
+// vehicles ahead of it in the sort order (wrapping around the finish line) up
+// to that distance. The cost is O(n*log(n) + k), for n vehicles and k pairs.
+func broadPhasePairs(trk *track.Track, allInputs []vehCollisionInputs, margin phys.Meters) []vehPair {
+	n := len(allInputs)
+	pairs := make([]vehPair, 0)
+	if n < 2 {
+		return pairs
+	}
+
+	maxDim := phys.Meters(0)
+	for _, in := range allInputs {
+		maxDim = phys.Meters(math.Max(float64(maxDim), math.Max(float64(in.len), float64(in.width))))
+	}
+	maxDim += margin
+	order := make([]int, n)
+	dofs := make([]phys.Meters, n)
+	for v := range allInputs {
+		order[v] = v
+		dofs[v] = trk.NormalizeDofs(allInputs[v].dofs)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return (dofs[order[i]] < dofs[order[j]]) || ((dofs[order[i]] == dofs[order[j]]) && (order[i] < order[j]))
+	})
+
+	// A pair can be found from both ends when maxDim is more than half of the
+	// track length.
+	seen := make(map[vehPair]bool)
+	for i, v0 := range order {
+		for k := 1; k < n; k++ {
+			v1 := order[(i+k)%n]
+			ahead := dofs[v1] - dofs[v0]
+			if (ahead < 0) || ((ahead == 0) && (i+k >= n)) {
+				ahead += trk.CenLen()
+			}
+			if ahead > maxDim {
+				break
+			}
+			pair := vehPair{v0, v1}
+			if v1 < v0 {
+				pair = vehPair{v1, v0}
+			}
+			if !seen[pair] {
+				seen[pair] = true
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return (pairs[i].Veh1 < pairs[j].Veh1) || ((pairs[i].Veh1 == pairs[j].Veh1) && (pairs[i].Veh2 < pairs[j].Veh2))
+	})
+	return pairs
+}
+
+// collisionContact describes how two colliding rectangles touch.
+type collisionContact struct {
+	poi    phys.Point  // absolute Cartesian
+	normal phys.Point  // unit vector, from inputs[0] towards inputs[1]
+	depth  phys.Meters // overlap along normal
+}
+
+// collisionEpsilon lets rectangles that touch, give or take floating point
+// error, count as colliding.
+const collisionEpsilon = 1.0e-9
+
+// newCollisionEvent fills in a CollisionEvent for a new collision between the
+// vehicles with ids.
+func newCollisionEvent(now phys.SimTime, ids [2]int, inputs [2]vehCollisionInputs, contact collisionContact) CollisionEvent {
+	// Convert absolute Cartesian point into vehicle-relative point for each
+	// vehicle
+	var vehInfo [2]VehicleCollisionInfo
+	impactPose := phys.Pose{Point: contact.poi, Theta: 0}
+	toOther := [2]phys.Point{contact.normal, scalePoint(contact.normal, -1)}
+	for i := range vehInfo {
+		vehInfo[i].Id = ids[i]
+		vehInfo[i].POI = impactPose.RelativeTo(inputs[i].pose).Point
+		vehInfo[i].Side = collisionSide(inputs[i], toOther[i])
+	}
+	relVel := phys.Point{X: inputs[0].vel.X - inputs[1].vel.X, Y: inputs[0].vel.Y - inputs[1].vel.Y}
+	return CollisionEvent{
+		ImpactTime:   now,
+		VehInfo:      vehInfo,
+		Normal:       contact.normal,
+		ClosingSpeed: phys.MetersPerSec(dotPoints(relVel, contact.normal)),
+		Penetration:  contact.depth,
+	}
+}
+
+// collisionSide classifies which side of a rectangle was hit, given the
+// absolute direction towards the other object. The boundaries between sides
+// are the rectangle's diagonals, so long vehicles have long left/right sides.
+func collisionSide(in vehCollisionInputs, toOther phys.Point) CollisionSide {
+	rel := phys.PolarPoint{R: 1, A: toOther.ToPolarPoint().A - in.pose.Theta}.ToPoint()
+	if (math.Abs(float64(rel.X)) * float64(in.width)) >= (math.Abs(float64(rel.Y)) * float64(in.len)) {
+		if rel.X >= 0 {
+			return CollisionFront
+		}
+		return CollisionRear
+	}
+	if rel.Y >= 0 {
+		return CollisionLeft
+	}
+	return CollisionRight
 }
 
 // calcPointOfImpact determines if two vehicles are colliding, based on their
@@ -210,72 +542,129 @@ func (cd *CollisionDetector) updateHelper(now phys.SimTime, trk *track.Track, al
 //   - Not colliding => returns false with invalid phys.Point
 //   -     Colliding => returns true  with   valid phys.Point
 func calcPointOfImpact(inputs [2]vehCollisionInputs) (bool, phys.Point) {
-	// Collision detect algorithm:
-	// - A vehicles is modeled as a rectangle
-	// - Check if any of the four corners of one vehicle is inside the other vehicle
-
-	collisionPoints := make([]phys.Point, 0)
-	for rv := 0; rv < 2; rv++ { // rv = index of the "Reference" vehicle
-		ov := (rv + 1) % 2 //        ov = index of the "Other"     vehicle
+	isCollision, contact := calcContact(inputs)
+	return isCollision, contact.poi
+}
 
-		// Abs = calculate the Other vehicle's four corner points, in absolute
-		// Cartesian frame of reference
-		ovHalfLen := inputs[ov].len / 2
-		ovHalfWid := inputs[ov].width / 2
-		ovCornersAbs := []phys.Point{
-			inputs[ov].pose.AdvancePose(phys.Pose{Point: phys.Point{X: +ovHalfLen, Y: +ovHalfWid}, Theta: 0}).Point, // front L
-			inputs[ov].pose.AdvancePose(phys.Pose{Point: phys.Point{X: +ovHalfLen, Y: -ovHalfWid}, Theta: 0}).Point, // front R
-			inputs[ov].pose.AdvancePose(phys.Pose{Point: phys.Point{X: -ovHalfLen, Y: +ovHalfWid}, Theta: 0}).Point, // back  L
-			inputs[ov].pose.AdvancePose(phys.Pose{Point: phys.Point{X: -ovHalfLen, Y: -ovHalfWid}, Theta: 0}).Point, // back  R
+// calcContact determines if two vehicles are colliding, and if so, how they
+// touch.
+func calcContact(inputs [2]vehCollisionInputs) (bool, collisionContact) {
+	// Collision detect algorithm:
+	// - A vehicle is modeled as a rectangle
+	// - Separating axis test: two rectangles are not colliding iff their
+	//   projections onto one of the four edge normals do not overlap. The axis
+	//   with the least overlap gives the normal and penetration depth.
+	axes := [4]phys.Point{}
+	for i := range inputs {
+		u, v := rectAxes(inputs[i].pose)
+		axes[2*i], axes[2*i+1] = u, v
+	}
+	ctrDelta := phys.Point{X: inputs[1].pose.X - inputs[0].pose.X, Y: inputs[1].pose.Y - inputs[0].pose.Y}
+	contact := collisionContact{depth: phys.Meters(math.Inf(1))}
+	for _, axis := range axes {
+		dist := dotPoints(ctrDelta, axis)
+		overlap := rectRadius(inputs[0], axis) + rectRadius(inputs[1], axis) - math.Abs(dist)
+		if overlap < -collisionEpsilon {
+			return false, collisionContact{}
 		}
-		// for _, corner := range ovCornersAbs {
-		// 	fmt.Printf("ov=%v => ovCornersAbs=%s\n", ov, corner.String())
-		// }
-
-		// Rel = calculate the Other vehicle's four corner points, in Cartesian
-		// frame of reference relative to the Reference vehicle
-		ovCornersRel := make([]phys.Point, 4)
-		for i, cp := range ovCornersAbs {
-			cpose := phys.Pose{Point: cp, Theta: 0}
-			ovCornersRel[i] = cpose.RelativeTo(inputs[rv].pose).Point
+		if overlap < float64(contact.depth) {
+			contact.depth = phys.Meters(math.Max(overlap, 0))
+			contact.normal = axis
+			if dist < 0 {
+				contact.normal = scalePoint(axis, -1)
+			}
 		}
-		// for _, corner := range ovCornersRel {
-		// 	fmt.Printf("ov=%v => ovCornersRel=%s\n", ov, corner.String())
-		// }
+	}
 
-		// Determine which of the Other vehicle's four corners are inside the
-		// Reference vehicle's rectangle
+	// Point of impact:
+	// - The average of the corners of each rectangle that are inside the other
+	// - If there are none, the rectangles cross each other, eg in an X => the
+	//   average of the points where their edges cross
+	// This is not a perfect answer, but is straightforward and should be good
+	// enough.
+	points := make([]phys.Point, 0)
+	for rv := 0; rv < 2; rv++ { // rv = index of the "Reference" vehicle
+		ov := (rv + 1) % 2 //        ov = index of the "Other"     vehicle
 		rvHalfLen := inputs[rv].len / 2
 		rvHalfWid := inputs[rv].width / 2
-		// xstr := fmt.Sprintf("x = [%v %v %v %v %v %v %v %v]", rvHalfLen, rvHalfLen, -rvHalfLen, -rvHalfLen, ovCornersRel[0].X, ovCornersRel[1].X, ovCornersRel[2].X, ovCornersRel[3].X)
-		// ystr := fmt.Sprintf("y = [%v %v %v %v %v %v %v %v]", rvHalfWid, -rvHalfWid, rvHalfWid, -rvHalfWid, ovCornersRel[0].Y, ovCornersRel[1].Y, ovCornersRel[2].Y, ovCornersRel[3].Y)
-		// fmt.Printf("%s\n%s\n", xstr, ystr)  // XXX: quick-and-dirty for Matlab display
-		for i, point := range ovCornersRel {
-			if (point.X > rvHalfLen) || (point.X < -rvHalfLen) ||
-				(point.Y > +rvHalfWid) || (point.Y < -rvHalfWid) {
-				continue
+		for _, corner := range rectCorners(inputs[ov]) {
+			rel := phys.Pose{Point: corner, Theta: 0}.RelativeTo(inputs[rv].pose).Point
+			if (math.Abs(float64(rel.X)) <= float64(rvHalfLen)+collisionEpsilon) &&
+				(math.Abs(float64(rel.Y)) <= float64(rvHalfWid)+collisionEpsilon) {
+				points = append(points, corner)
 			}
-			// Note: record the Abs collision point, not Rel
-			collisionPoints = append(collisionPoints, ovCornersAbs[i])
-			//fmt.Printf("ov=%v, corner=%v, collisionPoint=%v\n", ov, i, ovCornersAbs[i])
 		}
 	}
+	if len(points) == 0 {
+		c0, c1 := rectCorners(inputs[0]), rectCorners(inputs[1])
+		for i := range c0 {
+			for j := range c1 {
+				if ok, p := segmentIntersection(c0[i], c0[(i+1)%4], c1[j], c1[(j+1)%4]); ok {
+					points = append(points, p)
+				}
+			}
+		}
+	}
+	if len(points) == 0 {
+		// degenerate, eg exactly overlapping edges
+		points = append(points, inputs[0].pose.Point, inputs[1].pose.Point)
+	}
+	for _, p := range points {
+		contact.poi.X += p.X
+		contact.poi.Y += p.Y
+	}
+	contact.poi.X /= phys.Meters(len(points))
+	contact.poi.Y /= phys.Meters(len(points))
+
+	return true, contact
+}
+
+// rectAxes returns the unit vectors along a rectangle's length and width.
+func rectAxes(pose phys.Pose) (phys.Point, phys.Point) {
+	cos, sin := math.Cos(float64(pose.Theta)), math.Sin(float64(pose.Theta))
+	return phys.Point{X: phys.Meters(cos), Y: phys.Meters(sin)}, phys.Point{X: phys.Meters(-sin), Y: phys.Meters(cos)}
+}
 
-	if len(collisionPoints) == 0 {
-		return false, phys.Point{X: 0, Y: 0}
+// rectRadius is half of the length of a rectangle's projection onto axis.
+func rectRadius(in vehCollisionInputs, axis phys.Point) float64 {
+	u, v := rectAxes(in.pose)
+	return (float64(in.len/2) * math.Abs(dotPoints(u, axis))) + (float64(in.width/2) * math.Abs(dotPoints(v, axis)))
+}
+
+// rectCorners returns a rectangle's corners, in order around the rectangle.
+func rectCorners(in vehCollisionInputs) [4]phys.Point {
+	halfLen := in.len / 2
+	halfWid := in.width / 2
+	return [4]phys.Point{
+		in.pose.AdvancePose(phys.Pose{Point: phys.Point{X: +halfLen, Y: +halfWid}, Theta: 0}).Point, // front L
+		in.pose.AdvancePose(phys.Pose{Point: phys.Point{X: +halfLen, Y: -halfWid}, Theta: 0}).Point, // front R
+		in.pose.AdvancePose(phys.Pose{Point: phys.Point{X: -halfLen, Y: -halfWid}, Theta: 0}).Point, // back  R
+		in.pose.AdvancePose(phys.Pose{Point: phys.Point{X: -halfLen, Y: +halfWid}, Theta: 0}).Point, // back  L
 	}
+}
 
-	// There may be >1 collision point. If so, the "net" collision point (absolute
-	// Cartesian space) applies to both vehicles and is simply the average of all
-	// detected collision points. This is not a perfect answer, but is
-	// straightforward and should be good enough.
-	collisionPoint := phys.Point{X: 0, Y: 0}
-	for _, cp := range collisionPoints {
-		collisionPoint.X += cp.X
-		collisionPoint.Y += cp.Y
+// segmentIntersection returns the point where segments a1-a2 and b1-b2 cross.
+// Parallel segments do not cross.
+func segmentIntersection(a1, a2, b1, b2 phys.Point) (bool, phys.Point) {
+	da := phys.Point{X: a2.X - a1.X, Y: a2.Y - a1.Y}
+	db := phys.Point{X: b2.X - b1.X, Y: b2.Y - b1.Y}
+	denom := float64(da.X*db.Y - da.Y*db.X)
+	if math.Abs(denom) < collisionEpsilon*collisionEpsilon {
+		return false, phys.Point{}
+	}
+	ab := phys.Point{X: b1.X - a1.X, Y: b1.Y - a1.Y}
+	ta := float64(ab.X*db.Y-ab.Y*db.X) / denom
+	tb := float64(ab.X*da.Y-ab.Y*da.X) / denom
+	if (ta < 0) || (ta > 1) || (tb < 0) || (tb > 1) {
+		return false, phys.Point{}
 	}
-	collisionPoint.X /= phys.Meters(len(collisionPoints))
-	collisionPoint.Y /= phys.Meters(len(collisionPoints))
+	return true, phys.Point{X: a1.X + phys.Meters(ta)*da.X, Y: a1.Y + phys.Meters(ta)*da.Y}
+}
+
+func dotPoints(p1, p2 phys.Point) float64 {
+	return float64(p1.X*p2.X + p1.Y*p2.Y)
+}
 
-	return true, collisionPoint
+func scalePoint(p phys.Point, k float64) phys.Point {
+	return phys.Point{X: p.X * phys.Meters(k), Y: p.Y * phys.Meters(k)}
 }
@@ -6,9 +6,12 @@ package robo
 import (
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
 )
 
 //////////////////////////////////////////////////////////////////////
@@ -199,3 +202,313 @@ func TestCollisionCalcPointOfImpact(t *testing.T) {
 		}
 	}
 }
+
+// contactTestVec is one vehicle 1 placement, relative to vehicle 0 at the
+// origin with Theta=0, and the expected collision event details.
+type contactTestVec struct {
+	name        string
+	len0, wid0  phys.Meters
+	len1, wid1  phys.Meters
+	x1, y1      phys.Meters
+	t1          phys.Radians
+	isCollision bool
+	sides       [2]CollisionSide
+	normal      phys.Point
+	depth       phys.Meters
+}
+
+func TestCollisionCalcContact(t *testing.T) {
+	const truckLen, truckWid = 0.240, 0.044
+	testTable := []contactTestVec{
+		{"rear-end", veh0Len, veh0Wid, veh1Len, veh1Wid, (veh0Len+veh1Len)/2 - 0.01, 0.005, 0, true,
+			[2]CollisionSide{CollisionFront, CollisionRear}, phys.Point{X: 1, Y: 0}, 0.01},
+		{"head-on", veh0Len, veh0Wid, veh1Len, veh1Wid, (veh0Len+veh1Len)/2 - 0.01, 0.005, math.Pi, true,
+			[2]CollisionSide{CollisionFront, CollisionFront}, phys.Point{X: 1, Y: 0}, 0.01},
+		{"rear", veh0Len, veh0Wid, veh1Len, veh1Wid, -(veh0Len+veh1Len)/2 + 0.01, 0.005, 0, true,
+			[2]CollisionSide{CollisionRear, CollisionFront}, phys.Point{X: -1, Y: 0}, 0.01},
+		{"t-bone left", veh0Len, veh0Wid, veh1Len, veh1Wid, 0.03, veh0Wid/2 + veh1Len/2 - 0.005, -math.Pi / 2, true,
+			[2]CollisionSide{CollisionLeft, CollisionFront}, phys.Point{X: 0, Y: 1}, 0.005},
+		{"t-bone right", veh0Len, veh0Wid, veh1Len, veh1Wid, -0.03, -veh0Wid/2 - veh1Len/2 + 0.005, math.Pi / 2, true,
+			[2]CollisionSide{CollisionRight, CollisionFront}, phys.Point{X: 0, Y: -1}, 0.005},
+		{"side-by-side", veh0Len, veh0Wid, veh1Len, veh1Wid, 0.05, (veh0Wid+veh1Wid)/2 - 0.002, 0, true,
+			[2]CollisionSide{CollisionLeft, CollisionRight}, phys.Point{X: 0, Y: 1}, 0.002},
+		{"apart", veh0Len, veh0Wid, veh1Len, veh1Wid, 0.05, (veh0Wid+veh1Wid)/2 + 0.002, 0, false,
+			[2]CollisionSide{}, phys.Point{}, 0},
+		{"touching", veh0Len, veh0Wid, veh1Len, veh1Wid, (veh0Len + veh1Len) / 2, 0, 0, true,
+			[2]CollisionSide{CollisionFront, CollisionRear}, phys.Point{X: 1, Y: 0}, 0},
+		// no corner of either truck is inside the other
+		{"trucks in an X", truckLen, truckWid, truckLen, truckWid, 0, 0.01, math.Pi / 2, true,
+			[2]CollisionSide{CollisionLeft, CollisionRear}, phys.Point{X: 0, Y: 1}, truckWid/2 + truckLen/2 - 0.01},
+	}
+
+	for _, vec := range testTable {
+		inputs := [2]vehCollisionInputs{
+			vehCollisionInputs{pose: phys.Pose{}, len: vec.len0, width: vec.wid0},
+			vehCollisionInputs{pose: phys.Pose{Point: phys.Point{X: vec.x1, Y: vec.y1}, Theta: vec.t1}, len: vec.len1, width: vec.wid1},
+		}
+		isCollision, contact := calcContact(inputs)
+		testEqual(t, vec.name+" isCollision", vec.isCollision, isCollision)
+		if !isCollision {
+			continue
+		}
+		ce := newCollisionEvent(0, [2]int{0, 1}, inputs, contact)
+		for i := range ce.VehInfo {
+			testEqual(t, fmt.Sprintf("%s VehInfo[%d].Side", vec.name, i), vec.sides[i], ce.VehInfo[i].Side)
+		}
+		testMetersAreNear(t, vec.name+" Normal.X", vec.normal.X, ce.Normal.X)
+		testMetersAreNear(t, vec.name+" Normal.Y", vec.normal.Y, ce.Normal.Y)
+		testMetersAreNear(t, vec.name+" Penetration", vec.depth, ce.Penetration)
+	}
+
+	// the POI of trucks in an X is where their edges cross
+	inputs := [2]vehCollisionInputs{
+		vehCollisionInputs{pose: phys.Pose{}, len: truckLen, width: truckWid},
+		vehCollisionInputs{pose: phys.Pose{Theta: math.Pi / 2}, len: truckLen, width: truckWid},
+	}
+	isCollision, poi := calcPointOfImpact(inputs)
+	testEqual(t, "X isCollision", true, isCollision)
+	testMetersAreNear(t, "X POI.X", 0, poi.X)
+	testMetersAreNear(t, "X POI.Y", 0, poi.Y)
+}
+
+func TestCollisionClosingSpeed(t *testing.T) {
+	// vehicle 0 runs into the back of a slower vehicle 1
+	inputs := [2]vehCollisionInputs{
+		vehCollisionInputs{pose: phys.Pose{}, len: veh0Len, width: veh0Wid, vel: phys.Point{X: 1.0, Y: 0}},
+		vehCollisionInputs{pose: phys.Pose{Point: phys.Point{X: 0.15, Y: 0.005}}, len: veh1Len, width: veh1Wid, vel: phys.Point{X: 0.2, Y: 0}},
+	}
+	isCollision, contact := calcContact(inputs)
+	testEqual(t, "isCollision", true, isCollision)
+	ce := newCollisionEvent(0, [2]int{0, 1}, inputs, contact)
+	if !phys.MetersPerSecAreNear(0.8, ce.ClosingSpeed, 1.0e-6) {
+		t.Errorf("ClosingSpeed exp=0.8, got=%v", ce.ClosingSpeed)
+	}
+
+	// swapping the vehicles flips the normal, but not the closing speed
+	inputs[0], inputs[1] = inputs[1], inputs[0]
+	_, contact = calcContact(inputs)
+	ce = newCollisionEvent(0, [2]int{1, 0}, inputs, contact)
+	if !phys.MetersPerSecAreNear(0.8, ce.ClosingSpeed, 1.0e-6) {
+		t.Errorf("swapped ClosingSpeed exp=0.8, got=%v", ce.ClosingSpeed)
+	}
+	testMetersAreNear(t, "swapped Normal.X", -1, ce.Normal.X)
+}
+
+func TestCollisionIsSideCollision(t *testing.T) {
+	testTable := []struct {
+		vci                      VehicleCollisionInfo
+		front, rear, left, right bool
+	}{
+		// Side is known
+		{VehicleCollisionInfo{Side: CollisionFront}, true, false, false, false},
+		{VehicleCollisionInfo{Side: CollisionRear}, false, true, false, false},
+		{VehicleCollisionInfo{Side: CollisionLeft}, false, false, true, false},
+		{VehicleCollisionInfo{Side: CollisionRight}, false, false, false, true},
+		// Side is unknown => angle of the POI
+		{VehicleCollisionInfo{POI: phys.Point{X: +0.04, Y: +0.001}}, true, false, false, false},
+		{VehicleCollisionInfo{POI: phys.Point{X: -0.04, Y: +0.001}}, false, true, false, false},
+		{VehicleCollisionInfo{POI: phys.Point{X: -0.04, Y: -0.001}}, false, true, false, false},
+		{VehicleCollisionInfo{POI: phys.Point{X: +0.001, Y: +0.02}}, false, false, true, false},
+		{VehicleCollisionInfo{POI: phys.Point{X: -0.001, Y: -0.02}}, false, false, false, true},
+	}
+	for i, vec := range testTable {
+		tag := fmt.Sprintf("Vec %d (%v, %v)", i, vec.vci.Side, vec.vci.POI)
+		testEqual(t, tag+" front", vec.front, vec.vci.IsFrontCollision())
+		testEqual(t, tag+" rear", vec.rear, vec.vci.IsRearCollision())
+		testEqual(t, tag+" left", vec.left, vec.vci.IsLeftSideCollision())
+		testEqual(t, tag+" right", vec.right, vec.vci.IsRightSideCollision())
+	}
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// randomFleetInputs places n vehicles at random on the track, in random lanes
+// and directions.
+func randomFleetInputs(trk *track.Track, n int, seed int64) []vehCollisionInputs {
+	rng := rand.New(rand.NewSource(seed))
+	inputs := make([]vehCollisionInputs, n)
+	for v := range inputs {
+		tp := track.Pose{
+			Point: track.Point{
+				Dofs: phys.Meters(rng.Float64()) * trk.CenLen(),
+				Cofs: phys.Meters(rng.Float64()-0.5) * trk.Width(),
+			},
+			DAngle: phys.Radians(rng.Intn(2)) * math.Pi,
+		}
+		inputs[v] = vehCollisionInputs{
+			id:    v,
+			dofs:  tp.Dofs,
+			pose:  trk.ToPose(tp),
+			len:   phys.Meters(0.06 + 0.04*rng.Float64()),
+			width: phys.Meters(0.03 + 0.02*rng.Float64()),
+		}
+	}
+	return inputs
+}
+
+// bruteForceCollisions checks every vehicle pair, as the detector did before
+// it had a broad phase.
+func bruteForceCollisions(trk *track.Track, allInputs []vehCollisionInputs) map[vehPair]phys.Point {
+	collisions := make(map[vehPair]phys.Point)
+	for v0 := range allInputs {
+		for v1 := v0 + 1; v1 < len(allInputs); v1++ {
+			if trk.DofsDist(allInputs[v0].dofs, allInputs[v1].dofs) > pairMaxDimension(allInputs[v0], allInputs[v1]) {
+				continue
+			}
+			if isCollision, poi := calcPointOfImpact([2]vehCollisionInputs{allInputs[v0], allInputs[v1]}); isCollision {
+				collisions[vehPair{v0, v1}] = poi
+			}
+		}
+	}
+	return collisions
+}
+
+func TestCollisionBroadPhaseMatchesBruteForce(t *testing.T) {
+	trk := newTestTrack(t)
+	for _, n := range []int{0, 1, 2, 10, 100, 400} {
+		for seed := int64(0); seed < 5; seed++ {
+			inputs := randomFleetInputs(trk, n, seed)
+			exp := bruteForceCollisions(trk, inputs)
+			cd := NewCollisionDetector(trk, &[]Vehicle{})
+			cd.updateHelper(0, trk, inputs)
+			got := cd.CurCollisions()
+			testEqual(t, fmt.Sprintf("n=%d seed=%d collisions", n, seed), len(exp), len(got))
+			for _, ce := range got {
+				pair := vehPair{ce.VehInfo[0].Id, ce.VehInfo[1].Id}
+				if _, ok := exp[pair]; !ok {
+					t.Errorf("n=%d seed=%d: unexpected collision %v", n, seed, pair)
+				}
+			}
+		}
+	}
+
+	// vehicles on either side of the finish line
+	inputs := randomFleetInputs(trk, 2, 0)
+	for v, dofs := range []phys.Meters{trk.CenLen() - 0.02, 0.02} {
+		tp := track.Pose{Point: track.Point{Dofs: dofs, Cofs: 0}}
+		inputs[v] = vehCollisionInputs{id: v, dofs: dofs, pose: trk.ToPose(tp), len: 0.08, width: 0.04}
+	}
+	cd := NewCollisionDetector(trk, &[]Vehicle{})
+	cd.updateHelper(0, trk, inputs)
+	testEqual(t, "finish line collisions", 1, len(cd.CurCollisions()))
+
+	// collisions end when the fleet shrinks
+	cd.updateHelper(1, trk, inputs[:1])
+	testEqual(t, "shrunk fleet collisions", 0, len(cd.CurCollisions()))
+}
+
+func TestCollisionBroadPhasePairs(t *testing.T) {
+	trk := newTestTrack(t)
+	inputs := randomFleetInputs(trk, 200, 1)
+	pairs := broadPhasePairs(trk, inputs, 0)
+	if !sort.SliceIsSorted(pairs, func(i, j int) bool {
+		return (pairs[i].Veh1 < pairs[j].Veh1) || ((pairs[i].Veh1 == pairs[j].Veh1) && (pairs[i].Veh2 < pairs[j].Veh2))
+	}) {
+		t.Errorf("pairs are not sorted")
+	}
+	seen := make(map[vehPair]bool)
+	for _, pair := range pairs {
+		if (pair.Veh1 >= pair.Veh2) || seen[pair] {
+			t.Errorf("pair %v is invalid or repeated", pair)
+		}
+		seen[pair] = true
+	}
+	if len(pairs) >= (200 * 199 / 2 / 10) {
+		t.Errorf("broad phase found %d candidate pairs; expected far fewer than all pairs", len(pairs))
+	}
+}
+
+// benchmarkCollisions uses a track that is long enough for the n vehicles to
+// drive in traffic, rather than all piled on top of each other.
+func benchmarkCollisions(b *testing.B, n int, detect func(trk *track.Track, inputs []vehCollisionInputs)) {
+	trk, err := track.NewStarterKitTrack(0.2, 0, fmt.Sprintf("capsule_%d", 1+(n/4)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	inputs := randomFleetInputs(trk, n, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		detect(trk, inputs)
+	}
+}
+
+func benchmarkBruteForce(b *testing.B, n int) {
+	benchmarkCollisions(b, n, func(trk *track.Track, inputs []vehCollisionInputs) {
+		bruteForceCollisions(trk, inputs)
+	})
+}
+
+func benchmarkBroadPhase(b *testing.B, n int) {
+	cd := NewCollisionDetector(nil, &[]Vehicle{})
+	benchmarkCollisions(b, n, func(trk *track.Track, inputs []vehCollisionInputs) {
+		cd.updateHelper(0, trk, inputs)
+	})
+}
+
+func BenchmarkCollisionBruteForce10(b *testing.B)  { benchmarkBruteForce(b, 10) }
+func BenchmarkCollisionBruteForce100(b *testing.B) { benchmarkBruteForce(b, 100) }
+func BenchmarkCollisionBruteForce500(b *testing.B) { benchmarkBruteForce(b, 500) }
+func BenchmarkCollisionBroadPhase10(b *testing.B)  { benchmarkBroadPhase(b, 10) }
+func BenchmarkCollisionBroadPhase100(b *testing.B) { benchmarkBroadPhase(b, 100) }
+func BenchmarkCollisionBroadPhase500(b *testing.B) { benchmarkBroadPhase(b, 500) }
+
+//////////////////////////////////////////////////////////////////////
+
+// headOnInputs places two vehicles head-on on a straight part of the track.
+func headOnInputs(trk *track.Track, dofs0, dofs1 phys.Meters) []vehCollisionInputs {
+	tps := []track.Pose{
+		track.Pose{Point: track.Point{Dofs: dofs0, Cofs: 0}, DAngle: 0},
+		track.Pose{Point: track.Point{Dofs: dofs1, Cofs: 0}, DAngle: math.Pi},
+	}
+	inputs := make([]vehCollisionInputs, len(tps))
+	for v, tp := range tps {
+		inputs[v] = vehCollisionInputs{id: v, dofs: tp.Dofs, pose: trk.ToPose(tp), len: veh1Len, width: veh1Wid, tpose: tp}
+	}
+	return inputs
+}
+
+func TestCollisionSwept(t *testing.T) {
+	trk := newTestTrack(t)
+	const dt = 100 * phys.SimMillisecond
+
+	// in one update, the vehicles drive right through each other
+	cd := NewCollisionDetector(trk, &[]Vehicle{})
+	cd.updateHelper(0, trk, headOnInputs(trk, 1.6, 1.9))
+	testEqual(t, "collisions before", 0, len(cd.CurCollisions()))
+	cd.updateHelper(dt, trk, headOnInputs(trk, 1.9, 1.6))
+	ces := cd.NewCollisions()
+	testEqual(t, "swept collisions", 1, len(ces))
+	testEqual(t, "ongoing swept collisions", 1, len(cd.CurCollisions()))
+
+	// each vehicle drove 0.3m in dt; they touch when their centers are one
+	// vehicle length apart
+	expImpactTime := float64(dt) * (0.3 - veh1Len) / 0.6
+	if math.Abs(float64(ces[0].ImpactTime)-expImpactTime) > float64(phys.SimMillisecond) {
+		t.Errorf("ImpactTime exp=%v, got=%v", phys.SimTime(expImpactTime), ces[0].ImpactTime)
+	}
+	testEqual(t, "side 0", CollisionFront, ces[0].VehInfo[0].Side)
+	testEqual(t, "side 1", CollisionFront, ces[0].VehInfo[1].Side)
+	testMetersAreNear(t, "impact dofs", phys.Meters(1.75-veh1Len/2), cd.sweptPoses[vehPair{0, 1}][0].Dofs)
+
+	// the swept collision ends on the next update
+	cd.updateHelper(2*dt, trk, headOnInputs(trk, 1.9, 1.6))
+	testEqual(t, "collisions after", 0, len(cd.CurCollisions()))
+
+	// repositioned vehicles jump, rather than drive
+	cd = NewCollisionDetector(trk, &[]Vehicle{})
+	cd.updateHelper(0, trk, headOnInputs(trk, 1.6, 1.9))
+	inputs := headOnInputs(trk, 1.9, 1.6)
+	inputs[1].repositions++
+	cd.updateHelper(dt, trk, inputs)
+	testEqual(t, "repositioned collisions", 0, len(cd.CurCollisions()))
+
+	// a collision that is still ongoing gets the interpolated impact time too
+	cd = NewCollisionDetector(trk, &[]Vehicle{})
+	cd.updateHelper(0, trk, headOnInputs(trk, 1.6, 1.9))
+	cd.updateHelper(dt, trk, headOnInputs(trk, 1.74, 1.76))
+	ces = cd.CurCollisions()
+	testEqual(t, "overlapping collisions", 1, len(ces))
+	if (ces[0].ImpactTime <= 0) || (ces[0].ImpactTime >= dt) {
+		t.Errorf("ImpactTime=%v should be between updates", ces[0].ImpactTime)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// Physical response to vehicle collisions. Vehicles are constrained to the
+// road, so the response is modeled in track coordinates: along the road (Dofs)
+// for front/rear impacts, and across it (Cofs) for side impacts.
+
+package robo
+
+import (
+	"math"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// CollisionResponseParams tunes the CollisionResponder.
+type CollisionResponseParams struct {
+	// Restitution is the fraction of the closing speed that remains as
+	// separating speed after an impact; 0 => the vehicles move together, 1 =>
+	// perfectly elastic.
+	Restitution float64
+
+	// SidePush is how far a side impact pushes a vehicle's center offset, per
+	// unit of closing speed, ie in seconds. The vehicle then drives back to
+	// its commanded center offset.
+	SidePush float64
+
+	// A vehicle whose speed changes by at least StallDeltaV in one impact
+	// stalls for StallTime; by at least SpinDeltaV, it also spins around to
+	// face the opposite direction. 0 => never.
+	StallDeltaV phys.MetersPerSec
+	StallTime   phys.SimTime
+	SpinDeltaV  phys.MetersPerSec
+}
+
+// DefaultCollisionResponseParams returns parameters for mildly bouncy
+// collisions, where only severe hits stall or spin a vehicle.
+func DefaultCollisionResponseParams() CollisionResponseParams {
+	return CollisionResponseParams{
+		Restitution: 0.3,
+		SidePush:    0.05,
+		StallDeltaV: 0.8,
+		StallTime:   1 * phys.SimSecond,
+		SpinDeltaV:  1.5,
+	}
+}
+
+// CollisionResponder detects vehicle collisions exactly like the
+// CollisionDetector, and then reacts to them: overlapping vehicles are
+// separated, speed is exchanged based on vehicle mass and restitution, side
+// impacts push the center offset, and severe hits stall or spin a vehicle.
+type CollisionResponder struct {
+	*CollisionDetector
+	params       CollisionResponseParams
+	stalledUntil map[int]phys.SimTime // by vehicle Id; missing => not stalled
+}
+
+// NewCollisionResponder creates a new responder suited for the specific trk
+// and set of vehicles.
+func NewCollisionResponder(trk *track.Track, vehs *[]Vehicle, params CollisionResponseParams) *CollisionResponder {
+	return &CollisionResponder{
+		CollisionDetector: NewCollisionDetector(trk, vehs),
+		params:            params,
+		stalledUntil:      make(map[int]phys.SimTime),
+	}
+}
+
+// IsStalled returns true if the vehicle with the Id is stalled from a severe
+// hit.
+func (cr *CollisionResponder) IsStalled(id int) bool {
+	_, ok := cr.stalledUntil[id]
+	return ok
+}
+
+func (cr *CollisionResponder) update(now phys.SimTime, trk *track.Track, vehs *[]Vehicle) {
+	// stalled vehicles are held by the simulator, until the stall is over
+	for id, until := range cr.stalledUntil {
+		v := FindVehicle(*vehs, id)
+		if v < 0 {
+			delete(cr.stalledUntil, id) // the vehicle was removed
+		} else if now >= until {
+			delete(cr.stalledUntil, id)
+			(*vehs)[v].held = false
+		}
+	}
+
+	cr.CollisionDetector.update(now, trk, vehs)
+	moved := make(map[int]bool)
+	for _, pair := range sortedVehPairs(cr.curCollisions) {
+		a, b := &(*vehs)[FindVehicle(*vehs, pair.Veh1)], &(*vehs)[FindVehicle(*vehs, pair.Veh2)]
+		if poses, ok := cr.sweptPoses[pair]; ok {
+			// the vehicles passed through each other => back to where they hit
+			a.curPose, b.curPose = poses[0], poses[1]
+		}
+		cr.respond(now, trk, a, b, pair)
+		moved[pair.Veh1], moved[pair.Veh2] = true, true
+	}
+
+	// the next update sweeps the responding vehicles from where they are now,
+	// not from where the detector saw them
+	cr.refreshInputs(trk, *vehs, moved)
+}
+
+// respond separates two colliding vehicles, along the axis (Dofs or Cofs) with
+// the least overlap, and exchanges their speed along that axis if they are
+// still closing in on each other.
+func (cr *CollisionResponder) respond(now phys.SimTime, trk *track.Track, a, b *Vehicle, pair vehPair) {
+	pa, pb := a.CurTrackPose(), b.CurTrackPose()
+	dd := float64(pb.Dofs - pa.Dofs) // b relative to a, in [-CenLen/2, CenLen/2]
+	if half := float64(trk.CenLen()) / 2; dd > half {
+		dd -= float64(trk.CenLen())
+	} else if dd < -half {
+		dd += float64(trk.CenLen())
+	}
+	dc := float64(pb.Cofs - pa.Cofs)
+	overlapD := float64(a.Length()+b.Length())/2 - math.Abs(dd)
+	overlapC := float64(a.Width()+b.Width())/2 - math.Abs(dc)
+	if (overlapD <= 0) || (overlapC <= 0) {
+		return // eg only the corners of angled vehicles touch
+	}
+
+	// a's share of the response is b's share of the total mass, and vice versa
+	ma, mb := float64(a.Mass()), float64(b.Mass())
+	shareA, shareB := mb/(ma+mb), ma/(ma+mb)
+	e := cr.params.Restitution
+
+	if overlapD < overlapC {
+		// front/rear impact
+		dir := sign(dd) // direction from a to b
+		a.curPose.Dofs = trk.NormalizeDofs(a.curPose.Dofs - phys.Meters(dir*overlapD*shareA))
+		b.curPose.Dofs = trk.NormalizeDofs(b.curPose.Dofs + phys.Meters(dir*overlapD*shareB))
+
+		va, vb := float64(a.curVel.D), float64(b.curVel.D)
+		closing := (va - vb) * dir
+		if closing <= 0 {
+			return
+		}
+		// 1D collision with restitution, in track coordinates
+		vaNew := va - (1+e)*closing*dir*shareA
+		vbNew := vb + (1+e)*closing*dir*shareB
+		cr.setDspd(now, a, pair.Veh1, vaNew, math.Abs(vaNew-va))
+		cr.setDspd(now, b, pair.Veh2, vbNew, math.Abs(vbNew-vb))
+	} else {
+		// side impact
+		dir := sign(dc)
+		closing := math.Max(0, float64(a.curVel.C-b.curVel.C)*dir)
+		if closing == 0 {
+			// eg a lane change was already done; base the push on the speed
+			// difference along the road instead
+			closing = math.Abs(float64(a.curVel.D - b.curVel.D))
+		}
+		pushA := overlapC*shareA + cr.params.SidePush*closing*shareA
+		pushB := overlapC*shareB + cr.params.SidePush*closing*shareB
+		pushCofs(trk, a, -dir*pushA)
+		pushCofs(trk, b, +dir*pushB)
+		cr.checkSevere(now, a, pair.Veh1, closing*shareA)
+		cr.checkSevere(now, b, pair.Veh2, closing*shareB)
+	}
+}
+
+// setDspd sets a vehicle's speed after an impact. Vehicles cannot be pushed
+// backwards, so they stop instead. The vehicle then accelerates back to its
+// commanded speed.
+func (cr *CollisionResponder) setDspd(now phys.SimTime, veh *Vehicle, id int, trackDspd float64, deltaV float64) {
+	dspd := trackDspd
+	if !veh.IsFacingTrackwise() {
+		dspd = -dspd
+	}
+	dspd = math.Max(0, dspd)
+	veh.desDspd = phys.MetersPerSec(dspd)
+	veh.curVel.D = phys.MetersPerSec(math.Copysign(dspd, float64(veh.curVel.D)))
+	cr.checkSevere(now, veh, id, deltaV)
+}
+
+// checkSevere stalls or spins a vehicle after a severe hit.
+func (cr *CollisionResponder) checkSevere(now phys.SimTime, veh *Vehicle, id int, deltaV float64) {
+	p := &cr.params
+	if (p.StallDeltaV <= 0) || (deltaV < float64(p.StallDeltaV)) {
+		return
+	}
+	veh.turn = vehTurn{} // a hit ends any turn
+	if (p.SpinDeltaV > 0) && (deltaV >= float64(p.SpinDeltaV)) {
+		if veh.IsFacingTrackwise() {
+			veh.curPose.DAngle = math.Pi
+		} else {
+			veh.curPose.DAngle = 0
+		}
+	}
+	veh.desDspd = 0
+	veh.curVel = track.Vel{}
+	veh.held = true
+	cr.stalledUntil[id] = now + p.StallTime
+}
+
+// pushCofs moves a vehicle sideways, without changing its commanded center
+// offset.
+func pushCofs(trk *track.Track, veh *Vehicle, delta float64) {
+	halfWidth := float64(trk.Width()) / 2
+	cofs := math.Max(-halfWidth, math.Min(halfWidth, float64(veh.curPose.Cofs)+delta))
+	veh.curPose.Cofs = phys.Meters(cofs)
+	veh.desCofs = phys.Meters(cofs)
+}
+
+func sign(x float64) float64 {
+	if x < 0 {
+		return -1
+	}
+	return 1
+}
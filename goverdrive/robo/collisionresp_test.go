@@ -0,0 +1,152 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+func TestCollisionResponderRearEnd(t *testing.T) {
+	params := DefaultCollisionResponseParams()
+	params.StallDeltaV = 0
+	rsys := newTestSystem(t, nil, newResponder(params), "gs", "sk")
+	q := NewEventQueue(rsys.Events, EvCollisionStart)
+
+	// vehicle 0 drives into the back of stopped vehicle 1
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.70, Cofs: 0}})
+	rsys.Vehicles[1].Reposition(track.Pose{Point: track.Point{Dofs: 1.85, Cofs: 0}})
+	rsys.Vehicles[0].SetCmdDriveDspd(1.0, 100)
+	for i := 0; (i < 100) && (q.Len() == 0); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "collisions", 1, q.Len())
+
+	// equal masses => vehicle 1 gets most of vehicle 0's speed
+	v0, v1 := rsys.Vehicles[0].CurDriveDspd(), rsys.Vehicles[1].CurDriveDspd()
+	if !((v1 > 0.5) && (v0 < 0.5)) {
+		t.Errorf("after impact, speeds are v0=%v, v1=%v", v0, v1)
+	}
+	gap := rsys.Track.DofsDist(rsys.Vehicles[0].CurTrackPose().Dofs, rsys.Vehicles[1].CurTrackPose().Dofs)
+	testMetersAreNear(t, "separated", rsys.Vehicles[0].Length(), gap)
+}
+
+func TestCollisionResponderSide(t *testing.T) {
+	rsys := newTestSystem(t, nil, newResponder(DefaultCollisionResponseParams()), "gs", "sk")
+
+	// vehicle 0 changes lanes into vehicle 1
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.80, Cofs: -0.05}})
+	rsys.Vehicles[1].Reposition(track.Pose{Point: track.Point{Dofs: 1.81, Cofs: 0.0}})
+	rsys.Vehicles[0].SetCmdDriveCofs(0.0, 0.2)
+	for i := 0; i < 20; i++ {
+		rsys.Tick()
+	}
+	if cofs := rsys.Vehicles[1].CurTrackCofs(); cofs < 0.01 {
+		t.Errorf("vehicle 1 was not pushed aside; cofs=%v", cofs)
+	}
+	testEqual(t, "vehicle 1 cmd cofs", phys.Meters(0), rsys.Vehicles[1].CmdTrackCofs())
+}
+
+func TestCollisionResponderSevere(t *testing.T) {
+	rsys := newTestSystem(t, nil, newResponder(DefaultCollisionResponseParams()), "gs", "sk")
+	cr := rsys.Collider.(*CollisionResponder)
+
+	// head-on, fast enough to spin both vehicles around
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.70, Cofs: 0}})
+	rsys.Vehicles[1].Reposition(track.Pose{Point: track.Point{Dofs: 1.90, Cofs: 0}, DAngle: math.Pi})
+	rsys.Vehicles[0].SetCmdDriveDspd(1.2, 100)
+	rsys.Vehicles[1].SetCmdDriveDspd(1.2, 100)
+	for i := 0; (i < 100) && !cr.IsStalled(0); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "veh 0 stalled", true, cr.IsStalled(0))
+	testEqual(t, "veh 1 stalled", true, cr.IsStalled(1))
+	testEqual(t, "veh 0 spun", false, rsys.Vehicles[0].IsFacingTrackwise())
+
+	// stalled vehicles do not move at all, even though they are still
+	// commanded to drive
+	dofs := rsys.Vehicles[0].CurTrackPose().Dofs
+	odom := rsys.Vehicles[0].Odom()
+	for i := 0; cr.IsStalled(0); i++ {
+		if i >= 200 {
+			t.Fatalf("stall did not end")
+		}
+		testEqual(t, fmt.Sprintf("tick %d stalled dofs", i), dofs, rsys.Vehicles[0].CurTrackPose().Dofs)
+		testEqual(t, fmt.Sprintf("tick %d stalled odom", i), odom, rsys.Vehicles[0].Odom())
+		testEqual(t, fmt.Sprintf("tick %d stalled dspd", i), phys.MetersPerSec(0), rsys.Vehicles[0].CurTrackVel().D)
+		rsys.Tick()
+	}
+
+	// then it drives again
+	for i := 0; i < 20; i++ {
+		rsys.Tick()
+	}
+	if rsys.Vehicles[0].Odom() <= odom {
+		t.Errorf("vehicle 0 did not drive after the stall; odom=%v", rsys.Vehicles[0].Odom())
+	}
+}
+
+func TestCollisionResponderSwept(t *testing.T) {
+	rsys := newTestSystem(t, nil, newResponder(DefaultCollisionResponseParams()), "gs", "sk")
+	q := NewEventQueue(rsys.Events, EvCollisionStart)
+
+	// head-on, fast enough to pass through each other in one tick
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.70, Cofs: 0}})
+	rsys.Vehicles[1].Reposition(track.Pose{Point: track.Point{Dofs: 1.90, Cofs: 0}, DAngle: math.Pi})
+	rsys.Tick() // the sweep starts from the poses of the previous tick
+	rsys.Vehicles[0].SetCmdDriveDspd(15, 3000)
+	rsys.Vehicles[1].SetCmdDriveDspd(15, 3000)
+	for i := 0; (i < 10) && (q.Len() == 0); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "collisions", 1, q.Len())
+
+	// the vehicles hit, rather than passed through
+	if rsys.Vehicles[0].CurTrackPose().Dofs >= rsys.Vehicles[1].CurTrackPose().Dofs {
+		t.Errorf("vehicles passed through each other: Dofs=%v, %v",
+			rsys.Vehicles[0].CurTrackPose().Dofs, rsys.Vehicles[1].CurTrackPose().Dofs)
+	}
+}
+
+// TestCollisionResponderSweptNeighbor checks that a vehicle that was moved back
+// to where it hit is swept from there on the next update, rather than from
+// where it passed through, which would sweep it back past its neighbors.
+func TestCollisionResponderSweptNeighbor(t *testing.T) {
+	rsys := newTestSystem(t, nil, newResponder(DefaultCollisionResponseParams()), "gs", "sk", "nk")
+	cr := rsys.Collider.(*CollisionResponder)
+	trk := &rsys.Track
+	const dt = 100 * phys.SimMillisecond
+	place := func(v int, dofs, cofs phys.Meters, dangle phys.Radians) {
+		rsys.Vehicles[v].curPose = track.Pose{Point: track.Point{Dofs: dofs, Cofs: cofs}, DAngle: dangle}
+	}
+
+	// vehicle 2 is just out of the lane of vehicles 0 and 1
+	place(0, 1.60, 0, 0)
+	place(1, 1.90, 0, math.Pi)
+	place(2, 1.94, 0.048, 0)
+	cr.update(0, trk, &rsys.Vehicles)
+
+	// vehicles 0 and 1 drive through each other, and are moved back
+	place(0, 1.90, 0, 0)
+	place(1, 1.60, 0, math.Pi)
+	cr.update(dt, trk, &rsys.Vehicles)
+	ces := cr.NewCollisions()
+	testEqual(t, "swept collisions", 1, len(ces))
+	if rsys.Vehicles[0].CurTrackPose().Dofs > 1.75 {
+		t.Fatalf("vehicle 0 was not moved back: Dofs=%v", rsys.Vehicles[0].CurTrackPose().Dofs)
+	}
+
+	// vehicle 2 moves into the lane, ahead of where vehicle 0 is now
+	place(2, 1.94, 0, 0)
+	cr.update(2*dt, trk, &rsys.Vehicles)
+	for _, ce := range cr.NewCollisions() {
+		if (ce.VehInfo[0].Id == 2) || (ce.VehInfo[1].Id == 2) {
+			t.Errorf("phantom collision: %+v", ce)
+		}
+	}
+}
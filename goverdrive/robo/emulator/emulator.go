@@ -0,0 +1,628 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+// Package emulator exposes simulated vehicles as virtual devices on local
+// sockets, so that controllers written for physical vehicles (eg
+// examples/vehicle-tool) can be tested without hardware. Each vehicle listens on
+// its own TCP or Unix socket, which stands in for its BLE connection: the
+// controller writes C2V messages, and reads V2C responses and localization
+// updates, in the byte format of the robo/protocol package, back to back.
+//
+// Like the API server, whoever drives the robotics system services the
+// emulator once per tick, eg the engine's game loops: commands are applied on
+// that goroutine, and the localization events of the tick are sent to the
+// connected controllers. The package does not depend on a window, so headless
+// tests can drive the robotics system and the emulator directly.
+package emulator
+
+import (
+	"fmt"
+	"image/color"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/colornames"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/protocol"
+)
+
+const (
+	// connBuffer is the number of messages buffered per connection; a
+	// controller that falls further behind misses messages, like over BLE
+	connBuffer = 256
+
+	// inboxSize is the number of C2V messages, from all connections, that can
+	// wait for Service
+	inboxSize = 256
+
+	// defCspd is the lane change speed when a message does not have one
+	defCspd phys.MetersPerSec = 0.1
+)
+
+// Params are the fixed answers of the virtual vehicles.
+type Params struct {
+	Version      uint16 // firmware version, for ANKI_VEHICLE_MSG_V2C_VERSION_RESPONSE
+	BatteryLevel uint16 // millivolts, for ANKI_VEHICLE_MSG_V2C_BATTERY_LEVEL_RESPONSE
+}
+
+// DefaultParams returns the answers of a fully charged vehicle.
+func DefaultParams() Params {
+	return Params{
+		Version:      0x2e6b,
+		BatteryLevel: 4100,
+	}
+}
+
+// Emulator serves virtual vehicles. Set it in the engine's GamePhaseVizConfig
+// or HeadlessConfig so that the game loop services it, or call Attach and
+// Service directly.
+//
+// The virtual vehicles behave like physical ones, as far as the simulation
+// allows:
+//   - Speed and lane change commands are ignored until SDK mode is turned on
+//     with protocol.SdkOptionOverrideLocalization.
+//   - Lane changes are relative to the offset that was last set with
+//     SetOffsetFromRoadCenter, in the vehicle's driving direction.
+//   - Road pieces are reported by index, since tracks have no piece ids.
+//   - A vehicle stops when its controller disconnects.
+//   - Only one controller can connect to a vehicle at a time.
+type Emulator struct {
+	params Params
+	inbox  chan connMsg
+	done   chan struct{} // closed by Close
+	wg     sync.WaitGroup
+
+	// owned by the goroutine that calls Service
+	rsys   *robo.System
+	events *robo.EventQueue
+	vehs   map[int]*vehState // by vehicle Id
+
+	// shared with the connection goroutines
+	mu        sync.Mutex
+	closed    bool
+	listeners []net.Listener
+	conns     map[int]*conn // by vehicle Id
+}
+
+// connMsg is a C2V message, or a disconnect (msg==nil), from one connection.
+type connMsg struct {
+	conn *conn
+	msg  protocol.Msg
+}
+
+// conn is one controller's connection to one virtual vehicle.
+type conn struct {
+	vehId int
+	nc    net.Conn
+	msgs  chan []byte
+	done  chan struct{} // closed when the connection is
+	once  sync.Once
+}
+
+// vehState is what a virtual vehicle remembers from its controller's messages.
+type vehState struct {
+	conn    *conn
+	sdkMode bool
+
+	// SetOffsetFromRoadCenter; lane changes are relative to it
+	refOffsetMm float32
+	refCofs     phys.Meters
+
+	laneChangeId  uint8
+	laneChangeSpd uint16
+	engine        [3]protocol.LightConfig // red, green, blue
+}
+
+// New creates an emulator. It serves no vehicles until Listen or ListenAll is
+// called.
+func New(params Params) *Emulator {
+	return &Emulator{
+		params: params,
+		inbox:  make(chan connMsg, inboxSize),
+		done:   make(chan struct{}),
+		vehs:   make(map[int]*vehState),
+		conns:  make(map[int]*conn),
+	}
+}
+
+// Params returns the emulator's parameters.
+func (em *Emulator) Params() Params {
+	return em.params
+}
+
+// Listen exposes the vehicle with the Id as a virtual device on a local socket,
+// in the background. network is "tcp" or "unix".
+func (em *Emulator) Listen(vehId int, network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	if em.closed {
+		l.Close()
+		return fmt.Errorf("Emulator is closed")
+	}
+	em.listeners = append(em.listeners, l)
+	em.wg.Add(1)
+	go em.accept(vehId, l)
+	return nil
+}
+
+// ListenAll exposes vehicles on consecutive addresses. For TCP, eg
+// "localhost:9000", vehicle Id n listens on port 9000+n. For Unix sockets, eg
+// "unix:/tmp/goverdrive", vehicle Id n listens on "/tmp/goverdrive.n".
+func (em *Emulator) ListenAll(addr string, vehIds []int) error {
+	for _, id := range vehIds {
+		network, vaddr, err := vehAddr(addr, id)
+		if err != nil {
+			return err
+		}
+		if err = em.Listen(id, network, vaddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vehAddr returns the socket of one vehicle; see ListenAll.
+func vehAddr(addr string, vehId int) (network, vaddr string, err error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", fmt.Sprintf("%s.%d", strings.TrimPrefix(addr, "unix:"), vehId), nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("Emulator address=%q is neither host:port nor unix:path", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", "", fmt.Errorf("Emulator address=%q does not have a numeric port", addr)
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port+vehId)), nil
+}
+
+// Close stops listening, disconnects all controllers, and waits for the
+// connection goroutines to finish. C2V messages that were not serviced yet
+// are dropped.
+func (em *Emulator) Close() {
+	em.mu.Lock()
+	if !em.closed {
+		em.closed = true
+		close(em.done)
+		for _, l := range em.listeners {
+			l.Close()
+		}
+		em.listeners = nil
+		for _, c := range em.conns {
+			c.close()
+		}
+	}
+	em.mu.Unlock()
+	em.wg.Wait()
+}
+
+//////////////////////////////////////////////////////////////////////
+// Connection side
+
+func (em *Emulator) accept(vehId int, l net.Listener) {
+	defer em.wg.Done()
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return // closed
+		}
+		c := &conn{vehId: vehId, nc: nc, msgs: make(chan []byte, connBuffer), done: make(chan struct{})}
+		em.mu.Lock()
+		busy := em.closed || (em.conns[vehId] != nil)
+		if !busy {
+			em.conns[vehId] = c
+			em.wg.Add(2)
+		}
+		em.mu.Unlock()
+		if busy {
+			nc.Close() // like a vehicle that is already connected over BLE
+			continue
+		}
+		go c.write(&em.wg)
+		go em.read(c)
+	}
+}
+
+// read passes the connection's messages to Service, until the connection or
+// the emulator is closed. Messages that cannot be decoded are skipped.
+func (em *Emulator) read(c *conn) {
+	defer em.wg.Done()
+	defer func() {
+		em.mu.Lock()
+		if em.conns[c.vehId] == c {
+			delete(em.conns, c.vehId)
+		}
+		em.mu.Unlock()
+		c.close()
+		em.post(connMsg{conn: c})
+	}()
+	for {
+		b, err := protocol.ReadMsgBytes(c.nc)
+		if err != nil {
+			return
+		}
+		m, err := protocol.Unmarshal(b)
+		if err != nil {
+			continue
+		}
+		if !em.post(connMsg{conn: c, msg: m}) {
+			return
+		}
+		if _, ok := m.(*protocol.Disconnect); ok {
+			return
+		}
+	}
+}
+
+// post waits for room in the inbox. It returns false, without posting, if the
+// emulator is closed first.
+func (em *Emulator) post(m connMsg) bool {
+	select {
+	case em.inbox <- m:
+		return true
+	case <-em.done:
+		return false
+	}
+}
+
+func (c *conn) write(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case b := <-c.msgs:
+			if _, err := c.nc.Write(b); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// send queues a message, or drops it if it can not be encoded, or if the
+// controller is too far behind or gone.
+func (c *conn) send(m protocol.Msg) {
+	b, err := protocol.Marshal(m)
+	if err != nil {
+		return
+	}
+	select {
+	case <-c.done:
+	case c.msgs <- b:
+	default:
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		c.nc.Close()
+		close(c.done)
+	})
+}
+
+// conn returns the connection to a vehicle, or nil.
+func (em *Emulator) conn(vehId int) *conn {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	return em.conns[vehId]
+}
+
+//////////////////////////////////////////////////////////////////////
+// Robotics side
+
+// Attach starts serving a robotics system, and stops serving the previous one.
+// The game loops call it before starting a game phase; Service calls it too.
+//
+// NOTE: Vehicles only report where they are with localization updates, so
+// Attach modifies rsys if it has no localizer: it installs one with
+// robo.DefaultLocalizationParams(). Set a localizer first to use other params.
+func (em *Emulator) Attach(rsys *robo.System) {
+	if em.rsys == rsys {
+		return
+	}
+	if em.events != nil {
+		em.events.Close()
+	}
+	if rsys.Localizer() == nil {
+		rsys.SetLocalizer(robo.NewLocalizer(robo.DefaultLocalizationParams()))
+	}
+	em.rsys = rsys
+	em.events = robo.NewEventQueue(rsys.Events, robo.EvLocPositionUpdate, robo.EvLocTransitionUpdate,
+		robo.EvVehDelocalized, robo.EvVehRemoved)
+}
+
+// Service applies pending C2V messages, and sends the localization updates
+// since the previous call. The game loops call it once per game tick, on the
+// goroutine that ticks rsys.
+func (em *Emulator) Service(rsys *robo.System) {
+	em.Attach(rsys)
+	for pending := true; pending; {
+		select {
+		case m := <-em.inbox:
+			em.handle(rsys, m)
+		default:
+			pending = false
+		}
+	}
+
+	for _, ev := range em.events.Drain() {
+		c := em.conn(ev.VehId)
+		if c == nil {
+			continue
+		}
+		if ev.Kind == robo.EvVehRemoved {
+			c.close() // the device is gone
+			continue
+		}
+		veh := rsys.Vehicle(ev.VehId)
+		if (veh == nil) || (ev.Localization == nil) {
+			continue
+		}
+		st := em.vehs[ev.VehId]
+		if (st == nil) || (st.conn != c) {
+			st = &vehState{conn: c}
+			em.vehs[ev.VehId] = st
+		}
+		c.send(st.localizationMsg(veh, ev.Localization))
+	}
+}
+
+// handle applies one C2V message to its vehicle, on the Service goroutine.
+func (em *Emulator) handle(rsys *robo.System, m connMsg) {
+	st := em.vehs[m.conn.vehId]
+	if (st != nil) && (st.conn != m.conn) {
+		st = nil // from an older connection
+	}
+	veh := rsys.Vehicle(m.conn.vehId)
+	if m.msg == nil {
+		// disconnected; the vehicle stops
+		if st != nil {
+			delete(em.vehs, m.conn.vehId)
+			if veh != nil {
+				veh.SetCmdDriveDspd(0, veh.MaxDdcl())
+			}
+		}
+		return
+	}
+	if veh == nil {
+		m.conn.close() // eg removed
+		return
+	}
+	if st == nil {
+		st = &vehState{conn: m.conn}
+		em.vehs[m.conn.vehId] = st
+	}
+
+	switch msg := m.msg.(type) {
+	case *protocol.PingRequest:
+		st.conn.send(&protocol.PingResponse{})
+	case *protocol.VersionRequest:
+		st.conn.send(&protocol.VersionResponse{Version: em.params.Version})
+	case *protocol.BatteryLevelRequest:
+		st.conn.send(&protocol.BatteryLevelResponse{BatteryLevel: em.params.BatteryLevel})
+	case *protocol.SdkMode:
+		st.sdkMode = (msg.On != 0) && ((msg.Flags & protocol.SdkOptionOverrideLocalization) != 0)
+	case *protocol.SetSpeed:
+		if !st.sdkMode {
+			return
+		}
+		dspd := phys.MetersPerSec(msg.SpeedMmPerSec) / 1000
+		if dspd < 0 {
+			dspd = 0
+		}
+		dacl := phys.MetersPerSec2(msg.AccelMmPerSec2) / 1000
+		if dacl <= 0 {
+			dacl = veh.MaxDacl()
+		}
+		veh.SetCmdDriveDspd(dspd, dacl)
+	case *protocol.SetOffsetFromRoadCenter:
+		st.refOffsetMm = msg.OffsetMm
+		st.refCofs = veh.CurDriveCofs()
+	case *protocol.ChangeLane:
+		if !st.sdkMode {
+			return
+		}
+		cspd := phys.MetersPerSec(msg.HorizontalSpeedMmPerSec) / 1000
+		if cspd <= 0 {
+			cspd = defCspd
+		}
+		st.laneChangeId++
+		st.laneChangeSpd = msg.HorizontalSpeedMmPerSec
+		veh.SetCmdDriveCofs(st.refCofs+(phys.Meters(msg.OffsetFromRoadCenterMm-st.refOffsetMm)/1000), cspd)
+	case *protocol.CancelLaneChange:
+		veh.SetCmdDriveCofs(veh.CurDriveCofs(), defCspd)
+	case *protocol.Turn:
+		// there are no intersections, so every trigger is immediate
+		if tt := robo.TurnType(msg.Type); (tt > robo.TurnNone) && (tt <= robo.TurnUturnJump) {
+			veh.CmdTurn(tt, robo.DefUturnRadius)
+		}
+	case *protocol.SetLights:
+		st.setLights(veh, msg.LightMask)
+	case *protocol.LightsPattern:
+		st.setLightsPattern(veh, rsys.Now(), msg)
+	}
+	// SetConfigParams and V2C messages are ignored, and the reader handles
+	// Disconnect
+}
+
+// localizationMsg converts a localization update to its V2C message. Offsets
+// are in the vehicle's driving direction.
+func (st *vehState) localizationMsg(veh *robo.Vehicle, u *robo.LocalizationUpdate) protocol.Msg {
+	offsetMm := float32(u.Cofs * 1000)
+	if u.Reverse {
+		offsetMm = -offsetMm
+	}
+	switch u.Kind {
+	case robo.EvLocPositionUpdate:
+		m := &protocol.LocalizationPositionUpdate{
+			LocationId:                         uint8(u.LocationId),
+			RoadPieceId:                        uint8(u.Rpi),
+			OffsetFromRoadCenterMm:             offsetMm,
+			SpeedMmPerSec:                      uint16(u.Dspd * 1000),
+			LastRecvLaneChangeCmdId:            st.laneChangeId,
+			LastExecLaneChangeCmdId:            st.laneChangeId,
+			LastDesiredLaneChangeSpeedMmPerSec: st.laneChangeSpd,
+			LastDesiredSpeedMmPerSec:           uint16(veh.CmdDriveDspd() * 1000),
+		}
+		if u.Reverse {
+			m.ParsingFlags |= protocol.ParseFlagsMaskReverseParsing | protocol.ParseFlagsMaskReverseDriving
+		}
+		return m
+	case robo.EvLocTransitionUpdate:
+		return &protocol.LocalizationTransitionUpdate{
+			RoadPieceIdx:                       int8(u.Rpi),
+			RoadPieceIdxPrev:                   int8(u.PrevRpi),
+			OffsetFromRoadCenterMm:             offsetMm,
+			LastRecvLaneChangeId:               st.laneChangeId,
+			LastExecLaneChangeId:               st.laneChangeId,
+			LastDesiredLaneChangeSpeedMmPerSec: st.laneChangeSpd,
+		}
+	}
+	return &protocol.VehicleDelocalized{}
+}
+
+//////////////////////////////////////////////////////////////////////
+// Lights
+//
+// The light groups of light.Gen2Spec stand in for the vehicle's LEDs: "top" for
+// the RGB engine light, "guns" for the front lights, and "tail" for the tail
+// light. Vehicles without these groups ignore the light messages.
+
+// setLights applies a SetLights mask, whose low nibble says which lights are
+// set, and high nibble whether they are on.
+func (st *vehState) setLights(veh *robo.Vehicle, mask uint8) {
+	groups := map[int]string{
+		protocol.LightHeadlights:  "guns",
+		protocol.LightBrakelights: "tail",
+		protocol.LightFrontlights: "guns",
+		protocol.LightEngine:      "top",
+	}
+	for bit := protocol.LightHeadlights; bit <= protocol.LightEngine; bit++ {
+		if ((mask >> uint(bit)) & 1) == 0 {
+			continue
+		}
+		c := color.Color(colornames.Black)
+		if ((mask >> uint(4+bit)) & 1) != 0 {
+			c = lightColor(groups[bit], protocol.MaxLightIntensity)
+		}
+		setLight(veh, groups[bit], c)
+	}
+}
+
+// setLightsPattern applies the channels of a LightsPattern. Steady and fade
+// effects set the final intensity; the other effects alternate between the
+// start and end intensities, once per cycle.
+func (st *vehState) setLightsPattern(veh *robo.Vehicle, now phys.SimTime, msg *protocol.LightsPattern) {
+	engine := false
+	for _, cfg := range msg.Channels {
+		switch cfg.Channel {
+		case protocol.LightChannelRed:
+			st.engine[0], engine = cfg, true
+		case protocol.LightChannelGreen:
+			st.engine[1], engine = cfg, true
+		case protocol.LightChannelBlue:
+			st.engine[2], engine = cfg, true
+		case protocol.LightChannelTail:
+			start, end := patternIntensities(cfg)
+			animateLight(veh, now, "tail", lightColor("tail", start), lightColor("tail", end), cfg)
+		case protocol.LightChannelFrontL, protocol.LightChannelFrontR:
+			start, end := patternIntensities(cfg)
+			animateLight(veh, now, "guns", lightColor("guns", start), lightColor("guns", end), cfg)
+		}
+	}
+	if !engine {
+		return
+	}
+
+	// the engine channels mix into one color
+	var start, end [3]uint8
+	var animCfg protocol.LightConfig
+	for i, cfg := range st.engine {
+		start[i], end[i] = patternIntensities(cfg)
+		if start[i] != end[i] {
+			animCfg = cfg
+		}
+	}
+	rgb := func(in [3]uint8) color.Color {
+		return color.RGBA{R: scaleIntensity(255, in[0]), G: scaleIntensity(255, in[1]), B: scaleIntensity(255, in[2]), A: 255}
+	}
+	animateLight(veh, now, "top", rgb(start), rgb(end), animCfg)
+}
+
+// patternIntensities returns the intensities that a channel alternates
+// between; they are equal if it is not animated.
+func patternIntensities(cfg protocol.LightConfig) (start, end uint8) {
+	switch cfg.Effect {
+	case protocol.LightEffectSteady:
+		return cfg.Start, cfg.Start
+	case protocol.LightEffectFade:
+		return cfg.End, cfg.End
+	case protocol.LightEffectFlash, protocol.LightEffectRandom:
+		return 0, protocol.MaxLightIntensity
+	}
+	return cfg.Start, cfg.End
+}
+
+// animateLight sets a light group to a color, or alternates it between two
+// colors at the rate of the channel config.
+func animateLight(veh *robo.Vehicle, now phys.SimTime, name string, start, end color.Color, cfg protocol.LightConfig) {
+	if !hasLight(veh, name) {
+		return
+	}
+	if start == end {
+		veh.Lights().Set(name, start)
+		return
+	}
+	periodMs := uint(10000)
+	if cfg.CyclesPer10Sec > 0 {
+		periodMs /= uint(cfg.CyclesPer10Sec)
+	}
+	frames := []light.Frame{{Color: start, Tms: periodMs / 2}, {Color: end, Tms: periodMs / 2}}
+	veh.Lights().SetAnimation(now, name, frames, light.RepeatForever)
+}
+
+func setLight(veh *robo.Vehicle, name string, c color.Color) {
+	if hasLight(veh, name) {
+		veh.Lights().Set(name, c)
+	}
+}
+
+func hasLight(veh *robo.Vehicle, name string) bool {
+	for _, n := range veh.Lights().Names() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lightColor returns the color of a light group at an intensity, from 0 to
+// protocol.MaxLightIntensity.
+func lightColor(name string, intensity uint8) color.Color {
+	full := colornames.White
+	switch name {
+	case "guns":
+		full = colornames.Goldenrod
+	case "tail":
+		full = colornames.Red
+	}
+	return color.RGBA{R: scaleIntensity(full.R, intensity), G: scaleIntensity(full.G, intensity), B: scaleIntensity(full.B, intensity), A: 255}
+}
+
+func scaleIntensity(full uint8, intensity uint8) uint8 {
+	if intensity > protocol.MaxLightIntensity {
+		intensity = protocol.MaxLightIntensity
+	}
+	return uint8(uint(full) * uint(intensity) / protocol.MaxLightIntensity)
+}
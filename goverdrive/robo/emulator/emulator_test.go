@@ -0,0 +1,293 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package emulator
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/protocol"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// testTimeout bounds every wait for a socket, so that a broken emulator fails
+// the test rather than hanging it.
+const testTimeout = 5 * time.Second
+
+func testEqual(t *testing.T, desc string, exp interface{}, got interface{}) {
+	if exp != got {
+		t.Errorf("%s error: exp=%v, got=%v", desc, exp, got)
+	}
+}
+
+// newTestSystem creates a system with two idle vehicles, Ids 0 and 1, on the
+// capsule track.
+func newTestSystem(t *testing.T) *robo.System {
+	trk, err := track.NewStarterKitTrack(0.2, 0, "capsule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehs := make([]robo.Vehicle, 0)
+	for _, vt := range []robo.VehType{"gs", "sk"} {
+		veh, err := robo.NewVehicle(vt, light.Gen2Spec, trk.CenLen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		vehs = append(vehs, *veh)
+	}
+	rsys := robo.NewSystem(trk, &vehs, robo.NewIdealSimulator(), robo.NewCollisionDetector(trk, &vehs))
+	rsys.Vehicles[1].Reposition(track.Pose{Point: track.Point{Dofs: trk.CenLen() / 2}})
+	return rsys
+}
+
+// newTestEmulator creates an emulator that serves both vehicles on Unix
+// sockets in a new directory. The caller closes the emulator, then removes the
+// directory.
+func newTestEmulator(t *testing.T) (em *Emulator, addr string, dir string) {
+	dir, err := ioutil.TempDir("", "emulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = "unix:" + filepath.Join(dir, "veh")
+	em = New(DefaultParams())
+	if err = em.ListenAll(addr, []int{0, 1}); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return em, addr, dir
+}
+
+// controller is the other end of a virtual vehicle's socket. Its V2C messages
+// are decoded in the background.
+type controller struct {
+	nc   net.Conn
+	msgs chan protocol.Msg // closed when the connection is
+}
+
+func dial(t *testing.T, addr string, vehId int) *controller {
+	network, vaddr, err := vehAddr(addr, vehId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc, err := net.Dial(network, vaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &controller{nc: nc, msgs: make(chan protocol.Msg, 1024)}
+	go func() {
+		defer close(c.msgs)
+		for {
+			b, err := protocol.ReadMsgBytes(nc)
+			if err != nil {
+				return
+			}
+			if m, err := protocol.Unmarshal(b); err == nil {
+				c.msgs <- m
+			}
+		}
+	}()
+	return c
+}
+
+func (c *controller) send(t *testing.T, msgs ...protocol.Msg) {
+	for _, m := range msgs {
+		b, err := protocol.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.nc.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitFor ticks the system and services the emulator until the controller
+// receives a message with the id, and returns it.
+func (c *controller) waitFor(t *testing.T, em *Emulator, rsys *robo.System, id protocol.MsgId) protocol.Msg {
+	deadline := time.After(testTimeout)
+	for {
+		rsys.Tick()
+		em.Service(rsys)
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				t.Fatalf("Connection closed while waiting for msg id=0x%02x", id)
+			}
+			if m.Id() == id {
+				return m
+			}
+		case <-time.After(time.Millisecond):
+		case <-deadline:
+			t.Fatalf("Msg id=0x%02x was not received", id)
+		}
+	}
+}
+
+// sync waits until the emulator has applied all of the messages that were sent
+// before, since each connection's messages are handled in order.
+func (c *controller) sync(t *testing.T, em *Emulator, rsys *robo.System) {
+	c.send(t, &protocol.PingRequest{})
+	c.waitFor(t, em, rsys, protocol.MsgV2CPingResponse)
+}
+
+// waitClosed waits until the emulator closes the controller's connection.
+func (c *controller) waitClosed(t *testing.T) {
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-c.msgs:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Connection was not closed")
+		}
+	}
+}
+
+func TestVehAddr(t *testing.T) {
+	tests := []struct {
+		addr, network, vaddr string
+	}{
+		{"localhost:9000", "tcp", "localhost:9002"},
+		{"127.0.0.1:9100", "tcp", "127.0.0.1:9102"},
+		{"unix:/tmp/goverdrive", "unix", "/tmp/goverdrive.2"},
+	}
+	for _, test := range tests {
+		network, vaddr, err := vehAddr(test.addr, 2)
+		testEqual(t, test.addr+" err", nil, err)
+		testEqual(t, test.addr+" network", test.network, network)
+		testEqual(t, test.addr+" vaddr", test.vaddr, vaddr)
+	}
+	for _, bad := range []string{"localhost", "localhost:http", ""} {
+		if _, _, err := vehAddr(bad, 0); err == nil {
+			t.Errorf("Address %q should be rejected", bad)
+		}
+	}
+}
+
+func TestRequests(t *testing.T) {
+	rsys := newTestSystem(t)
+	em, addr, dir := newTestEmulator(t)
+	defer os.RemoveAll(dir)
+	defer em.Close()
+	c := dial(t, addr, 1)
+
+	c.send(t, &protocol.VersionRequest{})
+	m := c.waitFor(t, em, rsys, protocol.MsgV2CVersionResponse)
+	testEqual(t, "version", DefaultParams().Version, m.(*protocol.VersionResponse).Version)
+	c.send(t, &protocol.BatteryLevelRequest{})
+	m = c.waitFor(t, em, rsys, protocol.MsgV2CBatteryLevelResponse)
+	testEqual(t, "battery", DefaultParams().BatteryLevel, m.(*protocol.BatteryLevelResponse).BatteryLevel)
+	c.sync(t, em, rsys)
+
+	// only one controller at a time
+	busy := dial(t, addr, 1)
+	busy.waitClosed(t)
+	c.sync(t, em, rsys)
+}
+
+func TestSdkMode(t *testing.T) {
+	rsys := newTestSystem(t)
+	em, addr, dir := newTestEmulator(t)
+	defer os.RemoveAll(dir)
+	defer em.Close()
+	c := dial(t, addr, 0)
+	veh := rsys.Vehicle(0)
+
+	// ignored without SDK mode
+	c.send(t, &protocol.SetSpeed{SpeedMmPerSec: 500, AccelMmPerSec2: 1000})
+	c.send(t, &protocol.ChangeLane{HorizontalSpeedMmPerSec: 100, OffsetFromRoadCenterMm: 30})
+	c.sync(t, em, rsys)
+	testEqual(t, "dspd without SDK", phys.MetersPerSec(0), veh.CmdDriveDspd())
+	testEqual(t, "cofs without SDK", phys.Meters(0), veh.CmdDriveCofs())
+
+	c.send(t, &protocol.SdkMode{On: 1, Flags: protocol.SdkOptionOverrideLocalization})
+	c.send(t, &protocol.SetSpeed{SpeedMmPerSec: 500, AccelMmPerSec2: 1000})
+	c.send(t, &protocol.SetOffsetFromRoadCenter{OffsetMm: 10})
+	c.send(t, &protocol.ChangeLane{HorizontalSpeedMmPerSec: 100, OffsetFromRoadCenterMm: 40})
+	c.sync(t, em, rsys)
+	testEqual(t, "dspd", phys.MetersPerSec(0.5), veh.CmdDriveDspd())
+	if math.Abs(float64(veh.CmdDriveCofs()-0.03)) > 1e-6 {
+		t.Errorf("Lane change relative to the offset error: exp=0.03, got=%v", veh.CmdDriveCofs())
+	}
+
+	// the vehicle stops when the controller disconnects
+	c.nc.Close()
+	deadline := time.After(testTimeout)
+	for veh.CmdDriveDspd() != 0 {
+		rsys.Tick()
+		em.Service(rsys)
+		select {
+		case <-time.After(time.Millisecond):
+		case <-deadline:
+			t.Fatal("Vehicle did not stop after its controller disconnected")
+		}
+	}
+}
+
+func TestLocalizationUpdates(t *testing.T) {
+	rsys := newTestSystem(t)
+	em, addr, dir := newTestEmulator(t)
+	defer os.RemoveAll(dir)
+	defer em.Close()
+	c := dial(t, addr, 0)
+
+	em.Attach(rsys)
+	if rsys.Localizer() == nil {
+		t.Fatal("Attach did not install a localizer")
+	}
+
+	c.send(t, &protocol.SdkMode{On: 1, Flags: protocol.SdkOptionOverrideLocalization})
+	c.send(t, &protocol.SetSpeed{SpeedMmPerSec: 500, AccelMmPerSec2: 5000})
+	m := c.waitFor(t, em, rsys, protocol.MsgV2CLocalizationPositionUpdate)
+	pu := m.(*protocol.LocalizationPositionUpdate)
+	testEqual(t, "desired speed", uint16(500), pu.LastDesiredSpeedMmPerSec)
+	testEqual(t, "reverse", uint8(0), pu.ParsingFlags&protocol.ParseFlagsMaskReverseDriving)
+	c.waitFor(t, em, rsys, protocol.MsgV2CLocalizationTransitionUpdate)
+
+	// removing the vehicle is like the device going away
+	rsys.RemoveVehicle(0)
+	em.Service(rsys)
+	c.waitClosed(t)
+}
+
+// TestCloseUnblocksReaders checks that Close returns while a connection is
+// blocked on a full inbox, ie when nothing services the emulator.
+func TestCloseUnblocksReaders(t *testing.T) {
+	em, addr, dir := newTestEmulator(t)
+	defer os.RemoveAll(dir)
+	c := dial(t, addr, 0)
+	for i := 0; i < inboxSize+10; i++ {
+		c.send(t, &protocol.PingRequest{})
+	}
+	deadline := time.After(testTimeout)
+	for len(em.inbox) < inboxSize {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-deadline:
+			t.Fatalf("Inbox did not fill up: len=%d", len(em.inbox))
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		em.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("Close did not return")
+	}
+	c.waitClosed(t)
+}
@@ -0,0 +1,345 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+// Package estimate turns the sparse localization updates of vehicles into a
+// continuous track.Pose estimate of each vehicle, for controlling real cars.
+// Between updates, an estimate is dead-reckoned along the track geometry at the
+// estimated speed. Each update corrects it, with a small Kalman filter on the
+// distance driven and the speed, and a separate one on the center offset.
+package estimate
+
+import (
+	"math"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// Params tunes the Estimator.
+type Params struct {
+	// LocationSpacing must match the vehicles' location codes; see
+	// robo.LocalizationParams. An update only says which code a vehicle read,
+	// so its position is uncertain by about one code.
+	LocationSpacing phys.Meters
+
+	// SpeedStdDev and CofsStdDev are the standard deviations of the noise on
+	// reported speeds and center offsets.
+	SpeedStdDev phys.MetersPerSec
+	CofsStdDev  phys.Meters
+
+	// AccelStdDev is how much vehicles change speed between updates, and
+	// CofsDriftRate how fast they move across the road, eg to change lanes.
+	// Higher values trust the updates more than the dead reckoning.
+	AccelStdDev   phys.MetersPerSec2
+	CofsDriftRate phys.MetersPerSec
+
+	// MaxDeadReckonTime is how far past the latest update an estimate is
+	// dead-reckoned. Vehicles that stop do not read codes, so after this the
+	// estimate stays put, and only its uncertainty grows.
+	MaxDeadReckonTime phys.SimTime
+
+	// MaxJump is how far, in standard deviations, an update may be from the
+	// estimate. Further updates, eg after a lost stream, restart the estimate.
+	MaxJump float64
+}
+
+// DefaultParams returns parameters that match robo.DefaultLocalizationParams().
+func DefaultParams() Params {
+	return Params{
+		LocationSpacing:   0.04,
+		SpeedStdDev:       0.02,
+		CofsStdDev:        0.003,
+		AccelStdDev:       2.0,
+		CofsDriftRate:     0.1,
+		MaxDeadReckonTime: 300 * phys.SimMillisecond,
+		MaxJump:           5,
+	}
+}
+
+// unknownSpeedVar is the variance of a speed that has not been reported, in
+// (m/s)^2.
+const unknownSpeedVar = 1.0
+
+// Estimate is the estimated state of one vehicle, at one time.
+type Estimate struct {
+	Localized  bool              // false => the pose is where the vehicle was last seen
+	Time       phys.SimTime      // of the estimate
+	UpdateTime phys.SimTime      // MeasuredTime of the latest update
+	Pose       track.Pose        // DAngle is 0 or pi
+	Dspd       phys.MetersPerSec // <0 => counter-trackwise
+
+	// Uncertainty, as standard deviations. DofsStdDev is along the driving
+	// direction.
+	DofsStdDev phys.Meters
+	CofsStdDev phys.Meters
+	DspdStdDev phys.MetersPerSec
+}
+
+// Estimator maintains the estimates of all vehicles, by vehicle Id.
+type Estimator struct {
+	trk    *track.Track
+	params Params
+	vehs   map[int]*vehState
+}
+
+// vehState is the filter state of one vehicle, at the time of its latest
+// update.
+type vehState struct {
+	localized  bool
+	time       phys.SimTime
+	updateTime phys.SimTime
+	dofs       phys.Meters
+	cofs       phys.Meters
+	reverse    bool
+	spd        phys.MetersPerSec // driving speed; always >= 0
+
+	// covariance of the distance driven and the speed, and variance of cofs
+	pss, psv, pvv float64
+	pcc           float64
+}
+
+func New(trk *track.Track, params Params) *Estimator {
+	if params.LocationSpacing <= 0 {
+		panic("estimate.New requires LocationSpacing > 0")
+	}
+	return &Estimator{
+		trk:    trk,
+		params: params,
+		vehs:   make(map[int]*vehState),
+	}
+}
+
+// Params returns the estimator's parameters.
+func (e *Estimator) Params() Params {
+	return e.params
+}
+
+// Subscribe updates the estimator with the localization events published on
+// the bus, and forgets vehicles that are removed.
+func (e *Estimator) Subscribe(bus *robo.EventBus) robo.SubscriptionId {
+	return bus.Subscribe(func(ev robo.Event) {
+		if ev.Kind == robo.EvVehRemoved {
+			e.Forget(ev.VehId)
+		} else if ev.Localization != nil {
+			e.Update(*ev.Localization)
+		}
+	}, robo.EvLocPositionUpdate, robo.EvLocTransitionUpdate, robo.EvVehDelocalized, robo.EvVehRemoved)
+}
+
+// Forget drops the estimate of a vehicle.
+func (e *Estimator) Forget(vehId int) {
+	delete(e.vehs, vehId)
+}
+
+// Estimate returns the estimate of a vehicle at time now, dead-reckoned from its
+// latest update. A vehicle with no updates yet is not Localized.
+func (e *Estimator) Estimate(vehId int, now phys.SimTime) Estimate {
+	st, ok := e.vehs[vehId]
+	if !ok {
+		return Estimate{Time: now}
+	}
+	pst := *st
+	if pst.localized {
+		e.predict(&pst, now)
+	}
+
+	est := Estimate{
+		Localized:  pst.localized,
+		Time:       now,
+		UpdateTime: pst.updateTime,
+		Pose:       track.Pose{Point: track.Point{Dofs: pst.dofs, Cofs: pst.cofs}},
+		Dspd:       pst.spd,
+		DofsStdDev: phys.Meters(math.Sqrt(pst.pss)),
+		CofsStdDev: phys.Meters(math.Sqrt(pst.pcc)),
+		DspdStdDev: phys.MetersPerSec(math.Sqrt(pst.pvv)),
+	}
+	if pst.reverse {
+		est.Pose.DAngle = math.Pi
+		est.Dspd = -pst.spd
+	}
+	return est
+}
+
+// Update corrects the estimate of a vehicle with a localization update. Updates
+// must be passed in the order they were measured.
+func (e *Estimator) Update(u robo.LocalizationUpdate) {
+	p := &e.params
+	st, ok := e.vehs[u.VehId]
+	if !ok {
+		st = &vehState{}
+		e.vehs[u.VehId] = st
+	}
+	if u.Kind == robo.EvVehDelocalized {
+		st.localized = false
+		return
+	}
+
+	// a code is read anywhere over its length, ie uniformly
+	measDofs, measVar := e.measuredDofs(u)
+	if !st.localized {
+		e.restart(st, u, measDofs, measVar)
+		return
+	}
+	e.predict(st, u.MeasuredTime)
+
+	if u.Reverse != st.reverse {
+		// the vehicle turned around; its speed starts over
+		st.reverse = u.Reverse
+		st.spd = 0
+		st.psv = 0
+		st.pvv = unknownSpeedVar
+	}
+
+	// distance driven
+	innov := float64(e.trk.DriveDeltaDofs(e.pose(st), measDofs))
+	s := st.pss + measVar
+	if math.Abs(innov) > (p.MaxJump * math.Sqrt(s)) {
+		e.restart(st, u, measDofs, measVar)
+		return
+	}
+	k1, k2 := st.pss/s, st.psv/s
+	e.correct(st, k1*innov, k2*innov)
+	st.pss, st.psv, st.pvv = (1-k1)*st.pss, (1-k1)*st.psv, st.pvv-k2*st.psv
+
+	// speed; transitions do not report it
+	if u.Kind == robo.EvLocPositionUpdate {
+		innov = float64(u.Dspd - st.spd)
+		s = st.pvv + sq(float64(p.SpeedStdDev))
+		k1, k2 = st.psv/s, st.pvv/s
+		e.correct(st, k1*innov, k2*innov)
+		st.pss, st.psv, st.pvv = st.pss-k1*st.psv, (1-k2)*st.psv, (1-k2)*st.pvv
+	}
+
+	// center offset
+	k := st.pcc / (st.pcc + sq(float64(p.CofsStdDev)))
+	st.cofs += phys.Meters(k * float64(u.Cofs-st.cofs))
+	st.pcc *= (1 - k)
+	st.updateTime = u.MeasuredTime
+}
+
+// measuredDofs returns the Dofs of an update, and its variance.
+func (e *Estimator) measuredDofs(u robo.LocalizationUpdate) (phys.Meters, float64) {
+	spacing := float64(e.params.LocationSpacing)
+	rp := e.trk.Rp(u.Rpi)
+	dofs := e.trk.RpEntryDofs(u.Rpi)
+	if u.Kind == robo.EvLocPositionUpdate {
+		dofs += phys.Meters(math.Min(float64(rp.CenLen()), (float64(u.LocationId)+0.5)*spacing))
+	} else if u.Reverse {
+		// entered from the far end
+		dofs += rp.CenLen()
+	}
+	return e.trk.NormalizeDofs(dofs), sq(spacing) / 12
+}
+
+// restart starts a new estimate from an update alone.
+func (e *Estimator) restart(st *vehState, u robo.LocalizationUpdate, measDofs phys.Meters, measVar float64) {
+	*st = vehState{
+		localized:  true,
+		time:       u.MeasuredTime,
+		updateTime: u.MeasuredTime,
+		dofs:       measDofs,
+		cofs:       u.Cofs,
+		reverse:    u.Reverse,
+		spd:        u.Dspd,
+		pss:        measVar,
+		pvv:        sq(float64(e.params.SpeedStdDev)),
+		pcc:        sq(float64(e.params.CofsStdDev)),
+	}
+	if u.Kind != robo.EvLocPositionUpdate {
+		st.spd = 0
+		st.pvv = unknownSpeedVar
+	}
+}
+
+// predict dead-reckons a state forward to time t.
+func (e *Estimator) predict(st *vehState, t phys.SimTime) {
+	if t <= st.time {
+		return
+	}
+	p := &e.params
+	dt := float64(t-st.time) / float64(phys.SimSecond)
+
+	// motion stops at MaxDeadReckonTime, but uncertainty does not
+	reckonEnd := t
+	if (p.MaxDeadReckonTime > 0) && (reckonEnd > (st.updateTime + p.MaxDeadReckonTime)) {
+		reckonEnd = st.updateTime + p.MaxDeadReckonTime
+	}
+	if reckonEnd > st.time {
+		reckonDt := float64(reckonEnd-st.time) / float64(phys.SimSecond)
+		e.correct(st, float64(st.spd)*reckonDt, 0)
+	}
+
+	q := sq(float64(p.AccelStdDev))
+	st.pss += (2 * dt * st.psv) + (dt * dt * st.pvv) + (q * dt * dt * dt * dt / 4)
+	st.psv += (dt * st.pvv) + (q * dt * dt * dt / 2)
+	st.pvv += q * dt * dt
+	st.pcc += sq(float64(p.CofsDriftRate) * dt)
+	st.time = t
+}
+
+// correct moves a state by a driving distance, which may be negative, and
+// changes its speed.
+func (e *Estimator) correct(st *vehState, dist float64, dspd float64) {
+	reverse := st.reverse
+	if dist < 0 {
+		reverse = !reverse
+		dist = -dist
+	}
+	st.dofs = advance(e.trk, st.dofs, st.cofs, phys.Meters(dist), reverse)
+	st.spd += phys.MetersPerSec(dspd)
+	if st.spd < 0 {
+		st.spd = 0
+	}
+}
+
+func (e *Estimator) pose(st *vehState) track.Pose {
+	pose := track.Pose{Point: track.Point{Dofs: st.dofs, Cofs: st.cofs}}
+	if st.reverse {
+		pose.DAngle = math.Pi
+	}
+	return pose
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// advance returns the Dofs after driving a distance from dofs, along center
+// offset cofs. Like the simulators, Dofs is measured along road center, so it
+// changes faster than the distance on the inside of curves.
+func advance(trk *track.Track, dofs, cofs, dist phys.Meters, reverse bool) phys.Meters {
+	numRp := trk.NumRp()
+	rpi, rpDofs := trk.RpiAndRpDofs(trk.NormalizeDofs(dofs))
+	for {
+		rp := trk.Rp(rpi)
+		scale := phys.Meters(1)
+		if rp.CurveRadius(0) != 0 {
+			scale = rp.CurveRadius(0) / rp.CurveRadius(cofs)
+		}
+		left := rp.CenLen() - rpDofs
+		if reverse {
+			left = rpDofs
+		}
+		if (dist * scale) <= left {
+			if reverse {
+				rpDofs -= dist * scale
+			} else {
+				rpDofs += dist * scale
+			}
+			return trk.NormalizeDofs(trk.RpEntryDofs(rpi) + rpDofs)
+		}
+
+		dist -= left / scale
+		if reverse {
+			rpi = track.Rpi((int(rpi) + numRp - 1) % numRp)
+			prev := trk.Rp(rpi)
+			rpDofs = prev.CenLen()
+		} else {
+			rpi = track.Rpi((int(rpi) + 1) % numRp)
+			rpDofs = 0
+		}
+	}
+}
+
+func sq(x float64) float64 {
+	return x * x
+}
@@ -0,0 +1,251 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package estimate
+
+import (
+	"math"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+func testEqual(t *testing.T, desc string, exp interface{}, got interface{}) {
+	if exp != got {
+		t.Errorf("%s error: exp=%v, got=%v", desc, exp, got)
+	}
+}
+
+// newTestTrack creates the capsule track that the tests drive on.
+func newTestTrack(t *testing.T) *track.Track {
+	trk, err := track.NewStarterKitTrack(0.2, 0, "capsule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trk
+}
+
+// newEstimateSystem creates a system with one vehicle, a localizer and an
+// estimator that follows its events.
+func newEstimateSystem(t *testing.T, lparams robo.LocalizationParams) (*robo.System, *Estimator) {
+	trk := newTestTrack(t)
+	veh, err := robo.NewVehicle("gs", light.Gen2Spec, trk.CenLen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehs := []robo.Vehicle{*veh}
+	rsys := robo.NewSystem(trk, &vehs, robo.NewIdealSimulator(), robo.NewCollisionDetector(trk, &vehs))
+	rsys.SetLocalizer(robo.NewLocalizer(lparams))
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0.1, Cofs: 0}})
+	rsys.Tick()
+
+	params := DefaultParams()
+	params.LocationSpacing = lparams.LocationSpacing
+	est := New(&rsys.Track, params)
+	est.Subscribe(rsys.Events)
+	return rsys, est
+}
+
+// estimateError returns how far the estimate of a vehicle is from the truth,
+// along the track and across it.
+func estimateError(rsys *robo.System, est *Estimator, vehId int) (Estimate, phys.Meters, phys.Meters) {
+	e := est.Estimate(vehId, rsys.Now())
+	truth := rsys.Vehicle(vehId).CurTrackPose()
+	return e, rsys.Track.DofsDist(truth.Dofs, e.Pose.Dofs), phys.Meters(math.Abs(float64(truth.Cofs - e.Pose.Cofs)))
+}
+
+func TestAdvance(t *testing.T) {
+	trk, err := track.NewModularTrack(0.2, 0.1, "SLLSSLLS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cofs := range []phys.Meters{-0.05, 0, 0.05} {
+		for _, dofs := range []phys.Meters{0, 0.3, trk.RpEntryDofs(2), trk.CenLen() - 0.01} {
+			lap := advance(trk, dofs, cofs, trk.Len(cofs), false)
+			if trk.DofsDist(dofs, lap) > 1e-6 {
+				t.Errorf("cofs=%v dofs=%v: one lap ends at %v", cofs, dofs, lap)
+			}
+			there := advance(trk, dofs, cofs, 0.8, false)
+			back := advance(trk, there, cofs, 0.8, true)
+			if trk.DofsDist(dofs, back) > 1e-6 {
+				t.Errorf("cofs=%v dofs=%v: there and back ends at %v", cofs, dofs, back)
+			}
+		}
+	}
+
+	// Dofs changes faster than the distance on the inside of curves
+	rp := trk.Rp(1)
+	if rp.IsStraight() {
+		t.Fatal("piece 1 should be a curve")
+	}
+	entry := trk.RpEntryDofs(1)
+	inside := advance(trk, entry, rp.CurveRadius(0)-rp.CurveRadius(0.05), 0.1, false) - entry
+	outside := advance(trk, entry, rp.CurveRadius(0.05)-rp.CurveRadius(0), 0.1, false) - entry
+	if (inside <= 0.1) || (outside >= 0.1) {
+		t.Errorf("curves should scale the distance: inside=%v, outside=%v", inside, outside)
+	}
+}
+
+func TestEstimateFollowsVehicle(t *testing.T) {
+	rsys, est := newEstimateSystem(t, robo.DefaultLocalizationParams())
+	testEqual(t, "not localized before driving", false, est.Estimate(0, rsys.Now()).Localized)
+
+	rsys.Vehicles[0].SetCmdDriveDspd(0.6, 1.0)
+	maxDofsErr, maxCofsErr := phys.Meters(0), phys.Meters(0)
+	for i := 0; i < 1000; i++ {
+		if i == 300 {
+			rsys.Vehicles[0].SetCmdDriveCofs(0.05, 0.1)
+		}
+		if i == 600 {
+			rsys.Vehicles[0].SetCmdDriveDspd(0.9, 1.0)
+		}
+		rsys.Tick()
+		e, dofsErr, cofsErr := estimateError(rsys, est, 0)
+		if i < 50 {
+			continue
+		}
+		testEqual(t, "localized", true, e.Localized)
+		maxDofsErr = phys.Meters(math.Max(float64(maxDofsErr), float64(dofsErr)))
+		maxCofsErr = phys.Meters(math.Max(float64(maxCofsErr), float64(cofsErr)))
+	}
+
+	// dead reckoning hides the latency, which is more than a code
+	lparams := rsys.Localizer().Params()
+	latencyDist := phys.Meters(0.9 * float64(lparams.Latency+lparams.LatencyJitter) / float64(phys.SimSecond))
+	if maxDofsErr > latencyDist {
+		t.Errorf("max Dofs error=%v should be less than the latency distance=%v", maxDofsErr, latencyDist)
+	}
+	if maxCofsErr > 0.02 {
+		t.Errorf("max Cofs error=%v is too high", maxCofsErr)
+	}
+	e := est.Estimate(0, rsys.Now())
+	if !phys.MetersPerSecAreNear(0.9, e.Dspd, 0.05) {
+		t.Errorf("estimated Dspd=%v should be near 0.9", e.Dspd)
+	}
+}
+
+func TestEstimateUncertainty(t *testing.T) {
+	lparams := robo.DefaultLocalizationParams()
+	lparams.MinUpdatePeriod = 200 * phys.SimMillisecond
+	lparams.Latency = 0
+	lparams.LatencyJitter = 0
+	rsys, est := newEstimateSystem(t, lparams)
+	rsys.Vehicles[0].SetCmdDriveDspd(0.5, 10)
+	for i := 0; i < 100; i++ {
+		rsys.Tick()
+	}
+
+	// uncertainty grows until the next update, which shrinks it
+	prev := est.Estimate(0, rsys.Now())
+	grew, shrank := false, false
+	for i := 0; i < 50; i++ {
+		rsys.Tick()
+		e := est.Estimate(0, rsys.Now())
+		if e.UpdateTime == prev.UpdateTime {
+			if e.DofsStdDev > prev.DofsStdDev {
+				grew = true
+			}
+		} else if e.DofsStdDev < prev.DofsStdDev {
+			shrank = true
+		}
+		prev = e
+	}
+	testEqual(t, "grew between updates", true, grew)
+	testEqual(t, "shrank on update", true, shrank)
+
+	// a stopped vehicle sends no updates, but the estimate stops too
+	rsys.Vehicles[0].SetCmdDriveDspd(0, 5)
+	for i := 0; i < 100; i++ {
+		rsys.Tick()
+	}
+	e, dofsErr, _ := estimateError(rsys, est, 0)
+	stopped := e.Pose.Dofs
+	for i := 0; i < 100; i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "estimate stays put", stopped, est.Estimate(0, rsys.Now()).Pose.Dofs)
+	if dofsErr > 0.2 {
+		t.Errorf("Dofs error=%v after stopping is too high", dofsErr)
+	}
+	if est.Estimate(0, rsys.Now()).DofsStdDev <= e.DofsStdDev {
+		t.Errorf("uncertainty should keep growing without updates")
+	}
+}
+
+func TestEstimateReversal(t *testing.T) {
+	// the turn starts at the edge, so that the whole road is needed for it
+	rsys, est := newEstimateSystem(t, robo.DefaultLocalizationParams())
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0.1, Cofs: -rsys.Track.MaxCofs()}})
+	rsys.Vehicles[0].SetCmdDriveDspd(0.5, 10)
+	for i := 0; i < 100; i++ {
+		rsys.Tick()
+	}
+	rsys.Vehicles[0].CmdUturn(0.1)
+	for i := 0; (i < 300) && rsys.Vehicles[0].IsTurning(); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "delocalized by the turn", false, est.Estimate(0, rsys.Now()).Localized)
+
+	for i := 0; i < 100; i++ {
+		rsys.Tick()
+	}
+	e, dofsErr, _ := estimateError(rsys, est, 0)
+	testEqual(t, "localized", true, e.Localized)
+	testEqual(t, "reverse", true, e.Dspd < 0)
+	testEqual(t, "DAngle", phys.Radians(math.Pi), e.Pose.DAngle)
+	if dofsErr > 0.05 {
+		t.Errorf("Dofs error=%v after the turn is too high", dofsErr)
+	}
+}
+
+func TestEstimateDelocalized(t *testing.T) {
+	rsys, est := newEstimateSystem(t, robo.DefaultLocalizationParams())
+	rsys.Vehicles[0].SetCmdDriveDspd(0.5, 10)
+	for i := 0; i < 100; i++ {
+		rsys.Tick()
+	}
+
+	// picking up the vehicle delocalizes it, and the next update restarts the
+	// estimate, however far away
+	delocalized := 0
+	rsys.Events.Subscribe(func(ev robo.Event) {
+		delocalized++
+		testEqual(t, "delocalized", false, est.Estimate(0, rsys.Now()).Localized)
+	}, robo.EvVehDelocalized)
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.5, Cofs: -0.03}})
+	for i := 0; i < 60; i++ {
+		rsys.Tick()
+	}
+	e, dofsErr, cofsErr := estimateError(rsys, est, 0)
+	testEqual(t, "delocalized events", 1, delocalized)
+	testEqual(t, "relocalized", true, e.Localized)
+	if (dofsErr > 0.05) || (cofsErr > 0.01) {
+		t.Errorf("errors=(%v, %v) after relocalizing are too high", dofsErr, cofsErr)
+	}
+
+	// removed vehicles are forgotten
+	rsys.RemoveVehicle(0)
+	rsys.Tick()
+	testEqual(t, "forgotten", Estimate{Time: rsys.Now()}, est.Estimate(0, rsys.Now()))
+}
+
+func TestEstimateJump(t *testing.T) {
+	trk := newTestTrack(t)
+	est := New(trk, DefaultParams())
+	u := robo.LocalizationUpdate{Kind: robo.EvLocPositionUpdate, VehId: 3, MeasuredTime: phys.SimSecond, Rpi: 1, LocationId: 2, Dspd: 0.5}
+	est.Update(u)
+	e := est.Estimate(3, u.MeasuredTime)
+	testEqual(t, "localized", true, e.Localized)
+	testEqual(t, "Dofs", trk.RpEntryDofs(1)+0.1, e.Pose.Dofs)
+
+	// an update that is far from the estimate restarts it
+	u.MeasuredTime += 100 * phys.SimMillisecond
+	u.Rpi = 4
+	u.LocationId = 0
+	est.Update(u)
+	e = est.Estimate(3, u.MeasuredTime)
+	testEqual(t, "restarted Dofs", trk.NormalizeDofs(trk.RpEntryDofs(4)+0.02), e.Pose.Dofs)
+}
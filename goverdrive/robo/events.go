@@ -0,0 +1,169 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// events.go is an event bus, so that any number of game modules can react to
+// the same robotics and game events independently, instead of each one polling
+// for changes.
+
+package robo
+
+import (
+	"sort"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// EventKind is the type of an event.
+type EventKind string
+
+const (
+	EvCollisionStart  EventKind = "CollisionStart"  // Collision
+	EvCollisionEnd    EventKind = "CollisionEnd"    // Collision (from the start of the collision)
+	EvLapCompleted    EventKind = "LapCompleted"    // VehId, Lap, Data (eg lapmetrics.CompletedLapInfo)
+	EvRegionEnter     EventKind = "RegionEnter"     // VehId, Region
+	EvRegionExit      EventKind = "RegionExit"      // VehId, Region
+	EvVehRepositioned EventKind = "VehRepositioned" // VehId, Pose
+	EvVehAdded        EventKind = "VehAdded"        // VehId
+	EvVehRemoved      EventKind = "VehRemoved"      // VehId
+	EvPhaseStart      EventKind = "PhaseStart"      // Phase
+	EvPhaseStop       EventKind = "PhaseStop"       // Phase
+
+	EvObstacleCollisionStart EventKind = "ObstacleCollisionStart" // VehId, ObstacleCollision
+	EvObstacleCollisionEnd   EventKind = "ObstacleCollisionEnd"   // VehId, ObstacleCollision (from the start of the collision)
+
+	EvLocPositionUpdate   EventKind = "LocPositionUpdate"   // VehId, Localization
+	EvLocTransitionUpdate EventKind = "LocTransitionUpdate" // VehId, Localization
+	EvVehDelocalized      EventKind = "VehDelocalized"      // VehId, Localization
+
+	EvVehCmdOverBudget EventKind = "VehCmdOverBudget" // VehId, VehCmd
+)
+
+// Event is published on an EventBus. Only the fields relevant to Kind are set;
+// see the EventKind constants.
+type Event struct {
+	Time              phys.SimTime // filled in by the bus
+	Kind              EventKind
+	VehId             int
+	Collision         *CollisionEvent
+	ObstacleCollision *ObstacleCollisionEvent
+	Localization      *LocalizationUpdate
+	VehCmd            *VehCmd
+	Lap               int
+	Region            string
+	Pose              *track.Pose
+	Phase             string
+	Data              interface{} // extra, publisher-specific info
+}
+
+// EventHandler is called for each event that matches a subscription.
+type EventHandler func(ev Event)
+
+// SubscriptionId identifies a subscription, for unsubscribing.
+type SubscriptionId int
+
+type subscription struct {
+	kinds   map[EventKind]bool // empty => all kinds
+	handler EventHandler
+}
+
+func (sub *subscription) matches(kind EventKind) bool {
+	return (len(sub.kinds) == 0) || sub.kinds[kind]
+}
+
+// EventBus delivers published events to subscribers, synchronously and in the
+// order they were published.
+//
+// Handlers run in the middle of the robotics tick or game logic that published
+// the event. Handlers that need to issue vehicle commands should use an
+// EventQueue instead, and drain it from the game phase's Update().
+type EventBus struct {
+	now    phys.SimTime
+	nextId SubscriptionId
+	subs   map[SubscriptionId]*subscription
+}
+
+// NewEventBus creates an event bus with no subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[SubscriptionId]*subscription),
+	}
+}
+
+// Subscribe registers a handler for the listed kinds of events, or all events
+// if no kinds are listed.
+func (eb *EventBus) Subscribe(handler EventHandler, kinds ...EventKind) SubscriptionId {
+	sub := subscription{kinds: make(map[EventKind]bool), handler: handler}
+	for _, k := range kinds {
+		sub.kinds[k] = true
+	}
+	eb.nextId++
+	eb.subs[eb.nextId] = &sub
+	return eb.nextId
+}
+
+// Unsubscribe removes a subscription. It is safe to call from a handler.
+func (eb *EventBus) Unsubscribe(id SubscriptionId) {
+	delete(eb.subs, id)
+}
+
+// Publish stamps the event with the current sim time, and delivers it to all
+// matching subscribers, in the order they subscribed.
+func (eb *EventBus) Publish(ev Event) {
+	ev.Time = eb.now
+	ids := make([]int, 0, len(eb.subs))
+	for id := range eb.subs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		sub, ok := eb.subs[SubscriptionId(id)]
+		if ok && sub.matches(ev.Kind) {
+			sub.handler(ev)
+		}
+	}
+}
+
+// setTime sets the sim time used to stamp events. Only the robotics system
+// should call it.
+func (eb *EventBus) setTime(now phys.SimTime) {
+	eb.now = now
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// EventQueue collects events from a bus until they are drained. Unlike
+// Collider.NewCollisions(), no events are ever dropped, no matter how
+// irregularly the queue is drained.
+type EventQueue struct {
+	bus    *EventBus
+	id     SubscriptionId
+	events []Event
+}
+
+// NewEventQueue creates a queue that collects the listed kinds of events, or all
+// events if no kinds are listed.
+func NewEventQueue(bus *EventBus, kinds ...EventKind) *EventQueue {
+	q := EventQueue{bus: bus, events: make([]Event, 0)}
+	q.id = bus.Subscribe(func(ev Event) { q.events = append(q.events, ev) }, kinds...)
+	return &q
+}
+
+// Drain returns all events since the last call to Drain, in the order they were
+// published.
+func (q *EventQueue) Drain() []Event {
+	events := q.events
+	q.events = make([]Event, 0)
+	return events
+}
+
+// Len returns the number of events waiting to be drained.
+func (q *EventQueue) Len() int {
+	return len(q.events)
+}
+
+// Close unsubscribes the queue from the bus. Events already in the queue can
+// still be drained.
+func (q *EventQueue) Close() {
+	q.bus.Unsubscribe(q.id)
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/robo/track"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	got := make([]EventKind, 0)
+	id := bus.Subscribe(func(ev Event) { got = append(got, ev.Kind) })
+	q := NewEventQueue(bus, EvLapCompleted)
+
+	bus.setTime(10)
+	bus.Publish(Event{Kind: EvPhaseStart})
+	bus.Publish(Event{Kind: EvLapCompleted, Lap: 1})
+	bus.Unsubscribe(id)
+	bus.setTime(20)
+	bus.Publish(Event{Kind: EvLapCompleted, Lap: 2})
+
+	testEqual(t, "len(handler events)", 2, len(got))
+	testEqual(t, "handler event 0", EvPhaseStart, got[0])
+	testEqual(t, "handler event 1", EvLapCompleted, got[1])
+
+	// the queue keeps everything until it is drained
+	testEqual(t, "queue len", 2, q.Len())
+	evs := q.Drain()
+	testEqual(t, "len(queue events)", 2, len(evs))
+	testEqual(t, "queue event 0 lap", 1, evs[0].Lap)
+	testEqual(t, "queue event 0 time", 10, int(evs[0].Time))
+	testEqual(t, "queue event 1 lap", 2, evs[1].Lap)
+	testEqual(t, "queue event 1 time", 20, int(evs[1].Time))
+	testEqual(t, "queue len after drain", 0, q.Len())
+
+	q.Close()
+	bus.Publish(Event{Kind: EvLapCompleted, Lap: 3})
+	testEqual(t, "queue len after close", 0, q.Len())
+}
+
+func TestSystemEvents(t *testing.T) {
+	rsys := newTestSystem(t, nil, nil, "gs", "sk")
+	q := NewEventQueue(rsys.Events)
+
+	// vehicle 1 is far away from vehicle 0, and from the region
+	rsys.WatchRegion("zone", track.NewRegion(&rsys.Track, track.Point{Dofs: 0.5, Cofs: -0.1}, 0.1, 0.2))
+	rsys.Vehicles[1].Reposition(track.Pose{Point: track.Point{Dofs: 0.3, Cofs: 0}})
+	rsys.Tick()
+	evs := q.Drain()
+	testEqual(t, "len(reposition events)", 1, len(evs))
+	testEqual(t, "reposition kind", EvVehRepositioned, evs[0].Kind)
+	testEqual(t, "reposition veh", 1, evs[0].VehId)
+
+	// move vehicle 0 into the region, and onto vehicle 1
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0.55, Cofs: 0}})
+	rsys.Tick()
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0.3, Cofs: 0}})
+	rsys.Tick()
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0.0, Cofs: 0}})
+	rsys.Tick()
+	evs = q.Drain()
+	expKinds := []EventKind{
+		EvVehRepositioned, EvRegionEnter,
+		EvVehRepositioned, EvCollisionStart, EvRegionExit,
+		EvVehRepositioned, EvCollisionEnd,
+	}
+	testEqual(t, "len(events)", len(expKinds), len(evs))
+	for i := 0; (i < len(expKinds)) && (i < len(evs)); i++ {
+		testEqual(t, "event kind", expKinds[i], evs[i].Kind)
+		testEqual(t, "event veh", 0, evs[i].VehId)
+	}
+	if len(evs) == len(expKinds) {
+		testEqual(t, "region name", "zone", evs[1].Region)
+		testEqual(t, "collision veh", 1, evs[3].Collision.VehInfo[1].Id)
+		testEqual(t, "collision time", evs[3].Time, evs[6].Collision.ImpactTime)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"golang.org/x/image/colornames"
 	"image/color"
+	"sort"
+	"strings"
 
 	"github.com/anki/goverdrive/phys"
 )
@@ -39,10 +41,26 @@ type Group struct {
 	lights   []Position
 }
 
+// NewGroup creates a light group, eg for a custom Spec.
+func NewGroup(defColor color.Color, lights []Position) Group {
+	return Group{defColor: defColor, lights: lights}
+}
+
 // Spec is the spec for the full set of lights for the vehicle. The
 // handle to each light group in the set is a string name.
 type Spec map[string]Group
 
+// SpecByName returns one of the predefined specs: "gen2" or "hexpod".
+func SpecByName(name string) (Spec, error) {
+	switch strings.ToLower(name) {
+	case "gen2":
+		return Gen2Spec, nil
+	case "hexpod":
+		return HexPodSpec, nil
+	}
+	return nil, fmt.Errorf("Light spec name=%s is not recognized", name)
+}
+
 // Gen2Spec is matches the real lights on OverDrive (Gen2) vehicle hardware.
 var Gen2Spec = Spec{
 	"top": Group{defColor: colornames.Black,
@@ -104,10 +122,12 @@ type animation struct {
 // VehLights has the physical spec and state of the set of lights for one
 // vehicle.
 type VehLights struct {
-	spec   Spec
-	static map[string]color.Color // light name -> color
-	anim   map[string]*animation  // light name -> animation
-	cur    map[string]color.Color // light name -> color
+	spec     Spec
+	static   map[string]color.Color // light name -> color
+	anim     map[string]*animation  // light name -> animation
+	cur      map[string]color.Color // light name -> color
+	observer func(c Cmd)            // nil => no observer
+	link     func(c Cmd)            // nil => commands take effect immediately; see SetLink
 }
 
 // VehLightState has all of the information needed to visualize one point light.
@@ -133,6 +153,71 @@ func NewVehLights(spec Spec) *VehLights {
 	}
 }
 
+// SetObserver sets a function that is called for every command that changes
+// the lights, eg to record a game session. Use nil to remove the observer.
+func (vl *VehLights) SetObserver(observer func(c Cmd)) {
+	vl.observer = observer
+}
+
+// SetLink sets a function that commands are sent to, instead of taking effect
+// immediately, eg to emulate BLE latency. The link applies them later, with
+// Apply. Use nil to remove the link.
+func (vl *VehLights) SetLink(link func(c Cmd)) {
+	vl.link = link
+}
+
+func (vl *VehLights) notify(c Cmd) {
+	if vl.observer != nil {
+		vl.observer(c)
+	}
+}
+
+// send notifies the observer, and passes the command to the link, if any. It
+// returns false if the command should take effect immediately.
+func (vl *VehLights) send(c Cmd) bool {
+	vl.notify(c)
+	if vl.link == nil {
+		return false
+	}
+	vl.link(c)
+	return true
+}
+
+// Apply makes a command take effect, eg when it arrives over a link. The
+// observer is not notified; it already was, when the command was sent.
+func (vl *VehLights) Apply(now phys.SimTime, c Cmd) {
+	for _, name := range c.Names {
+		vl.validateName(name)
+	}
+	switch c.Kind {
+	case CmdSet:
+		for _, name := range c.Names {
+			vl.anim[name] = nil
+			vl.static[name] = c.Color
+		}
+	case CmdAnimation:
+		for l, name := range c.Names {
+			frames := make([]Frame, len(c.Frames))
+			for i, f := range c.Frames {
+				frames[i] = Frame{Color: f.Colors[l], Tms: f.Tms}
+			}
+			vl.anim[name] = startAnimation(now, frames, c.RepeatCount)
+		}
+	default:
+		panic(fmt.Sprintf("VehLights.Apply(%v) failed, command kind not recognized", c.Kind))
+	}
+}
+
+// Names returns the names of the vehicle's light groups, sorted.
+func (vl *VehLights) Names() []string {
+	names := make([]string, 0, len(vl.spec))
+	for name := range vl.spec {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (vl *VehLights) validateName(name string) {
 	if _, ok := vl.spec[name]; !ok {
 		panic(fmt.Sprintf("VehLights.Set(%v) failed, light name not recognized", name))
@@ -143,6 +228,9 @@ func (vl *VehLights) validateName(name string) {
 // animation for the light.
 func (vl *VehLights) Set(name string, color color.Color) {
 	vl.validateName(name)
+	if vl.send(Cmd{Kind: CmdSet, Names: []string{name}, Color: toRGBA(color)}) {
+		return
+	}
 	vl.anim[name] = nil
 	vl.static[name] = color
 }
@@ -155,6 +243,13 @@ func (vl *VehLights) SetAnimation(now phys.SimTime, name string, frames []Frame,
 	if len(frames) == 0 {
 		panic("SetAnimation with len(frames)=0 is invalid")
 	}
+	cmdFrames := make([]CmdFrame, len(frames))
+	for i, f := range frames {
+		cmdFrames[i] = CmdFrame{Colors: []color.RGBA{toRGBA(f.Color)}, Tms: f.Tms}
+	}
+	if vl.send(Cmd{Kind: CmdAnimation, Names: []string{name}, Frames: cmdFrames, RepeatCount: repeatCount}) {
+		return
+	}
 	vl.anim[name] = startAnimation(now, frames, repeatCount)
 }
 
@@ -165,8 +260,20 @@ func (vl *VehLights) SetGroupAnimation(now phys.SimTime, names []string, gframes
 	if len(gframes) == 0 {
 		panic("SetGroupAnimation with len(gframes)=0 is invalid")
 	}
-	for l, name := range names {
+	for _, name := range names {
 		vl.validateName(name)
+	}
+	cmdFrames := make([]CmdFrame, len(gframes))
+	for i, gf := range gframes {
+		cmdFrames[i] = CmdFrame{Colors: make([]color.RGBA, len(names)), Tms: gf.Tms}
+		for l := range names {
+			cmdFrames[i].Colors[l] = toRGBA(gf.Colors[l])
+		}
+	}
+	if vl.send(Cmd{Kind: CmdAnimation, Names: names, Frames: cmdFrames, RepeatCount: repeatCount}) {
+		return
+	}
+	for l, name := range names {
 		frames := make([]Frame, len(gframes))
 		for i := range gframes {
 			frames[i].Color = gframes[i].Colors[l]
@@ -211,6 +318,39 @@ func (vl *VehLights) VizInfo() []*VizInfo {
 	return vizinfo
 }
 
+//////////////////////////////////////////////////////////////////////
+
+// CmdKind is the kind of light command
+type CmdKind string
+
+const (
+	CmdSet       CmdKind = "set"       // VehLights.Set()
+	CmdAnimation CmdKind = "animation" // VehLights.SetAnimation() or SetGroupAnimation()
+)
+
+// CmdFrame is an animation frame in a Cmd. Colors[i] is the color of light
+// Cmd.Names[i].
+type CmdFrame struct {
+	Colors []color.RGBA
+	Tms    uint // duration, in milliseconds
+}
+
+// Cmd is a serializable record of one command that changed a vehicle's lights.
+// Only the fields relevant to Kind are used.
+type Cmd struct {
+	Kind        CmdKind
+	Names       []string
+	Color       color.RGBA `json:",omitempty"` // CmdSet
+	Frames      []CmdFrame `json:",omitempty"` // CmdAnimation
+	RepeatCount int        `json:",omitempty"` // CmdAnimation
+}
+
+// toRGBA converts any color to its RGBA representation, so that it can be
+// serialized.
+func toRGBA(c color.Color) color.RGBA {
+	return color.RGBAModel.Convert(c).(color.RGBA)
+}
+
 func startAnimation(now phys.SimTime, frames []Frame, repeatCount int) *animation {
 	return &animation{
 		frames:       frames,
@@ -0,0 +1,104 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package light
+
+import (
+	"image/color"
+
+	"github.com/anki/goverdrive/phys"
+)
+
+// GroupSnapshot is a serializable copy of a light Group.
+type GroupSnapshot struct {
+	DefColor color.RGBA
+	Lights   []Position
+}
+
+// SpecSnapshot is a serializable copy of a Spec.
+type SpecSnapshot map[string]GroupSnapshot
+
+// AnimationSnapshot is a serializable copy of an ongoing animation.
+type AnimationSnapshot struct {
+	Frames       []CmdFrame // one color per frame
+	CurFrame     int
+	FrameEndTime phys.SimTime
+	CountLeft    int
+}
+
+// VehLightsSnapshot is a serializable copy of the complete state of a
+// VehLights, except for the observer.
+type VehLightsSnapshot struct {
+	Spec   SpecSnapshot
+	Static map[string]color.RGBA
+	Cur    map[string]color.RGBA
+	Anim   map[string]AnimationSnapshot `json:",omitempty"` // only ongoing animations
+}
+
+// Snapshot returns a serializable copy of the spec.
+func (spec Spec) Snapshot() SpecSnapshot {
+	ss := make(SpecSnapshot, len(spec))
+	for name, g := range spec {
+		ss[name] = GroupSnapshot{DefColor: toRGBA(g.defColor), Lights: append([]Position(nil), g.lights...)}
+	}
+	return ss
+}
+
+// Spec recreates the spec from the snapshot.
+func (ss SpecSnapshot) Spec() Spec {
+	spec := make(Spec, len(ss))
+	for name, gs := range ss {
+		spec[name] = NewGroup(gs.DefColor, append([]Position(nil), gs.Lights...))
+	}
+	return spec
+}
+
+// Snapshot returns a serializable copy of the lights' state.
+func (vl *VehLights) Snapshot() VehLightsSnapshot {
+	snap := VehLightsSnapshot{
+		Spec:   vl.spec.Snapshot(),
+		Static: make(map[string]color.RGBA, len(vl.static)),
+		Cur:    make(map[string]color.RGBA, len(vl.cur)),
+		Anim:   make(map[string]AnimationSnapshot),
+	}
+	for name, c := range vl.static {
+		snap.Static[name] = toRGBA(c)
+	}
+	for name, c := range vl.cur {
+		snap.Cur[name] = toRGBA(c)
+	}
+	for name, a := range vl.anim {
+		if a == nil {
+			continue
+		}
+		frames := make([]CmdFrame, len(a.frames))
+		for i, f := range a.frames {
+			frames[i] = CmdFrame{Colors: []color.RGBA{toRGBA(f.Color)}, Tms: f.Tms}
+		}
+		snap.Anim[name] = AnimationSnapshot{Frames: frames, CurFrame: a.curFrame, FrameEndTime: a.frameEndTime, CountLeft: a.countLeft}
+	}
+	return snap
+}
+
+// NewVehLightsFromSnapshot recreates lights from a snapshot. There is no
+// observer.
+func NewVehLightsFromSnapshot(snap VehLightsSnapshot) *VehLights {
+	vl := NewVehLights(snap.Spec.Spec())
+	for name, c := range snap.Static {
+		vl.static[name] = c
+	}
+	for name, c := range snap.Cur {
+		vl.cur[name] = c
+	}
+	for name, as := range snap.Anim {
+		frames := make([]Frame, len(as.Frames))
+		for i, f := range as.Frames {
+			frames[i] = Frame{Tms: f.Tms}
+			if len(f.Colors) > 0 {
+				frames[i].Color = f.Colors[0]
+			}
+		}
+		vl.anim[name] = &animation{frames: frames, curFrame: as.CurFrame, frameEndTime: as.FrameEndTime, countLeft: as.CountLeft}
+	}
+	return vl
+}
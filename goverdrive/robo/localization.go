@@ -0,0 +1,333 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// localization.go emulates how physical vehicles report where they are. Real
+// vehicles read location codes printed on the road pieces, and only send
+// position, transition and delocalized messages over BLE, at a limited rate,
+// with latency and noise. Game logic can be validated against this stream, and
+// the perceived poses built from it, instead of the perfect CurTrackPose.
+
+package robo
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// LocalizationParams tunes the Localizer. Zero values disable the
+// corresponding latency, drops and noise.
+type LocalizationParams struct {
+	Seed int64 // for the noise and drops; equal seeds give equal streams
+
+	// LocationSpacing is the distance between location codes along each road
+	// piece, at road center. A vehicle reports its position when it reads a new
+	// code, so the rate of updates is proportional to its speed.
+	LocationSpacing phys.Meters
+
+	// MinUpdatePeriod limits the rate of position updates, like the BLE
+	// connection interval. Codes that are read sooner are not reported.
+	MinUpdatePeriod phys.SimTime
+
+	// Latency is the delay from reading a code to the event, plus up to
+	// LatencyJitter of uniformly random delay. The messages from one vehicle are
+	// never reordered.
+	Latency       phys.SimTime
+	LatencyJitter phys.SimTime
+
+	// DropRate is the probability that a position or transition update is lost.
+	DropRate float64
+
+	// CofsNoise and SpeedNoise are the standard deviations of the noise on the
+	// reported center offset and speed.
+	CofsNoise  phys.Meters
+	SpeedNoise phys.MetersPerSec
+
+	// A vehicle cannot read codes while it is turning, or while its angle to the
+	// road exceeds MaxReadAngle, eg after it is spun by a collision. It is
+	// delocalized when it cannot read codes for DelocalizeTime, and immediately
+	// when it is repositioned (ie picked up).
+	MaxReadAngle   phys.Radians
+	DelocalizeTime phys.SimTime
+}
+
+// DefaultLocalizationParams returns parameters that roughly match physical
+// vehicles.
+func DefaultLocalizationParams() LocalizationParams {
+	return LocalizationParams{
+		Seed:            1,
+		LocationSpacing: 0.04,
+		MinUpdatePeriod: 30 * phys.SimMillisecond,
+		Latency:         40 * phys.SimMillisecond,
+		LatencyJitter:   20 * phys.SimMillisecond,
+		DropRate:        0.02,
+		CofsNoise:       0.003,
+		SpeedNoise:      0.02,
+		MaxReadAngle:    0.5,
+		DelocalizeTime:  300 * phys.SimMillisecond,
+	}
+}
+
+// LocalizationUpdate is the information in one localization message from a
+// vehicle, ie ANKI_VEHICLE_MSG_V2C_LOCALIZATION_POSITION_UPDATE,
+// ANKI_VEHICLE_MSG_V2C_LOCALIZATION_TRANSITION_UPDATE or
+// ANKI_VEHICLE_MSG_V2C_VEHICLE_DELOCALIZED.
+type LocalizationUpdate struct {
+	Kind         EventKind    // EvLocPositionUpdate, EvLocTransitionUpdate or EvVehDelocalized
+	VehId        int          //
+	MeasuredTime phys.SimTime // when the vehicle sent it; the event is published later
+
+	Rpi        track.Rpi         // position and transition
+	PrevRpi    track.Rpi         // transition only
+	LocationId int               // position only; index of the location code in the road piece
+	Cofs       phys.Meters       // position and transition; track Cofs, measured, with noise
+	Dspd       phys.MetersPerSec // position only; measured, with noise; always >= 0
+	Reverse    bool              // position and transition; driving counter-trackwise
+}
+
+// PerceivedPose is what a controller knows about a vehicle, from the
+// localization events that have been published so far.
+type PerceivedPose struct {
+	Localized bool
+	Time      phys.SimTime      // MeasuredTime of the latest position or transition update
+	Pose      track.Pose        // Dofs is the center of the latest location code; DAngle is 0 or pi
+	Dspd      phys.MetersPerSec // latest reported speed; <0 => counter-trackwise
+}
+
+// Localizer produces localization events for the vehicles of a System; see
+// System.SetLocalizer.
+type Localizer struct {
+	params  LocalizationParams
+	src     *countingSource
+	rng     *rand.Rand
+	vehs    map[int]*vehLocState // by vehicle Id
+	pending []pendingLocUpdate   // not yet published
+}
+
+// vehLocState is what a vehicle knows about itself, and what a controller knows
+// about it.
+type vehLocState struct {
+	localized       bool
+	rpi             track.Rpi // of the latest code read; <0 => none since delocalized
+	locId           int
+	repositions     int
+	unreadable      bool
+	unreadableSince phys.SimTime
+	lastPosition    phys.SimTime // MeasuredTime of the latest position update
+	lastDeliver     phys.SimTime // of the latest message, so that they are never reordered
+	perceived       PerceivedPose
+}
+
+type pendingLocUpdate struct {
+	at     phys.SimTime
+	update LocalizationUpdate
+}
+
+func NewLocalizer(params LocalizationParams) *Localizer {
+	if params.LocationSpacing <= 0 {
+		panic("NewLocalizer requires LocationSpacing > 0")
+	}
+	src := &countingSource{src: rand.NewSource(params.Seed).(rand.Source64)}
+	return &Localizer{
+		params:  params,
+		src:     src,
+		rng:     rand.New(src),
+		vehs:    make(map[int]*vehLocState),
+		pending: make([]pendingLocUpdate, 0),
+	}
+}
+
+// Params returns the localizer's parameters.
+func (l *Localizer) Params() LocalizationParams {
+	return l.params
+}
+
+// PerceivedPose returns what a controller knows about the vehicle with the Id.
+// It is not Localized until the vehicle's first position update is published.
+func (l *Localizer) PerceivedPose(vehId int) PerceivedPose {
+	if st, ok := l.vehs[vehId]; ok {
+		return st.perceived
+	}
+	return PerceivedPose{}
+}
+
+//////////////////////////////////////////////////////////////////////
+// System
+
+// SetLocalizer turns on localization events for all vehicles. A nil localizer
+// turns them off.
+func (s *System) SetLocalizer(l *Localizer) {
+	s.localizer = l
+}
+
+// Localizer returns the system's localizer, or nil if there is none.
+func (s *System) Localizer() *Localizer {
+	return s.localizer
+}
+
+// update runs once per tick, after the vehicles move. Vehicles are sensed in Id
+// order, so that the noise is repeatable.
+func (l *Localizer) update(s *System) {
+	seen := make(map[int]bool, len(s.Vehicles))
+	for v := range s.Vehicles {
+		seen[s.Vehicles[v].id] = true
+		l.sense(s, &s.Vehicles[v])
+	}
+	for id := range l.vehs {
+		if !seen[id] {
+			delete(l.vehs, id)
+		}
+	}
+	l.publish(s)
+}
+
+func (l *Localizer) sense(s *System, veh *Vehicle) {
+	p := &l.params
+	now := s.now
+	st, ok := l.vehs[veh.id]
+	if !ok {
+		st = &vehLocState{rpi: -1, repositions: veh.repositions}
+		l.vehs[veh.id] = st
+	}
+
+	if veh.repositions != st.repositions {
+		st.repositions = veh.repositions
+		st.rpi = -1
+		st.unreadable = false
+		l.delocalize(st, veh.id, now)
+		return
+	}
+	if !l.canRead(veh) {
+		if !st.unreadable {
+			st.unreadable = true
+			st.unreadableSince = now
+		}
+		if (now - st.unreadableSince) >= p.DelocalizeTime {
+			st.rpi = -1
+			l.delocalize(st, veh.id, now)
+		}
+		return
+	}
+	st.unreadable = false
+	if veh.curVel.D == 0 {
+		// codes are only read when driving over them
+		return
+	}
+
+	pose := veh.CurTrackPose()
+	rpi, rpDofs := s.Track.RpiAndRpDofs(pose.Dofs)
+	locId := int(rpDofs / p.LocationSpacing)
+	if (rpi == st.rpi) && (locId == st.locId) {
+		return
+	}
+	reverse := !veh.IsFacingTrackwise()
+	cofs := pose.Cofs + phys.Meters(l.rng.NormFloat64()*float64(p.CofsNoise))
+	dspd := veh.CurDriveDspd() + phys.MetersPerSec(l.rng.NormFloat64()*float64(p.SpeedNoise))
+	if dspd < 0 {
+		dspd = 0
+	}
+	if (st.rpi >= 0) && (rpi != st.rpi) {
+		l.sendUnlessDropped(st, LocalizationUpdate{Kind: EvLocTransitionUpdate, VehId: veh.id, MeasuredTime: now, Rpi: rpi, PrevRpi: st.rpi, Cofs: cofs, Reverse: reverse})
+	}
+	st.rpi = rpi
+	st.locId = locId
+	if st.localized && ((now - st.lastPosition) < p.MinUpdatePeriod) {
+		return
+	}
+	st.localized = true
+	st.lastPosition = now
+	l.sendUnlessDropped(st, LocalizationUpdate{Kind: EvLocPositionUpdate, VehId: veh.id, MeasuredTime: now, Rpi: rpi, LocationId: locId, Cofs: cofs, Dspd: dspd, Reverse: reverse})
+}
+
+// canRead returns true if the vehicle is able to read the location codes under
+// it.
+func (l *Localizer) canRead(veh *Vehicle) bool {
+	if veh.IsTurning() {
+		return false
+	}
+	absDAngle := math.Abs(float64(veh.curPose.DAngle))
+	roadAngle := math.Min(absDAngle, math.Pi-absDAngle)
+	return roadAngle <= float64(l.params.MaxReadAngle)
+}
+
+func (l *Localizer) delocalize(st *vehLocState, vehId int, now phys.SimTime) {
+	if !st.localized {
+		return
+	}
+	st.localized = false
+	l.send(st, LocalizationUpdate{Kind: EvVehDelocalized, VehId: vehId, MeasuredTime: now})
+}
+
+func (l *Localizer) sendUnlessDropped(st *vehLocState, u LocalizationUpdate) {
+	if (l.params.DropRate > 0) && (l.rng.Float64() < l.params.DropRate) {
+		return
+	}
+	l.send(st, u)
+}
+
+func (l *Localizer) send(st *vehLocState, u LocalizationUpdate) {
+	at := u.MeasuredTime + l.params.Latency
+	if l.params.LatencyJitter > 0 {
+		at += phys.SimTime(l.rng.Int63n(int64(l.params.LatencyJitter)))
+	}
+	if at < st.lastDeliver {
+		at = st.lastDeliver
+	}
+	st.lastDeliver = at
+	l.pending = append(l.pending, pendingLocUpdate{at: at, update: u})
+}
+
+// publish publishes the updates that are due, in the order they are due, and
+// updates the perceived poses. Updates of removed vehicles are dropped.
+func (l *Localizer) publish(s *System) {
+	due := make([]pendingLocUpdate, 0)
+	later := l.pending[:0]
+	for _, pu := range l.pending {
+		if pu.at <= s.now {
+			due = append(due, pu)
+		} else {
+			later = append(later, pu)
+		}
+	}
+	l.pending = later
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at < due[j].at })
+
+	for _, pu := range due {
+		u := pu.update
+		st, ok := l.vehs[u.VehId]
+		if !ok {
+			continue
+		}
+		l.perceive(&s.Track, &st.perceived, u)
+		s.Events.Publish(Event{Kind: u.Kind, VehId: u.VehId, Localization: &u})
+	}
+}
+
+// perceive updates a perceived pose with a localization update.
+func (l *Localizer) perceive(trk *track.Track, pp *PerceivedPose, u LocalizationUpdate) {
+	if u.Kind == EvVehDelocalized {
+		pp.Localized = false
+		return
+	}
+	rp := trk.Rp(u.Rpi)
+	dofs := trk.RpEntryDofs(u.Rpi)
+	if u.Kind == EvLocPositionUpdate {
+		dofs += phys.Meters(math.Min(float64(rp.CenLen()), (float64(u.LocationId)+0.5)*float64(l.params.LocationSpacing)))
+		pp.Dspd = u.Dspd
+		if u.Reverse {
+			pp.Dspd = -u.Dspd
+		}
+	} else if u.Reverse {
+		// entered from the far end
+		dofs += rp.CenLen()
+	}
+	pp.Localized = true
+	pp.Time = u.MeasuredTime
+	pp.Pose = track.Pose{Point: track.Point{Dofs: trk.NormalizeDofs(dofs), Cofs: u.Cofs}, DAngle: 0}
+	if u.Reverse {
+		pp.Pose.DAngle = math.Pi
+	}
+}
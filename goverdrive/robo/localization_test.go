@@ -0,0 +1,276 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// idealLocalizationParams has no latency, drops or noise.
+func idealLocalizationParams() LocalizationParams {
+	return LocalizationParams{LocationSpacing: 0.04, MaxReadAngle: 0.5, DelocalizeTime: 100 * phys.SimMillisecond}
+}
+
+// newLocalizationSystem creates a system with one vehicle, driving at dspd.
+func newLocalizationSystem(t *testing.T, params LocalizationParams, dspd phys.MetersPerSec) (*System, *EventQueue) {
+	rsys := newTestSystem(t, nil, nil, "gs")
+	rsys.SetLocalizer(NewLocalizer(params))
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0.1, Cofs: 0.02}})
+	rsys.Tick()
+	rsys.Vehicles[0].SetCmdDriveDspd(dspd, 100)
+	return rsys, NewEventQueue(rsys.Events, EvLocPositionUpdate, EvLocTransitionUpdate, EvVehDelocalized)
+}
+
+// countEvents counts the events of each kind.
+func countEvents(evs []Event) map[EventKind]int {
+	counts := make(map[EventKind]int)
+	for _, ev := range evs {
+		counts[ev.Kind]++
+	}
+	return counts
+}
+
+func TestLocalizerPositionUpdates(t *testing.T) {
+	params := idealLocalizationParams()
+	rsys, q := newLocalizationSystem(t, params, 0.5)
+	loc := rsys.Localizer()
+	testEqual(t, "not localized before driving", false, loc.PerceivedPose(0).Localized)
+
+	// with no latency, each update is where the vehicle is, to within a code
+	maxErr := params.LocationSpacing/2 + 0.01
+	rsys.Events.Subscribe(func(ev Event) {
+		pp := loc.PerceivedPose(ev.VehId)
+		truth := rsys.Vehicle(ev.VehId).CurTrackPose()
+		if d := rsys.Track.DofsDist(truth.Dofs, pp.Pose.Dofs); d > maxErr {
+			t.Errorf("t=%v perceived Dofs=%v is %v from the truth=%v", ev.Time, pp.Pose.Dofs, d, truth.Dofs)
+		}
+		testMetersAreNear(t, "perceived Cofs", truth.Cofs, pp.Pose.Cofs)
+		testEqual(t, "localized", true, pp.Localized)
+		testEqual(t, "measured now", ev.Time, ev.Localization.MeasuredTime)
+	}, EvLocPositionUpdate)
+
+	odom := rsys.Vehicles[0].Odom()
+	for i := 0; i < 200; i++ {
+		rsys.Tick()
+	}
+	dist := rsys.Vehicles[0].Odom() - odom
+	counts := countEvents(q.Drain())
+
+	// one update per code, ie the rate is proportional to the speed; partial
+	// codes at the end of each piece add a few
+	numCodes := int(dist / params.LocationSpacing)
+	if (counts[EvLocPositionUpdate] < numCodes-1) || (counts[EvLocPositionUpdate] > numCodes+rsys.Track.NumRp()+1) {
+		t.Errorf("%d position updates over %v, expected about %d", counts[EvLocPositionUpdate], dist, numCodes)
+	}
+	testEqual(t, "delocalized", 0, counts[EvVehDelocalized])
+	testEqual(t, "perceived speed", phys.MetersPerSec(0.5), loc.PerceivedPose(0).Dspd)
+
+	// stopped vehicles do not read codes
+	rsys.Vehicles[0].SetCmdDriveDspd(0, 100)
+	rsys.Tick()
+	q.Drain()
+	for i := 0; i < 50; i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "no updates when stopped", 0, q.Len())
+	testEqual(t, "still localized", true, loc.PerceivedPose(0).Localized)
+}
+
+func TestLocalizerRateLimit(t *testing.T) {
+	params := idealLocalizationParams()
+	params.MinUpdatePeriod = 100 * phys.SimMillisecond
+	rsys, q := newLocalizationSystem(t, params, 1.0)
+	for i := 0; i < 200; i++ {
+		rsys.Tick()
+	}
+	var prev *LocalizationUpdate
+	positions := 0
+	for _, ev := range q.Drain() {
+		if ev.Kind != EvLocPositionUpdate {
+			continue
+		}
+		positions++
+		if (prev != nil) && ((ev.Localization.MeasuredTime - prev.MeasuredTime) < params.MinUpdatePeriod) {
+			t.Errorf("position updates at %v and %v are too close", prev.MeasuredTime, ev.Localization.MeasuredTime)
+		}
+		prev = ev.Localization
+	}
+	if (positions < 15) || (positions > 20) {
+		t.Errorf("%d position updates in 2 sec, expected about 20", positions)
+	}
+}
+
+func TestLocalizerTransitions(t *testing.T) {
+	rsys, q := newLocalizationSystem(t, idealLocalizationParams(), 1.0)
+	numRp := rsys.Track.NumRp()
+	truePieces := 0
+	prevRpi, _ := rsys.Track.RpiAndRpDofs(rsys.Vehicles[0].CurTrackPose().Dofs)
+	for i := 0; i < 300; i++ {
+		rsys.Tick()
+		rpi, _ := rsys.Track.RpiAndRpDofs(rsys.Vehicles[0].CurTrackPose().Dofs)
+		if rpi != prevRpi {
+			truePieces++
+		}
+		prevRpi = rpi
+	}
+	if truePieces <= numRp {
+		t.Fatalf("the vehicle should drive more than one lap")
+	}
+	transitions := 0
+	for _, ev := range q.Drain() {
+		if ev.Kind != EvLocTransitionUpdate {
+			continue
+		}
+		transitions++
+		u := ev.Localization
+		testEqual(t, "next piece", (int(u.PrevRpi)+1)%numRp, int(u.Rpi))
+		testEqual(t, "reverse", false, u.Reverse)
+	}
+	testEqual(t, "transitions", truePieces, transitions)
+}
+
+func TestLocalizerLatency(t *testing.T) {
+	params := idealLocalizationParams()
+	params.Latency = 50 * phys.SimMillisecond
+	params.LatencyJitter = 20 * phys.SimMillisecond
+	params.Seed = 3
+	rsys, q := newLocalizationSystem(t, params, 1.0)
+	rsys.Tick()
+	testEqual(t, "no event yet", 0, q.Len())
+	testEqual(t, "not perceived yet", false, rsys.Localizer().PerceivedPose(0).Localized)
+
+	for i := 0; i < 200; i++ {
+		rsys.Tick()
+	}
+	evs := q.Drain()
+	if len(evs) == 0 {
+		t.Fatal("expected events")
+	}
+	prevMeasured := phys.SimTime(0)
+	for _, ev := range evs {
+		delay := ev.Time - ev.Localization.MeasuredTime
+		if (delay < params.Latency) || (delay > params.Latency+params.LatencyJitter+simDeltaT) {
+			t.Errorf("delay=%v is out of range", delay)
+		}
+		if ev.Localization.MeasuredTime < prevMeasured {
+			t.Errorf("update measured at %v was reordered after %v", ev.Localization.MeasuredTime, prevMeasured)
+		}
+		prevMeasured = ev.Localization.MeasuredTime
+	}
+}
+
+func TestLocalizerDelocalized(t *testing.T) {
+	rsys, q := newLocalizationSystem(t, idealLocalizationParams(), 0.5)
+	loc := rsys.Localizer()
+	for i := 0; i < 20; i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "localized", true, loc.PerceivedPose(0).Localized)
+	q.Drain()
+
+	// picking up the vehicle delocalizes it immediately
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.0, Cofs: 0}})
+	rsys.Tick()
+	evs := q.Drain()
+	testEqual(t, "len(reposition events)", 1, len(evs))
+	if len(evs) == 1 {
+		testEqual(t, "delocalized", EvVehDelocalized, evs[0].Kind)
+	}
+	testEqual(t, "perceived", false, loc.PerceivedPose(0).Localized)
+
+	// it relocalizes at the next code, without a transition
+	rsys.Tick()
+	testEqual(t, "relocalized", true, loc.PerceivedPose(0).Localized)
+	counts := countEvents(q.Drain())
+	testEqual(t, "position after reposition", 1, counts[EvLocPositionUpdate])
+	testEqual(t, "no transition after reposition", 0, counts[EvLocTransitionUpdate])
+
+	// a U-turn is long enough to lose the codes, and then the vehicle drives in
+	// reverse
+	rsys.Vehicles[0].CmdUturn(0.1)
+	for i := 0; (i < 200) && rsys.Vehicles[0].IsTurning(); i++ {
+		rsys.Tick()
+	}
+	counts = countEvents(q.Drain())
+	testEqual(t, "delocalized by turn", 1, counts[EvVehDelocalized])
+	for i := 0; i < 10; i++ {
+		rsys.Tick()
+	}
+	pp := loc.PerceivedPose(0)
+	testEqual(t, "localized after turn", true, pp.Localized)
+	testEqual(t, "perceived reverse", true, pp.Dspd < 0)
+	if !phys.RadiansAreNear(math.Pi, pp.Pose.DAngle, 0.001) {
+		t.Errorf("perceived DAngle=%v should be pi", pp.Pose.DAngle)
+	}
+}
+
+func TestLocalizerDrops(t *testing.T) {
+	params := idealLocalizationParams()
+	params.DropRate = 1
+	rsys, q := newLocalizationSystem(t, params, 0.5)
+	for i := 0; i < 100; i++ {
+		rsys.Tick()
+	}
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.0, Cofs: 0}})
+	rsys.Tick()
+	counts := countEvents(q.Drain())
+	testEqual(t, "positions", 0, counts[EvLocPositionUpdate])
+	testEqual(t, "transitions", 0, counts[EvLocTransitionUpdate])
+	testEqual(t, "delocalized is never dropped", 1, counts[EvVehDelocalized])
+}
+
+func TestLocalizerRemovedVehicle(t *testing.T) {
+	params := idealLocalizationParams()
+	params.Latency = 50 * phys.SimMillisecond
+	rsys, q := newLocalizationSystem(t, params, 0.5)
+	for i := 0; i < 20; i++ {
+		rsys.Tick()
+	}
+	q.Drain()
+	rsys.RemoveVehicle(0)
+	for i := 0; i < 20; i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "no updates from a removed vehicle", 0, q.Len())
+	testEqual(t, "forgotten", false, rsys.Localizer().PerceivedPose(0).Localized)
+}
+
+func TestLocalizerSnapshot(t *testing.T) {
+	rsys, _ := newLocalizationSystem(t, DefaultLocalizationParams(), 0.8)
+	for i := 0; i < 57; i++ {
+		rsys.Tick()
+	}
+	snap := mustJSONRoundTrip(t, rsys.Snapshot())
+	if snap.Localization == nil {
+		t.Fatal("localization state is not saved")
+	}
+	testEqual(t, "pending saved", true, len(snap.Localization.Pending) > 0)
+	wantState, wantEvs := runSnapshotSystem(t, rsys, 100)
+	if err := rsys.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	state, evs := runSnapshotSystem(t, rsys, 100)
+	testEqual(t, "rewound state", wantState, state)
+	testEqual(t, "rewound events", wantEvs, evs)
+	perceived, _ := json.Marshal(rsys.Localizer().PerceivedPose(0))
+	if string(perceived) == "{}" {
+		t.Errorf("perceived pose should be restored")
+	}
+
+	rsys.SetLocalizer(nil)
+	if err := rsys.Restore(snap); err == nil {
+		t.Errorf("expected an error for a localizer mismatch")
+	}
+	params := DefaultLocalizationParams()
+	params.Seed++
+	rsys.SetLocalizer(NewLocalizer(params))
+	if err := rsys.Restore(snap); err == nil {
+		t.Errorf("expected an error for a localizer Seed mismatch")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// Obstacles are non-vehicle objects on the track, such as cones, barriers and
+// moving hazards. They take part in collision detection, but they are not
+// pushed around by vehicles.
+
+package robo
+
+import (
+	"image/color"
+	"math"
+	"sort"
+
+	cn "golang.org/x/image/colornames"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+var (
+	DefObstacleColor color.Color = cn.Orange
+)
+
+// Obstacle is a rectangular object on the track, aligned with the road. An
+// obstacle with Dspd!=0 moves along the track, eg a moving hazard.
+type Obstacle struct {
+	Point  track.Point       // center
+	Length phys.Meters       // along the road
+	Width  phys.Meters       // across the road
+	Dspd   phys.MetersPerSec // Dofs speed; <0 => counter-trackwise
+	Color  color.Color       // nil => DefObstacleColor
+	id     int
+}
+
+// Id identifies the obstacle in events. It is assigned by System.AddObstacle.
+func (o *Obstacle) Id() int {
+	return o.id
+}
+
+// ObstacleCollisionEvent captures the information about a vehicle's collision
+// with an obstacle, at the moment of impact. The POI (point-of-impact) is in
+// the vehicle's frame of reference.
+type ObstacleCollisionEvent struct {
+	ImpactTime phys.SimTime
+	ObstacleId int
+	VehInfo    VehicleCollisionInfo
+}
+
+// vehObstPair identifies a collision between a vehicle and an obstacle.
+type vehObstPair struct {
+	VehId, ObstacleId int
+}
+
+//////////////////////////////////////////////////////////////////////
+
+// AddObstacle places an obstacle on the track, and returns its id.
+func (s *System) AddObstacle(o Obstacle) int {
+	s.nextObstacleId++
+	o.id = s.nextObstacleId
+	o.Point.Dofs = s.Track.NormalizeDofs(o.Point.Dofs)
+	s.obstacles = append(s.obstacles, &o)
+	return o.id
+}
+
+// RemoveObstacle removes an obstacle from the track. Ongoing collisions with it
+// end on the next tick.
+func (s *System) RemoveObstacle(id int) {
+	for i, o := range s.obstacles {
+		if o.id == id {
+			s.obstacles = append(s.obstacles[:i], s.obstacles[i+1:]...)
+			return
+		}
+	}
+}
+
+// Obstacle returns the obstacle with the id, or nil if there is none. Games can
+// change its fields, eg to move or resize it.
+func (s *System) Obstacle(id int) *Obstacle {
+	for _, o := range s.obstacles {
+		if o.id == id {
+			return o
+		}
+	}
+	return nil
+}
+
+// Obstacles returns all of the obstacles, in the order they were added.
+func (s *System) Obstacles() []*Obstacle {
+	return s.obstacles
+}
+
+// CurObstacleCollisions returns all vehicle-obstacle collisions that are
+// ongoing, in vehicle order.
+func (s *System) CurObstacleCollisions() []ObstacleCollisionEvent {
+	events := make([]ObstacleCollisionEvent, 0, len(s.obstacleCollisions))
+	for _, pair := range sortedVehObstPairs(s.obstacleCollisions) {
+		events = append(events, s.obstacleCollisions[pair])
+	}
+	return events
+}
+
+// updateObstacles moves the obstacles, detects vehicle collisions with them,
+// and publishes collision start/end events.
+func (s *System) updateObstacles() {
+	fdt := float64(s.dt) * 1e-9
+	for _, o := range s.obstacles {
+		if o.Dspd != 0 {
+			o.Point.Dofs = s.Track.NormalizeDofs(o.Point.Dofs + phys.Meters(float64(o.Dspd)*fdt))
+		}
+	}
+
+	cur := make(map[vehObstPair]ObstacleCollisionEvent)
+	for v := range s.Vehicles {
+		veh := &s.Vehicles[v]
+		vehInputs := vehCollisionInputs{
+			dofs:  veh.CurTrackPose().Dofs,
+			pose:  s.Track.ToPose(veh.CurTrackPose()),
+			len:   veh.Length(),
+			width: veh.Width(),
+		}
+		for _, o := range s.obstacles {
+			maxDim := math.Max(math.Max(float64(veh.Length()), float64(veh.Width())), math.Max(float64(o.Length), float64(o.Width)))
+			if s.Track.DofsDist(vehInputs.dofs, o.Point.Dofs) > phys.Meters(maxDim) {
+				continue
+			}
+			obstInputs := vehCollisionInputs{
+				dofs:  o.Point.Dofs,
+				pose:  s.Track.ToPose(track.Pose{Point: o.Point}),
+				len:   o.Length,
+				width: o.Width,
+			}
+			isCollision, contact := calcContact([2]vehCollisionInputs{vehInputs, obstInputs})
+			if !isCollision {
+				continue
+			}
+			pair := vehObstPair{veh.id, o.id}
+			if prev, ok := s.obstacleCollisions[pair]; ok {
+				cur[pair] = prev // preserve the initial time of impact
+				continue
+			}
+			impactPose := phys.Pose{Point: contact.poi, Theta: 0}
+			cur[pair] = ObstacleCollisionEvent{
+				ImpactTime: s.now,
+				ObstacleId: o.id,
+				VehInfo: VehicleCollisionInfo{
+					Id:   veh.id,
+					POI:  impactPose.RelativeTo(vehInputs.pose).Point,
+					Side: collisionSide(vehInputs, contact.normal),
+				},
+			}
+		}
+	}
+
+	for _, pair := range sortedVehObstPairs(s.obstacleCollisions) {
+		if _, ok := cur[pair]; !ok {
+			oce := s.obstacleCollisions[pair]
+			s.Events.Publish(Event{Kind: EvObstacleCollisionEnd, VehId: pair.VehId, ObstacleCollision: &oce})
+		}
+	}
+	for _, pair := range sortedVehObstPairs(cur) {
+		if _, ok := s.obstacleCollisions[pair]; !ok {
+			oce := cur[pair]
+			s.Events.Publish(Event{Kind: EvObstacleCollisionStart, VehId: pair.VehId, ObstacleCollision: &oce})
+		}
+	}
+	s.obstacleCollisions = cur
+}
+
+func sortedVehObstPairs(m map[vehObstPair]ObstacleCollisionEvent) []vehObstPair {
+	pairs := make([]vehObstPair, 0, len(m))
+	for pair := range m {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return (pairs[i].VehId < pairs[j].VehId) || ((pairs[i].VehId == pairs[j].VehId) && (pairs[i].ObstacleId < pairs[j].ObstacleId))
+	})
+	return pairs
+}
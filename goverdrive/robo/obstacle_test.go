@@ -0,0 +1,62 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/robo/track"
+)
+
+func TestObstacleStatic(t *testing.T) {
+	rsys := newTestSystem(t, nil, nil, "gs")
+	q := NewEventQueue(rsys.Events, EvObstacleCollisionStart, EvObstacleCollisionEnd)
+	id := rsys.AddObstacle(Obstacle{Point: track.Point{Dofs: 1.9, Cofs: 0}, Length: 0.03, Width: 0.03})
+	testEqual(t, "obstacles", 1, len(rsys.Obstacles()))
+
+	// drive into the obstacle
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.7, Cofs: 0}})
+	rsys.Vehicles[0].SetCmdDriveDspd(0.5, 100)
+	for i := 0; (i < 200) && (q.Len() == 0); i++ {
+		rsys.Tick()
+	}
+	evs := q.Drain()
+	testEqual(t, "events", 1, len(evs))
+	testEqual(t, "kind", EvObstacleCollisionStart, evs[0].Kind)
+	testEqual(t, "obstacle", id, evs[0].ObstacleCollision.ObstacleId)
+	testEqual(t, "ongoing", 1, len(rsys.CurObstacleCollisions()))
+	if evs[0].ObstacleCollision.VehInfo.POI.X <= 0 {
+		t.Errorf("POI=%v should be at the front of the vehicle", evs[0].ObstacleCollision.VehInfo.POI)
+	}
+	testEqual(t, "side", CollisionFront, evs[0].ObstacleCollision.VehInfo.Side)
+
+	// removing the obstacle ends the collision
+	rsys.RemoveObstacle(id)
+	rsys.Tick()
+	evs = q.Drain()
+	testEqual(t, "events", 1, len(evs))
+	testEqual(t, "kind", EvObstacleCollisionEnd, evs[0].Kind)
+	testEqual(t, "ongoing", 0, len(rsys.CurObstacleCollisions()))
+	testEqual(t, "obstacles", 0, len(rsys.Obstacles()))
+}
+
+func TestObstacleMoving(t *testing.T) {
+	rsys := newTestSystem(t, nil, nil, "gs")
+	q := NewEventQueue(rsys.Events, EvObstacleCollisionStart)
+
+	// the obstacle drives backwards into the stopped vehicle
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 1.7, Cofs: 0}})
+	id := rsys.AddObstacle(Obstacle{Point: track.Point{Dofs: 1.9, Cofs: 0}, Length: 0.03, Width: 0.03, Dspd: -0.5})
+	dofs0 := rsys.Obstacle(id).Point.Dofs
+	for i := 0; (i < 200) && (q.Len() == 0); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "collisions", 1, q.Len())
+	if rsys.Obstacle(id).Point.Dofs >= dofs0 {
+		t.Errorf("obstacle did not move: Dofs=%v", rsys.Obstacle(id).Point.Dofs)
+	}
+	if rsys.Obstacle(id+1) != nil {
+		t.Errorf("unknown obstacle id should give nil")
+	}
+}
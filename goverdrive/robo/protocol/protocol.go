@@ -0,0 +1,733 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+// Package protocol encodes and decodes the messages that are exchanged with
+// physical vehicles over BLE. It is a byte-exact port of the C library's
+// ankidrive/protocol.h and src/protocol.c.
+//
+// Each message is a size byte, a message id byte and a little-endian payload,
+// where the size counts the id and the payload, but not itself. C2V messages go
+// from the controller to the vehicle, and V2C messages the other way.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	MsgMaxSize        = 20 // ANKI_VEHICLE_MSG_MAX_SIZE; one BLE write
+	MsgPayloadMaxSize = 18 // ANKI_VEHICLE_MSG_PAYLOAD_MAX_SIZE
+	MsgBaseSize       = 1  // ANKI_VEHICLE_MSG_BASE_SIZE; the size of the msg id
+)
+
+// MsgId identifies a vehicle message.
+type MsgId uint8
+
+const (
+	MsgC2VDisconnect                     MsgId = 0x0d
+	MsgC2VPingRequest                    MsgId = 0x16
+	MsgV2CPingResponse                   MsgId = 0x17
+	MsgC2VVersionRequest                 MsgId = 0x18
+	MsgV2CVersionResponse                MsgId = 0x19
+	MsgC2VBatteryLevelRequest            MsgId = 0x1a
+	MsgV2CBatteryLevelResponse           MsgId = 0x1b
+	MsgC2VSetLights                      MsgId = 0x1d
+	MsgC2VSetSpeed                       MsgId = 0x24
+	MsgC2VChangeLane                     MsgId = 0x25
+	MsgC2VCancelLaneChange               MsgId = 0x26
+	MsgV2CLocalizationPositionUpdate     MsgId = 0x27
+	MsgV2CLocalizationTransitionUpdate   MsgId = 0x29
+	MsgV2CLocalizationIntersectionUpdate MsgId = 0x2a
+	MsgV2CVehicleDelocalized             MsgId = 0x2b
+	MsgC2VSetOffsetFromRoadCenter        MsgId = 0x2c
+	MsgV2COffsetFromRoadCenterUpdate     MsgId = 0x2d
+	MsgC2VTurn                           MsgId = 0x32
+	MsgC2VLightsPattern                  MsgId = 0x33
+	MsgC2VSetConfigParams                MsgId = 0x45
+	MsgC2VSdkMode                        MsgId = 0x90
+)
+
+// Msg is one vehicle message. The message types in this package are the only
+// implementations.
+type Msg interface {
+	Id() MsgId
+
+	// payloadSize is the size of the payload, ie the size byte minus
+	// MsgBaseSize.
+	payloadSize() int
+	putPayload(p []byte) error
+	getPayload(p []byte) error
+}
+
+// Marshal returns the bytes of a message, starting with the size byte. It
+// returns an error if the message can not be encoded, eg a LightsPattern with
+// too many channels.
+func Marshal(m Msg) ([]byte, error) {
+	b := make([]byte, 2+m.payloadSize())
+	b[0] = byte(MsgBaseSize + m.payloadSize())
+	b[1] = byte(m.Id())
+	if err := m.putPayload(b[2:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Unmarshal decodes the message at the start of b. The payload may be longer
+// than the message type needs, eg from newer vehicle firmware; the extra bytes
+// are ignored.
+func Unmarshal(b []byte) (Msg, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("Msg is too short: len=%d", len(b))
+	}
+	size := int(b[0])
+	if size < MsgBaseSize {
+		return nil, fmt.Errorf("Msg size=%d is invalid", size)
+	}
+	if len(b) < (1 + size) {
+		return nil, fmt.Errorf("Msg id=0x%02x is truncated: size=%d, len=%d", b[1], size, len(b))
+	}
+
+	m := newMsg(MsgId(b[1]))
+	if m == nil {
+		return nil, fmt.Errorf("Msg id=0x%02x is not recognized", b[1])
+	}
+	payload := b[2 : 1+size]
+	if len(payload) < m.payloadSize() {
+		return nil, fmt.Errorf("Msg id=0x%02x payload is too short: exp=%d, got=%d", b[1], m.payloadSize(), len(payload))
+	}
+	if err := m.getPayload(payload); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadMsgBytes reads the bytes of one message from a stream of messages, eg a
+// socket, where each message starts with its size byte. The message is not
+// decoded, so that a stream can skip messages that Unmarshal rejects.
+func ReadMsgBytes(r io.Reader) ([]byte, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1+int(size[0]))
+	b[0] = size[0]
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// newMsg returns a zero message of the type with the id, or nil.
+func newMsg(id MsgId) Msg {
+	switch id {
+	case MsgC2VDisconnect:
+		return &Disconnect{}
+	case MsgC2VPingRequest:
+		return &PingRequest{}
+	case MsgV2CPingResponse:
+		return &PingResponse{}
+	case MsgC2VVersionRequest:
+		return &VersionRequest{}
+	case MsgV2CVersionResponse:
+		return &VersionResponse{}
+	case MsgC2VBatteryLevelRequest:
+		return &BatteryLevelRequest{}
+	case MsgV2CBatteryLevelResponse:
+		return &BatteryLevelResponse{}
+	case MsgC2VSetLights:
+		return &SetLights{}
+	case MsgC2VSetSpeed:
+		return &SetSpeed{}
+	case MsgC2VChangeLane:
+		return &ChangeLane{}
+	case MsgC2VCancelLaneChange:
+		return &CancelLaneChange{}
+	case MsgV2CLocalizationPositionUpdate:
+		return &LocalizationPositionUpdate{}
+	case MsgV2CLocalizationTransitionUpdate:
+		return &LocalizationTransitionUpdate{}
+	case MsgV2CLocalizationIntersectionUpdate:
+		return &LocalizationIntersectionUpdate{}
+	case MsgV2CVehicleDelocalized:
+		return &VehicleDelocalized{}
+	case MsgC2VSetOffsetFromRoadCenter:
+		return &SetOffsetFromRoadCenter{}
+	case MsgV2COffsetFromRoadCenterUpdate:
+		return &OffsetFromRoadCenterUpdate{}
+	case MsgC2VTurn:
+		return &Turn{}
+	case MsgC2VLightsPattern:
+		return &LightsPattern{}
+	case MsgC2VSetConfigParams:
+		return &SetConfigParams{}
+	case MsgC2VSdkMode:
+		return &SdkMode{}
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Messages without a payload
+
+type Disconnect struct{}
+type PingRequest struct{}
+type PingResponse struct{}
+type VersionRequest struct{}
+type BatteryLevelRequest struct{}
+type CancelLaneChange struct{}
+type VehicleDelocalized struct{}
+
+func (*Disconnect) Id() MsgId          { return MsgC2VDisconnect }
+func (*PingRequest) Id() MsgId         { return MsgC2VPingRequest }
+func (*PingResponse) Id() MsgId        { return MsgV2CPingResponse }
+func (*VersionRequest) Id() MsgId      { return MsgC2VVersionRequest }
+func (*BatteryLevelRequest) Id() MsgId { return MsgC2VBatteryLevelRequest }
+func (*CancelLaneChange) Id() MsgId    { return MsgC2VCancelLaneChange }
+func (*VehicleDelocalized) Id() MsgId  { return MsgV2CVehicleDelocalized }
+
+func (*Disconnect) payloadSize() int          { return 0 }
+func (*PingRequest) payloadSize() int         { return 0 }
+func (*PingResponse) payloadSize() int        { return 0 }
+func (*VersionRequest) payloadSize() int      { return 0 }
+func (*BatteryLevelRequest) payloadSize() int { return 0 }
+func (*CancelLaneChange) payloadSize() int    { return 0 }
+func (*VehicleDelocalized) payloadSize() int  { return 0 }
+
+func (*Disconnect) putPayload(p []byte) error          { return nil }
+func (*PingRequest) putPayload(p []byte) error         { return nil }
+func (*PingResponse) putPayload(p []byte) error        { return nil }
+func (*VersionRequest) putPayload(p []byte) error      { return nil }
+func (*BatteryLevelRequest) putPayload(p []byte) error { return nil }
+func (*CancelLaneChange) putPayload(p []byte) error    { return nil }
+func (*VehicleDelocalized) putPayload(p []byte) error  { return nil }
+
+func (*Disconnect) getPayload(p []byte) error          { return nil }
+func (*PingRequest) getPayload(p []byte) error         { return nil }
+func (*PingResponse) getPayload(p []byte) error        { return nil }
+func (*VersionRequest) getPayload(p []byte) error      { return nil }
+func (*BatteryLevelRequest) getPayload(p []byte) error { return nil }
+func (*CancelLaneChange) getPayload(p []byte) error    { return nil }
+func (*VehicleDelocalized) getPayload(p []byte) error  { return nil }
+
+//////////////////////////////////////////////////////////////////////
+// Version and battery
+
+type VersionResponse struct {
+	Version uint16
+}
+
+func (*VersionResponse) Id() MsgId        { return MsgV2CVersionResponse }
+func (*VersionResponse) payloadSize() int { return 2 }
+
+func (m *VersionResponse) putPayload(p []byte) error {
+	binary.LittleEndian.PutUint16(p, m.Version)
+	return nil
+}
+
+func (m *VersionResponse) getPayload(p []byte) error {
+	m.Version = binary.LittleEndian.Uint16(p)
+	return nil
+}
+
+type BatteryLevelResponse struct {
+	BatteryLevel uint16 // millivolts
+}
+
+func (*BatteryLevelResponse) Id() MsgId        { return MsgV2CBatteryLevelResponse }
+func (*BatteryLevelResponse) payloadSize() int { return 2 }
+
+func (m *BatteryLevelResponse) putPayload(p []byte) error {
+	binary.LittleEndian.PutUint16(p, m.BatteryLevel)
+	return nil
+}
+
+func (m *BatteryLevelResponse) getPayload(p []byte) error {
+	m.BatteryLevel = binary.LittleEndian.Uint16(p)
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// SDK mode and configuration
+
+const (
+	// SdkOptionOverrideLocalization must be set when enabling SDK mode, for
+	// the vehicle to accept speed and lane change commands.
+	SdkOptionOverrideLocalization = 0x1
+)
+
+type SdkMode struct {
+	On    uint8 // 1 => on, 0 => off
+	Flags uint8 // eg SdkOptionOverrideLocalization
+}
+
+func (*SdkMode) Id() MsgId        { return MsgC2VSdkMode }
+func (*SdkMode) payloadSize() int { return 2 }
+
+func (m *SdkMode) putPayload(p []byte) error {
+	p[0], p[1] = m.On, m.Flags
+	return nil
+}
+
+func (m *SdkMode) getPayload(p []byte) error {
+	m.On, m.Flags = p[0], p[1]
+	return nil
+}
+
+// TrackMaterial is the material that the location codes are printed on.
+type TrackMaterial uint8
+
+const (
+	TrackMaterialPlastic TrackMaterial = 0
+	TrackMaterialVinyl   TrackMaterial = 1
+)
+
+const (
+	SuperCodeNone      = 0
+	SuperCodeBoostJump = 1
+	SuperCodeAll       = SuperCodeBoostJump
+)
+
+// SetConfigParams is experimental, like in the C library.
+type SetConfigParams struct {
+	SuperCodeParseMask uint8 // eg SuperCodeAll
+	TrackMaterial      TrackMaterial
+}
+
+func (*SetConfigParams) Id() MsgId        { return MsgC2VSetConfigParams }
+func (*SetConfigParams) payloadSize() int { return 2 }
+
+func (m *SetConfigParams) putPayload(p []byte) error {
+	p[0], p[1] = m.SuperCodeParseMask, uint8(m.TrackMaterial)
+	return nil
+}
+
+func (m *SetConfigParams) getPayload(p []byte) error {
+	m.SuperCodeParseMask, m.TrackMaterial = p[0], TrackMaterial(p[1])
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Driving
+
+type SetSpeed struct {
+	SpeedMmPerSec              int16
+	AccelMmPerSec2             int16
+	RespectRoadPieceSpeedLimit uint8 // 1 => respect, 0 => ignore
+}
+
+func (*SetSpeed) Id() MsgId        { return MsgC2VSetSpeed }
+func (*SetSpeed) payloadSize() int { return 5 }
+
+func (m *SetSpeed) putPayload(p []byte) error {
+	binary.LittleEndian.PutUint16(p[0:], uint16(m.SpeedMmPerSec))
+	binary.LittleEndian.PutUint16(p[2:], uint16(m.AccelMmPerSec2))
+	p[4] = m.RespectRoadPieceSpeedLimit
+	return nil
+}
+
+func (m *SetSpeed) getPayload(p []byte) error {
+	m.SpeedMmPerSec = int16(binary.LittleEndian.Uint16(p[0:]))
+	m.AccelMmPerSec2 = int16(binary.LittleEndian.Uint16(p[2:]))
+	m.RespectRoadPieceSpeedLimit = p[4]
+	return nil
+}
+
+// SetOffsetFromRoadCenter sets the vehicle's internal offset from road center,
+// which a following ChangeLane is relative to.
+type SetOffsetFromRoadCenter struct {
+	OffsetMm float32
+}
+
+func (*SetOffsetFromRoadCenter) Id() MsgId        { return MsgC2VSetOffsetFromRoadCenter }
+func (*SetOffsetFromRoadCenter) payloadSize() int { return 4 }
+
+func (m *SetOffsetFromRoadCenter) putPayload(p []byte) error {
+	putFloat32(p, m.OffsetMm)
+	return nil
+}
+
+func (m *SetOffsetFromRoadCenter) getPayload(p []byte) error {
+	m.OffsetMm = getFloat32(p)
+	return nil
+}
+
+type ChangeLane struct {
+	HorizontalSpeedMmPerSec  uint16
+	HorizontalAccelMmPerSec2 uint16
+	OffsetFromRoadCenterMm   float32
+	HopIntent                uint8
+	Tag                      uint8
+}
+
+func (*ChangeLane) Id() MsgId        { return MsgC2VChangeLane }
+func (*ChangeLane) payloadSize() int { return 10 }
+
+func (m *ChangeLane) putPayload(p []byte) error {
+	binary.LittleEndian.PutUint16(p[0:], m.HorizontalSpeedMmPerSec)
+	binary.LittleEndian.PutUint16(p[2:], m.HorizontalAccelMmPerSec2)
+	putFloat32(p[4:], m.OffsetFromRoadCenterMm)
+	p[8], p[9] = m.HopIntent, m.Tag
+	return nil
+}
+
+func (m *ChangeLane) getPayload(p []byte) error {
+	m.HorizontalSpeedMmPerSec = binary.LittleEndian.Uint16(p[0:])
+	m.HorizontalAccelMmPerSec2 = binary.LittleEndian.Uint16(p[2:])
+	m.OffsetFromRoadCenterMm = getFloat32(p[4:])
+	m.HopIntent, m.Tag = p[8], p[9]
+	return nil
+}
+
+// TurnType matches robo.TurnType.
+type TurnType uint8
+
+const (
+	TurnNone      TurnType = 0
+	TurnLeft      TurnType = 1
+	TurnRight     TurnType = 2
+	TurnUturn     TurnType = 3
+	TurnUturnJump TurnType = 4
+)
+
+// TurnTrigger is when the vehicle executes a turn. Vehicles only support
+// TurnTriggerImmediate.
+type TurnTrigger uint8
+
+const (
+	TurnTriggerImmediate    TurnTrigger = 0
+	TurnTriggerIntersection TurnTrigger = 1
+)
+
+type Turn struct {
+	Type    TurnType
+	Trigger TurnTrigger
+}
+
+func (*Turn) Id() MsgId        { return MsgC2VTurn }
+func (*Turn) payloadSize() int { return 2 }
+
+func (m *Turn) putPayload(p []byte) error {
+	p[0], p[1] = uint8(m.Type), uint8(m.Trigger)
+	return nil
+}
+
+func (m *Turn) getPayload(p []byte) error {
+	m.Type, m.Trigger = TurnType(p[0]), TurnTrigger(p[1])
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Localization
+
+// Masks of the ParsingFlags of LocalizationPositionUpdate.
+const (
+	ParseFlagsMaskNumBits        = 0x0f // bits per code that were read
+	ParseFlagsMaskInvertedColor  = 0x80 // the track has an inverted code scheme
+	ParseFlagsMaskReverseParsing = 0x40 // the code was read in reverse
+	ParseFlagsMaskReverseDriving = 0x20 // the vehicle is driving in reverse
+)
+
+type LocalizationPositionUpdate struct {
+	LocationId             uint8
+	RoadPieceId            uint8
+	OffsetFromRoadCenterMm float32
+	SpeedMmPerSec          uint16
+	ParsingFlags           uint8
+
+	// ACK of the commands received
+	LastRecvLaneChangeCmdId            uint8
+	LastExecLaneChangeCmdId            uint8
+	LastDesiredLaneChangeSpeedMmPerSec uint16
+	LastDesiredSpeedMmPerSec           uint16
+}
+
+func (*LocalizationPositionUpdate) Id() MsgId        { return MsgV2CLocalizationPositionUpdate }
+func (*LocalizationPositionUpdate) payloadSize() int { return 15 }
+
+func (m *LocalizationPositionUpdate) putPayload(p []byte) error {
+	p[0], p[1] = m.LocationId, m.RoadPieceId
+	putFloat32(p[2:], m.OffsetFromRoadCenterMm)
+	binary.LittleEndian.PutUint16(p[6:], m.SpeedMmPerSec)
+	p[8], p[9], p[10] = m.ParsingFlags, m.LastRecvLaneChangeCmdId, m.LastExecLaneChangeCmdId
+	binary.LittleEndian.PutUint16(p[11:], m.LastDesiredLaneChangeSpeedMmPerSec)
+	binary.LittleEndian.PutUint16(p[13:], m.LastDesiredSpeedMmPerSec)
+	return nil
+}
+
+func (m *LocalizationPositionUpdate) getPayload(p []byte) error {
+	m.LocationId, m.RoadPieceId = p[0], p[1]
+	m.OffsetFromRoadCenterMm = getFloat32(p[2:])
+	m.SpeedMmPerSec = binary.LittleEndian.Uint16(p[6:])
+	m.ParsingFlags, m.LastRecvLaneChangeCmdId, m.LastExecLaneChangeCmdId = p[8], p[9], p[10]
+	m.LastDesiredLaneChangeSpeedMmPerSec = binary.LittleEndian.Uint16(p[11:])
+	m.LastDesiredSpeedMmPerSec = binary.LittleEndian.Uint16(p[13:])
+	return nil
+}
+
+type LocalizationTransitionUpdate struct {
+	RoadPieceIdx           int8
+	RoadPieceIdxPrev       int8
+	OffsetFromRoadCenterMm float32
+
+	// ACK of the commands received
+	LastRecvLaneChangeId               uint8
+	LastExecLaneChangeId               uint8
+	LastDesiredLaneChangeSpeedMmPerSec uint16
+	AveFollowLineDriftPixels           int8
+	HadLaneChangeActivity              uint8
+
+	// track grade detection
+	UphillCounter   uint8
+	DownhillCounter uint8
+
+	// wheel displacement since the last transition bar
+	LeftWheelDistCm  uint8
+	RightWheelDistCm uint8
+}
+
+func (*LocalizationTransitionUpdate) Id() MsgId        { return MsgV2CLocalizationTransitionUpdate }
+func (*LocalizationTransitionUpdate) payloadSize() int { return 16 }
+
+func (m *LocalizationTransitionUpdate) putPayload(p []byte) error {
+	p[0], p[1] = uint8(m.RoadPieceIdx), uint8(m.RoadPieceIdxPrev)
+	putFloat32(p[2:], m.OffsetFromRoadCenterMm)
+	p[6], p[7] = m.LastRecvLaneChangeId, m.LastExecLaneChangeId
+	binary.LittleEndian.PutUint16(p[8:], m.LastDesiredLaneChangeSpeedMmPerSec)
+	p[10], p[11] = uint8(m.AveFollowLineDriftPixels), m.HadLaneChangeActivity
+	p[12], p[13] = m.UphillCounter, m.DownhillCounter
+	p[14], p[15] = m.LeftWheelDistCm, m.RightWheelDistCm
+	return nil
+}
+
+func (m *LocalizationTransitionUpdate) getPayload(p []byte) error {
+	m.RoadPieceIdx, m.RoadPieceIdxPrev = int8(p[0]), int8(p[1])
+	m.OffsetFromRoadCenterMm = getFloat32(p[2:])
+	m.LastRecvLaneChangeId, m.LastExecLaneChangeId = p[6], p[7]
+	m.LastDesiredLaneChangeSpeedMmPerSec = binary.LittleEndian.Uint16(p[8:])
+	m.AveFollowLineDriftPixels, m.HadLaneChangeActivity = int8(p[10]), p[11]
+	m.UphillCounter, m.DownhillCounter = p[12], p[13]
+	m.LeftWheelDistCm, m.RightWheelDistCm = p[14], p[15]
+	return nil
+}
+
+// IntersectionCode is the code that a LocalizationIntersectionUpdate read.
+type IntersectionCode uint8
+
+const (
+	IntersectionCodeNone        IntersectionCode = 0
+	IntersectionCodeEntryFirst  IntersectionCode = 1
+	IntersectionCodeExitFirst   IntersectionCode = 2
+	IntersectionCodeEntrySecond IntersectionCode = 3
+	IntersectionCodeExitSecond  IntersectionCode = 4
+)
+
+type LocalizationIntersectionUpdate struct {
+	RoadPieceIdx                int8
+	OffsetFromRoadCenterMm      float32
+	IntersectionCode            IntersectionCode
+	IsExiting                   uint8
+	MmSinceLastTransitionBar    uint16
+	MmSinceLastIntersectionCode uint16
+}
+
+func (*LocalizationIntersectionUpdate) Id() MsgId        { return MsgV2CLocalizationIntersectionUpdate }
+func (*LocalizationIntersectionUpdate) payloadSize() int { return 11 }
+
+func (m *LocalizationIntersectionUpdate) putPayload(p []byte) error {
+	p[0] = uint8(m.RoadPieceIdx)
+	putFloat32(p[1:], m.OffsetFromRoadCenterMm)
+	p[5], p[6] = uint8(m.IntersectionCode), m.IsExiting
+	binary.LittleEndian.PutUint16(p[7:], m.MmSinceLastTransitionBar)
+	binary.LittleEndian.PutUint16(p[9:], m.MmSinceLastIntersectionCode)
+	return nil
+}
+
+func (m *LocalizationIntersectionUpdate) getPayload(p []byte) error {
+	m.RoadPieceIdx = int8(p[0])
+	m.OffsetFromRoadCenterMm = getFloat32(p[1:])
+	m.IntersectionCode, m.IsExiting = IntersectionCode(p[5]), p[6]
+	m.MmSinceLastTransitionBar = binary.LittleEndian.Uint16(p[7:])
+	m.MmSinceLastIntersectionCode = binary.LittleEndian.Uint16(p[9:])
+	return nil
+}
+
+type OffsetFromRoadCenterUpdate struct {
+	OffsetFromRoadCenterMm float32
+	LaneChangeId           uint8
+}
+
+func (*OffsetFromRoadCenterUpdate) Id() MsgId        { return MsgV2COffsetFromRoadCenterUpdate }
+func (*OffsetFromRoadCenterUpdate) payloadSize() int { return 5 }
+
+func (m *OffsetFromRoadCenterUpdate) putPayload(p []byte) error {
+	putFloat32(p, m.OffsetFromRoadCenterMm)
+	p[4] = m.LaneChangeId
+	return nil
+}
+
+func (m *OffsetFromRoadCenterUpdate) getPayload(p []byte) error {
+	m.OffsetFromRoadCenterMm = getFloat32(p)
+	m.LaneChangeId = p[4]
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Lights
+
+// Bits of the LightMask of SetLights. The low nibble says which lights are
+// valid, and the high nibble is their values.
+const (
+	LightHeadlights  = 0
+	LightBrakelights = 1
+	LightFrontlights = 2
+	LightEngine      = 3
+)
+
+type SetLights struct {
+	LightMask uint8
+}
+
+func (*SetLights) Id() MsgId        { return MsgC2VSetLights }
+func (*SetLights) payloadSize() int { return 1 }
+
+func (m *SetLights) putPayload(p []byte) error {
+	p[0] = m.LightMask
+	return nil
+}
+
+func (m *SetLights) getPayload(p []byte) error {
+	m.LightMask = p[0]
+	return nil
+}
+
+const (
+	MaxLightIntensity = 14 // ANKI_VEHICLE_MAX_LIGHT_INTENSITY
+	MaxLightTime      = 11 // ANKI_VEHICLE_MAX_LIGHT_TIME
+
+	// LightChannelCountMax is the most channels in one LightsPattern.
+	LightChannelCountMax = 3
+)
+
+// LightChannel is an LED channel: the RGB engine lights, the tail lights, or
+// the front lights.
+type LightChannel uint8
+
+const (
+	LightChannelRed    LightChannel = 0
+	LightChannelTail   LightChannel = 1
+	LightChannelBlue   LightChannel = 2
+	LightChannelGreen  LightChannel = 3
+	LightChannelFrontL LightChannel = 4
+	LightChannelFrontR LightChannel = 5
+	LightChannelCount  LightChannel = 6
+)
+
+// LightEffect is how a channel's intensity changes between Start and End.
+type LightEffect uint8
+
+const (
+	LightEffectSteady LightEffect = 0 // intensity is Start
+	LightEffectFade   LightEffect = 1 // from Start to End
+	LightEffectThrob  LightEffect = 2 // from Start to End and back to Start
+	LightEffectFlash  LightEffect = 3 // on between time Start and time End, inclusive
+	LightEffectRandom LightEffect = 4 // flash erratically; Start and End are ignored
+	LightEffectCount  LightEffect = 5
+)
+
+// LightConfig is the pattern of one channel, in a LightsPattern.
+type LightConfig struct {
+	Channel        LightChannel
+	Effect         LightEffect
+	Start          uint8
+	End            uint8
+	CyclesPer10Sec uint8
+}
+
+// NewLightConfig returns a channel config like anki_vehicle_light_config(),
+// which limits the intensities and cycles.
+// NOTE: Like the C library, cyclesPerMin is limited to MaxLightTime before it
+// is converted, so CyclesPer10Sec is at most 1.
+func NewLightConfig(channel LightChannel, effect LightEffect, start, end uint8, cyclesPerMin uint16) LightConfig {
+	if start > MaxLightIntensity {
+		start = MaxLightIntensity
+	}
+	if end > MaxLightIntensity {
+		end = MaxLightIntensity
+	}
+	if cyclesPerMin > MaxLightTime {
+		cyclesPerMin = MaxLightTime
+	}
+	return LightConfig{
+		Channel:        channel,
+		Effect:         effect,
+		Start:          start,
+		End:            end,
+		CyclesPer10Sec: uint8(cyclesPerMin / 6),
+	}
+}
+
+// LightsPattern sets the patterns of up to LightChannelCountMax channels. It is
+// always sent at full size, with unused channels zeroed.
+type LightsPattern struct {
+	Channels []LightConfig
+}
+
+// Append adds a channel config to the pattern. It returns false if the
+// pattern is full.
+func (m *LightsPattern) Append(cfg LightConfig) bool {
+	if len(m.Channels) >= LightChannelCountMax {
+		return false
+	}
+	m.Channels = append(m.Channels, cfg)
+	return true
+}
+
+func (*LightsPattern) Id() MsgId        { return MsgC2VLightsPattern }
+func (*LightsPattern) payloadSize() int { return 1 + (5 * LightChannelCountMax) }
+
+func (m *LightsPattern) putPayload(p []byte) error {
+	if len(m.Channels) > LightChannelCountMax {
+		return fmt.Errorf("LightsPattern channel count=%d is invalid; max is %d", len(m.Channels), LightChannelCountMax)
+	}
+	p[0] = uint8(len(m.Channels))
+	for i, cfg := range m.Channels {
+		c := p[1+(5*i):]
+		c[0], c[1], c[2], c[3], c[4] = uint8(cfg.Channel), uint8(cfg.Effect), cfg.Start, cfg.End, cfg.CyclesPer10Sec
+	}
+	return nil
+}
+
+func (m *LightsPattern) getPayload(p []byte) error {
+	n := int(p[0])
+	if n > LightChannelCountMax {
+		return fmt.Errorf("LightsPattern channel count=%d is invalid; max is %d", n, LightChannelCountMax)
+	}
+	m.Channels = make([]LightConfig, n)
+	for i := range m.Channels {
+		c := p[1+(5*i):]
+		m.Channels[i] = LightConfig{
+			Channel:        LightChannel(c[0]),
+			Effect:         LightEffect(c[1]),
+			Start:          c[2],
+			End:            c[3],
+			CyclesPer10Sec: c[4],
+		}
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+
+func putFloat32(p []byte, f float32) {
+	binary.LittleEndian.PutUint32(p, math.Float32bits(f))
+}
+
+func getFloat32(p []byte) float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(p))
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func testEqual(t *testing.T, desc string, exp interface{}, got interface{}) {
+	if exp != got {
+		t.Errorf("%s error: exp=%v, got=%v", desc, exp, got)
+	}
+}
+
+func testBytes(t *testing.T, desc string, exp []byte, got []byte) {
+	if !bytes.Equal(exp, got) {
+		t.Errorf("%s error: exp=% x, got=% x", desc, exp, got)
+	}
+}
+
+// mustMarshal marshals a message, failing the test on error.
+func mustMarshal(t *testing.T, m Msg) []byte {
+	b, err := Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testRoundTrip checks that a message marshals to the bytes, and that the
+// bytes unmarshal to the message.
+func testRoundTrip(t *testing.T, desc string, m Msg, b []byte) {
+	testBytes(t, desc, b, mustMarshal(t, m))
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Errorf("%s error: %v", desc, err)
+		return
+	}
+	if !reflect.DeepEqual(m, got) {
+		t.Errorf("%s error: exp=%+v, got=%+v", desc, m, got)
+	}
+}
+
+// The vectors are from test/test_protocol.c.
+func TestCVectors(t *testing.T) {
+	testRoundTrip(t, "sdk mode", &SdkMode{On: 1, Flags: SdkOptionOverrideLocalization},
+		[]byte{0x03, 0x90, 0x01, 0x01})
+	testRoundTrip(t, "set speed", &SetSpeed{SpeedMmPerSec: 1000, AccelMmPerSec2: 25000},
+		[]byte{0x06, 0x24, 0xe8, 0x03, 0xa8, 0x61, 0x00})
+	testRoundTrip(t, "set offset", &SetOffsetFromRoadCenter{OffsetMm: 0},
+		[]byte{0x05, 0x2c, 0, 0, 0, 0})
+	testRoundTrip(t, "change lane", &ChangeLane{HorizontalSpeedMmPerSec: 1000, HorizontalAccelMmPerSec2: 10000, OffsetFromRoadCenterMm: 20},
+		[]byte{0x0b, 0x25, 0xe8, 0x03, 0x10, 0x27, 0x00, 0x00, 0xa0, 0x41, 0, 0})
+	testRoundTrip(t, "turn 180", &Turn{Type: TurnUturn, Trigger: TurnTriggerImmediate},
+		[]byte{0x03, 0x32, 0x03, 0x00})
+	testRoundTrip(t, "disconnect", &Disconnect{}, []byte{0x01, 0x0d})
+	testRoundTrip(t, "version request", &VersionRequest{}, []byte{0x01, 0x18})
+	testRoundTrip(t, "battery request", &BatteryLevelRequest{}, []byte{0x01, 0x1a})
+
+	// regression test against a STEADY LIGHT_BLUE, max intensity
+	var lp LightsPattern
+	testEqual(t, "append red", true, lp.Append(NewLightConfig(LightChannelRed, LightEffectSteady, 0, 0, 0)))
+	testEqual(t, "append green", true, lp.Append(NewLightConfig(LightChannelGreen, LightEffectSteady, 0, 0, 0)))
+	testEqual(t, "append blue", true, lp.Append(NewLightConfig(LightChannelBlue, LightEffectSteady, MaxLightIntensity, MaxLightIntensity, 0)))
+	testEqual(t, "append when full", false, lp.Append(NewLightConfig(LightChannelTail, LightEffectSteady, 0, 0, 0)))
+	testRoundTrip(t, "lights steady blue", &lp, []byte{
+		0x11, 0x33,
+		0x03,
+		0x00, 0x00, 0x00, 0x00, 0x00,
+		0x03, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x0e, 0x0e, 0x00,
+	})
+}
+
+func TestLightConfig(t *testing.T) {
+	cfg := NewLightConfig(LightChannelRed, LightEffectThrob, 0, 10, 10)
+	testEqual(t, "cycles", uint8(1), cfg.CyclesPer10Sec)
+	cfg = NewLightConfig(LightChannelRed, LightEffectThrob, 20, 30, 600)
+	testEqual(t, "start", uint8(MaxLightIntensity), cfg.Start)
+	testEqual(t, "end", uint8(MaxLightIntensity), cfg.End)
+	testEqual(t, "cycles", uint8(MaxLightTime/6), cfg.CyclesPer10Sec)
+
+	// unused channels are sent as zeros
+	lp := &LightsPattern{}
+	lp.Append(NewLightConfig(LightChannelTail, LightEffectFlash, 2, 5, 6))
+	testRoundTrip(t, "one channel", lp, []byte{
+		0x11, 0x33,
+		0x01,
+		0x01, 0x03, 0x02, 0x05, 0x01,
+		0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0,
+	})
+}
+
+func TestSizes(t *testing.T) {
+	// size bytes from ankidrive/protocol.h
+	sizes := []struct {
+		m    Msg
+		size int
+	}{
+		{&Disconnect{}, 1},
+		{&PingRequest{}, 1},
+		{&PingResponse{}, 1},
+		{&VersionRequest{}, 1},
+		{&VersionResponse{}, 3},
+		{&BatteryLevelRequest{}, 1},
+		{&BatteryLevelResponse{}, 3},
+		{&SetLights{}, 2},
+		{&SetSpeed{}, 6},
+		{&ChangeLane{}, 11},
+		{&CancelLaneChange{}, 1},
+		{&LocalizationPositionUpdate{}, 16},
+		{&LocalizationTransitionUpdate{}, 17},
+		{&LocalizationIntersectionUpdate{}, 12},
+		{&VehicleDelocalized{}, 1},
+		{&SetOffsetFromRoadCenter{}, 5},
+		{&OffsetFromRoadCenterUpdate{}, 6},
+		{&Turn{}, 3},
+		{&LightsPattern{}, 17},
+		{&SetConfigParams{}, 3},
+		{&SdkMode{}, 3},
+	}
+	for _, s := range sizes {
+		b := mustMarshal(t, s.m)
+		testEqual(t, "size", s.size, int(b[0]))
+		testEqual(t, "len", s.size+1, len(b))
+		testEqual(t, "id", s.m.Id(), MsgId(b[1]))
+		if len(b) > MsgMaxSize {
+			t.Errorf("Msg id=0x%02x is larger than one write", b[1])
+		}
+	}
+}
+
+func TestV2CMsgs(t *testing.T) {
+	testRoundTrip(t, "ping response", &PingResponse{}, []byte{0x01, 0x17})
+	testRoundTrip(t, "version", &VersionResponse{Version: 0x2e6b}, []byte{0x03, 0x19, 0x6b, 0x2e})
+	testRoundTrip(t, "battery", &BatteryLevelResponse{BatteryLevel: 3900}, []byte{0x03, 0x1b, 0x3c, 0x0f})
+	testRoundTrip(t, "delocalized", &VehicleDelocalized{}, []byte{0x01, 0x2b})
+
+	testRoundTrip(t, "position update", &LocalizationPositionUpdate{
+		LocationId:                         12,
+		RoadPieceId:                        33,
+		OffsetFromRoadCenterMm:             -20,
+		SpeedMmPerSec:                      600,
+		ParsingFlags:                       ParseFlagsMaskReverseDriving | 7,
+		LastRecvLaneChangeCmdId:            4,
+		LastExecLaneChangeCmdId:            3,
+		LastDesiredLaneChangeSpeedMmPerSec: 100,
+		LastDesiredSpeedMmPerSec:           700,
+	}, []byte{0x10, 0x27, 12, 33, 0x00, 0x00, 0xa0, 0xc1, 0x58, 0x02, 0x27, 4, 3, 0x64, 0x00, 0xbc, 0x02})
+
+	testRoundTrip(t, "transition update", &LocalizationTransitionUpdate{
+		RoadPieceIdx:                       5,
+		RoadPieceIdxPrev:                   -1,
+		OffsetFromRoadCenterMm:             1.5,
+		LastRecvLaneChangeId:               2,
+		LastExecLaneChangeId:               2,
+		LastDesiredLaneChangeSpeedMmPerSec: 0x1234,
+		AveFollowLineDriftPixels:           -3,
+		HadLaneChangeActivity:              1,
+		UphillCounter:                      6,
+		DownhillCounter:                    7,
+		LeftWheelDistCm:                    56,
+		RightWheelDistCm:                   58,
+	}, []byte{0x11, 0x29, 0x05, 0xff, 0x00, 0x00, 0xc0, 0x3f, 2, 2, 0x34, 0x12, 0xfd, 1, 6, 7, 56, 58})
+
+	testRoundTrip(t, "intersection update", &LocalizationIntersectionUpdate{
+		RoadPieceIdx:                10,
+		OffsetFromRoadCenterMm:      0,
+		IntersectionCode:            IntersectionCodeExitFirst,
+		IsExiting:                   1,
+		MmSinceLastTransitionBar:    300,
+		MmSinceLastIntersectionCode: 2,
+	}, []byte{0x0c, 0x2a, 10, 0, 0, 0, 0, 2, 1, 0x2c, 0x01, 0x02, 0x00})
+
+	testRoundTrip(t, "offset update", &OffsetFromRoadCenterUpdate{OffsetFromRoadCenterMm: 20, LaneChangeId: 9},
+		[]byte{0x06, 0x2d, 0x00, 0x00, 0xa0, 0x41, 9})
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	bad := [][]byte{
+		{},
+		{0x01},
+		{0x00, 0x17},
+		{0x06, 0x24, 0xe8, 0x03}, // truncated
+		{0x03, 0x24, 0xe8, 0x03}, // payload too short for the type
+		{0x01, 0x99},             // not recognized
+		append([]byte{0x11, 0x33, 0x04}, make([]byte, 15)...), // too many light channels
+	}
+	for _, b := range bad {
+		if m, err := Unmarshal(b); err == nil {
+			t.Errorf("% x should not unmarshal; got %+v", b, m)
+		}
+	}
+
+	// extra bytes, eg from newer firmware or the next message, are ignored
+	m, err := Unmarshal([]byte{0x04, 0x19, 0x6b, 0x2e, 0xff, 0x01, 0x17})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "version", VersionResponse{Version: 0x2e6b}, *(m.(*VersionResponse)))
+}
+
+func TestMarshalErrors(t *testing.T) {
+	// Append stops at LightChannelCountMax, but Channels is exported
+	cfg := NewLightConfig(LightChannelTail, LightEffectSteady, MaxLightIntensity, 0, 0)
+	m := &LightsPattern{Channels: []LightConfig{cfg, cfg, cfg, cfg}}
+	if b, err := Marshal(m); err == nil {
+		t.Errorf("LightsPattern with %d channels should not marshal; got % x", len(m.Channels), b)
+	}
+
+	m.Channels = m.Channels[:LightChannelCountMax]
+	b, err := Marshal(m)
+	testEqual(t, "err", nil, err)
+	testEqual(t, "len", 1+m.payloadSize()+MsgBaseSize, len(b))
+}
+
+func TestReadMsgBytes(t *testing.T) {
+	stream := append(mustMarshal(t, &SetSpeed{SpeedMmPerSec: 500}), mustMarshal(t, &PingRequest{})...)
+	stream = append(stream, 0x03, 0x99, 0x01, 0x02) // not recognized, but still framed
+	stream = append(stream, 0x04, 0x19)             // truncated
+	r := bytes.NewReader(stream)
+
+	b, err := ReadMsgBytes(r)
+	testEqual(t, "err", nil, err)
+	testBytes(t, "set speed", mustMarshal(t, &SetSpeed{SpeedMmPerSec: 500}), b)
+	b, err = ReadMsgBytes(r)
+	testEqual(t, "err", nil, err)
+	testBytes(t, "ping", []byte{0x01, 0x16}, b)
+	b, err = ReadMsgBytes(r)
+	testEqual(t, "err", nil, err)
+	testBytes(t, "unknown", []byte{0x03, 0x99, 0x01, 0x02}, b)
+	_, err = ReadMsgBytes(r)
+	testEqual(t, "truncated", io.ErrUnexpectedEOF, err)
+	_, err = ReadMsgBytes(r)
+	testEqual(t, "end", io.EOF, err)
+}
@@ -4,8 +4,9 @@
 package robo
 
 import (
-	_ "fmt"
+	"fmt"
 	"math"
+	"math/rand"
 
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo/track"
@@ -37,6 +38,13 @@ func NewIdealSimulator() *IdealSimulator {
 func (sim *IdealSimulator) Tick(dt phys.SimTime, trk *track.Track, vehs *[]Vehicle) {
 	for v, _ := range *vehs {
 		var veh *Vehicle = &(*vehs)[v]
+		if veh.held {
+			veh.curVel = track.Vel{}
+			continue
+		}
+		if veh.tickTurn(dt, trk) {
+			continue
+		}
 		rpi, _ := trk.RpiAndRpDofs(veh.CurTrackPose().Dofs)
 		rp := trk.Rp(rpi)
 
@@ -127,3 +135,230 @@ func (sim *IdealSimulator) Tick(dt phys.SimTime, trk *track.Track, vehs *[]Vehic
 		veh.odom += phys.Meters(pathLen)
 	}
 }
+
+//////////////////////////////////////////////////////////////////////
+
+// RealisticSimParams tunes the RealisticSimulator. Zero values disable the
+// corresponding effect.
+type RealisticSimParams struct {
+	Seed int64 // for the noise; equal seeds give equal simulations
+
+	// SpeedLag is the time constant of the first-order response of the
+	// current speed to the desired speed.
+	SpeedLag phys.SimTime
+
+	// MaxLatAcl limits the speed on curves, to sqrt(MaxLatAcl * radius).
+	MaxLatAcl phys.MetersPerSec2
+
+	// SpeedNoise is the standard deviation of the noise added to the current
+	// speed on each tick.
+	SpeedNoise phys.MetersPerSec
+
+	// Cofs drift is the difference between the current and desired center
+	// offset. It is a random walk with DriftRate standard deviation per
+	// sqrt(second), plus CurveDrift times the lateral acceleration toward the
+	// outside of curves. The vehicle corrects it with time constant
+	// DriftCorrection, and it never exceeds MaxDrift.
+	DriftRate       phys.MetersPerSec
+	CurveDrift      float64 // seconds
+	DriftCorrection phys.SimTime
+	MaxDrift        phys.Meters
+}
+
+// DefaultRealisticSimParams returns parameters that roughly match physical
+// vehicles.
+func DefaultRealisticSimParams() RealisticSimParams {
+	return RealisticSimParams{
+		Seed:            1,
+		SpeedLag:        150 * phys.SimMillisecond,
+		MaxLatAcl:       5.0,
+		SpeedNoise:      0.005,
+		DriftRate:       0.005,
+		CurveDrift:      0.002,
+		DriftCorrection: 1 * phys.SimSecond,
+		MaxDrift:        0.02,
+	}
+}
+
+// RealisticSimulator simulates motion closer to physical vehicles than the
+// IdealSimulator: each vehicle type has a maximum speed and acceleration (see
+// VehTypeInfo), the current speed lags the desired speed, speed is limited on
+// curves, and the center offset drifts. All randomness comes from the seed.
+type RealisticSimulator struct {
+	params RealisticSimParams
+	src    *countingSource
+	rng    *rand.Rand
+}
+
+func NewRealisticSimulator(params RealisticSimParams) *RealisticSimulator {
+	src := &countingSource{src: rand.NewSource(params.Seed).(rand.Source64)}
+	return &RealisticSimulator{
+		params: params,
+		src:    src,
+		rng:    rand.New(src),
+	}
+}
+
+// countingSource counts the random numbers drawn, so that the state of the
+// simulator can be saved and restored; see System.Snapshot.
+type countingSource struct {
+	src   rand.Source64
+	draws uint64
+}
+
+func (cs *countingSource) Int63() int64 {
+	cs.draws++
+	return cs.src.Int63()
+}
+
+func (cs *countingSource) Uint64() uint64 {
+	cs.draws++
+	return cs.src.Uint64()
+}
+
+func (cs *countingSource) Seed(seed int64) {
+	cs.src.Seed(seed)
+	cs.draws = 0
+}
+
+func (sim *RealisticSimulator) snapshot() *SimSnapshot {
+	return &SimSnapshot{Seed: sim.params.Seed, Draws: sim.src.draws}
+}
+
+func (sim *RealisticSimulator) restore(snap *SimSnapshot) error {
+	if (snap == nil) || (snap.Seed != sim.params.Seed) {
+		return fmt.Errorf("Snapshot is not from a RealisticSimulator with Seed=%d", sim.params.Seed)
+	}
+	sim.src.Seed(snap.Seed)
+	for sim.src.draws < snap.Draws {
+		sim.src.Int63()
+	}
+	return nil
+}
+
+func (sim *RealisticSimulator) Tick(dt phys.SimTime, trk *track.Track, vehs *[]Vehicle) {
+	p := &sim.params
+	fdt := float64(dt) * 1e-9
+	for v := range *vehs {
+		var veh *Vehicle = &(*vehs)[v]
+		if veh.held {
+			veh.curVel = track.Vel{}
+			continue
+		}
+		if veh.tickTurn(dt, trk) {
+			continue
+		}
+		rpi, _ := trk.RpiAndRpDofs(veh.CurTrackPose().Dofs)
+		rp := trk.Rp(rpi)
+		radius := float64(rp.CurveRadius(veh.CurTrackPose().Cofs))
+
+		// Desired speed ramps toward the commanded speed, within motor limits
+		maxDspd := float64(veh.MaxDspd())
+		maxDacl := float64(veh.MaxDacl())
+		maxDdcl := float64(veh.MaxDdcl())
+		cmdDspd := math.Min(float64(veh.cmdDspd), maxDspd)
+		desDspd := float64(veh.desDspd)
+		dspdDelta := fdt * math.Min(float64(veh.cmdDacl), maxDacl)
+		if desDspd > cmdDspd {
+			dspdDelta = fdt * math.Min(float64(veh.cmdDacl), maxDdcl)
+		}
+		if math.Abs(desDspd-cmdDspd) <= dspdDelta {
+			desDspd = cmdDspd
+		} else if desDspd < cmdDspd {
+			desDspd += dspdDelta
+		} else {
+			desDspd -= dspdDelta
+		}
+
+		// Current speed follows the desired speed with a lag, and is limited on
+		// curves
+		limDspd := desDspd
+		if (radius > 0) && (p.MaxLatAcl > 0) {
+			limDspd = math.Min(limDspd, math.Sqrt(float64(p.MaxLatAcl)*radius))
+		}
+		prevDspd := float64(veh.CurDriveDspd())
+		alpha := 1.0
+		if p.SpeedLag > 0 {
+			alpha = 1 - math.Exp(-float64(dt)/float64(p.SpeedLag))
+		}
+		accel := (limDspd - prevDspd) * alpha
+		accel = math.Max(-maxDdcl*fdt, math.Min(maxDacl*fdt, accel))
+		curDspd := prevDspd + accel
+		if (p.SpeedNoise > 0) && (limDspd > 0) {
+			curDspd += float64(p.SpeedNoise) * sim.rng.NormFloat64()
+		}
+		curDspd = math.Max(0, math.Min(maxDspd, curDspd))
+
+		// Calc new dofs; Dofs is measured along road center
+		deltaFwd := ((prevDspd + curDspd) / 2) * fdt
+		deltaDofs := deltaFwd
+		if radius > 0 {
+			deltaDofs *= float64(rp.CurveRadius(0)) / radius
+		}
+
+		// Desired center offset moves toward the commanded one
+		if veh.cmdCofs < -trk.MaxCofs() {
+			veh.cmdCofs = -trk.MaxCofs()
+		} else if veh.cmdCofs > trk.MaxCofs() {
+			veh.cmdCofs = trk.MaxCofs()
+		}
+		desCofs := float64(veh.desCofs)
+		cmdCofs := float64(veh.cmdCofs)
+		maxDeltaCofs := fdt * math.Abs(float64(veh.cmdCspd))
+		if math.Abs(cmdCofs-desCofs) <= maxDeltaCofs {
+			desCofs = cmdCofs
+		} else if desCofs < cmdCofs {
+			desCofs += maxDeltaCofs
+		} else {
+			desCofs -= maxDeltaCofs
+		}
+
+		// Current center offset drifts from the desired one, but only while
+		// driving
+		prevCofs := float64(veh.curPose.Cofs)
+		drift := prevCofs - float64(veh.desCofs)
+		if curDspd > 0 {
+			if p.DriftCorrection > 0 {
+				drift *= math.Exp(-float64(dt) / float64(p.DriftCorrection))
+			}
+			if p.DriftRate > 0 {
+				drift += float64(p.DriftRate) * math.Sqrt(fdt) * sim.rng.NormFloat64()
+			}
+			if radius > 0 {
+				outward := -1.0 // curve left => outside is to the right
+				if rp.DAngle() < 0 {
+					outward = 1.0
+				}
+				drift += outward * p.CurveDrift * (curDspd * curDspd / radius) * fdt
+			}
+		}
+		maxDrift := float64(p.MaxDrift)
+		drift = math.Max(-maxDrift, math.Min(maxDrift, drift))
+		halfWidth := float64(trk.Width()) / 2
+		curCofs := math.Max(-halfWidth, math.Min(halfWidth, desCofs+drift))
+
+		// Update the vehicle's state
+		veh.desDspd = phys.MetersPerSec(desDspd)
+		veh.desCofs = phys.Meters(desCofs)
+		if veh.IsFacingTrackwise() {
+			veh.curVel.D = phys.MetersPerSec(curDspd)
+			veh.curPose.Dofs += phys.Meters(deltaDofs)
+		} else {
+			veh.curVel.D = -phys.MetersPerSec(curDspd)
+			veh.curPose.Dofs -= phys.Meters(deltaDofs)
+		}
+		veh.curPose.Dofs = trk.NormalizeDofs(veh.curPose.Dofs)
+		veh.curPose.Cofs = phys.Meters(curCofs)
+		veh.curVel.C = phys.MetersPerSec((curCofs - prevCofs) / fdt)
+
+		// Update pose angle based on new V and H speeds
+		if curDspd > 0 {
+			angle := math.Atan2(float64(veh.curVel.C), float64(veh.curVel.D))
+			veh.curPose.DAngle = phys.Radians(angle)
+		}
+
+		// Update Odometer
+		deltaCofs := curCofs - prevCofs
+		veh.odom += phys.Meters(math.Sqrt((deltaFwd * deltaFwd) + (deltaCofs * deltaCofs)))
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// runSim drives one vehicle at cmdDspd for a number of ticks, and returns it
+// and the track.
+func runSim(t *testing.T, sim Simulator, vt VehType, cmdDspd phys.MetersPerSec, ticks int) (*Vehicle, *track.Track) {
+	trk := newTestTrack(t)
+	vehs := []Vehicle{mustNewVehicle(t, vt, trk.CenLen())}
+	vehs[0].SetCmdDriveDspd(cmdDspd, 10.0)
+	for i := 0; i < ticks; i++ {
+		sim.Tick(simDeltaT, trk, &vehs)
+	}
+	return &vehs[0], trk
+}
+
+func TestRealisticSimulatorLimits(t *testing.T) {
+	params := DefaultRealisticSimParams()
+	params.SpeedNoise = 0
+	params.MaxLatAcl = 0
+
+	// accel is limited by the motors, then speed
+	veh, _ := runSim(t, NewRealisticSimulator(params), "gs", 3.0, 10)
+	if float64(veh.CurDriveDspd()) > (10 * float64(veh.MaxDacl()) * 0.01) {
+		t.Errorf("speed=%v after 0.1 sec exceeds max accel=%v", veh.CurDriveDspd(), veh.MaxDacl())
+	}
+	veh, _ = runSim(t, NewRealisticSimulator(params), "xr", 3.0, 400)
+	testMetersAreNear(t, "truck top speed", phys.Meters(veh.MaxDspd()), phys.Meters(veh.CurDriveDspd()))
+
+	// lag => current speed trails the ideal simulator
+	ideal, _ := runSim(t, NewIdealSimulator(), "gs", 1.0, 10)
+	veh, _ = runSim(t, NewRealisticSimulator(params), "gs", 1.0, 10)
+	if veh.Odom() >= ideal.Odom() {
+		t.Errorf("realistic odom=%v should trail ideal odom=%v", veh.Odom(), ideal.Odom())
+	}
+
+	// curves limit the speed; the capsule's first curve starts at Dofs=0.22
+	params.MaxLatAcl = 2.0
+	params.DriftRate = 0
+	params.CurveDrift = 0
+	veh, trk := runSim(t, NewRealisticSimulator(params), "gs", 1.5, 90)
+	testEqual(t, "in curve", track.Rpi(1), trk.RpiAt(veh.CurTrackPose().Dofs))
+	if veh.CurDriveDspd() > 0.78 {
+		t.Errorf("curve speed=%v exceeds the lateral accel limit", veh.CurDriveDspd())
+	}
+}
+
+func TestRealisticSimulatorSeed(t *testing.T) {
+	params := DefaultRealisticSimParams()
+	a, _ := runSim(t, NewRealisticSimulator(params), "gs", 1.0, 500)
+	b, _ := runSim(t, NewRealisticSimulator(params), "gs", 1.0, 500)
+	testEqual(t, "same seed pose", a.CurTrackPose(), b.CurTrackPose())
+	testEqual(t, "same seed odom", a.Odom(), b.Odom())
+
+	params.Seed++
+	c, _ := runSim(t, NewRealisticSimulator(params), "gs", 1.0, 500)
+	if a.CurTrackPose() == c.CurTrackPose() {
+		t.Errorf("different seeds gave the same pose")
+	}
+
+	// drift is bounded
+	if cofs := c.CurTrackCofs(); (cofs > params.MaxDrift) || (cofs < -params.MaxDrift) {
+		t.Errorf("cofs=%v exceeds max drift=%v", cofs, params.MaxDrift)
+	}
+}
+
+func TestRealisticSimulatorMaxDdcl(t *testing.T) {
+	defer saveVehTypes()()
+	spec := testVehTypeSpec("xd")
+	spec.MaxDdcl = 1.0
+	if err := RegisterVehType(spec); err != nil {
+		t.Fatal(err)
+	}
+	params := DefaultRealisticSimParams()
+	params.SpeedNoise = 0
+	params.MaxLatAcl = 0
+	sim := NewRealisticSimulator(params)
+	trk := newTestTrack(t)
+	vehs := []Vehicle{mustNewVehicle(t, "xd", trk.CenLen())}
+	vehs[0].SetCmdDriveDspd(1.0, 10.0)
+	for i := 0; i < 200; i++ {
+		sim.Tick(simDeltaT, trk, &vehs)
+	}
+	prevDspd := vehs[0].CurDriveDspd()
+
+	// slowing down is limited by MaxDdcl, not MaxDacl
+	vehs[0].SetCmdDriveDspd(0, 10.0)
+	for i := 0; i < 10; i++ {
+		sim.Tick(simDeltaT, trk, &vehs)
+	}
+	drop := float64(prevDspd - vehs[0].CurDriveDspd())
+	if drop > (float64(spec.MaxDdcl)*0.1 + 1e-6) {
+		t.Errorf("speed drop=%v after 0.1 sec exceeds max decel=%v", drop, spec.MaxDdcl)
+	}
+	if drop <= 0 {
+		t.Errorf("vehicle should slow down")
+	}
+}
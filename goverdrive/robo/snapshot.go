@@ -0,0 +1,665 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// snapshot.go saves the complete state of a System to a serializable Snapshot,
+// and restores it exactly, eg to save and load a game session, rewind during a
+// playtest, or branch "what if" simulations from the same starting point.
+//
+// A snapshot does not include the track, the event bus subscribers, or the
+// vehicle command observer; those belong to the System that restores it.
+
+package robo
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// Snapshot is the complete state of a System. It can be serialized, eg with
+// encoding/json.
+type Snapshot struct {
+	Time   phys.SimTime
+	Dt     phys.SimTime
+	CenLen phys.Meters // of the track, to catch restoring onto a different track
+
+	Vehicles   []VehicleSnapshot
+	NextVehId  int
+	Collisions []CollisionEvent // ongoing, as of the last tick
+	Regions    []RegionSnapshot
+
+	Obstacles          []ObstacleSnapshot
+	NextObstacleId     int
+	ObstacleCollisions []ObstacleCollisionEvent // ongoing
+
+	Collider     ColliderSnapshot
+	Sim          *SimSnapshot          `json:",omitempty"` // nil => the simulator has no state, eg IdealSimulator
+	Localization *LocalizationSnapshot `json:",omitempty"` // nil => no Localizer
+	CmdLink      *CmdLinkSnapshot      `json:",omitempty"` // nil => no CmdLink
+}
+
+// VehicleSnapshot is the complete state of one Vehicle.
+type VehicleSnapshot struct {
+	Id          int
+	Type        VehType
+	TypeInfo    VehTypeInfoSnapshot
+	TrackLen    phys.Meters
+	Lights      light.VehLightsSnapshot
+	Odom        phys.Meters
+	CurPose     track.Pose
+	CurVel      track.Vel
+	CmdDspd     phys.MetersPerSec
+	CmdDacl     phys.MetersPerSec2
+	DesDspd     phys.MetersPerSec
+	CmdCofs     phys.Meters
+	CmdCspd     phys.MetersPerSec
+	DesCofs     phys.Meters
+	Repositions int
+	Turn        *TurnSnapshot `json:",omitempty"` // nil => no turn in progress
+}
+
+// VehTypeInfoSnapshot is a serializable copy of a VehTypeInfo. Vehicles keep
+// the type info they were created with, so it is saved with them.
+type VehTypeInfoSnapshot struct {
+	FullName string
+	Color    color.RGBA
+	Width    phys.Meters
+	Length   phys.Meters
+	Mass     phys.Grams
+	MaxDspd  phys.MetersPerSec
+	MaxDacl  phys.MetersPerSec2
+	MaxDdcl  phys.MetersPerSec2
+	Cspd     phys.MetersPerSec
+	Lights   light.SpecSnapshot
+}
+
+// TurnSnapshot is a turn in progress.
+type TurnSnapshot struct {
+	Turn    TurnType
+	Radius  phys.Meters
+	Start   track.Pose
+	Angle   float64
+	FwdSign float64
+	LatSign float64
+}
+
+// RegionSnapshot is a watched region, and the vehicles inside it.
+type RegionSnapshot struct {
+	Name   string
+	C1     track.Point
+	Len    phys.Meters
+	Width  phys.Meters
+	Inside []int // vehicle Ids
+}
+
+// ObstacleSnapshot is one obstacle.
+type ObstacleSnapshot struct {
+	Id     int
+	Point  track.Point
+	Length phys.Meters
+	Width  phys.Meters
+	Dspd   phys.MetersPerSec
+	Color  *color.RGBA `json:",omitempty"` // nil => DefObstacleColor
+}
+
+// ColliderSnapshot is the state of a CollisionDetector or CollisionResponder.
+type ColliderSnapshot struct {
+	CurCollisions []CollisionEvent
+	NewCollisions []CollisionEvent
+	PrevInputs    []CollisionInputSnapshot
+	PrevTime      phys.SimTime
+	SweptPoses    []SweptPosesSnapshot
+	Stalls        []StallSnapshot `json:",omitempty"` // CollisionResponder only
+}
+
+// CollisionInputSnapshot is what the collider saw of one vehicle on its last
+// update, for swept collisions.
+type CollisionInputSnapshot struct {
+	Id          int
+	Dofs        phys.Meters
+	Pose        phys.Pose
+	Len         phys.Meters
+	Width       phys.Meters
+	Vel         phys.Point
+	TrackPose   track.Pose
+	Repositions int
+}
+
+// SweptPosesSnapshot holds the impact poses of a collision that was only found
+// by the sweep.
+type SweptPosesSnapshot struct {
+	Veh1, Veh2 int
+	Poses      [2]track.Pose
+}
+
+// StallSnapshot is a vehicle that is stalled by a CollisionResponder.
+type StallSnapshot struct {
+	VehId int
+	Until phys.SimTime
+}
+
+// SimSnapshot is the state of a RealisticSimulator's random numbers.
+type SimSnapshot struct {
+	Seed  int64
+	Draws uint64
+}
+
+// LocalizationSnapshot is the state of a Localizer.
+type LocalizationSnapshot struct {
+	Seed     int64
+	Draws    uint64
+	Vehicles []VehLocalizationSnapshot
+	Pending  []PendingLocalizationSnapshot // in the order they were sent
+}
+
+// VehLocalizationSnapshot is the localization state of one vehicle.
+type VehLocalizationSnapshot struct {
+	VehId           int
+	Localized       bool
+	Rpi             track.Rpi
+	LocationId      int
+	Repositions     int
+	Unreadable      bool
+	UnreadableSince phys.SimTime
+	LastPosition    phys.SimTime
+	LastDeliver     phys.SimTime
+	Perceived       PerceivedPose
+}
+
+// PendingLocalizationSnapshot is a localization update that is not published
+// yet.
+type PendingLocalizationSnapshot struct {
+	At     phys.SimTime
+	Update LocalizationUpdate
+}
+
+// CmdLinkSnapshot is the state of a CmdLink.
+type CmdLinkSnapshot struct {
+	Seed     int64
+	Draws    uint64
+	Vehicles []VehCmdLinkSnapshot
+	Pending  []PendingVehCmdSnapshot // in the order they were sent
+}
+
+// VehCmdLinkSnapshot is the link state of one vehicle.
+type VehCmdLinkSnapshot struct {
+	VehId       int
+	WriteTimes  []phys.SimTime
+	LastDeliver phys.SimTime
+	Stats       CmdLinkStats
+}
+
+// PendingVehCmdSnapshot is a vehicle command that has not taken effect yet.
+type PendingVehCmdSnapshot struct {
+	At  phys.SimTime
+	Cmd VehCmd
+}
+
+// simSnapshotter is implemented by simulators that have state.
+type simSnapshotter interface {
+	snapshot() *SimSnapshot
+	restore(snap *SimSnapshot) error
+}
+
+//////////////////////////////////////////////////////////////////////
+// System
+
+// Snapshot returns the complete state of the system. The snapshot does not
+// share any memory with the system.
+func (s *System) Snapshot() *Snapshot {
+	snap := &Snapshot{
+		Time:               s.now,
+		Dt:                 s.dt,
+		CenLen:             s.Track.CenLen(),
+		Vehicles:           make([]VehicleSnapshot, len(s.Vehicles)),
+		NextVehId:          s.nextVehId,
+		Collisions:         make([]CollisionEvent, 0, len(s.collisions)),
+		Regions:            make([]RegionSnapshot, len(s.regions)),
+		Obstacles:          make([]ObstacleSnapshot, len(s.obstacles)),
+		NextObstacleId:     s.nextObstacleId,
+		ObstacleCollisions: make([]ObstacleCollisionEvent, 0, len(s.obstacleCollisions)),
+		Collider:           s.Collider.snapshot(),
+	}
+	for v := range s.Vehicles {
+		snap.Vehicles[v] = s.Vehicles[v].snapshot()
+	}
+	for _, pair := range sortedVehPairs(s.collisions) {
+		snap.Collisions = append(snap.Collisions, s.collisions[pair])
+	}
+	for r, wr := range s.regions {
+		rs := RegionSnapshot{Name: wr.name, C1: wr.region.C1(), Len: wr.region.Len(), Width: wr.region.Width(), Inside: make([]int, 0)}
+		for id, inside := range wr.inside {
+			if inside {
+				rs.Inside = append(rs.Inside, id)
+			}
+		}
+		sort.Ints(rs.Inside)
+		snap.Regions[r] = rs
+	}
+	for i, o := range s.obstacles {
+		obs := ObstacleSnapshot{Id: o.id, Point: o.Point, Length: o.Length, Width: o.Width, Dspd: o.Dspd}
+		if o.Color != nil {
+			c := toRGBA(o.Color)
+			obs.Color = &c
+		}
+		snap.Obstacles[i] = obs
+	}
+	for _, pair := range sortedVehObstPairs(s.obstacleCollisions) {
+		snap.ObstacleCollisions = append(snap.ObstacleCollisions, s.obstacleCollisions[pair])
+	}
+	if ss, ok := s.sim.(simSnapshotter); ok {
+		snap.Sim = ss.snapshot()
+	}
+	if s.localizer != nil {
+		snap.Localization = s.localizer.snapshot()
+	}
+	if s.cmdLink != nil {
+		snap.CmdLink = s.cmdLink.snapshot()
+	}
+	return snap
+}
+
+// Restore replaces the complete state of the system with a snapshot, eg from
+// Snapshot on this or another System with the same track, simulator, and
+// collider. The event bus subscribers and vehicle command observer are kept,
+// and no events are published. If the snapshot does not fit the system, an
+// error is returned and the system is unchanged.
+// NOTE: Pointers to vehicles and obstacles must be refreshed after Restore.
+func (s *System) Restore(snap *Snapshot) error {
+	if snap == nil {
+		return fmt.Errorf("Snapshot is nil")
+	}
+	if math.Abs(float64(snap.CenLen-s.Track.CenLen())) > 1e-9 {
+		return fmt.Errorf("Snapshot track length=%v does not match the system's track length=%v", snap.CenLen, s.Track.CenLen())
+	}
+	if snap.Dt <= 0 {
+		return fmt.Errorf("Snapshot Dt=%v is invalid", snap.Dt)
+	}
+	for v := 1; v < len(snap.Vehicles); v++ {
+		if snap.Vehicles[v].Id <= snap.Vehicles[v-1].Id {
+			return fmt.Errorf("Snapshot vehicles are not in Id order")
+		}
+	}
+	ss, hasSimState := s.sim.(simSnapshotter)
+	if hasSimState != (snap.Sim != nil) {
+		return fmt.Errorf("Snapshot simulator state does not match the system's simulator")
+	}
+	if hasSimState && (ss.snapshot().Seed != snap.Sim.Seed) {
+		return fmt.Errorf("Snapshot simulator Seed=%d does not match the system's simulator", snap.Sim.Seed)
+	}
+	if (s.localizer != nil) != (snap.Localization != nil) {
+		return fmt.Errorf("Snapshot localization state does not match the system's localizer")
+	}
+	if (s.localizer != nil) && (s.localizer.params.Seed != snap.Localization.Seed) {
+		return fmt.Errorf("Snapshot localization Seed=%d does not match the system's localizer", snap.Localization.Seed)
+	}
+	if (s.cmdLink != nil) != (snap.CmdLink != nil) {
+		return fmt.Errorf("Snapshot command link state does not match the system's command link")
+	}
+	if (s.cmdLink != nil) && (s.cmdLink.params.Seed != snap.CmdLink.Seed) {
+		return fmt.Errorf("Snapshot command link Seed=%d does not match the system's command link", snap.CmdLink.Seed)
+	}
+	if err := s.Collider.restore(snap.Collider); err != nil {
+		return err
+	}
+	if hasSimState {
+		if err := ss.restore(snap.Sim); err != nil {
+			return err
+		}
+	}
+	if s.localizer != nil {
+		s.localizer.restore(snap.Localization)
+	}
+	if s.cmdLink != nil {
+		s.cmdLink.restore(snap.CmdLink)
+	}
+
+	s.now = snap.Time
+	s.dt = snap.Dt
+	s.Events.setTime(s.now)
+	s.Vehicles = s.Vehicles[:0]
+	for _, vs := range snap.Vehicles {
+		s.Vehicles = append(s.Vehicles, restoreVehicle(vs))
+	}
+	for v := range s.Vehicles {
+		s.Vehicles[v].events = s.Events
+		s.observeVehCmds(&s.Vehicles[v])
+		s.linkVehCmds(&s.Vehicles[v])
+		if cr, ok := s.Collider.(*CollisionResponder); ok {
+			s.Vehicles[v].held = cr.IsStalled(s.Vehicles[v].id)
+		}
+	}
+	s.nextVehId = snap.NextVehId
+
+	s.collisions = make(map[vehPair]CollisionEvent)
+	for _, ce := range snap.Collisions {
+		s.collisions[vehPair{ce.VehInfo[0].Id, ce.VehInfo[1].Id}] = ce
+	}
+	s.regions = make([]watchedRegion, len(snap.Regions))
+	for r, rs := range snap.Regions {
+		wr := watchedRegion{name: rs.Name, region: track.NewRegion(&s.Track, rs.C1, rs.Len, rs.Width), inside: make(map[int]bool)}
+		for _, v := range s.Vehicles {
+			wr.inside[v.id] = false
+		}
+		for _, id := range rs.Inside {
+			wr.inside[id] = true
+		}
+		s.regions[r] = wr
+	}
+
+	s.obstacles = make([]*Obstacle, len(snap.Obstacles))
+	for i, obs := range snap.Obstacles {
+		o := &Obstacle{Point: obs.Point, Length: obs.Length, Width: obs.Width, Dspd: obs.Dspd, id: obs.Id}
+		if obs.Color != nil {
+			o.Color = *obs.Color
+		}
+		s.obstacles[i] = o
+	}
+	s.nextObstacleId = snap.NextObstacleId
+	s.obstacleCollisions = make(map[vehObstPair]ObstacleCollisionEvent)
+	for _, oce := range snap.ObstacleCollisions {
+		s.obstacleCollisions[vehObstPair{oce.VehInfo.Id, oce.ObstacleId}] = oce
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Vehicle
+
+func (v *Vehicle) snapshot() VehicleSnapshot {
+	vs := VehicleSnapshot{
+		Id:   v.id,
+		Type: v.vtype,
+		TypeInfo: VehTypeInfoSnapshot{
+			FullName: v.info.FullName,
+			Color:    toRGBA(v.info.Color),
+			Width:    v.info.Width,
+			Length:   v.info.Length,
+			Mass:     v.info.Mass,
+			MaxDspd:  v.info.MaxDspd,
+			MaxDacl:  v.info.MaxDacl,
+			MaxDdcl:  v.info.MaxDdcl,
+			Cspd:     v.info.Cspd,
+			Lights:   v.info.Lights.Snapshot(),
+		},
+		TrackLen:    v.trackLen,
+		Lights:      v.lights.Snapshot(),
+		Odom:        v.odom,
+		CurPose:     v.curPose,
+		CurVel:      v.curVel,
+		CmdDspd:     v.cmdDspd,
+		CmdDacl:     v.cmdDacl,
+		DesDspd:     v.desDspd,
+		CmdCofs:     v.cmdCofs,
+		CmdCspd:     v.cmdCspd,
+		DesCofs:     v.desCofs,
+		Repositions: v.repositions,
+	}
+	if v.IsTurning() {
+		t := v.turn
+		vs.Turn = &TurnSnapshot{Turn: t.turn, Radius: t.radius, Start: t.start, Angle: t.angle, FwdSign: t.fwdSign, LatSign: t.latSign}
+	}
+	return vs
+}
+
+// restoreVehicle recreates a vehicle from a snapshot. It is not part of a
+// System yet.
+func restoreVehicle(vs VehicleSnapshot) Vehicle {
+	ti := vs.TypeInfo
+	v := Vehicle{
+		trackLen: vs.TrackLen,
+		vtype:    vs.Type,
+		info: VehTypeInfo{
+			FullName: ti.FullName,
+			Color:    ti.Color,
+			Width:    ti.Width,
+			Length:   ti.Length,
+			Mass:     ti.Mass,
+			MaxDspd:  ti.MaxDspd,
+			MaxDacl:  ti.MaxDacl,
+			MaxDdcl:  ti.MaxDdcl,
+			Cspd:     ti.Cspd,
+			Lights:   ti.Lights.Spec(),
+		},
+		lights:      *light.NewVehLightsFromSnapshot(vs.Lights),
+		odom:        vs.Odom,
+		curPose:     vs.CurPose,
+		curVel:      vs.CurVel,
+		cmdDspd:     vs.CmdDspd,
+		cmdDacl:     vs.CmdDacl,
+		desDspd:     vs.DesDspd,
+		cmdCofs:     vs.CmdCofs,
+		cmdCspd:     vs.CmdCspd,
+		desCofs:     vs.DesCofs,
+		id:          vs.Id,
+		repositions: vs.Repositions,
+	}
+	if t := vs.Turn; t != nil {
+		v.turn = vehTurn{turn: t.Turn, radius: t.Radius, start: t.Start, angle: t.Angle, fwdSign: t.FwdSign, latSign: t.LatSign}
+	}
+	return v
+}
+
+//////////////////////////////////////////////////////////////////////
+// Colliders
+
+func (cd *CollisionDetector) snapshot() ColliderSnapshot {
+	snap := ColliderSnapshot{
+		CurCollisions: make([]CollisionEvent, 0, len(cd.curCollisions)),
+		NewCollisions: make([]CollisionEvent, 0, len(cd.newCollisions)),
+		PrevInputs:    make([]CollisionInputSnapshot, len(cd.prevInputs)),
+		PrevTime:      cd.prevTime,
+		SweptPoses:    make([]SweptPosesSnapshot, 0, len(cd.sweptPoses)),
+	}
+	for _, pair := range sortedVehPairs(cd.curCollisions) {
+		snap.CurCollisions = append(snap.CurCollisions, cd.curCollisions[pair])
+	}
+	for _, pair := range sortedVehPairs(cd.newCollisions) {
+		snap.NewCollisions = append(snap.NewCollisions, cd.newCollisions[pair])
+	}
+	for i, in := range cd.prevInputs {
+		snap.PrevInputs[i] = CollisionInputSnapshot{
+			Id:          in.id,
+			Dofs:        in.dofs,
+			Pose:        in.pose,
+			Len:         in.len,
+			Width:       in.width,
+			Vel:         in.vel,
+			TrackPose:   in.tpose,
+			Repositions: in.repositions,
+		}
+	}
+	pairs := make([]vehPair, 0, len(cd.sweptPoses))
+	for pair := range cd.sweptPoses {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return (pairs[i].Veh1 < pairs[j].Veh1) || ((pairs[i].Veh1 == pairs[j].Veh1) && (pairs[i].Veh2 < pairs[j].Veh2))
+	})
+	for _, pair := range pairs {
+		snap.SweptPoses = append(snap.SweptPoses, SweptPosesSnapshot{Veh1: pair.Veh1, Veh2: pair.Veh2, Poses: cd.sweptPoses[pair]})
+	}
+	return snap
+}
+
+func (cd *CollisionDetector) restore(snap ColliderSnapshot) error {
+	if len(snap.Stalls) > 0 {
+		return fmt.Errorf("Snapshot has stalled vehicles, but the collider is not a CollisionResponder")
+	}
+	cd.restoreState(snap)
+	return nil
+}
+
+func (cd *CollisionDetector) restoreState(snap ColliderSnapshot) {
+	cd.curCollisions = make(map[vehPair]CollisionEvent)
+	for _, ce := range snap.CurCollisions {
+		cd.curCollisions[vehPair{ce.VehInfo[0].Id, ce.VehInfo[1].Id}] = ce
+	}
+	cd.newCollisions = make(map[vehPair]CollisionEvent)
+	for _, ce := range snap.NewCollisions {
+		cd.newCollisions[vehPair{ce.VehInfo[0].Id, ce.VehInfo[1].Id}] = ce
+	}
+	cd.prevInputs = make([]vehCollisionInputs, len(snap.PrevInputs))
+	for i, in := range snap.PrevInputs {
+		cd.prevInputs[i] = vehCollisionInputs{
+			id:          in.Id,
+			dofs:        in.Dofs,
+			pose:        in.Pose,
+			len:         in.Len,
+			width:       in.Width,
+			vel:         in.Vel,
+			tpose:       in.TrackPose,
+			repositions: in.Repositions,
+		}
+	}
+	cd.prevTime = snap.PrevTime
+	cd.sweptPoses = make(map[vehPair][2]track.Pose)
+	for _, sp := range snap.SweptPoses {
+		cd.sweptPoses[vehPair{sp.Veh1, sp.Veh2}] = sp.Poses
+	}
+}
+
+func (cr *CollisionResponder) snapshot() ColliderSnapshot {
+	snap := cr.CollisionDetector.snapshot()
+	ids := make([]int, 0, len(cr.stalledUntil))
+	for id := range cr.stalledUntil {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		snap.Stalls = append(snap.Stalls, StallSnapshot{VehId: id, Until: cr.stalledUntil[id]})
+	}
+	return snap
+}
+
+func (cr *CollisionResponder) restore(snap ColliderSnapshot) error {
+	cr.CollisionDetector.restoreState(snap)
+	cr.stalledUntil = make(map[int]phys.SimTime)
+	for _, st := range snap.Stalls {
+		cr.stalledUntil[st.VehId] = st.Until
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Localizer
+
+func (l *Localizer) snapshot() *LocalizationSnapshot {
+	snap := &LocalizationSnapshot{
+		Seed:     l.params.Seed,
+		Draws:    l.src.draws,
+		Vehicles: make([]VehLocalizationSnapshot, 0, len(l.vehs)),
+		Pending:  make([]PendingLocalizationSnapshot, len(l.pending)),
+	}
+	ids := make([]int, 0, len(l.vehs))
+	for id := range l.vehs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		st := l.vehs[id]
+		snap.Vehicles = append(snap.Vehicles, VehLocalizationSnapshot{
+			VehId:           id,
+			Localized:       st.localized,
+			Rpi:             st.rpi,
+			LocationId:      st.locId,
+			Repositions:     st.repositions,
+			Unreadable:      st.unreadable,
+			UnreadableSince: st.unreadableSince,
+			LastPosition:    st.lastPosition,
+			LastDeliver:     st.lastDeliver,
+			Perceived:       st.perceived,
+		})
+	}
+	for i, pu := range l.pending {
+		snap.Pending[i] = PendingLocalizationSnapshot{At: pu.at, Update: pu.update}
+	}
+	return snap
+}
+
+// restore restores the state of the localizer. The Seed must already match.
+func (l *Localizer) restore(snap *LocalizationSnapshot) {
+	l.src.Seed(snap.Seed)
+	for l.src.draws < snap.Draws {
+		l.src.Int63()
+	}
+	l.vehs = make(map[int]*vehLocState)
+	for _, vs := range snap.Vehicles {
+		l.vehs[vs.VehId] = &vehLocState{
+			localized:       vs.Localized,
+			rpi:             vs.Rpi,
+			locId:           vs.LocationId,
+			repositions:     vs.Repositions,
+			unreadable:      vs.Unreadable,
+			unreadableSince: vs.UnreadableSince,
+			lastPosition:    vs.LastPosition,
+			lastDeliver:     vs.LastDeliver,
+			perceived:       vs.Perceived,
+		}
+	}
+	l.pending = make([]pendingLocUpdate, len(snap.Pending))
+	for i, ps := range snap.Pending {
+		l.pending[i] = pendingLocUpdate{at: ps.At, update: ps.Update}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////
+// CmdLink
+
+func (l *CmdLink) snapshot() *CmdLinkSnapshot {
+	snap := &CmdLinkSnapshot{
+		Seed:     l.params.Seed,
+		Draws:    l.src.draws,
+		Vehicles: make([]VehCmdLinkSnapshot, 0, len(l.vehs)),
+		Pending:  make([]PendingVehCmdSnapshot, len(l.pending)),
+	}
+	ids := make([]int, 0, len(l.vehs))
+	for id := range l.vehs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		st := l.vehs[id]
+		snap.Vehicles = append(snap.Vehicles, VehCmdLinkSnapshot{
+			VehId:       id,
+			WriteTimes:  append([]phys.SimTime{}, st.writeTimes...),
+			LastDeliver: st.lastDeliver,
+			Stats:       st.stats,
+		})
+	}
+	for i, pc := range l.pending {
+		snap.Pending[i] = PendingVehCmdSnapshot{At: pc.at, Cmd: pc.cmd}
+	}
+	return snap
+}
+
+// restore restores the state of the link. The Seed must already match.
+func (l *CmdLink) restore(snap *CmdLinkSnapshot) {
+	l.src.Seed(snap.Seed)
+	for l.src.draws < snap.Draws {
+		l.src.Int63()
+	}
+	l.vehs = make(map[int]*vehLinkState)
+	for _, vs := range snap.Vehicles {
+		l.vehs[vs.VehId] = &vehLinkState{
+			writeTimes:  append([]phys.SimTime{}, vs.WriteTimes...),
+			lastDeliver: vs.LastDeliver,
+			stats:       vs.Stats,
+		}
+	}
+	l.pending = make([]pendingVehCmd, len(snap.Pending))
+	for i, ps := range snap.Pending {
+		l.pending[i] = pendingVehCmd{at: ps.At, cmd: ps.Cmd}
+	}
+}
+
+// toRGBA converts any color to its RGBA representation, so that it can be
+// serialized.
+func toRGBA(c color.Color) color.RGBA {
+	return color.RGBAModel.Convert(c).(color.RGBA)
+}
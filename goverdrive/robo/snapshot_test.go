@@ -0,0 +1,185 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"encoding/json"
+	"image/color"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// newSnapshotSystem creates an empty system with a noisy simulator and a
+// collision responder that stalls easily.
+func newSnapshotSystem(t *testing.T) *System {
+	params := DefaultCollisionResponseParams()
+	params.StallDeltaV = 0.01
+	return newTestSystem(t, NewRealisticSimulator(DefaultRealisticSimParams()), newResponder(params))
+}
+
+// mustJSONRoundTrip serializes and deserializes a snapshot.
+func mustJSONRoundTrip(t *testing.T, snap *Snapshot) *Snapshot {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Snapshot
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+// runSnapshotSystem ticks the system, and returns its final state and all of
+// the events it published, both as JSON.
+func runSnapshotSystem(t *testing.T, rsys *System, ticks int) (string, string) {
+	q := NewEventQueue(rsys.Events)
+	defer q.Close()
+	for i := 0; i < ticks; i++ {
+		rsys.Tick()
+	}
+	state, err := json.Marshal(rsys.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs, err := json.Marshal(q.Drain())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(state), string(evs)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	rsys := newSnapshotSystem(t)
+	cr := rsys.Collider.(*CollisionResponder)
+	for i, dofs := range []float64{0.1, 0.3, 0.9} {
+		veh := mustNewVehicle(t, "gs", rsys.Track.CenLen())
+		veh.Reposition(track.Pose{Point: track.Point{Dofs: 0, Cofs: 0}})
+		id := rsys.AddVehicle(veh)
+		testEqual(t, "id", i, id)
+		rsys.Vehicle(id).Reposition(track.Pose{Point: track.Point{Dofs: phys.Meters(dofs), Cofs: 0}})
+	}
+	rsys.WatchRegion("zone", track.NewRegion(&rsys.Track, track.Point{Dofs: 0.35, Cofs: -0.1}, 0.2, 0.2))
+	rsys.AddObstacle(Obstacle{Point: track.Point{Dofs: 1.5, Cofs: 0.05}, Length: 0.05, Width: 0.05, Color: color.Gray{Y: 100}})
+	rsys.Tick()
+
+	// vehicle 0 rams vehicle 1, vehicle 2 is turning, and an animation is running
+	rsys.Vehicle(0).SetCmdDriveDspd(1.0, 100)
+	rsys.Vehicle(2).SetCmdDriveDspd(0.5, 100)
+	rsys.Vehicle(1).Lights().SetAnimation(rsys.Now(), "top", []light.Frame{{Color: color.White, Tms: 30}, {Color: color.Black, Tms: 50}}, 10)
+	for i := 0; (i < 100) && !cr.IsStalled(1); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "veh 1 stalled", true, cr.IsStalled(1))
+	rsys.Vehicle(2).CmdTurn(TurnUturn, 0.1)
+	rsys.Tick()
+	testEqual(t, "veh 2 turning", true, rsys.Vehicle(2).IsTurning())
+
+	snap := mustJSONRoundTrip(t, rsys.Snapshot())
+	testEqual(t, "stalls saved", true, len(snap.Collider.Stalls) > 0)
+	testEqual(t, "obstacle saved", 1, len(snap.Obstacles))
+	testEqual(t, "turn saved", true, snap.Vehicles[2].Turn != nil)
+	testEqual(t, "animation saved", 1, len(snap.Vehicles[1].Lights.Anim))
+	wantState, wantEvs := runSnapshotSystem(t, rsys, 200)
+
+	// rewind the same system
+	if err := rsys.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	state, evs := runSnapshotSystem(t, rsys, 200)
+	testEqual(t, "rewound state", wantState, state)
+	testEqual(t, "rewound events", wantEvs, evs)
+
+	// branch a new system
+	branch := newSnapshotSystem(t)
+	if err := branch.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "branch time", snap.Time, branch.Now())
+	testEqual(t, "branch next id", 3, branch.AddVehicle(mustNewVehicle(t, "sk", branch.Track.CenLen())))
+	branch.RemoveVehicle(3)
+	if err := branch.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	state, evs = runSnapshotSystem(t, branch, 200)
+	testEqual(t, "branch state", wantState, state)
+	testEqual(t, "branch events", wantEvs, evs)
+}
+
+func TestSnapshotIsIndependent(t *testing.T) {
+	rsys := newAddRemoveSystem(t, newDetector)
+	snap := rsys.Snapshot()
+	before, _ := json.Marshal(snap)
+	rsys.Vehicles[0].SetCmdDriveDspd(1.0, 100)
+	rsys.Vehicles[0].Lights().Set("top", color.White)
+	for i := 0; i < 10; i++ {
+		rsys.Tick()
+	}
+	after, _ := json.Marshal(snap)
+	testEqual(t, "snapshot unchanged", string(before), string(after))
+
+	// the restored vehicles still publish events and obey commands
+	if err := rsys.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	q := NewEventQueue(rsys.Events, EvCollisionStart)
+	rsys.Vehicles[0].SetCmdDriveDspd(1.0, 100)
+	for i := 0; (i < 100) && (q.Len() == 0); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "collision after restore", 1, q.Len())
+}
+
+func TestSnapshotRestoreErrors(t *testing.T) {
+	rsys := newSnapshotSystem(t)
+	cr := rsys.Collider.(*CollisionResponder)
+	rsys.AddVehicle(mustNewVehicle(t, "gs", rsys.Track.CenLen()))
+	rsys.Tick()
+	good := rsys.Snapshot()
+	copySnap := func() *Snapshot { return mustJSONRoundTrip(t, good) }
+
+	bad := map[string]*Snapshot{"nil": nil}
+	snap := copySnap()
+	snap.CenLen += 0.5
+	bad["track"] = snap
+	snap = copySnap()
+	snap.Dt = 0
+	bad["dt"] = snap
+	snap = copySnap()
+	snap.Vehicles = append(snap.Vehicles, snap.Vehicles[0])
+	bad["id order"] = snap
+	snap = copySnap()
+	snap.Sim = nil
+	bad["no sim"] = snap
+	snap = copySnap()
+	snap.Sim.Seed++
+	bad["sim seed"] = snap
+	for tag, snap := range bad {
+		if err := rsys.Restore(snap); err == nil {
+			t.Errorf("%s: expected an error", tag)
+		}
+	}
+	testEqual(t, "unchanged", 1, len(rsys.Vehicles))
+
+	// an ideal simulator has no state to restore
+	ideal := newTestSystem(t, nil, newResponder(DefaultCollisionResponseParams()))
+	if err := ideal.Restore(copySnap()); err == nil {
+		t.Errorf("expected an error for a simulator mismatch")
+	}
+
+	// stalls can only be restored into a CollisionResponder
+	snap = copySnap()
+	snap.Collider.Stalls = []StallSnapshot{{VehId: 0, Until: snap.Time + 1}}
+	detector := newTestSystem(t, NewRealisticSimulator(DefaultRealisticSimParams()), nil)
+	if err := detector.Restore(snap); err == nil {
+		t.Errorf("expected an error for stalls without a CollisionResponder")
+	}
+	if err := rsys.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "stall restored", true, cr.IsStalled(0))
+}
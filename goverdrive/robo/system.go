@@ -6,6 +6,9 @@
 package robo
 
 import (
+	"fmt"
+	"sort"
+
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo/track"
 )
@@ -19,24 +22,62 @@ const (
 )
 
 // System is the complete robotics system being simulated.
+//
+// Each vehicle has a stable Id, which is used in events, collisions, etc.
+// Vehicles is in Id order, and the vehicles passed to NewSystem get Ids that
+// match their index. Once vehicles are removed, a vehicle's index can differ
+// from its Id; see Vehicle and FindVehicle.
 type System struct {
 	dt       phys.SimTime // length of time for one sim tick
 	now      phys.SimTime
 	Track    track.Track
 	Vehicles []Vehicle
 	Collider VehicleCollider
+	Events   *EventBus
 	sim      Simulator
+
+	nextVehId   int
+	cmdObserver VehCmdObserver // nil => none; see SetVehCmdObserver
+	cmdLink     *CmdLink       // nil => none; see SetCmdLink
+
+	collisions map[vehPair]CollisionEvent // ongoing, as of the last tick
+	regions    []watchedRegion
+
+	obstacles          []*Obstacle
+	nextObstacleId     int
+	obstacleCollisions map[vehObstPair]ObstacleCollisionEvent // ongoing
+
+	localizer *Localizer // nil => none; see SetLocalizer
+}
+
+// watchedRegion is a track region that publishes enter/exit events.
+type watchedRegion struct {
+	name   string
+	region *track.Region
+	inside map[int]bool // by vehicle Id
 }
 
 func NewSystem(trk *track.Track, vehs *[]Vehicle, sim Simulator, collider VehicleCollider) *System {
-	return &System{
-		dt:       simDeltaT,
-		now:      0,
-		Track:    *trk,
-		Vehicles: *vehs,
-		Collider: collider,
-		sim:      sim,
+	s := &System{
+		dt:         simDeltaT,
+		now:        0,
+		Track:      *trk,
+		Vehicles:   *vehs,
+		Collider:   collider,
+		Events:     NewEventBus(),
+		sim:        sim,
+		collisions: make(map[vehPair]CollisionEvent),
+		regions:    make([]watchedRegion, 0),
+
+		obstacles:          make([]*Obstacle, 0),
+		obstacleCollisions: make(map[vehObstPair]ObstacleCollisionEvent),
+	}
+	for i := range s.Vehicles {
+		s.Vehicles[i].id = i
+		s.Vehicles[i].events = s.Events
 	}
+	s.nextVehId = len(s.Vehicles)
+	return s
 }
 
 func (s *System) SimDeltaT() phys.SimTime {
@@ -52,10 +93,159 @@ func (s *System) Now() phys.SimTime {
 // should call Tick.
 func (s *System) Tick() {
 	s.now += s.dt
+	if s.cmdLink != nil {
+		s.cmdLink.deliver(s)
+	}
 	s.sim.Tick(s.dt, &s.Track, &s.Vehicles)
 	for _, v := range s.Vehicles {
 		v.Lights().Update(s.now)
 	}
+	s.Events.setTime(s.now)
 	s.Collider.update(s.now, &s.Track, &s.Vehicles)
+	s.publishCollisionEvents()
+	s.updateObstacles()
+	s.publishRegionEvents()
+	if s.localizer != nil {
+		s.localizer.update(s)
+	}
 	// TODO: Update/apply external forces?
 }
+
+//////////////////////////////////////////////////////////////////////
+// Vehicles
+
+// AddVehicle adds a vehicle to the system, eg to spawn a vehicle or let a
+// player join mid-phase, and returns its Id. The vehicle appears where it is,
+// as if it was placed there, and collisions are detected from the next tick.
+// NOTE: Adding a vehicle can move the other vehicles in memory, so pointers
+// into Vehicles must be refreshed.
+func (s *System) AddVehicle(veh Vehicle) int {
+	s.Vehicles = append(s.Vehicles, veh)
+	v := &s.Vehicles[len(s.Vehicles)-1]
+	v.id = s.nextVehId
+	v.events = s.Events
+	s.nextVehId++
+	s.observeVehCmds(v)
+	s.linkVehCmds(v)
+	for _, wr := range s.regions {
+		wr.inside[v.id] = wr.region.ContainsPoint(v.CurTrackPose().Point)
+	}
+	s.Events.Publish(Event{Kind: EvVehAdded, VehId: v.id})
+	return v.id
+}
+
+// RemoveVehicle removes the vehicle with the Id, if there is one, eg to retire
+// an eliminated player. Its ongoing collisions end on the next tick. The Ids of
+// the other vehicles do not change.
+func (s *System) RemoveVehicle(id int) {
+	i := FindVehicle(s.Vehicles, id)
+	if i < 0 {
+		return
+	}
+	s.Vehicles[i].events = nil
+	s.Vehicles[i].cmdObserver = nil
+	s.Vehicles[i].cmdLink = nil
+	s.Vehicles[i].Lights().SetObserver(nil)
+	s.Vehicles[i].Lights().SetLink(nil)
+	s.Vehicles = append(s.Vehicles[:i], s.Vehicles[i+1:]...)
+	for _, wr := range s.regions {
+		delete(wr.inside, id)
+	}
+	s.Events.Publish(Event{Kind: EvVehRemoved, VehId: id})
+}
+
+// Vehicle returns the vehicle with the Id, or nil if there is none.
+func (s *System) Vehicle(id int) *Vehicle {
+	if i := FindVehicle(s.Vehicles, id); i >= 0 {
+		return &s.Vehicles[i]
+	}
+	return nil
+}
+
+// FindVehicle returns the index of the vehicle with the Id, or -1 if there is
+// none. The vehicles must be in Id order, like System.Vehicles.
+func FindVehicle(vehs []Vehicle, id int) int {
+	i := sort.Search(len(vehs), func(i int) bool { return vehs[i].id >= id })
+	if (i < len(vehs)) && (vehs[i].id == id) {
+		return i
+	}
+	return -1
+}
+
+//////////////////////////////////////////////////////////////////////
+// Regions and events
+
+// WatchRegion publishes EvRegionEnter and EvRegionExit events whenever a
+// vehicle enters or exits the track region. The name identifies the region in
+// the events, and must be unique.
+func (s *System) WatchRegion(name string, region *track.Region) {
+	for _, wr := range s.regions {
+		if wr.name == name {
+			panic(fmt.Sprintf("WatchRegion: region %q is already watched", name))
+		}
+	}
+	wr := watchedRegion{name: name, region: region, inside: make(map[int]bool)}
+	for _, veh := range s.Vehicles {
+		wr.inside[veh.id] = region.ContainsPoint(veh.CurTrackPose().Point)
+	}
+	s.regions = append(s.regions, wr)
+}
+
+// UnwatchRegion stops publishing events for the named track region.
+func (s *System) UnwatchRegion(name string) {
+	for i, wr := range s.regions {
+		if wr.name == name {
+			s.regions = append(s.regions[:i], s.regions[i+1:]...)
+			return
+		}
+	}
+}
+
+// publishCollisionEvents compares the ongoing collisions to those of the
+// previous tick. Collisions are published in vehicle order, so that the order
+// is repeatable.
+func (s *System) publishCollisionEvents() {
+	cur := make(map[vehPair]CollisionEvent)
+	for _, ce := range s.Collider.CurCollisions() {
+		cur[vehPair{ce.VehInfo[0].Id, ce.VehInfo[1].Id}] = ce
+	}
+
+	for _, pair := range sortedVehPairs(s.collisions) {
+		if _, ok := cur[pair]; !ok {
+			ce := s.collisions[pair]
+			s.Events.Publish(Event{Kind: EvCollisionEnd, VehId: pair.Veh1, Collision: &ce})
+		}
+	}
+	for _, pair := range sortedVehPairs(cur) {
+		if _, ok := s.collisions[pair]; !ok {
+			ce := cur[pair]
+			s.Events.Publish(Event{Kind: EvCollisionStart, VehId: pair.Veh1, Collision: &ce})
+		}
+	}
+	s.collisions = cur
+}
+
+func (s *System) publishRegionEvents() {
+	for _, wr := range s.regions {
+		for _, veh := range s.Vehicles {
+			inside := wr.region.ContainsPoint(veh.CurTrackPose().Point)
+			if inside && !wr.inside[veh.id] {
+				s.Events.Publish(Event{Kind: EvRegionEnter, VehId: veh.id, Region: wr.name})
+			} else if !inside && wr.inside[veh.id] {
+				s.Events.Publish(Event{Kind: EvRegionExit, VehId: veh.id, Region: wr.name})
+			}
+			wr.inside[veh.id] = inside
+		}
+	}
+}
+
+func sortedVehPairs(m map[vehPair]CollisionEvent) []vehPair {
+	pairs := make([]vehPair, 0, len(m))
+	for pair := range m {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return (pairs[i].Veh1 < pairs[j].Veh1) || ((pairs[i].Veh1 == pairs[j].Veh1) && (pairs[i].Veh2 < pairs[j].Veh2))
+	})
+	return pairs
+}
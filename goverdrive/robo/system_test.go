@@ -0,0 +1,134 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// newAddRemoveSystem creates a system with two vehicles, far apart.
+func newAddRemoveSystem(t *testing.T, newCollider newColliderFunc) *System {
+	rsys := newTestSystem(t, nil, newCollider, "gs", "sk")
+	rsys.Vehicles[0].Reposition(track.Pose{Point: track.Point{Dofs: 0.1, Cofs: 0}})
+	rsys.Vehicles[1].Reposition(track.Pose{Point: track.Point{Dofs: 0.5, Cofs: 0}})
+	rsys.Tick()
+	return rsys
+}
+
+func TestSystemAddRemoveVehicle(t *testing.T) {
+	rsys := newAddRemoveSystem(t, newDetector)
+	q := NewEventQueue(rsys.Events, EvVehAdded, EvVehRemoved, EvCollisionStart, EvCollisionEnd)
+	cmds := make([]VehCmd, 0)
+	rsys.SetVehCmdObserver(func(cmd VehCmd) { cmds = append(cmds, cmd) })
+
+	// a new vehicle lands on top of vehicle 1
+	veh := mustNewVehicle(t, "th", rsys.Track.CenLen())
+	veh.Reposition(track.Pose{Point: track.Point{Dofs: 0.5, Cofs: 0}})
+	id := rsys.AddVehicle(veh)
+	testEqual(t, "new id", 2, id)
+	testEqual(t, "new vehicle", VehType("th"), rsys.Vehicle(id).Type())
+	rsys.Tick()
+	evs := q.Drain()
+	testEqual(t, "len(add events)", 2, len(evs))
+	if len(evs) == 2 {
+		testEqual(t, "added kind", EvVehAdded, evs[0].Kind)
+		testEqual(t, "added veh", id, evs[0].VehId)
+		testEqual(t, "collision kind", EvCollisionStart, evs[1].Kind)
+		testEqual(t, "collision veh 0", 1, evs[1].Collision.VehInfo[0].Id)
+		testEqual(t, "collision veh 1", id, evs[1].Collision.VehInfo[1].Id)
+	}
+
+	// the observer also sees the new vehicle's commands
+	rsys.Vehicle(id).SetCmdDriveDspd(0.5, 1.0)
+	testEqual(t, "len(cmds)", 1, len(cmds))
+	if len(cmds) == 1 {
+		testEqual(t, "cmd veh", id, cmds[0].VehId)
+	}
+
+	// removing a vehicle ends its collisions; the other Ids do not change
+	rsys.RemoveVehicle(1)
+	testEqual(t, "num vehicles", 2, len(rsys.Vehicles))
+	testEqual(t, "removed vehicle", (*Vehicle)(nil), rsys.Vehicle(1))
+	testEqual(t, "index of new vehicle", 1, FindVehicle(rsys.Vehicles, id))
+	testEqual(t, "index of removed vehicle", -1, FindVehicle(rsys.Vehicles, 1))
+	testEqual(t, "id of vehicle 0", 0, rsys.Vehicles[0].Id())
+	rsys.Tick()
+	evs = q.Drain()
+	testEqual(t, "len(remove events)", 2, len(evs))
+	if len(evs) == 2 {
+		testEqual(t, "removed kind", EvVehRemoved, evs[0].Kind)
+		testEqual(t, "removed veh", 1, evs[0].VehId)
+		testEqual(t, "collision end kind", EvCollisionEnd, evs[1].Kind)
+	}
+
+	// removing an unknown vehicle does nothing, and Ids are not reused
+	rsys.RemoveVehicle(1)
+	testEqual(t, "no events", 0, q.Len())
+	testEqual(t, "next id", 3, rsys.AddVehicle(mustNewVehicle(t, "gs", rsys.Track.CenLen())))
+}
+
+func TestSystemAddVehicleIsNotSwept(t *testing.T) {
+	rsys := newAddRemoveSystem(t, newDetector)
+	q := NewEventQueue(rsys.Events, EvCollisionStart)
+
+	// a vehicle that is added in front of a driving vehicle is only hit when the
+	// driving vehicle reaches it, not because it "jumped" there
+	rsys.Vehicles[0].SetCmdDriveDspd(1.0, 100)
+	rsys.Tick()
+	veh := mustNewVehicle(t, "sk", rsys.Track.CenLen())
+	veh.Reposition(track.Pose{Point: track.Point{Dofs: 0.3, Cofs: 0}})
+	rsys.AddVehicle(veh)
+	rsys.Tick()
+	testEqual(t, "no collision yet", 0, q.Len())
+	for i := 0; (i < 100) && (q.Len() == 0); i++ {
+		rsys.Tick()
+	}
+	evs := q.Drain()
+	testEqual(t, "len(collisions)", 1, len(evs))
+	if len(evs) == 1 {
+		testEqual(t, "hit veh 0", 0, evs[0].Collision.VehInfo[0].Id)
+		testEqual(t, "hit veh 1", 2, evs[0].Collision.VehInfo[1].Id)
+	}
+}
+
+func TestSystemRemoveStalledVehicle(t *testing.T) {
+	params := DefaultCollisionResponseParams()
+	params.StallDeltaV = 0.01
+	rsys := newAddRemoveSystem(t, newResponder(params))
+	cr := rsys.Collider.(*CollisionResponder)
+
+	// vehicle 0 rams vehicle 1, which stalls
+	rsys.Vehicles[0].SetCmdDriveDspd(1.0, 100)
+	for i := 0; (i < 100) && !cr.IsStalled(1); i++ {
+		rsys.Tick()
+	}
+	testEqual(t, "veh 1 stalled", true, cr.IsStalled(1))
+
+	// the stall is forgotten when the vehicle is removed
+	rsys.RemoveVehicle(1)
+	rsys.Tick()
+	testEqual(t, "removed veh stalled", false, cr.IsStalled(1))
+	testEqual(t, "num vehicles", 1, len(rsys.Vehicles))
+}
+
+func TestSystemWatchRegionAddedVehicle(t *testing.T) {
+	rsys := newAddRemoveSystem(t, newDetector)
+	q := NewEventQueue(rsys.Events, EvRegionEnter, EvRegionExit)
+	rsys.WatchRegion("zone", track.NewRegion(&rsys.Track, track.Point{Dofs: 0.8, Cofs: -0.1}, 0.1, 0.2))
+
+	rsys.RemoveVehicle(0)
+	veh := mustNewVehicle(t, "gs", rsys.Track.CenLen())
+	veh.Reposition(track.Pose{Point: track.Point{Dofs: 0.7, Cofs: 0}})
+	id := rsys.AddVehicle(veh)
+	rsys.Vehicle(id).Reposition(track.Pose{Point: track.Point{Dofs: 0.85, Cofs: 0}})
+	rsys.Tick()
+	evs := q.Drain()
+	testEqual(t, "len(region events)", 1, len(evs))
+	if len(evs) == 1 {
+		testEqual(t, "enter kind", EvRegionEnter, evs[0].Kind)
+		testEqual(t, "enter veh", id, evs[0].VehId)
+	}
+}
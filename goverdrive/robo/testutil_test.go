@@ -0,0 +1,78 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// newTestTrack creates the capsule track that the tests drive on.
+func newTestTrack(t *testing.T) *track.Track {
+	trk, err := track.NewStarterKitTrack(0.2, 0, "capsule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trk
+}
+
+// mustNewVehicle creates a vehicle, failing the test on error.
+func mustNewVehicle(t *testing.T, vt VehType, trackLen phys.Meters) Vehicle {
+	veh, err := NewVehicle(vt, light.Gen2Spec, trackLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *veh
+}
+
+// saveVehTypes snapshots the vehicle type registry, for tests that register
+// types. Call the returned func, eg with defer, to restore the snapshot.
+func saveVehTypes() (restore func()) {
+	vehTypes.RLock()
+	saved := make(map[VehType]vehTypeEntry, len(vehTypes.m))
+	for vt, e := range vehTypes.m {
+		saved[vt] = e
+	}
+	vehTypes.RUnlock()
+	return func() {
+		vehTypes.Lock()
+		vehTypes.m = saved
+		vehTypes.Unlock()
+	}
+}
+
+// newColliderFunc creates the collider for the track and vehicles of a test
+// system.
+type newColliderFunc func(trk *track.Track, vehs *[]Vehicle) VehicleCollider
+
+func newDetector(trk *track.Track, vehs *[]Vehicle) VehicleCollider {
+	return NewCollisionDetector(trk, vehs)
+}
+
+func newResponder(params CollisionResponseParams) newColliderFunc {
+	return func(trk *track.Track, vehs *[]Vehicle) VehicleCollider {
+		return NewCollisionResponder(trk, vehs, params)
+	}
+}
+
+// newTestSystem creates a system on the test track, with one idle vehicle of
+// each type, in order, all at Dofs=0. A nil sim is an IdealSimulator, and a nil
+// newCollider is a CollisionDetector.
+func newTestSystem(t *testing.T, sim Simulator, newCollider newColliderFunc, vtypes ...VehType) *System {
+	trk := newTestTrack(t)
+	vehs := make([]Vehicle, len(vtypes))
+	for v, vt := range vtypes {
+		vehs[v] = mustNewVehicle(t, vt, trk.CenLen())
+	}
+	if sim == nil {
+		sim = NewIdealSimulator()
+	}
+	if newCollider == nil {
+		newCollider = newDetector
+	}
+	return NewSystem(trk, &vehs, sim, newCollider(trk, &vehs))
+}
@@ -245,3 +245,23 @@ func NewCustomTrack(width phys.Meters, maxCofs phys.Meters, name string) (*Track
 		return nil, fmt.Errorf("Custom track name=%v is not recognized", name)
 	}
 }
+
+//////////////////////////////////////////////////////////////////////
+
+// NewNamedTrack constructs a track from any supported track string: a modular
+// track topology string, a starter kit track name, or a custom track name.
+func NewNamedTrack(width phys.Meters, maxCofs phys.Meters, trackStr string) (*Track, error) {
+	if trackStr != "" {
+		if trk, err := NewModularTrack(width, maxCofs, trackStr); err == nil {
+			return trk, nil
+		}
+		if trk, err := NewStarterKitTrack(width, maxCofs, trackStr); err == nil {
+			return trk, nil
+		}
+		if trk, err := NewCustomTrack(width, maxCofs, trackStr); err == nil {
+			return trk, nil
+		}
+	}
+	return nil, fmt.Errorf("Track %q is not recognized. Supported starter kit tracks:\n  %s\nSupported custom tracks:\n  %s",
+		trackStr, StarterKitTrackNames("\n  "), CustomTrackNames("\n  "))
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// Vehicle turns are timed maneuvers: the simulator drives the vehicle along a
+// half circle, tick by tick, rather than teleporting it.
+
+package robo
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// TurnType matches the turn types of the vehicle protocol message
+// ANKI_VEHICLE_MSG_C2V_TURN. The tracks have no intersections, so left and
+// right turns are U-turns toward that side of the vehicle.
+type TurnType int
+
+const (
+	TurnNone      TurnType = 0 // no-op
+	TurnLeft      TurnType = 1 // U-turn toward the vehicle's left
+	TurnRight     TurnType = 2 // U-turn toward the vehicle's right
+	TurnUturn     TurnType = 3 // U-turn toward the road center
+	TurnUturnJump TurnType = 4 // instantaneous spin in place
+)
+
+const (
+	// MinTurnDspd is the speed of a turn that is commanded while the vehicle is
+	// stopped or slow.
+	MinTurnDspd phys.MetersPerSec = 0.2
+)
+
+func (tt TurnType) String() string {
+	switch tt {
+	case TurnNone:
+		return "none"
+	case TurnLeft:
+		return "left"
+	case TurnRight:
+		return "right"
+	case TurnUturn:
+		return "uturn"
+	case TurnUturnJump:
+		return "uturn_jump"
+	}
+	return "unknown"
+}
+
+// ParseTurnType returns the turn type with the name, eg "uturn".
+func ParseTurnType(name string) (TurnType, error) {
+	for tt := TurnNone; tt <= TurnUturnJump; tt++ {
+		if tt.String() == name {
+			return tt, nil
+		}
+	}
+	return TurnNone, fmt.Errorf("Turn=%q is not recognized; valid turns are none, left, right, uturn and uturn_jump", name)
+}
+
+// vehTurn is a turn in progress. The vehicle drives a half circle from the
+// start pose; in the vehicle's frame of reference, it is at forward=r*sin(a)
+// and lateral=r*(1-cos(a)) after turning by angle a.
+type vehTurn struct {
+	turn    TurnType // TurnNone => no turn in progress
+	radius  phys.Meters
+	start   track.Pose
+	angle   float64 // turned so far; the turn is done at Pi
+	fwdSign float64 // +1 => started facing trackwise
+	latSign float64 // +1 => moving toward +Cofs
+}
+
+// CmdTurn commands a turn of the given radius (<=0 => DefUturnRadius). The
+// turn starts immediately. Near the edge of the road, the radius is reduced so
+// that the turn stays within the track's MaxCofs. Turns are ignored while
+// another turn is in progress. Speed commands still apply during the turn.
+func (v *Vehicle) CmdTurn(turn TurnType, radius phys.Meters) {
+	v.issueCmd(VehCmd{Kind: VehCmdTurn, Turn: turn, Radius: radius})
+}
+
+func (v *Vehicle) cmdTurn(turn TurnType, radius phys.Meters) {
+	if (turn == TurnNone) || v.IsTurning() {
+		return
+	}
+	if radius <= 0 {
+		radius = DefUturnRadius
+	}
+	tp := v.CurTrackPose()
+	if turn == TurnUturnJump {
+		if v.IsFacingTrackwise() {
+			tp.DAngle = math.Pi // counter-trackwise
+		} else {
+			tp.DAngle = 0 // trackwise
+		}
+		v.reposition(tp)
+		v.curVel.D = -v.curVel.D
+		return
+	}
+
+	t := vehTurn{turn: turn, radius: radius, start: tp, fwdSign: 1}
+	if !v.IsFacingTrackwise() {
+		t.fwdSign = -1
+		t.start.DAngle = math.Pi
+	} else {
+		t.start.DAngle = 0
+	}
+	switch turn {
+	case TurnLeft:
+		t.latSign = t.fwdSign
+	case TurnRight:
+		t.latSign = -t.fwdSign
+	default: // toward the road center
+		if tp.Cofs < 0 {
+			t.latSign = 1
+		} else {
+			t.latSign = -1
+		}
+	}
+	v.turn = t
+	v.cmdCofs = tp.Cofs + phys.Meters(t.latSign*2*float64(radius))
+}
+
+// IsTurning returns true while a turn is in progress.
+func (v *Vehicle) IsTurning() bool {
+	return v.turn.turn != TurnNone
+}
+
+// CurTurn returns the turn in progress, or TurnNone.
+func (v *Vehicle) CurTurn() TurnType {
+	return v.turn.turn
+}
+
+// tickTurn advances a turn in progress by one tick, and returns false if there
+// is none. Simulators call it in place of their own driving model. The speed
+// along the half circle follows the commanded speed, but is at least
+// MinTurnDspd.
+func (v *Vehicle) tickTurn(dt phys.SimTime, trk *track.Track) bool {
+	t := &v.turn
+	if t.turn == TurnNone {
+		return false
+	}
+	fdt := float64(dt) * 1e-9
+	if t.angle == 0 {
+		// the half circle must fit on the road; a vehicle at the edge spins in
+		// place
+		room := float64(trk.MaxCofs()) - t.latSign*float64(t.start.Cofs)
+		t.radius = phys.Meters(math.Min(float64(t.radius), math.Max(0, room/2)))
+		v.cmdCofs = t.start.Cofs + phys.Meters(t.latSign*2*float64(t.radius))
+	}
+
+	desDspd := float64(v.desDspd)
+	cmdDspd := float64(v.cmdDspd)
+	dspdDelta := fdt * float64(v.cmdDacl)
+	if math.Abs(desDspd-cmdDspd) <= dspdDelta {
+		desDspd = cmdDspd
+	} else if desDspd < cmdDspd {
+		desDspd += dspdDelta
+	} else {
+		desDspd -= dspdDelta
+	}
+	speed := math.Max(desDspd, float64(MinTurnDspd))
+
+	// Dofs is measured along road center, so this is approximate on curves
+	r := float64(t.radius)
+	prevAngle := t.angle
+	t.angle = math.Min(math.Pi, t.angle+(speed*fdt/r))
+	sin, cos := math.Sin(t.angle), math.Cos(t.angle)
+	v.curPose.Dofs = trk.NormalizeDofs(t.start.Dofs + phys.Meters(t.fwdSign*r*sin))
+	v.curPose.Cofs = t.start.Cofs + phys.Meters(t.latSign*r*(1-cos))
+	v.curPose.DAngle = phys.NormalizeRadians(t.start.DAngle + phys.Radians(t.fwdSign*t.latSign*t.angle))
+	v.curVel.D = phys.MetersPerSec(t.fwdSign * speed * cos)
+	v.curVel.C = phys.MetersPerSec(t.latSign * speed * sin)
+	v.odom += phys.Meters(r * (t.angle - prevAngle))
+	v.desDspd = phys.MetersPerSec(desDspd)
+
+	if t.angle >= math.Pi {
+		// done => drive on in the new direction
+		if t.fwdSign > 0 {
+			v.curPose.DAngle = math.Pi
+		} else {
+			v.curPose.DAngle = 0
+		}
+		v.curVel.C = 0
+		v.desCofs = v.curPose.Cofs
+		v.turn = vehTurn{}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// newTurnSystem puts a vehicle driving at dspd on a straight part of the
+// track.
+func newTurnSystem(t *testing.T, sim Simulator, pose track.Pose, dspd phys.MetersPerSec) (*System, *Vehicle) {
+	rsys := newTestSystem(t, sim, nil, "gs")
+	veh := rsys.Vehicle(0)
+	veh.Reposition(pose)
+	veh.SetCmdDriveDspd(dspd, 100)
+	return rsys, veh
+}
+
+func TestTurnUturn(t *testing.T) {
+	rsys, veh := newTurnSystem(t, nil, track.Pose{Point: track.Point{Dofs: 1.7, Cofs: -0.05}}, 0.5)
+	rsys.Tick()
+	start := veh.CurTrackPose()
+	odom := veh.Odom()
+
+	veh.CmdUturn(DefUturnRadius)
+	testEqual(t, "turning", true, veh.IsTurning())
+	testEqual(t, "turn", TurnUturn, veh.CurTurn())
+	testEqual(t, "facing trackwise", false, veh.IsFacingTrackwise())
+	testMetersAreNear(t, "cmd cofs", start.Cofs+2*DefUturnRadius, veh.CmdTrackCofs())
+	testMetersAreNear(t, "no jump", start.Cofs, veh.CurTrackCofs())
+
+	// half a circle at 0.5 m/s
+	expTicks := int(math.Ceil(math.Pi * float64(DefUturnRadius) / 0.5 / (float64(simDeltaT) * 1e-9)))
+	ticks := 0
+	for ; (ticks < 100) && veh.IsTurning(); ticks++ {
+		rsys.Tick()
+		if ticks == (expTicks/2)-1 {
+			// about sideways, half way across, and ahead of the start
+			if !phys.RadiansAreNear(math.Pi/2, veh.CurTrackPose().DAngle, 0.1) {
+				t.Errorf("half way DAngle=%v", veh.CurTrackPose().DAngle)
+			}
+			if !phys.MetersAreNear(start.Cofs+DefUturnRadius, veh.CurTrackCofs(), 0.005) {
+				t.Errorf("half way Cofs=%v", veh.CurTrackCofs())
+			}
+			if veh.CurTrackPose().Dofs <= start.Dofs {
+				t.Errorf("half way Dofs=%v should be ahead of %v", veh.CurTrackPose().Dofs, start.Dofs)
+			}
+		}
+	}
+	testEqual(t, "ticks", expTicks, ticks)
+	testEqual(t, "turn", TurnNone, veh.CurTurn())
+	testMetersAreNear(t, "end Dofs", start.Dofs, veh.CurTrackPose().Dofs)
+	testMetersAreNear(t, "end Cofs", start.Cofs+2*DefUturnRadius, veh.CurTrackCofs())
+	testRadiansAreNear(t, "end DAngle", math.Pi, veh.CurTrackPose().DAngle)
+	testMetersAreNear(t, "odom", odom+math.Pi*DefUturnRadius, veh.Odom())
+
+	// then drive on, counter-trackwise
+	rsys.Tick()
+	if veh.CurTrackPose().Dofs >= start.Dofs {
+		t.Errorf("Dofs=%v should be behind %v", veh.CurTrackPose().Dofs, start.Dofs)
+	}
+	testMetersAreNear(t, "drive on Cofs", start.Cofs+2*DefUturnRadius, veh.CurTrackCofs())
+}
+
+func TestTurnTypes(t *testing.T) {
+	testTable := []struct {
+		turn     TurnType
+		dangle   phys.Radians
+		cofs     phys.Meters
+		expDCofs phys.Meters // after the turn
+	}{
+		{TurnLeft, 0, 0, +2 * DefUturnRadius},
+		{TurnRight, 0, 0, -2 * DefUturnRadius},
+		{TurnLeft, math.Pi, 0, -2 * DefUturnRadius},
+		{TurnRight, math.Pi, 0, +2 * DefUturnRadius},
+		{TurnUturn, math.Pi, +0.03, -2 * DefUturnRadius},
+		{TurnUturnJump, 0, 0.03, 0},
+	}
+	for _, vec := range testTable {
+		sim := NewRealisticSimulator(DefaultRealisticSimParams())
+		rsys, veh := newTurnSystem(t, sim, track.Pose{Point: track.Point{Dofs: 1.7, Cofs: vec.cofs}, DAngle: vec.dangle}, 0)
+		veh.CmdTurn(vec.turn, 0)
+		for i := 0; (i < 200) && veh.IsTurning(); i++ {
+			rsys.Tick()
+		}
+		tag := vec.turn.String()
+		if tt, err := ParseTurnType(tag); (err != nil) || (tt != vec.turn) {
+			t.Errorf("ParseTurnType(%q)=%v, %v", tag, tt, err)
+		}
+		testEqual(t, tag+" turning", false, veh.IsTurning())
+		testEqual(t, tag+" facing trackwise", vec.dangle != 0, veh.IsFacingTrackwise())
+		testMetersAreNear(t, tag+" Cofs", vec.cofs+vec.expDCofs, veh.CurTrackCofs())
+	}
+}
+
+func TestTurnNearEdge(t *testing.T) {
+	testTable := []struct {
+		turn    TurnType
+		cofs    phys.Meters
+		expCofs phys.Meters // after the turn
+	}{
+		{TurnLeft, 0.06, 0.1},    // smaller half circle, up to the edge
+		{TurnRight, -0.08, -0.1}, // smaller half circle, up to the edge
+		{TurnLeft, 0.1, 0.1},     // at the edge => spin in place
+		{TurnUturn, 0.1, 0.0},    // toward the center => fits
+	}
+	for _, vec := range testTable {
+		tag := fmt.Sprintf("%v at %v", vec.turn, vec.cofs)
+		rsys, veh := newTurnSystem(t, nil, track.Pose{Point: track.Point{Dofs: 1.7, Cofs: vec.cofs}}, 0.5)
+		maxCofs := rsys.Track.MaxCofs()
+		veh.CmdTurn(vec.turn, 0)
+		for i := 0; (i < 100) && veh.IsTurning(); i++ {
+			rsys.Tick()
+			if cofs := veh.CurTrackCofs(); (cofs > maxCofs+1e-9) || (cofs < -maxCofs-1e-9) {
+				t.Errorf("%s: Cofs=%v is off the road", tag, cofs)
+			}
+			if cofs := veh.CmdTrackCofs(); (cofs > maxCofs+1e-9) || (cofs < -maxCofs-1e-9) {
+				t.Errorf("%s: cmd Cofs=%v is off the road", tag, cofs)
+			}
+		}
+		testEqual(t, tag+" turning", false, veh.IsTurning())
+		testEqual(t, tag+" facing trackwise", false, veh.IsFacingTrackwise())
+		testMetersAreNear(t, tag+" Cofs", vec.expCofs, veh.CurTrackCofs())
+		testMetersAreNear(t, tag+" cmd Cofs", vec.expCofs, veh.CmdTrackCofs())
+	}
+}
+
+func TestTurnInterrupted(t *testing.T) {
+	rsys, veh := newTurnSystem(t, nil, track.Pose{Point: track.Point{Dofs: 1.7, Cofs: 0}}, 0.5)
+	veh.CmdTurn(TurnLeft, 0)
+	rsys.Tick()
+
+	// turns are ignored while turning
+	veh.CmdTurn(TurnRight, 0)
+	testEqual(t, "turn", TurnLeft, veh.CurTurn())
+	veh.CmdTurn(TurnUturnJump, 0)
+	testEqual(t, "turn", TurnLeft, veh.CurTurn())
+
+	// a reposition ends the turn
+	veh.Reposition(track.Pose{Point: track.Point{Dofs: 1.0, Cofs: 0}})
+	testEqual(t, "turning", false, veh.IsTurning())
+	testEqual(t, "facing trackwise", true, veh.IsFacingTrackwise())
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// VehCmdKind is the kind of vehicle command, named after the Vehicle method
+// that issues it.
+type VehCmdKind string
+
+const (
+	VehCmdDriveDspd  VehCmdKind = "SetCmdDriveDspd"
+	VehCmdDriveCofs  VehCmdKind = "SetCmdDriveCofs"
+	VehCmdTrackCofs  VehCmdKind = "SetCmdTrackCofs"
+	VehCmdUturn      VehCmdKind = "CmdUturn"
+	VehCmdTurn       VehCmdKind = "CmdTurn"
+	VehCmdReposition VehCmdKind = "Reposition"
+	VehCmdLights     VehCmdKind = "Lights"
+)
+
+// VehCmd is a serializable record of one command issued to a vehicle, eg for
+// recording a game session. Only the fields relevant to Kind are used.
+type VehCmd struct {
+	Time   phys.SimTime
+	VehId  int
+	Kind   VehCmdKind
+	Dspd   phys.MetersPerSec  `json:",omitempty"` // VehCmdDriveDspd
+	Dacl   phys.MetersPerSec2 `json:",omitempty"` // VehCmdDriveDspd
+	Cofs   phys.Meters        `json:",omitempty"` // VehCmd*Cofs
+	Cspd   phys.MetersPerSec  `json:",omitempty"` // VehCmd*Cofs
+	Radius phys.Meters        `json:",omitempty"` // VehCmdUturn, VehCmdTurn
+	Turn   TurnType           `json:",omitempty"` // VehCmdTurn
+	Pose   *track.Pose        `json:",omitempty"` // VehCmdReposition
+	Light  *light.Cmd         `json:",omitempty"` // VehCmdLights
+}
+
+// VehCmdObserver is called for every command issued to a vehicle.
+type VehCmdObserver func(cmd VehCmd)
+
+// SetVehCmdObserver sets a function that is called for every command issued to
+// every vehicle in the system, including light commands and vehicles added
+// later. The command's Time and VehId are filled in. Use nil to remove the
+// observer.
+func (s *System) SetVehCmdObserver(observer VehCmdObserver) {
+	s.cmdObserver = observer
+	for i := range s.Vehicles {
+		s.observeVehCmds(&s.Vehicles[i])
+	}
+}
+
+// observeVehCmds hooks up the system's command observer to one vehicle.
+func (s *System) observeVehCmds(veh *Vehicle) {
+	observer := s.cmdObserver
+	if observer == nil {
+		veh.cmdObserver = nil
+		veh.Lights().SetObserver(nil)
+		return
+	}
+
+	vehId := veh.id
+	veh.cmdObserver = func(cmd VehCmd) {
+		cmd.Time = s.now
+		cmd.VehId = vehId
+		observer(cmd)
+	}
+	veh.Lights().SetObserver(func(lc light.Cmd) {
+		observer(VehCmd{Time: s.now, VehId: vehId, Kind: VehCmdLights, Light: &lc})
+	})
+}
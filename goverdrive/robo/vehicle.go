@@ -8,8 +8,6 @@ import (
 	"image/color"
 	"math"
 
-	cn "golang.org/x/image/colornames"
-
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo/light"
 	"github.com/anki/goverdrive/robo/track"
@@ -20,45 +18,6 @@ const (
 	DefUturnRadius phys.Meters = 0.05
 )
 
-//////////////////////////////////////////////////////////////////////
-// Vehicle Types
-//////////////////////////////////////////////////////////////////////
-
-// VehType is a two-letter abbreviation for a vehicle "type" (aka "model" in
-// some contexts). Using two-letter names is simple, concise, and lines up
-// nicely for table-driven code.
-//
-// Examples:
-//   "gs" = Groundshock
-//   "sk" = Skull
-//   "th" = Thermo
-type VehType string // two letters, lowercase (eg "gs", "sk")
-
-// VehTypeInfo stores name, physical properties, etc for a vehicle.
-type VehTypeInfo struct {
-	FullName string // eg "Groundshock"
-	Color    color.Color
-	Width    phys.Meters
-	Length   phys.Meters
-	Mass     phys.Grams
-}
-
-// TODO: Better to put vehicle info into JSON file(s)?
-var vehTypeInfoTable = map[VehType]VehTypeInfo{
-	"gs": VehTypeInfo{FullName: "Groundshock" /**/, Color: cn.Royalblue /*******/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"sk": VehTypeInfo{FullName: "Skull" /********/, Color: cn.Darkslategray /***/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"nk": VehTypeInfo{FullName: "Nuke" /*********/, Color: cn.Limegreen /*******/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"th": VehTypeInfo{FullName: "Thermo" /*******/, Color: cn.Orangered /*******/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"gu": VehTypeInfo{FullName: "Guardian" /*****/, Color: cn.Skyblue /*********/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"bb": VehTypeInfo{FullName: "BigBang" /******/, Color: cn.Seagreen /********/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"fw": VehTypeInfo{FullName: "Freewheel" /****/, Color: cn.Lime /************/, Width: 0.044, Length: 0.24, Mass: 40.0},
-	"xr": VehTypeInfo{FullName: "X52" /**********/, Color: cn.Red /*************/, Width: 0.044, Length: 0.24, Mass: 40.0},
-	"xi": VehTypeInfo{FullName: "X52Ice" /*******/, Color: cn.White /***********/, Width: 0.044, Length: 0.24, Mass: 40.0},
-	"dy": VehTypeInfo{FullName: "Dynamo" /*******/, Color: cn.Darkgray /********/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"mm": VehTypeInfo{FullName: "Mammoth" /******/, Color: cn.Lightsteelblue /**/, Width: 0.044, Length: 0.08, Mass: 40.0},
-	"np": VehTypeInfo{FullName: "NukePhantom" /**/, Color: cn.Ghostwhite /******/, Width: 0.044, Length: 0.08, Mass: 40.0},
-}
-
 //////////////////////////////////////////////////////////////////////
 // Vehicle
 //////////////////////////////////////////////////////////////////////
@@ -74,6 +33,7 @@ var vehTypeInfoTable = map[VehType]VehTypeInfo{
 type Vehicle struct {
 	trackLen phys.Meters
 	vtype    VehType
+	info     VehTypeInfo // copied on creation, so that registry changes do not affect existing vehicles
 	lights   light.VehLights
 
 	odom    phys.Meters // odometer = total distance driven (runs continuously)
@@ -88,25 +48,33 @@ type Vehicle struct {
 	cmdCspd phys.MetersPerSec // commanded center speed (for lane change)
 	desCofs phys.Meters       // desired center offset at this moment
 
+	cmdObserver func(cmd VehCmd) // nil => no observer; see System.SetVehCmdObserver
+	cmdLink     func(cmd VehCmd) // nil => commands take effect immediately; see System.SetCmdLink
+	id          int              // stable Id in the System; see System.AddVehicle
+	events      *EventBus        // nil => not part of a System
+	repositions int              // count of repositions, so that colliders can tell a jump from driving
+	turn        vehTurn          // turn in progress, if any
+	held        bool             // true => the simulator does not move it, eg while stalled; see CollisionResponder
+
 	// TODO: Include fields to model [temporary] external accel? (eg centrifugal; hills; collision)
 	// TODO: Or, is this handled in a different part of the robotics system?
 }
 
 // NewVehicle creates a new vehicle of the desired type. The vehicle is idle at
-// the origin.
-func NewVehicle(vt VehType, lspec light.Spec, trackLen phys.Meters) *Vehicle {
-	_, ok := vehTypeInfoTable[vt]
-	if !ok {
-		helpstr := ""
-		for k, v := range vehTypeInfoTable {
-			helpstr += fmt.Sprintf("  %s  %s\n", k, v.FullName)
-		}
-		panic(fmt.Sprintf("VehType=%v is invalid. Valid vehicle types:\n%s", vt, helpstr))
+// the origin. A nil lspec means the vehicle type's default light spec.
+func NewVehicle(vt VehType, lspec light.Spec, trackLen phys.Meters) (*Vehicle, error) {
+	info, err := LookupVehType(vt)
+	if err != nil {
+		return nil, err
+	}
+	if lspec == nil {
+		lspec = info.Lights
 	}
 
 	return &Vehicle{
 		trackLen: trackLen,
 		vtype:    vt,
+		info:     info,
 		lights:   *light.NewVehLights(lspec),
 		odom:     0,
 		curPose:  track.Pose{Point: track.Point{Dofs: 0, Cofs: 0}, DAngle: 0},
@@ -115,9 +83,15 @@ func NewVehicle(vt VehType, lspec light.Spec, trackLen phys.Meters) *Vehicle {
 		cmdDacl:  0.1,
 		desDspd:  0,
 		cmdCofs:  0,
-		cmdCspd:  0.1,
+		cmdCspd:  info.Cspd,
 		desCofs:  0,
-	}
+	}, nil
+}
+
+// Id is the vehicle's stable Id in its System. It is used in events and
+// collisions to identify the vehicle.
+func (v *Vehicle) Id() int {
+	return v.id
 }
 
 // Type is the vehicle's type.
@@ -127,17 +101,37 @@ func (v *Vehicle) Type() VehType {
 
 // Width is the physical width of the vehicle.
 func (v *Vehicle) Width() phys.Meters {
-	return vehTypeInfoTable[v.vtype].Width
+	return v.info.Width
 }
 
 // Length is the physical length of the vehicle.
 func (v *Vehicle) Length() phys.Meters {
-	return vehTypeInfoTable[v.vtype].Length
+	return v.info.Length
+}
+
+// Mass is the vehicle's mass, eg for collision response.
+func (v *Vehicle) Mass() phys.Grams {
+	return v.info.Mass
+}
+
+// MaxDspd is the fastest the vehicle's motors can drive it.
+func (v *Vehicle) MaxDspd() phys.MetersPerSec {
+	return v.info.MaxDspd
+}
+
+// MaxDacl is the fastest the vehicle's motors can change its speed.
+func (v *Vehicle) MaxDacl() phys.MetersPerSec2 {
+	return v.info.MaxDacl
+}
+
+// MaxDdcl is the fastest the vehicle's motors and brakes can slow it down.
+func (v *Vehicle) MaxDdcl() phys.MetersPerSec2 {
+	return v.info.MaxDdcl
 }
 
 // Color is the vehicle's shell color
 func (v *Vehicle) Color() color.Color {
-	return vehTypeInfoTable[v.vtype].Color
+	return v.info.Color
 }
 
 // Lights returns a handle to the vehicle's lights.
@@ -163,9 +157,13 @@ func (v *Vehicle) CurTrackVel() track.Vel {
 
 // IsFacingTrackwise returns true if the vehicle is facing in the natural
 // forward direction of the track. If the vehicle is not stopped, this is also
-// the direcion the vehicle is driving.
+// the direcion the vehicle is driving. While a turn is in progress, it is the
+// direction the vehicle will be driving when the turn is done.
 // NOTE: The "trackwise" concept is akin to the "clockwise" concept.
 func (v *Vehicle) IsFacingTrackwise() bool {
+	if v.IsTurning() {
+		return v.turn.fwdSign < 0
+	}
 	absDAngle := math.Abs(float64(v.curPose.DAngle))
 	if absDAngle <= (math.Pi / 2) {
 		return true
@@ -248,6 +246,16 @@ func (v *Vehicle) CurTrackCofs() phys.Meters {
 // if a physical vehicle was picked up and move. This changes the "commanded"
 // Cofs, but does NOT change the commanded driving distance speed.
 func (v *Vehicle) Reposition(p track.Pose) {
+	v.notifyCmd(VehCmd{Kind: VehCmdReposition, Pose: &p})
+	v.reposition(p)
+	if v.events != nil {
+		v.events.Publish(Event{Kind: EvVehRepositioned, VehId: v.id, Pose: &p})
+	}
+}
+
+func (v *Vehicle) reposition(p track.Pose) {
+	v.repositions++
+	v.turn = vehTurn{}
 	v.curPose = p
 	v.desCofs = p.Cofs
 	v.cmdCofs = p.Cofs
@@ -256,41 +264,69 @@ func (v *Vehicle) Reposition(p track.Pose) {
 // SetCmdDriveDspd commands a new distance speed and acceleration, in the
 // vehicle's current driving direction.
 func (v *Vehicle) SetCmdDriveDspd(vs phys.MetersPerSec, va phys.MetersPerSec2) {
-	v.cmdDspd = vs
-	v.cmdDacl = va
+	v.issueCmd(VehCmd{Kind: VehCmdDriveDspd, Dspd: vs, Dacl: va})
 }
 
 // SetCmdDriveCofs commands a new center offset and speed, in the vehicle's
 // current driving direction.
 func (v *Vehicle) SetCmdDriveCofs(cofs phys.Meters, speed phys.MetersPerSec) {
-	if v.IsFacingTrackwise() {
-		v.cmdCofs = cofs
-	} else {
-		v.cmdCofs = -cofs
-	}
-	v.cmdCspd = speed
+	v.issueCmd(VehCmd{Kind: VehCmdDriveCofs, Cofs: cofs, Cspd: speed})
 }
 
 // SetCmdTrackCofs commands a new center offset and speed. The center offset is
 // absolute, in Track coordinate space.
 func (v *Vehicle) SetCmdTrackCofs(cofs phys.Meters, speed phys.MetersPerSec) {
-	v.cmdCofs = cofs
-	v.cmdCspd = speed
+	v.issueCmd(VehCmd{Kind: VehCmdTrackCofs, Cofs: cofs, Cspd: speed})
 }
 
-// CmdUturn commands a 180-degree uturn, toward the road center.
+// CmdUturn commands a 180-degree uturn, toward the road center. It is the same
+// as CmdTurn(TurnUturn, radius).
 func (v *Vehicle) CmdUturn(radius phys.Meters) {
-	// XXX(gwenz): For now, uturn is instantaneous
-	tp := v.CurTrackPose()
-	if tp.Cofs < 0 {
-		tp.Cofs += (radius * 2)
-	} else {
-		tp.Cofs -= (radius * 2)
+	v.issueCmd(VehCmd{Kind: VehCmdUturn, Radius: radius})
+}
+
+// notifyCmd passes a command to the vehicle's command observer, if any.
+func (v *Vehicle) notifyCmd(cmd VehCmd) {
+	if v.cmdObserver != nil {
+		v.cmdObserver(cmd)
 	}
-	if v.IsFacingTrackwise() {
-		tp.DAngle = math.Pi // counter-trackwise
-	} else {
-		tp.DAngle = 0 // trackwise
+}
+
+// issueCmd notifies the observer, and passes the command to the vehicle's
+// command link, if any, or else applies it immediately.
+func (v *Vehicle) issueCmd(cmd VehCmd) {
+	v.notifyCmd(cmd)
+	if v.cmdLink != nil {
+		v.cmdLink(cmd)
+		return
+	}
+	v.applyCmd(0, cmd)
+}
+
+// applyCmd makes a command take effect. now is only used for light
+// animations.
+func (v *Vehicle) applyCmd(now phys.SimTime, cmd VehCmd) {
+	switch cmd.Kind {
+	case VehCmdDriveDspd:
+		v.cmdDspd = cmd.Dspd
+		v.cmdDacl = cmd.Dacl
+	case VehCmdDriveCofs:
+		if v.IsFacingTrackwise() {
+			v.cmdCofs = cmd.Cofs
+		} else {
+			v.cmdCofs = -cmd.Cofs
+		}
+		v.cmdCspd = cmd.Cspd
+	case VehCmdTrackCofs:
+		v.cmdCofs = cmd.Cofs
+		v.cmdCspd = cmd.Cspd
+	case VehCmdUturn:
+		v.cmdTurn(TurnUturn, cmd.Radius)
+	case VehCmdTurn:
+		v.cmdTurn(cmd.Turn, cmd.Radius)
+	case VehCmdLights:
+		v.lights.Apply(now, *cmd.Light)
+	default:
+		panic(fmt.Sprintf("Vehicle.applyCmd(%v) failed, command kind not recognized", cmd.Kind))
 	}
-	v.Reposition(tp)
 }
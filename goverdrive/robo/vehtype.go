@@ -0,0 +1,313 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+//
+// vehtype.go is the registry of vehicle types. The built-in types are defined
+// in JSON, in the same format as vehicle type files, so that new or modified
+// types can be loaded at startup (see LoadVehTypes) or added at runtime (see
+// RegisterVehType) without code changes.
+
+package robo
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/colornames"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+)
+
+// VehType is a two-letter abbreviation for a vehicle "type" (aka "model" in
+// some contexts). Using two-letter names is simple, concise, and lines up
+// nicely for table-driven code.
+//
+// Examples:
+//   "gs" = Groundshock
+//   "sk" = Skull
+//   "th" = Thermo
+type VehType string // two letters, lowercase (eg "gs", "sk")
+
+// VehTypeInfo stores name, physical properties, etc for a vehicle.
+type VehTypeInfo struct {
+	FullName string // eg "Groundshock"
+	Color    color.Color
+	Width    phys.Meters
+	Length   phys.Meters
+	Mass     phys.Grams
+	MaxDspd  phys.MetersPerSec  // motor limit; see RealisticSimulator
+	MaxDacl  phys.MetersPerSec2 // motor limit; see RealisticSimulator
+	MaxDdcl  phys.MetersPerSec2 // motor/braking limit, when slowing down; see RealisticSimulator
+	Cspd     phys.MetersPerSec  // default lane change speed
+	Lights   light.Spec         // default light spec
+}
+
+// VehTypeSpec describes a vehicle type, as stored in a JSON vehicle type file.
+// A file holds a list of them.
+type VehTypeSpec struct {
+	Type     VehType
+	FullName string
+	Color    string // name from golang.org/x/image/colornames, eg "royalblue"
+	Width    phys.Meters
+	Length   phys.Meters
+	Mass     phys.Grams
+	MaxDspd  phys.MetersPerSec
+	MaxDacl  phys.MetersPerSec2
+	MaxDdcl  phys.MetersPerSec2 `json:",omitempty"` // 0 => MaxDacl
+	Cspd     phys.MetersPerSec  `json:",omitempty"` // 0 => DefVehCspd
+	Lights   string             `json:",omitempty"` // "" => "gen2"; see light.SpecByName
+}
+
+const (
+	// DefVehCspd is the default lane change speed, for vehicle types that do not
+	// specify one.
+	DefVehCspd phys.MetersPerSec = 0.1
+
+	// maxVehDimension is a sanity limit on vehicle width and length
+	maxVehDimension phys.Meters = 1.0
+)
+
+// defVehTypesJSON holds the built-in vehicle types.
+const defVehTypesJSON = `[
+  {"Type": "gs", "FullName": "Groundshock", "Color": "royalblue",      "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "sk", "FullName": "Skull",       "Color": "darkslategray",  "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "nk", "FullName": "Nuke",        "Color": "limegreen",      "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "th", "FullName": "Thermo",      "Color": "orangered",      "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "gu", "FullName": "Guardian",    "Color": "skyblue",        "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "bb", "FullName": "BigBang",     "Color": "seagreen",       "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "fw", "FullName": "Freewheel",   "Color": "lime",           "Width": 0.044, "Length": 0.24, "Mass": 40,  "MaxDspd": 1.2, "MaxDacl": 2.5},
+  {"Type": "xr", "FullName": "X52",         "Color": "red",            "Width": 0.044, "Length": 0.24, "Mass": 40,  "MaxDspd": 1.2, "MaxDacl": 2.5},
+  {"Type": "xi", "FullName": "X52Ice",      "Color": "white",          "Width": 0.044, "Length": 0.24, "Mass": 40,  "MaxDspd": 1.2, "MaxDacl": 2.5},
+  {"Type": "dy", "FullName": "Dynamo",      "Color": "darkgray",       "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "mm", "FullName": "Mammoth",     "Color": "lightsteelblue", "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0},
+  {"Type": "np", "FullName": "NukePhantom", "Color": "ghostwhite",     "Width": 0.044, "Length": 0.08, "Mass": 40,  "MaxDspd": 1.5, "MaxDacl": 4.0}
+]`
+
+// vehTypeEntry is one registered vehicle type.
+type vehTypeEntry struct {
+	spec VehTypeSpec
+	info VehTypeInfo
+}
+
+var vehTypes = struct {
+	sync.RWMutex
+	m map[VehType]vehTypeEntry
+}{m: make(map[VehType]vehTypeEntry)}
+
+func init() {
+	specs, err := ParseVehTypes([]byte(defVehTypesJSON))
+	if err != nil {
+		panic(fmt.Sprintf("Built-in vehicle types are invalid: %v", err))
+	}
+	if err = RegisterVehTypes(specs); err != nil {
+		panic(fmt.Sprintf("Built-in vehicle types are invalid: %v", err))
+	}
+}
+
+//////////////////////////////////////////////////////////////////////
+// Registry
+//////////////////////////////////////////////////////////////////////
+
+// LoadVehTypes reads a JSON vehicle type file, and registers its types. A type
+// that is already registered, including a built-in type, is replaced, but
+// vehicles that already exist are not affected. If any type in the file is
+// invalid, or listed more than once, none are registered.
+func LoadVehTypes(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	specs, err := ParseVehTypes(data)
+	if err != nil {
+		return fmt.Errorf("Vehicle type file %s: %v", filename, err)
+	}
+	if err = RegisterVehTypes(specs); err != nil {
+		return fmt.Errorf("Vehicle type file %s: %v", filename, err)
+	}
+	return nil
+}
+
+// ParseVehTypes parses the contents of a JSON vehicle type file.
+func ParseVehTypes(data []byte) ([]VehTypeSpec, error) {
+	var specs []VehTypeSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("Vehicle types could not be parsed: %v", err)
+	}
+	return specs, nil
+}
+
+// RegisterVehType validates a vehicle type and adds it to the registry, or
+// replaces the registered type of the same name. Built-in types, eg "gs", can
+// be replaced too, so that a vehicle type file can tune them.
+func RegisterVehType(spec VehTypeSpec) error {
+	return RegisterVehTypes([]VehTypeSpec{spec})
+}
+
+// RegisterVehTypes is like RegisterVehType, for several types. If any type is
+// invalid, or listed more than once, none are registered.
+func RegisterVehTypes(specs []VehTypeSpec) error {
+	entries := make([]vehTypeEntry, len(specs))
+	listed := make(map[VehType]bool)
+	for i, spec := range specs {
+		if listed[spec.Type] {
+			return fmt.Errorf("VehType=%q is listed more than once", spec.Type)
+		}
+		listed[spec.Type] = true
+		info, err := spec.Info()
+		if err != nil {
+			return err
+		}
+		entries[i] = vehTypeEntry{spec: spec, info: info}
+	}
+
+	vehTypes.Lock()
+	defer vehTypes.Unlock()
+	for _, e := range entries {
+		vehTypes.m[e.spec.Type] = e
+	}
+	return nil
+}
+
+// VehTypes returns the registered vehicle types, in sorted order.
+func VehTypes() []VehType {
+	vehTypes.RLock()
+	defer vehTypes.RUnlock()
+	vts := make([]VehType, 0, len(vehTypes.m))
+	for vt := range vehTypes.m {
+		vts = append(vts, vt)
+	}
+	sort.Slice(vts, func(i, j int) bool { return vts[i] < vts[j] })
+	return vts
+}
+
+// VehTypeSpecs returns the specs of the registered vehicle types, in sorted
+// order by type. The result can be saved as a vehicle type file.
+func VehTypeSpecs() []VehTypeSpec {
+	vts := VehTypes()
+	vehTypes.RLock()
+	defer vehTypes.RUnlock()
+	specs := make([]VehTypeSpec, 0, len(vts))
+	for _, vt := range vts {
+		if e, ok := vehTypes.m[vt]; ok {
+			specs = append(specs, e.spec)
+		}
+	}
+	return specs
+}
+
+// LookupVehType returns the info for a registered vehicle type.
+func LookupVehType(vt VehType) (VehTypeInfo, error) {
+	vehTypes.RLock()
+	e, ok := vehTypes.m[vt]
+	vehTypes.RUnlock()
+	if !ok {
+		return VehTypeInfo{}, fmt.Errorf("VehType=%q is invalid. Valid vehicle types:\n%s", vt, VehTypeHelp())
+	}
+	return e.info, nil
+}
+
+// IsValidVehType returns true if vt is a known vehicle type.
+func IsValidVehType(vt VehType) bool {
+	vehTypes.RLock()
+	defer vehTypes.RUnlock()
+	_, ok := vehTypes.m[vt]
+	return ok
+}
+
+// VehTypeHelp returns a multi-line list of the valid vehicle types and names.
+func VehTypeHelp() string {
+	helpstr := ""
+	for _, spec := range VehTypeSpecs() {
+		helpstr += fmt.Sprintf("  %s  %s\n", spec.Type, spec.FullName)
+	}
+	return helpstr
+}
+
+//////////////////////////////////////////////////////////////////////
+// Validation
+//////////////////////////////////////////////////////////////////////
+
+// Info validates the spec, and converts it to a VehTypeInfo, with defaults
+// filled in.
+func (spec VehTypeSpec) Info() (VehTypeInfo, error) {
+	fail := func(format string, a ...interface{}) (VehTypeInfo, error) {
+		return VehTypeInfo{}, fmt.Errorf("VehType=%q: %s", spec.Type, fmt.Sprintf(format, a...))
+	}
+	if !isVehTypeName(spec.Type) {
+		return fail("type must be two lowercase letters")
+	}
+	if strings.TrimSpace(spec.FullName) == "" {
+		return fail("FullName is required")
+	}
+	c, ok := colornames.Map[strings.ToLower(spec.Color)]
+	if !ok {
+		return fail("Color=%q is not recognized", spec.Color)
+	}
+	if (spec.Width <= 0) || (spec.Width > maxVehDimension) {
+		return fail("Width=%v is not reasonable", spec.Width)
+	}
+	if (spec.Length <= 0) || (spec.Length > maxVehDimension) {
+		return fail("Length=%v is not reasonable", spec.Length)
+	}
+	if spec.Mass <= 0 {
+		return fail("Mass=%v must be > 0", spec.Mass)
+	}
+	if spec.MaxDspd <= 0 {
+		return fail("MaxDspd=%v must be > 0", spec.MaxDspd)
+	}
+	if spec.MaxDacl <= 0 {
+		return fail("MaxDacl=%v must be > 0", spec.MaxDacl)
+	}
+	if spec.MaxDdcl < 0 {
+		return fail("MaxDdcl=%v must be >= 0", spec.MaxDdcl)
+	}
+	if spec.Cspd < 0 {
+		return fail("Cspd=%v must be >= 0", spec.Cspd)
+	}
+	lname := spec.Lights
+	if lname == "" {
+		lname = "gen2"
+	}
+	lspec, err := light.SpecByName(lname)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	info := VehTypeInfo{
+		FullName: spec.FullName,
+		Color:    c,
+		Width:    spec.Width,
+		Length:   spec.Length,
+		Mass:     spec.Mass,
+		MaxDspd:  spec.MaxDspd,
+		MaxDacl:  spec.MaxDacl,
+		MaxDdcl:  spec.MaxDdcl,
+		Cspd:     spec.Cspd,
+		Lights:   lspec,
+	}
+	if info.MaxDdcl == 0 {
+		info.MaxDdcl = info.MaxDacl
+	}
+	if info.Cspd == 0 {
+		info.Cspd = DefVehCspd
+	}
+	return info, nil
+}
+
+// isVehTypeName returns true if vt is two lowercase letters.
+func isVehTypeName(vt VehType) bool {
+	if len(vt) != 2 {
+		return false
+	}
+	for _, r := range vt {
+		if (r < 'a') || (r > 'z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package robo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/anki/goverdrive/phys"
+	"github.com/anki/goverdrive/robo/light"
+)
+
+// testVehTypeSpec is a valid spec for a type that is not built in.
+func testVehTypeSpec(vt VehType) VehTypeSpec {
+	return VehTypeSpec{Type: vt, FullName: "Test", Color: "Purple", Width: 0.05, Length: 0.1, Mass: 60, MaxDspd: 2.0, MaxDacl: 5.0}
+}
+
+func TestVehTypesBuiltin(t *testing.T) {
+	vts := VehTypes()
+	if !sort.SliceIsSorted(vts, func(i, j int) bool { return vts[i] < vts[j] }) {
+		t.Errorf("VehTypes=%v are not sorted", vts)
+	}
+	for _, vt := range []VehType{"gs", "sk", "nk", "th", "gu", "bb", "fw", "xr", "xi", "dy", "mm", "np"} {
+		info, err := LookupVehType(vt)
+		if err != nil {
+			t.Errorf("built-in %v", err)
+			continue
+		}
+		testEqual(t, string(vt)+" MaxDdcl defaults to MaxDacl", info.MaxDacl, info.MaxDdcl)
+		testEqual(t, string(vt)+" Cspd default", DefVehCspd, info.Cspd)
+		testEqual(t, string(vt)+" lights default", len(light.Gen2Spec), len(info.Lights))
+		testEqual(t, string(vt)+" mass", phys.Grams(40), info.Mass)
+	}
+}
+
+func TestVehTypeSpecInfo(t *testing.T) {
+	spec := testVehTypeSpec("zz")
+	spec.MaxDdcl = 7.0
+	spec.Cspd = 0.3
+	spec.Lights = "hexpod"
+	info, err := spec.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEqual(t, "MaxDdcl", phys.MetersPerSec2(7.0), info.MaxDdcl)
+	testEqual(t, "Cspd", phys.MetersPerSec(0.3), info.Cspd)
+	testEqual(t, "lights", len(light.HexPodSpec), len(info.Lights))
+
+	bad := map[string]func(s *VehTypeSpec){
+		"type too long":  func(s *VehTypeSpec) { s.Type = "zzz" },
+		"type uppercase": func(s *VehTypeSpec) { s.Type = "ZZ" },
+		"no name":        func(s *VehTypeSpec) { s.FullName = " " },
+		"unknown color":  func(s *VehTypeSpec) { s.Color = "blurple" },
+		"zero width":     func(s *VehTypeSpec) { s.Width = 0 },
+		"huge length":    func(s *VehTypeSpec) { s.Length = 3 },
+		"zero mass":      func(s *VehTypeSpec) { s.Mass = 0 },
+		"zero speed":     func(s *VehTypeSpec) { s.MaxDspd = 0 },
+		"zero accel":     func(s *VehTypeSpec) { s.MaxDacl = 0 },
+		"negative decel": func(s *VehTypeSpec) { s.MaxDdcl = -1 },
+		"negative cspd":  func(s *VehTypeSpec) { s.Cspd = -1 },
+		"unknown lights": func(s *VehTypeSpec) { s.Lights = "disco" },
+	}
+	for tag, f := range bad {
+		spec := testVehTypeSpec("zz")
+		f(&spec)
+		if _, err := spec.Info(); err == nil {
+			t.Errorf("%s: expected an error", tag)
+		}
+		if err := RegisterVehType(spec); err == nil {
+			t.Errorf("%s: expected RegisterVehType to fail", tag)
+		}
+	}
+	if IsValidVehType("zz") {
+		t.Errorf("invalid types should not be registered")
+	}
+}
+
+func TestLoadVehTypes(t *testing.T) {
+	defer saveVehTypes()()
+	dir, err := ioutil.TempDir("", "vehtypes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// one invalid type => nothing is registered
+	badFile := filepath.Join(dir, "bad.json")
+	ioutil.WriteFile(badFile, []byte(`[
+	  {"Type": "yx", "FullName": "Good", "Color": "red", "Width": 0.05, "Length": 0.1, "Mass": 50, "MaxDspd": 2, "MaxDacl": 5},
+	  {"Type": "yy", "FullName": "Bad", "Color": "red", "Width": 0.05, "Length": 0.1, "Mass": 0, "MaxDspd": 2, "MaxDacl": 5}
+	]`), 0644)
+	if err := LoadVehTypes(badFile); err == nil {
+		t.Errorf("expected an error for an invalid type")
+	}
+	if IsValidVehType("yx") || IsValidVehType("yy") {
+		t.Errorf("no types should be registered from an invalid file")
+	}
+	if err := LoadVehTypes(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+
+	goodFile := filepath.Join(dir, "good.json")
+	ioutil.WriteFile(goodFile, []byte(`[
+	  {"Type": "yx", "FullName": "Racer", "Color": "gold", "Width": 0.05, "Length": 0.1, "Mass": 50, "MaxDspd": 2, "MaxDacl": 5, "MaxDdcl": 8, "Cspd": 0.25}
+	]`), 0644)
+	if err := LoadVehTypes(goodFile); err != nil {
+		t.Fatal(err)
+	}
+	veh, err := NewVehicle("yx", nil, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetersAreNear(t, "width", 0.05, veh.Width())
+	testMetersAreNear(t, "length", 0.1, veh.Length())
+	testEqual(t, "mass", phys.Grams(50), veh.Mass())
+	testEqual(t, "max decel", phys.MetersPerSec2(8), veh.MaxDdcl())
+	testEqual(t, "lane change speed", phys.MetersPerSec(0.25), veh.cmdCspd)
+	testEqual(t, "default lights", len(light.Gen2Spec), len(veh.Lights().Names()))
+
+	found := false
+	for _, spec := range VehTypeSpecs() {
+		if spec.Type == "yx" {
+			found = true
+			testEqual(t, "listed name", "Racer", spec.FullName)
+		}
+	}
+	if !found {
+		t.Errorf("loaded type is not listed")
+	}
+}
+
+func TestNewVehicleErrors(t *testing.T) {
+	if _, err := NewVehicle("qq", light.Gen2Spec, 1.0); err == nil {
+		t.Errorf("expected an error for an unknown type")
+	}
+}
+
+func TestVehicleKeepsTypeInfo(t *testing.T) {
+	defer saveVehTypes()()
+	spec := testVehTypeSpec("xq")
+	if err := RegisterVehType(spec); err != nil {
+		t.Fatal(err)
+	}
+	veh := mustNewVehicle(t, "xq", 1.0)
+	spec.Length = 0.2
+	if err := RegisterVehType(spec); err != nil {
+		t.Fatal(err)
+	}
+	testMetersAreNear(t, "existing vehicle", 0.1, veh.Length())
+	veh = mustNewVehicle(t, "xq", 1.0)
+	testMetersAreNear(t, "new vehicle", 0.2, veh.Length())
+}
+
+func TestRegisterVehTypesDuplicate(t *testing.T) {
+	defer saveVehTypes()()
+	a := testVehTypeSpec("xw")
+	b := testVehTypeSpec("xw")
+	b.Length = 0.2
+	if err := RegisterVehTypes([]VehTypeSpec{a, b}); err == nil {
+		t.Errorf("expected an error for a type that is listed twice")
+	}
+	if IsValidVehType("xw") {
+		t.Errorf("no types should be registered from a list with duplicates")
+	}
+
+	// a built-in type can be replaced, by one spec per call
+	gs := testVehTypeSpec("gs")
+	if err := RegisterVehType(gs); err != nil {
+		t.Fatal(err)
+	}
+	veh := mustNewVehicle(t, "gs", 1.0)
+	testMetersAreNear(t, "replaced built-in", gs.Length, veh.Length())
+}
@@ -1,7 +1,11 @@
 // Copyright 2017 Anki, Inc.
 // Author: gwenz@anki.com
 
-package viz
+// Package shapes describes the game-specific objects that a game phase asks to
+// visualize, beyond the built-in track and vehicles: track regions and a few
+// primitive shapes. It does not depend on any graphics library, so that game
+// phases can be run without a window; package viz renders the objects.
+package shapes
 
 import (
 	"image/color"
@@ -15,7 +19,6 @@ const (
 	// Note that a thick line works as a rectangle. Boo-yeah!
 	shapeLine = 0
 	shapeCirc = 1
-	numShapes = 2
 )
 
 // GameShape defines a flexible container for specifying primitive shapes used
@@ -23,7 +26,7 @@ const (
 //   - Shape coordinates can be absolute or relative to a particular vehicle
 //   - Shape coordinates can be in Track or Cartesian coordinate space
 type GameShape struct {
-	vehId     int         // >= 0 means relative to that vehicle
+	vehId     int         // >= 0 means relative to the vehicle with that Id
 	shape     uint        // eg ShapeLine
 	isCartes  bool        // coordinate space: true => cartesian; false => track
 	x1        phys.Meters // X or Dofs of point 1
@@ -105,3 +108,14 @@ func (gs GameShape) Color() color.Color {
 func (gs GameShape) Thickness() phys.Meters {
 	return gs.thickness
 }
+
+// IsCircle returns true for a circle, and false for a line.
+func (gs GameShape) IsCircle() bool {
+	return gs.shape == shapeCirc
+}
+
+// Coords returns the X/Dofs and Y/Cofs of the shape's two points. For a
+// circle, point 1 is the center, and point 2 is on the circumference.
+func (gs GameShape) Coords() (x1, y1, x2, y2 phys.Meters) {
+	return gs.x1, gs.y1, gs.x2, gs.y2
+}
@@ -0,0 +1,16 @@
+// Copyright 2017 Anki, Inc.
+// Author: gwenz@anki.com
+
+package shapes
+
+import (
+	"image/color"
+
+	"github.com/anki/goverdrive/robo/track"
+)
+
+// TrackRegion for vizualization needs a color
+type TrackRegion struct {
+	track.Region
+	Color color.Color
+}
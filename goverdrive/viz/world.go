@@ -7,7 +7,8 @@
 //
 // Visualization features are fairly limited. Tracks, track regions, and
 // vehicles are natively supported. Anything beyond this is limited to a few
-// primitive geometric shapes, such as lines and circles.
+// primitive geometric shapes, such as lines and circles, which are described
+// by package viz/shapes.
 package viz
 
 import (
@@ -22,6 +23,7 @@ import (
 	"github.com/anki/goverdrive/phys"
 	"github.com/anki/goverdrive/robo"
 	"github.com/anki/goverdrive/robo/track"
+	"github.com/anki/goverdrive/viz/shapes"
 )
 
 //////////////////////////////////////////////////////////////////////
@@ -47,12 +49,6 @@ const (
 	WorldVizPadding = phys.Meters(0.08)
 )
 
-// TrackRegion for vizualization needs a color
-type TrackRegion struct {
-	track.Region
-	Color color.Color
-}
-
 // WorldViz visualizes the objects in the goverdrive "world", such as tracks and
 // vehicles.
 type WorldViz interface {
@@ -64,10 +60,10 @@ type WorldViz interface {
 
 	// RenderAll() renders each set of game objects onto a canvas.
 	//   - The object sets are rendered in the order they are passed in. Ie the
-	//     track regions are rendered before the vehicles.
+	//     track regions are rendered before the obstacles and vehicles.
 	//   - Within an object set, objects are rendered in the order they occur
 	//     within the slice.
-	RenderAll(track *track.Track, regions *[]*TrackRegion, vehs *[]robo.Vehicle, shapes *[]*GameShape) *pixelgl.Canvas
+	RenderAll(track *track.Track, regions *[]*shapes.TrackRegion, obstacles []*robo.Obstacle, vehs *[]robo.Vehicle, shapes *[]*shapes.GameShape) *pixelgl.Canvas
 }
 
 //////////////////////////////////////////////////////////////////////
@@ -107,7 +103,7 @@ func (wv *PixelWorldViz) MaxCorner() phys.Point {
 	return wv.maxCorner
 }
 
-func (wv *PixelWorldViz) RenderAll(trk *track.Track, regions *[]*TrackRegion, vehs *[]robo.Vehicle, shapes *[]*GameShape) *pixelgl.Canvas {
+func (wv *PixelWorldViz) RenderAll(trk *track.Track, regions *[]*shapes.TrackRegion, obstacles []*robo.Obstacle, vehs *[]robo.Vehicle, shapes *[]*shapes.GameShape) *pixelgl.Canvas {
 	if wv.canvas == nil {
 		bounds := pixel.R(
 			PixPerMeter*float64(wv.minCorner.X),
@@ -129,9 +125,14 @@ func (wv *PixelWorldViz) RenderAll(trk *track.Track, regions *[]*TrackRegion, ve
 		wv.addTrackRegion(trk, tr)
 	}
 
+	// Obstacles
+	for _, o := range obstacles {
+		wv.addObstacle(o, trk)
+	}
+
 	// Vehicles
 	for i, _ := range *vehs {
-		wv.addVehicle(i, trk, vehs)
+		wv.addVehicle(&(*vehs)[i], trk, vehs)
 	}
 
 	// Game Shapes
@@ -259,7 +260,7 @@ func (wv *PixelWorldViz) addTrackCLine(trk *track.Track, dofs, cofs1, cofs2, thi
 
 // addTrackRegion renders an unfilled track region which bends to the shape of
 // the track.
-func (wv *PixelWorldViz) addTrackRegion(track *track.Track, tr *TrackRegion) {
+func (wv *PixelWorldViz) addTrackRegion(track *track.Track, tr *shapes.TrackRegion) {
 	if tr.Len() >= track.CenLen() {
 		// XXX(gwenz): This avoids crashes and incorrectly rendered track regions.
 		// Probably it should not be necessary, with proper rendering algorithms.
@@ -291,7 +292,7 @@ func (wv *PixelWorldViz) addTrack(trk *track.Track) {
 
 		centerTrC1 := track.Point{Dofs: trk.RpEntryDofs(rpi), Cofs: 0}
 		centerTr := track.NewRegion(trk, centerTrC1, cenLen, 0.0001)
-		centerRegion := TrackRegion{
+		centerRegion := shapes.TrackRegion{
 			Region: *centerTr,
 			Color:  KTrackCenterColor,
 		}
@@ -299,7 +300,7 @@ func (wv *PixelWorldViz) addTrack(trk *track.Track) {
 
 		outlineTrC1 := track.Point{Dofs: trk.RpEntryDofs(rpi), Cofs: -trk.Width() / 2}
 		outlineTr := track.NewRegion(trk, outlineTrC1, cenLen, trk.Width())
-		outlineRegion := TrackRegion{
+		outlineRegion := shapes.TrackRegion{
 			Region: *outlineTr,
 			Color:  KTrackOutlineColor,
 		}
@@ -308,8 +309,7 @@ func (wv *PixelWorldViz) addTrack(trk *track.Track) {
 }
 
 // addVehicle renders a vehicle at its position on the track
-func (wv *PixelWorldViz) addVehicle(vehId int, track *track.Track, vehs *[]robo.Vehicle) {
-	v := &(*vehs)[vehId]
+func (wv *PixelWorldViz) addVehicle(v *robo.Vehicle, track *track.Track, vehs *[]robo.Vehicle) {
 	// car body = colored rectangle
 	wv.addLineAtPose(track.ToPose(v.CurTrackPose()),
 		phys.Point{X: -(v.Length() / 2), Y: 0},
@@ -317,53 +317,67 @@ func (wv *PixelWorldViz) addVehicle(vehId int, track *track.Track, vehs *[]robo.
 		v.Width(), v.Color())
 	// lights = filled circles
 	for _, lvi := range v.Lights().VizInfo() {
-		gs := NewCartesGameCirc(vehId, phys.Point{X: lvi.X, Y: lvi.Y}, lvi.R, lvi.Color, 0)
+		gs := shapes.NewCartesGameCirc(v.Id(), phys.Point{X: lvi.X, Y: lvi.Y}, lvi.R, lvi.Color, 0)
 		wv.addGameShape(gs, track, vehs)
 	}
 }
 
-// addGameShape renders the appropriate game shape
-func (wv *PixelWorldViz) addGameShape(gs *GameShape, trk *track.Track, vehs *[]robo.Vehicle) {
-	if (gs.VehId() >= 0) && (gs.VehId() >= len(*vehs)) {
-		panic(fmt.Sprintf("PixelWorldViz.addGameShape() with VehdId=%d is invalid; game only has %d vehicles!", gs.VehId(), len(*vehs)))
+// addObstacle renders an obstacle as a filled rectangle, aligned with the road.
+func (wv *PixelWorldViz) addObstacle(o *robo.Obstacle, trk *track.Track) {
+	clr := o.Color
+	if clr == nil {
+		clr = robo.DefObstacleColor
 	}
-	if gs.shape >= numShapes {
-		panic(fmt.Sprintf("PixelWorldViz.addGameShape: gs.shape=%v is invalid", gs.shape))
+	wv.addLineAtPose(trk.ToPose(track.Pose{Point: o.Point}),
+		phys.Point{X: -(o.Length / 2), Y: 0},
+		phys.Point{X: +(o.Length / 2), Y: 0},
+		o.Width, clr)
+}
+
+// addGameShape renders the appropriate game shape. Shapes that are relative to
+// a vehicle that is no longer in the system are not rendered.
+func (wv *PixelWorldViz) addGameShape(gs *shapes.GameShape, trk *track.Track, vehs *[]robo.Vehicle) {
+	var veh *robo.Vehicle
+	if gs.VehId() >= 0 {
+		v := robo.FindVehicle(*vehs, gs.VehId())
+		if v < 0 {
+			return
+		}
+		veh = &(*vehs)[v]
 	}
+	x1, y1, x2, y2 := gs.Coords()
 
 	if (gs.VehId() >= 0) && gs.IsCartesian() {
 		// shape's position is relative to vehicle's pose, in Cartesian coordinate space
-		pose := trk.ToPose((*vehs)[gs.VehId()].CurTrackPose())
-		pose1 := pose.AdvancePose(phys.Pose{Point: phys.Point{X: gs.x1, Y: gs.y1}, Theta: 0})
-		pose2 := pose.AdvancePose(phys.Pose{Point: phys.Point{X: gs.x2, Y: gs.y2}, Theta: 0})
+		pose := trk.ToPose(veh.CurTrackPose())
+		pose1 := pose.AdvancePose(phys.Pose{Point: phys.Point{X: x1, Y: y1}, Theta: 0})
+		pose2 := pose.AdvancePose(phys.Pose{Point: phys.Point{X: x2, Y: y2}, Theta: 0})
 
 		p1 := phys.Point{X: pose1.X, Y: pose1.Y}
 		p2 := phys.Point{X: pose2.X, Y: pose2.Y}
-		switch gs.shape {
-		case shapeLine:
-			wv.pv.AddLine(p1, p2, gs.Thickness(), gs.Color())
-		case shapeCirc:
+		if gs.IsCircle() {
 			radius := phys.Dist(p1, p2)
 			wv.pv.AddCircle(p1, radius, gs.Thickness(), gs.Color())
+		} else {
+			wv.pv.AddLine(p1, p2, gs.Thickness(), gs.Color())
 		}
 	} else if (gs.VehId() >= 0) && !gs.IsCartesian() {
 		// shape's position is relative to vehicle's pose, in Track coordinate space
-		vtp := (*vehs)[gs.VehId()].CurTrackPose()
-		tp1 := track.Pose{Point: track.Point{Dofs: gs.x1 + vtp.Dofs, Cofs: gs.y1 + vtp.Cofs}, DAngle: 0}
-		tp2 := track.Pose{Point: track.Point{Dofs: gs.x2 + vtp.Dofs, Cofs: gs.y2 + vtp.Cofs}, DAngle: 0}
+		vtp := veh.CurTrackPose()
+		tp1 := track.Pose{Point: track.Point{Dofs: x1 + vtp.Dofs, Cofs: y1 + vtp.Cofs}, DAngle: 0}
+		tp2 := track.Pose{Point: track.Point{Dofs: x2 + vtp.Dofs, Cofs: y2 + vtp.Cofs}, DAngle: 0}
 		tp1.Dofs = trk.NormalizeDofs(tp1.Dofs)
 		tp2.Dofs = trk.NormalizeDofs(tp2.Dofs)
 		pose1 := trk.ToPose(tp1)
 		pose2 := trk.ToPose(tp2)
 		p1 := phys.Point{X: pose1.X, Y: pose1.Y}
 		p2 := phys.Point{X: pose2.X, Y: pose2.Y}
-		switch gs.shape {
-		case shapeLine:
-			wv.addTrackDLine(trk, tp1.Cofs, tp1.Dofs, tp2.Dofs, gs.Thickness(), gs.Color())
-			//wv.pv.AddLine(p1, p2, gs.Thickness(), gs.Color())
-		case shapeCirc:
+		if gs.IsCircle() {
 			radius := phys.Dist(p1, p2)
 			wv.pv.AddCircle(p1, radius, gs.Thickness(), gs.Color())
+		} else {
+			wv.addTrackDLine(trk, tp1.Cofs, tp1.Dofs, tp2.Dofs, gs.Thickness(), gs.Color())
+			//wv.pv.AddLine(p1, p2, gs.Thickness(), gs.Color())
 		}
 	} else {
 		// shape's position is absolute
@@ -371,21 +385,20 @@ func (wv *PixelWorldViz) addGameShape(gs *GameShape, trk *track.Track, vehs *[]r
 		var pose2 phys.Pose
 		if gs.IsCartesian() {
 			// Cartesian coordinate space
-			pose1 = phys.Pose{Point: phys.Point{X: gs.x1, Y: gs.y1}, Theta: 0}
-			pose2 = phys.Pose{Point: phys.Point{X: gs.x2, Y: gs.y2}, Theta: 0}
+			pose1 = phys.Pose{Point: phys.Point{X: x1, Y: y1}, Theta: 0}
+			pose2 = phys.Pose{Point: phys.Point{X: x2, Y: y2}, Theta: 0}
 		} else {
 			// Track coordinate space
-			pose1 = trk.ToPose(track.Pose{Point: track.Point{Dofs: gs.x1, Cofs: gs.y1}, DAngle: 0})
-			pose2 = trk.ToPose(track.Pose{Point: track.Point{Dofs: gs.x2, Cofs: gs.y2}, DAngle: 0})
+			pose1 = trk.ToPose(track.Pose{Point: track.Point{Dofs: x1, Cofs: y1}, DAngle: 0})
+			pose2 = trk.ToPose(track.Pose{Point: track.Point{Dofs: x2, Cofs: y2}, DAngle: 0})
 		}
 		p1 := phys.Point{X: pose1.X, Y: pose1.Y}
 		p2 := phys.Point{X: pose2.X, Y: pose2.Y}
-		switch gs.shape {
-		case shapeLine:
-			wv.pv.AddLine(p1, p2, gs.Thickness(), gs.Color())
-		case shapeCirc:
+		if gs.IsCircle() {
 			radius := phys.Dist(p1, p2)
 			wv.pv.AddCircle(p1, radius, gs.Thickness(), gs.Color())
+		} else {
+			wv.pv.AddLine(p1, p2, gs.Thickness(), gs.Color())
 		}
 	}
 }